@@ -7,11 +7,17 @@ import (
 	"os"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	log "github.com/sirupsen/logrus"
 )
 
+// logFieldEscaper escapes quotes, backslashes and line breaks in the fields of
+// the access log lines, the same way as Apache
+var logFieldEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`, "\r", `\r`)
+
 // CommonLogFormat returns a line with the data that is available at the start
 // of a request handler. The log line is in NCSA format, the same log format
 // used by Apache. Fields where data is not available are indicated by a "-".
@@ -35,7 +41,7 @@ func (ac *Config) CommonLogFormat(req *http.Request, statusCode int, byteSize in
 		byteSizeString = fmt.Sprintf("%d", byteSize)
 	}
 	timestamp := strings.Replace(time.Now().Format("02/Jan/2006 15:04:05 -0700"), " ", ":", 1)
-	return fmt.Sprintf("%s - %s [%s] \"%s %s %s\" %s %s", ip, username, timestamp, req.Method, req.RequestURI, req.Proto, statusCodeString, byteSizeString)
+	return fmt.Sprintf("%s - %s [%s] \"%s %s %s\" %s %s", ip, username, timestamp, logFieldEscaper.Replace(req.Method), logFieldEscaper.Replace(req.RequestURI), req.Proto, statusCodeString, byteSizeString)
 }
 
 // CombinedLogFormat returns a line with the data that is available at the start
@@ -61,38 +67,127 @@ func (ac *Config) CombinedLogFormat(req *http.Request, statusCode int, byteSize
 		byteSizeString = fmt.Sprintf("%d", byteSize)
 	}
 	timestamp := strings.Replace(time.Now().Format("02/Jan/2006 15:04:05 -0700"), " ", ":", 1)
-	referer := req.Header.Get("Referer")
-	userAgent := req.Header.Get("User-Agent")
-	return fmt.Sprintf("%s - %s [%s] \"%s %s %s\" %s %s \"%s\" \"%s\"", ip, username, timestamp, req.Method, req.RequestURI, req.Proto, statusCodeString, byteSizeString, referer, userAgent)
+	referer := logFieldEscaper.Replace(req.Header.Get("Referer"))
+	userAgent := logFieldEscaper.Replace(req.Header.Get("User-Agent"))
+	return fmt.Sprintf("%s - %s [%s] \"%s %s %s\" %s %s \"%s\" \"%s\"", ip, username, timestamp, logFieldEscaper.Replace(req.Method), logFieldEscaper.Replace(req.RequestURI), req.Proto, statusCodeString, byteSizeString, referer, userAgent)
+}
+
+// accessLogQueueSize is the number of access log lines that can be waiting
+// to be written, before new lines are dropped
+const accessLogQueueSize = 4096
+
+// accessLogEntry is a line for the access log with the given filename
+type accessLogEntry struct {
+	filename, line string
+}
+
+// accessLogWriter writes access log lines in the background, so that
+// requests do not have to wait for the access logs to be written.
+// The files are opened for appending for every batch of lines, so that
+// the access logs can be rotated while the server is running.
+type accessLogWriter struct {
+	mut     sync.RWMutex // for not writing to the queue after it is closed
+	closed  bool
+	queue   chan accessLogEntry
+	done    chan struct{}
+	dropped uint64 // lines that were dropped because the queue was full
+}
+
+// newAccessLogWriter starts writing access log lines in the background
+func newAccessLogWriter() *accessLogWriter {
+	aw := &accessLogWriter{
+		queue: make(chan accessLogEntry, accessLogQueueSize),
+		done:  make(chan struct{}),
+	}
+	go aw.run()
+	return aw
+}
+
+// write queues the given line for the given access log. The line is dropped
+// if the queue is full. Returns false if the writer has been closed.
+func (aw *accessLogWriter) write(filename, line string) bool {
+	aw.mut.RLock()
+	defer aw.mut.RUnlock()
+	if aw.closed {
+		return false
+	}
+	select {
+	case aw.queue <- accessLogEntry{filename, line}:
+	default:
+		atomic.AddUint64(&aw.dropped, 1)
+	}
+	return true
+}
+
+// run writes the queued lines, in batches, until the queue is closed
+func (aw *accessLogWriter) run() {
+	defer close(aw.done)
+	for entry := range aw.queue {
+		// Collect the lines that are already waiting
+		batch := map[string][]string{entry.filename: {entry.line}}
+	collect:
+		for {
+			select {
+			case entry, ok := <-aw.queue:
+				if !ok {
+					break collect
+				}
+				batch[entry.filename] = append(batch[entry.filename], entry.line)
+			default:
+				break collect
+			}
+		}
+		for filename, lines := range batch {
+			if err := appendLines(filename, lines); err != nil {
+				log.Warn(err)
+			}
+		}
+		if dropped := atomic.SwapUint64(&aw.dropped, 0); dropped > 0 {
+			log.Warnf("Dropped %d access log lines, since they could not be written fast enough", dropped)
+		}
+	}
+}
+
+// close writes the lines that are waiting, and stops writing in the background
+func (aw *accessLogWriter) close() {
+	aw.mut.Lock()
+	if !aw.closed {
+		aw.closed = true
+		close(aw.queue)
+	}
+	aw.mut.Unlock()
+	<-aw.done
+}
+
+// appendLines appends the given lines to the given file
+func appendLines(filename string, lines []string) error {
+	f, err := os.OpenFile(filename, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return fmt.Errorf("Can not open %s: %s", filename, err)
+	}
+	defer f.Close()
+	if _, err := f.WriteString(strings.Join(lines, "\n") + "\n"); err != nil {
+		return fmt.Errorf("Can not write to %s: %s", filename, err)
+	}
+	return nil
 }
 
 // LogAccess creates one entry in the access log, given a http.Request,
 // a HTTP status code and the amount of bytes that have been transferred.
+// The entries are written in the background, while the server is running.
 func (ac *Config) LogAccess(req *http.Request, statusCode int, byteSize int64) {
-	if ac.commonAccessLogFilename != "" {
-		f, err := os.OpenFile(ac.commonAccessLogFilename, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
-		if err != nil {
-			log.Warnf("Can not open %s: %s", ac.commonAccessLogFilename, err)
+	write := func(filename, line string) {
+		if ac.accessLog != nil && ac.accessLog.write(filename, line) {
 			return
 		}
-		defer f.Close()
-		_, err = f.WriteString(ac.CommonLogFormat(req, statusCode, byteSize) + "\n")
-		if err != nil {
-			log.Warnf("Can not write to %s: %s", ac.commonAccessLogFilename, err)
-			return
+		if err := appendLines(filename, []string{line}); err != nil {
+			log.Warn(err)
 		}
 	}
+	if ac.commonAccessLogFilename != "" {
+		write(ac.commonAccessLogFilename, ac.CommonLogFormat(req, statusCode, byteSize))
+	}
 	if ac.combinedAccessLogFilename != "" {
-		f, err := os.OpenFile(ac.combinedAccessLogFilename, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
-		if err != nil {
-			log.Warnf("Can not open %s: %s", ac.combinedAccessLogFilename, err)
-			return
-		}
-		defer f.Close()
-		_, err = f.WriteString(ac.CombinedLogFormat(req, statusCode, byteSize) + "\n")
-		if err != nil {
-			log.Warnf("Can not write to %s: %s", ac.combinedAccessLogFilename, err)
-			return
-		}
+		write(ac.combinedAccessLogFilename, ac.CombinedLogFormat(req, statusCode, byteSize))
 	}
 }
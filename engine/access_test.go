@@ -0,0 +1,88 @@
+package engine
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bmizerany/assert"
+	"github.com/xyproto/algernon/utils"
+	"github.com/xyproto/datablock"
+)
+
+// combinedLine matches a line in the Combined Log Format
+var combinedLine = regexp.MustCompile(`^(\S+) - (\S+) \[(\d{2}/[A-Z][a-z]{2}/\d{4}:\d{2}:\d{2}:\d{2} [+-]\d{4})\] "([^"\\]*(?:\\.[^"\\]*)*)" (\d{3}|-) (\d+) "([^"\\]*(?:\\.[^"\\]*)*)" "([^"\\]*(?:\\.[^"\\]*)*)"$`)
+
+func TestCombinedLogFormat(t *testing.T) {
+	ac := &Config{}
+	req := httptest.NewRequest("GET", "/hello.txt?a=1", nil)
+	req.RemoteAddr = "192.0.2.1:1234"
+	req.Header.Set("Referer", "https://example.com/")
+	req.Header.Set("User-Agent", `Test "Agent"`)
+
+	fields := combinedLine.FindStringSubmatch(ac.CombinedLogFormat(req, http.StatusOK, 5))
+	assert.NotEqual(t, fields, nil)
+	assert.Equal(t, fields[1], "192.0.2.1")
+	assert.Equal(t, fields[4], "GET /hello.txt?a=1 HTTP/1.1")
+	assert.Equal(t, fields[5], "200")
+	assert.Equal(t, fields[6], "5")
+	assert.Equal(t, fields[7], "https://example.com/")
+	assert.Equal(t, fields[8], `Test \"Agent\"`)
+	_, err := time.Parse("02/Jan/2006:15:04:05 -0700", fields[3])
+	assert.Equal(t, err, nil)
+}
+
+func TestAccessLog(t *testing.T) {
+	dir, err := ioutil.TempDir("", "algernon_accesslog")
+	assert.Equal(t, err, nil)
+	defer os.RemoveAll(dir)
+	assert.Equal(t, ioutil.WriteFile(filepath.Join(dir, "hello.txt"), []byte("hello"), 0644), nil)
+	logFilename := filepath.Join(dir, "access.log")
+
+	ac := &Config{
+		disableRateLimiting:       true,
+		largeFileSize:             42 * utils.MiB,
+		combinedAccessLogFilename: logFilename,
+		accessLog:                 newAccessLogWriter(),
+	}
+	ac.initializeMime()
+	ac.fs = datablock.NewFileStat(false, time.Minute)
+	ac.cache = datablock.NewFileCache(1*utils.MiB, false, 64*utils.KiB, false, 0)
+	mux := http.NewServeMux()
+	ac.RegisterHandlers(mux, "/", dir, false)
+
+	for _, urlpath := range []string{"/hello.txt", "/missing"} {
+		req := httptest.NewRequest("GET", urlpath, nil)
+		req.Header.Set("User-Agent", "test")
+		mux.ServeHTTP(httptest.NewRecorder(), req)
+	}
+
+	// The lines are written when the access log writer is closed
+	ac.accessLog.close()
+	data, err := ioutil.ReadFile(logFilename)
+	assert.Equal(t, err, nil)
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	assert.Equal(t, len(lines), 2)
+	fields := combinedLine.FindStringSubmatch(lines[0])
+	assert.NotEqual(t, fields, nil)
+	assert.Equal(t, fields[4], "GET /hello.txt HTTP/1.1")
+	assert.Equal(t, fields[5], "200")
+	assert.Equal(t, fields[6], "5")
+	assert.Equal(t, fields[8], "test")
+	fields = combinedLine.FindStringSubmatch(lines[1])
+	assert.NotEqual(t, fields, nil)
+	assert.Equal(t, fields[4], "GET /missing HTTP/1.1")
+	assert.Equal(t, fields[5], "404")
+
+	// Lines are written directly after the writer is closed
+	ac.LogAccess(httptest.NewRequest("GET", "/late", nil), http.StatusOK, 0)
+	data, err = ioutil.ReadFile(logFilename)
+	assert.Equal(t, err, nil)
+	assert.Equal(t, strings.Count(string(data), "\n"), 3)
+}
@@ -0,0 +1,48 @@
+package engine
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// errAutoTLSWithCert is returned if automatic TLS is combined with a given
+// TLS certificate or key
+var errAutoTLSWithCert = errors.New("automatic TLS can not be combined with --cert or --key")
+
+// splitDomains splits a comma separated list of domains
+func splitDomains(domainList string) []string {
+	var domains []string
+	for _, domain := range strings.Split(domainList, ",") {
+		if domain = strings.TrimSpace(domain); domain != "" {
+			domains = append(domains, domain)
+		}
+	}
+	return domains
+}
+
+// autocertManager returns a manager that fetches and renews TLS certificates
+// from Let's Encrypt, for the domains given with --domains or EnableAutoTLS.
+// The certificates are cached in the directory given with --autotls-cache,
+// or in the user cache directory.
+func (ac *Config) autocertManager() (*autocert.Manager, error) {
+	if len(ac.autoTLSDomains) == 0 {
+		return nil, errors.New("automatic TLS needs at least one domain (see --domains)")
+	}
+	cacheDir := ac.autoTLSCacheDir
+	if cacheDir == "" {
+		userCacheDir, err := os.UserCacheDir()
+		if err != nil {
+			return nil, err
+		}
+		cacheDir = filepath.Join(userCacheDir, "algernon", "autocert")
+	}
+	return &autocert.Manager{
+		Prompt:     autocert.AcceptTOS,
+		HostPolicy: autocert.HostWhitelist(ac.autoTLSDomains...),
+		Cache:      autocert.DirCache(cacheDir),
+	}, nil
+}
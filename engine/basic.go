@@ -2,6 +2,11 @@ package engine
 
 import (
 	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"net/http"
@@ -15,16 +20,174 @@ import (
 	"github.com/russross/blackfriday"
 	log "github.com/sirupsen/logrus"
 	"github.com/xyproto/algernon/lua/convert"
+	"github.com/xyproto/algernon/lua/jnode"
 	"github.com/xyproto/algernon/utils"
 	"github.com/xyproto/gopher-lua"
 )
 
+// The default size limit for request bodies read by requestJSON
+const defaultJSONLimit int64 = 1 * utils.MiB
+
 // FutureStatus is useful when redirecting in combination with writing to a
 // buffer before writing to a client. May contain more fields in the future.
 type FutureStatus struct {
 	code int // Buffered HTTP status code
 }
 
+// changeHeader sets or adds a header to the response. If the header has
+// already been sent, a warning is logged, mentioning the given Lua function
+// name, and false is returned.
+func changeHeader(w http.ResponseWriter, funcName, key, value string, add bool) bool {
+	if hw, ok := w.(*hintsWriter); ok && hw.hints.headerSent() {
+		log.Warnf("%s: the header has already been sent, %s must be set before the output", funcName, key)
+		return false
+	}
+	if add {
+		w.Header().Add(key, value)
+	} else {
+		w.Header().Set(key, value)
+	}
+	return true
+}
+
+// redirect redirects the request to the given URL, with the given status code.
+// Any output that is written after the redirect is discarded, so that the
+// status code is not written twice.
+func redirect(w http.ResponseWriter, req *http.Request, newurl string, httpStatusCode int, httpStatus *FutureStatus) {
+	if httpStatus != nil {
+		httpStatus.code = httpStatusCode
+	}
+	http.Redirect(w, req, newurl, httpStatusCode)
+	if hw, ok := w.(*hintsWriter); ok {
+		hw.hints.completed = true
+	}
+}
+
+// readJSONBody reads the body of the given request, up to the given number of
+// bytes, and converts it from JSON to a Lua value
+func readJSONBody(L *lua.LState, w http.ResponseWriter, req *http.Request, limit int64) (lua.LValue, error) {
+	data, err := ioutil.ReadAll(http.MaxBytesReader(w, req.Body, limit))
+	if err != nil {
+		if _, tooLarge := err.(*http.MaxBytesError); tooLarge {
+			return lua.LNil, fmt.Errorf("the request body is too large (the limit is %s)", utils.DescribeBytes(limit))
+		}
+		return lua.LNil, err
+	}
+	return jnode.Decode(L, data)
+}
+
+// newUUID returns a random (version 4) UUID, using a cryptographically secure
+// source of randomness
+func newUUID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	b[6] = (b[6] & 0x0f) | 0x40 // version 4
+	b[8] = (b[8] & 0x3f) | 0x80 // variant 10
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:]), nil
+}
+
+// randomString returns a string of the given length, with characters from
+// the URL-safe base64 alphabet, using a cryptographically secure source of
+// randomness
+func randomString(length int) (string, error) {
+	if length <= 0 {
+		return "", nil
+	}
+	b := make([]byte, (length*6+7)/8)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b)[:length], nil
+}
+
+// base64Encoding returns the URL-safe base64 encoding if urlSafe is true,
+// or else the standard base64 encoding
+func base64Encoding(urlSafe bool) *base64.Encoding {
+	if urlSafe {
+		return base64.URLEncoding
+	}
+	return base64.StdEncoding
+}
+
+// markdownExtensions are the Markdown extensions that can be disabled with
+// the options table that is given to the markdown function
+var markdownExtensions = map[string]blackfriday.Extensions{
+	"tables":        blackfriday.Tables,
+	"autolink":      blackfriday.Autolink,
+	"strikethrough": blackfriday.Strikethrough,
+	"fencedcode":    blackfriday.FencedCode,
+}
+
+// renderMarkdown converts Markdown to HTML. Raw HTML is left out and only
+// links to trusted protocols are kept, unless "unsafe" is true in the given
+// options table. The options table may be nil, or disable the extensions in
+// markdownExtensions, like {tables=false}.
+func renderMarkdown(markdown []byte, options *lua.LTable) string {
+	extensions := blackfriday.CommonExtensions
+	flags := blackfriday.CommonHTMLFlags | blackfriday.SkipHTML | blackfriday.Safelink
+	if options != nil {
+		for name, extension := range markdownExtensions {
+			if options.RawGetString(name) == lua.LFalse {
+				extensions &^= extension
+			}
+		}
+		if lua.LVAsBool(options.RawGetString("unsafe")) {
+			flags &^= blackfriday.SkipHTML | blackfriday.Safelink
+		}
+	}
+	renderer := blackfriday.NewHTMLRenderer(blackfriday.HTMLRendererParameters{Flags: flags})
+	html := blackfriday.Run(markdown, blackfriday.WithExtensions(extensions), blackfriday.WithRenderer(renderer))
+	return strings.TrimSpace(string(html))
+}
+
+// optLocation returns the time zone location given as the optional argument
+// at the given position, or UTC if it is not given
+func optLocation(L *lua.LState, n int) (*time.Location, error) {
+	name := L.OptString(n, "")
+	if name == "" {
+		return time.UTC, nil
+	}
+	return time.LoadLocation(name)
+}
+
+// sleepContext waits for the given duration, or until the given context is
+// done. Returns true if the full duration elapsed.
+func sleepContext(ctx context.Context, duration time.Duration) bool {
+	timer := time.NewTimer(duration)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// loadSleep makes the sleep and sleepms functions available to the given Lua
+// state. Sleeping stops early when the given context is done, which should be
+// the context of the HTTP request, so that no goroutines are left sleeping
+// after the client has disconnected.
+func loadSleep(L *lua.LState, ctx context.Context) {
+
+	// Sleep for the given number of seconds (can be a float).
+	// Returns true if the full duration elapsed.
+	L.SetGlobal("sleep", L.NewFunction(func(L *lua.LState) int {
+		duration := time.Duration(float64(L.ToNumber(1)) * float64(time.Second))
+		L.Push(lua.LBool(sleepContext(ctx, duration)))
+		return 1 // number of results
+	}))
+
+	// Sleep for the given number of milliseconds (can be a float).
+	// Returns true if the full duration elapsed.
+	L.SetGlobal("sleepms", L.NewFunction(func(L *lua.LState) int {
+		duration := time.Duration(float64(L.ToNumber(1)) * float64(time.Millisecond))
+		L.Push(lua.LBool(sleepContext(ctx, duration)))
+		return 1 // number of results
+	}))
+}
+
 // LoadBasicSystemFunctions loads functions related to logging, markdown and the
 // current server directory into the given Lua state
 func (ac *Config) LoadBasicSystemFunctions(L *lua.LState) {
@@ -59,14 +222,8 @@ func (ac *Config) LoadBasicSystemFunctions(L *lua.LState) {
 		return 0 // number of results
 	}))
 
-	// Sleep for the given number of seconds (can be a float)
-	L.SetGlobal("sleep", L.NewFunction(func(L *lua.LState) int {
-		// Extract the correct number of nanoseconds
-		duration := time.Duration(float64(L.ToNumber(1)) * 1000000000.0)
-		// Wait and block the current thread of execution.
-		time.Sleep(duration)
-		return 0
-	}))
+	// Sleep functions that are not interrupted, since there is no request
+	loadSleep(L, context.Background())
 
 	// Return the current unixtime, with an attempt at nanosecond resolution
 	L.SetGlobal("unixnano", L.NewFunction(func(L *lua.LState) int {
@@ -75,13 +232,72 @@ func (ac *Config) LoadBasicSystemFunctions(L *lua.LState) {
 		return 1 // number of results
 	}))
 
-	// Convert Markdown to HTML
+	// Return the current Unix time, in seconds
+	L.SetGlobal("now", L.NewFunction(func(L *lua.LState) int {
+		L.Push(lua.LNumber(time.Now().Unix()))
+		return 1 // number of results
+	}))
+
+	// Format a Unix time with a Go time layout, like "2006-01-02 15:04:05".
+	// Takes an optional time zone, like "Europe/Oslo". The default is UTC.
+	// Returns nil and an error message if the time zone is unknown.
+	L.SetGlobal("formatTime", L.NewFunction(func(L *lua.LState) int {
+		unixTime := float64(L.CheckNumber(1))
+		layout := L.CheckString(2)
+		location, err := optLocation(L, 3)
+		if err != nil {
+			L.Push(lua.LNil)
+			L.Push(lua.LString(err.Error()))
+			return 2 // number of results
+		}
+		seconds := int64(unixTime)
+		nanoseconds := int64((unixTime - float64(seconds)) * float64(time.Second))
+		L.Push(lua.LString(time.Unix(seconds, nanoseconds).In(location).Format(layout)))
+		return 1 // number of results
+	}))
+
+	// Parse a time with a Go time layout, like "2006-01-02 15:04:05", and
+	// return the Unix time. Takes an optional time zone, like "Europe/Oslo",
+	// that is used if the layout has no time zone. The default is UTC.
+	// Returns nil and an error message if the time could not be parsed.
+	L.SetGlobal("parseTime", L.NewFunction(func(L *lua.LState) int {
+		value := L.CheckString(1)
+		layout := L.CheckString(2)
+		location, err := optLocation(L, 3)
+		if err != nil {
+			L.Push(lua.LNil)
+			L.Push(lua.LString(err.Error()))
+			return 2 // number of results
+		}
+		t, err := time.ParseInLocation(layout, value, location)
+		if err != nil {
+			L.Push(lua.LNil)
+			L.Push(lua.LString(err.Error()))
+			return 2 // number of results
+		}
+		L.Push(lua.LNumber(t.Unix()))
+		return 1 // number of results
+	}))
+
+	// Convert Markdown to HTML. The last argument may be a table with options.
 	L.SetGlobal("markdown", L.NewFunction(func(L *lua.LState) int {
-		// Retrieve all the function arguments as a bytes.Buffer
-		buf := convert.Arguments2buffer(L, true)
+		var options *lua.LTable
+		top := L.GetTop()
+		if table, ok := L.Get(top).(*lua.LTable); ok {
+			options = table
+			top--
+		}
+		// Gather the rest of the arguments in a buffer
+		var buf bytes.Buffer
+		for i := 1; i <= top; i++ {
+			buf.WriteString(L.Get(i).String())
+			if i != top {
+				buf.WriteString(" ")
+			}
+		}
+		buf.WriteString("\n")
 		// Convert the buffer to markdown and output the translated string
-		html := strings.TrimSpace(string(blackfriday.Run(buf.Bytes())))
-		L.Push(lua.LString(html))
+		L.Push(lua.LString(renderMarkdown(buf.Bytes(), options)))
 		return 1 // number of results
 	}))
 
@@ -103,6 +319,152 @@ func (ac *Config) LoadBasicSystemFunctions(L *lua.LState) {
 		return 1 // number of results
 	}))
 
+	// Return a random (version 4) UUID
+	L.SetGlobal("uuid", L.NewFunction(func(L *lua.LState) int {
+		id, err := newUUID()
+		if err != nil {
+			log.Error(err)
+			L.Push(lua.LNil)
+			L.Push(lua.LString(err.Error()))
+			return 2 // number of results
+		}
+		L.Push(lua.LString(id))
+		return 1 // number of results
+	}))
+
+	// Return a random string of the given length, with URL-safe characters
+	L.SetGlobal("randomString", L.NewFunction(func(L *lua.LState) int {
+		s, err := randomString(L.CheckInt(1))
+		if err != nil {
+			log.Error(err)
+			L.Push(lua.LNil)
+			L.Push(lua.LString(err.Error()))
+			return 2 // number of results
+		}
+		L.Push(lua.LString(s))
+		return 1 // number of results
+	}))
+
+	// Encode a string as base64. URL-safe base64 is used if the optional
+	// second argument is true.
+	L.SetGlobal("base64encode", L.NewFunction(func(L *lua.LState) int {
+		encoding := base64Encoding(L.OptBool(2, false))
+		L.Push(lua.LString(encoding.EncodeToString([]byte(L.CheckString(1)))))
+		return 1 // number of results
+	}))
+
+	// Decode a base64 string. URL-safe base64 is used if the optional second
+	// argument is true. Returns nil and an error message if the input is
+	// malformed.
+	L.SetGlobal("base64decode", L.NewFunction(func(L *lua.LState) int {
+		encoding := base64Encoding(L.OptBool(2, false))
+		data, err := encoding.DecodeString(L.CheckString(1))
+		if err != nil {
+			L.Push(lua.LNil)
+			L.Push(lua.LString(err.Error()))
+			return 2 // number of results
+		}
+		L.Push(lua.LString(data))
+		return 1 // number of results
+	}))
+
+	// Encode a string as hexadecimal
+	L.SetGlobal("hexencode", L.NewFunction(func(L *lua.LState) int {
+		L.Push(lua.LString(hex.EncodeToString([]byte(L.CheckString(1)))))
+		return 1 // number of results
+	}))
+
+	// Decode a hexadecimal string. Returns nil and an error message if the
+	// input is malformed.
+	L.SetGlobal("hexdecode", L.NewFunction(func(L *lua.LState) int {
+		data, err := hex.DecodeString(L.CheckString(1))
+		if err != nil {
+			L.Push(lua.LNil)
+			L.Push(lua.LString(err.Error()))
+			return 2 // number of results
+		}
+		L.Push(lua.LString(data))
+		return 1 // number of results
+	}))
+
+	// Encode a string for use in a URL query
+	L.SetGlobal("urlencode", L.NewFunction(func(L *lua.LState) int {
+		L.Push(lua.LString(url.QueryEscape(L.CheckString(1))))
+		return 1 // number of results
+	}))
+
+	// Decode a string that has been encoded for use in a URL query.
+	// Returns nil and an error message if the string is malformed.
+	L.SetGlobal("urldecode", L.NewFunction(func(L *lua.LState) int {
+		s, err := url.QueryUnescape(L.CheckString(1))
+		if err != nil {
+			L.Push(lua.LNil)
+			L.Push(lua.LString(err.Error()))
+			return 2 // number of results
+		}
+		L.Push(lua.LString(s))
+		return 1 // number of results
+	}))
+
+	// Parse a URL query string, like "a=1&b=2&b=3", and return a table with
+	// the keys and values. Keys with several values have a table of values.
+	// Returns nil and an error message if the query is malformed.
+	L.SetGlobal("parseQuery", L.NewFunction(func(L *lua.LState) int {
+		values, err := url.ParseQuery(L.CheckString(1))
+		if err != nil {
+			L.Push(lua.LNil)
+			L.Push(lua.LString(err.Error()))
+			return 2 // number of results
+		}
+		table := L.CreateTable(0, len(values))
+		for key, keyValues := range values {
+			if len(keyValues) == 1 {
+				table.RawSetString(key, lua.LString(keyValues[0]))
+				continue
+			}
+			table.RawSetString(key, convert.Strings2table(L, keyValues))
+		}
+		L.Push(table)
+		return 1 // number of results
+	}))
+
+	// Describe the given number of bytes as KiB or MiB, like "42 KiB",
+	// in the same way as in the error messages from the server
+	L.SetGlobal("humanBytes", L.NewFunction(func(L *lua.LState) int {
+		L.Push(lua.LString(utils.DescribeBytes(int64(L.CheckNumber(1)))))
+		return 1 // number of results
+	}))
+
+	// Return the value of the given environment variable, or an empty string
+	L.SetGlobal("getenv", L.NewFunction(func(L *lua.LState) int {
+		L.Push(lua.LString(os.Getenv(L.ToString(1))))
+		return 1 // number of results
+	}))
+
+	// Set an environment variable for the running server process.
+	// Returns true if successful.
+	L.SetGlobal("setenv", L.NewFunction(func(L *lua.LState) int {
+		if err := os.Setenv(L.ToString(1), L.ToString(2)); err != nil {
+			log.Error(err)
+			L.Push(lua.LBool(false))
+			return 1 // number of results
+		}
+		L.Push(lua.LBool(true))
+		return 1 // number of results
+	}))
+
+	// Return a table with all the environment variables
+	L.SetGlobal("environ", L.NewFunction(func(L *lua.LState) int {
+		m := make(map[string]string)
+		for _, keyValue := range os.Environ() {
+			if pos := strings.Index(keyValue, "="); pos > 0 {
+				m[keyValue[:pos]] = keyValue[pos+1:]
+			}
+		}
+		L.Push(convert.Map2table(L, m))
+		return 1 // number of results
+	}))
+
 }
 
 // LoadBasicWeb loads functions related to handling requests, outputting data to
@@ -188,6 +550,25 @@ func (ac *Config) LoadBasicWeb(w http.ResponseWriter, req *http.Request, L *lua.
 		return 1 // number of results
 	}))
 
+	// Return the current URL Path (same as urlpath)
+	L.SetGlobal("path", L.NewFunction(func(L *lua.LState) int {
+		L.Push(lua.LString(req.URL.Path))
+		return 1 // number of results
+	}))
+
+	// Return the IP address of the client. X-Forwarded-For is only used
+	// for requests from the proxies given with --trusted-proxies.
+	L.SetGlobal("clientIP", L.NewFunction(func(L *lua.LState) int {
+		L.Push(lua.LString(ac.requestClientIP(req)))
+		return 1 // number of results
+	}))
+
+	// Return the User-Agent header of the request
+	L.SetGlobal("useragent", L.NewFunction(func(L *lua.LState) int {
+		L.Push(lua.LString(req.UserAgent()))
+		return 1 // number of results
+	}))
+
 	// Return the current HTTP method (GET, POST etc)
 	L.SetGlobal("method", L.NewFunction(func(L *lua.LState) int {
 		L.Push(lua.LString(req.Method))
@@ -215,12 +596,19 @@ func (ac *Config) LoadBasicWeb(w http.ResponseWriter, req *http.Request, L *lua.
 		return 1 // number of results
 	}))
 
-	// Set the HTTP header in the request, for a given key and value
+	// Set the HTTP header in the response, for a given key and value.
+	// Returns false if the header has already been sent.
 	L.SetGlobal("setheader", L.NewFunction(func(L *lua.LState) int {
-		key := L.ToString(1)
-		value := L.ToString(2)
-		w.Header().Set(key, value)
-		return 0 // number of results
+		L.Push(lua.LBool(changeHeader(w, "setheader", L.ToString(1), L.ToString(2), false)))
+		return 1 // number of results
+	}))
+
+	// Add a HTTP header to the response, for a given key and value.
+	// Can be used for headers that may be given several times.
+	// Returns false if the header has already been sent.
+	L.SetGlobal("addheader", L.NewFunction(func(L *lua.LState) int {
+		L.Push(lua.LBool(changeHeader(w, "addheader", L.ToString(1), L.ToString(2), true)))
+		return 1 // number of results
 	}))
 
 	// Return the HTTP body in the request
@@ -236,6 +624,39 @@ func (ac *Config) LoadBasicWeb(w http.ResponseWriter, req *http.Request, L *lua.
 		return 1 // number of results
 	}))
 
+	// Read the HTTP body in the request as JSON, and return it as a table.
+	// Takes an optional size limit, in MiB. Returns nil and an error message
+	// if the body is too large or is not valid JSON.
+	L.SetGlobal("requestJSON", L.NewFunction(func(L *lua.LState) int {
+		limit := defaultJSONLimit
+		if L.GetTop() >= 1 {
+			limit = int64(float64(L.CheckNumber(1)) * float64(utils.MiB))
+		}
+		value, err := readJSONBody(L, w, req, limit)
+		if err != nil {
+			L.Push(lua.LNil)
+			L.Push(lua.LString(err.Error()))
+			return 2 // number of results
+		}
+		L.Push(value)
+		return 1 // number of results
+	}))
+
+	// Write the given value as JSON, with the Content-Type set to
+	// application/json. Returns true, or false and an error message.
+	L.SetGlobal("respondJSON", L.NewFunction(func(L *lua.LState) int {
+		data, err := json.Marshal(convert.Value2interface(L.CheckAny(1)))
+		if err != nil {
+			L.Push(lua.LBool(false))
+			L.Push(lua.LString(err.Error()))
+			return 2 // number of results
+		}
+		changeHeader(w, "respondJSON", "Content-Type", "application/json;charset=utf-8", false)
+		w.Write(data)
+		L.Push(lua.LBool(true))
+		return 1 // number of results
+	}))
+
 	// Set the HTTP status code (must come before print)
 	L.SetGlobal("status", L.NewFunction(func(L *lua.LState) int {
 		code := int(L.ToNumber(1))
@@ -307,6 +728,13 @@ func (ac *Config) LoadBasicWeb(w http.ResponseWriter, req *http.Request, L *lua.
 		return 1 // number of results
 	}))
 
+	// Return the first value for the given key in the posted form or in the
+	// URL query, or an empty string
+	L.SetGlobal("formValue", L.NewFunction(func(L *lua.LState) int {
+		L.Push(lua.LString(req.FormValue(L.CheckString(1))))
+		return 1 // number of results
+	}))
+
 	// Retrieve a table with keys and values from the URL in the request
 	L.SetGlobal("urldata", L.NewFunction(func(L *lua.LState) int {
 
@@ -346,21 +774,14 @@ func (ac *Config) LoadBasicWeb(w http.ResponseWriter, req *http.Request, L *lua.
 		if L.GetTop() == 2 {
 			httpStatusCode = int(L.ToNumber(2))
 		}
-		if httpStatus != nil {
-			httpStatus.code = httpStatusCode
-		}
-		http.Redirect(w, req, newurl, httpStatusCode)
+		redirect(w, req, newurl, httpStatusCode, httpStatus)
 		return 0 // number of results
 	}))
 
 	// Permanently redirect a request, which is the same as redirect(url, 301)
 	L.SetGlobal("permanent_redirect", L.NewFunction(func(L *lua.LState) int {
 		newurl := L.ToString(1)
-		httpStatusCode := http.StatusMovedPermanently
-		if httpStatus != nil {
-			httpStatus.code = httpStatusCode
-		}
-		http.Redirect(w, req, newurl, httpStatusCode)
+		redirect(w, req, newurl, http.StatusMovedPermanently, httpStatus)
 		return 0 // number of results
 	}))
 
@@ -0,0 +1,340 @@
+package engine
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bmizerany/assert"
+	"github.com/xyproto/algernon/lua/pool"
+	"github.com/xyproto/algernon/utils"
+	"github.com/xyproto/gopher-lua"
+)
+
+// serveLua serves the given Lua file and returns the response and the body.
+// The given URL path and query is requested, and redirects are not followed.
+func serveLua(t *testing.T, ac *Config, filename, urlPath string) (*http.Response, string) {
+	// Lua LState pool
+	ac.luapool = pool.New()
+	defer ac.luapool.Shutdown()
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		ac.FilePage(w, req, filename, "")
+	}))
+	defer server.Close()
+
+	client := &http.Client{
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	resp, err := client.Get(server.URL + urlPath)
+	assert.Equal(t, err, nil)
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	assert.Equal(t, err, nil)
+
+	return resp, string(body)
+}
+
+func TestSetHeader(t *testing.T) {
+	resp, body := serveLua(t, &Config{}, "testdata/headers.lua", "/")
+	assert.Equal(t, resp.StatusCode, http.StatusOK)
+	assert.Equal(t, resp.Header.Get("Cache-Control"), "no-cache")
+	assert.Equal(t, resp.Header["X-Tag"], []string{"a", "b"})
+
+	// Headers can not be set after the output has started
+	assert.Equal(t, resp.Header.Get("X-Late"), "")
+	assert.Equal(t, body, "hello\nfalse\n")
+}
+
+func TestSetHeaderDebugMode(t *testing.T) {
+	resp, body := serveLua(t, &Config{debugMode: true}, "testdata/headers.lua", "/")
+	assert.Equal(t, resp.Header.Get("Cache-Control"), "no-cache")
+	assert.Equal(t, resp.Header["X-Tag"], []string{"a", "b"})
+
+	// The response is buffered, so all headers are kept
+	assert.Equal(t, resp.Header.Get("X-Late"), "1")
+	assert.Equal(t, body, "hello\ntrue\n")
+}
+
+func TestRedirect(t *testing.T) {
+	for _, debugMode := range []bool{false, true} {
+		resp, body := serveLua(t, &Config{debugMode: debugMode}, "testdata/redirect.lua", "/")
+		assert.Equal(t, resp.StatusCode, http.StatusFound)
+		assert.Equal(t, resp.Header.Get("Location"), "/target")
+		// Output after the redirect is discarded
+		assert.Equal(t, strings.Contains(body, "not sent"), false)
+
+		resp, body = serveLua(t, &Config{debugMode: debugMode}, "testdata/redirect.lua", "/?code=303")
+		assert.Equal(t, resp.StatusCode, http.StatusSeeOther)
+		assert.Equal(t, resp.Header.Get("Location"), "/target")
+		assert.Equal(t, strings.Contains(body, "not sent"), false)
+	}
+}
+
+func TestEnvironment(t *testing.T) {
+	defer os.Unsetenv("ALGERNON_TEST")
+
+	L := lua.NewState()
+	defer L.Close()
+	(&Config{}).LoadBasicSystemFunctions(L)
+
+	err := L.DoString(`
+		assert(getenv("ALGERNON_TEST") == "")
+		assert(environ()["ALGERNON_TEST"] == nil)
+		assert(setenv("ALGERNON_TEST", "a=b"))
+		assert(getenv("ALGERNON_TEST") == "a=b")
+		assert(environ()["ALGERNON_TEST"] == "a=b")
+	`)
+	assert.Equal(t, err, nil)
+	assert.Equal(t, os.Getenv("ALGERNON_TEST"), "a=b")
+}
+
+func TestRandomIdentifiers(t *testing.T) {
+	L := lua.NewState()
+	defer L.Close()
+	(&Config{}).LoadBasicSystemFunctions(L)
+
+	err := L.DoString(`
+		id1, id2 = uuid(), uuid()
+		token = randomString(43)
+		assert(randomString(0) == "")
+		assert(#randomString(1) == 1)
+	`)
+	assert.Equal(t, err, nil)
+
+	uuidPattern := regexp.MustCompile(`^[0-9a-f]{8}-[0-9a-f]{4}-4[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}$`)
+	id1, id2 := L.GetGlobal("id1").String(), L.GetGlobal("id2").String()
+	assert.Equal(t, uuidPattern.MatchString(id1), true)
+	assert.Equal(t, uuidPattern.MatchString(id2), true)
+	assert.NotEqual(t, id1, id2)
+
+	token := L.GetGlobal("token").String()
+	assert.Equal(t, len(token), 43)
+	assert.Equal(t, regexp.MustCompile(`^[A-Za-z0-9_-]+$`).MatchString(token), true)
+}
+
+func TestEncoding(t *testing.T) {
+	L := lua.NewState()
+	defer L.Close()
+	(&Config{}).LoadBasicSystemFunctions(L)
+
+	err := L.DoString(`
+		local binary = "\0\1\254\255?>"
+		assert(base64encode(binary) == "AAH+/z8+")
+		assert(base64encode(binary, true) == "AAH-_z8-")
+		assert(base64decode(base64encode(binary)) == binary)
+		assert(base64decode(base64encode(binary, true), true) == binary)
+		assert(base64decode("") == "")
+
+		assert(hexencode(binary) == "0001feff3f3e")
+		assert(hexdecode("0001FEFF3f3e") == binary)
+
+		-- Malformed input
+		local data, err = base64decode("AAH-_z8-")
+		assert(data == nil and err ~= nil)
+		data, err = base64decode("AAH+/z8+", true)
+		assert(data == nil and err ~= nil)
+		data, err = hexdecode("abc")
+		assert(data == nil and err ~= nil)
+		data, err = hexdecode("zz")
+		assert(data == nil and err ~= nil)
+	`)
+	assert.Equal(t, err, nil)
+}
+
+func TestHumanBytes(t *testing.T) {
+	L := lua.NewState()
+	defer L.Close()
+	(&Config{}).LoadBasicSystemFunctions(L)
+
+	for _, size := range []int64{0, 1, 511, 512, 1023, 1024, 1536, utils.MiB - 1, utils.MiB, 5*utils.MiB + 1, 1024 * utils.MiB, 3 * 1024 * utils.MiB} {
+		assert.Equal(t, L.DoString("result = humanBytes("+strconv.FormatInt(size, 10)+")"), nil)
+		assert.Equal(t, L.GetGlobal("result").String(), utils.DescribeBytes(size))
+	}
+	assert.Equal(t, L.GetGlobal("result").String(), "3072 MiB")
+}
+
+func TestMarkdown(t *testing.T) {
+	L := lua.NewState()
+	defer L.Close()
+	(&Config{}).LoadBasicSystemFunctions(L)
+
+	err := L.DoString(`
+		assert(markdown("# Hello") == "<h1>Hello</h1>")
+		assert(markdown("[algernon](https://algernon.roboticoverlords.org)") == '<p><a href="https://algernon.roboticoverlords.org">algernon</a></p>')
+		assert(markdown("~~~\nx = 1\n~~~") == "<pre><code>x = 1\n</code></pre>")
+		assert(markdown("a", "b") == "<p>a b</p>")
+
+		-- Extensions can be disabled
+		local table = "| a |\n|---|\n| 1 |"
+		assert(markdown(table):find("<table>"))
+		assert(not markdown(table, {tables=false}):find("<table>"))
+		assert(markdown("https://example.com"):find("<a "))
+		assert(not markdown("https://example.com", {autolink=false}):find("<a "))
+
+		-- Raw HTML and unsafe links are left out by default
+		local unsafe = "<script>alert(1)</script>\n\n[x](javascript:alert(1)) <b>b</b>"
+		assert(not markdown(unsafe):find("<script>"))
+		assert(not markdown(unsafe):find("<b>"))
+		assert(not markdown(unsafe):find("javascript:"))
+
+		-- Unless the content is trusted
+		assert(markdown(unsafe, {unsafe=true}):find("<script>"))
+		assert(markdown(unsafe, {unsafe=true}):find('href="javascript:'))
+	`)
+	assert.Equal(t, err, nil)
+}
+
+func TestURLFunctions(t *testing.T) {
+	L := lua.NewState()
+	defer L.Close()
+	(&Config{}).LoadBasicSystemFunctions(L)
+
+	err := L.DoString(`
+		local s = "a b&c=d/é?"
+		assert(urlencode(s) == "a+b%26c%3Dd%2F%C3%A9%3F")
+		assert(urldecode(urlencode(s)) == s)
+		assert(urldecode("a%20b+c") == "a b c")
+		local decoded, err = urldecode("%zz")
+		assert(decoded == nil and err ~= nil)
+
+		local query = parseQuery("name=Bob&tag=a&tag=b&empty=")
+		assert(query.name == "Bob")
+		assert(type(query.tag) == "table" and #query.tag == 2 and query.tag[1] == "a" and query.tag[2] == "b")
+		assert(query.empty == "")
+		local query, err = parseQuery("a=%zz")
+		assert(query == nil and err ~= nil)
+	`)
+	assert.Equal(t, err, nil)
+}
+
+func TestFormValue(t *testing.T) {
+	L := lua.NewState()
+	defer L.Close()
+
+	req := httptest.NewRequest("POST", "/?page=2&name=query", strings.NewReader("name=posted"))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	(&Config{}).LoadBasicWeb(httptest.NewRecorder(), req, L, "index.lua", nil, nil)
+
+	err := L.DoString(`
+		assert(formValue("page") == "2")
+		-- Posted values take precedence over values in the URL
+		assert(formValue("name") == "posted")
+		assert(formValue("missing") == "")
+	`)
+	assert.Equal(t, err, nil)
+}
+
+func TestTimeFunctions(t *testing.T) {
+	L := lua.NewState()
+	defer L.Close()
+	(&Config{}).LoadBasicSystemFunctions(L)
+
+	err := L.DoString(`
+		local t = now()
+		assert(t > 1500000000 and t == math.floor(t))
+
+		-- 2018-06-01 12:30:00 UTC
+		local unix = 1527856200
+		assert(formatTime(unix, "2006-01-02 15:04:05") == "2018-06-01 12:30:00")
+		assert(formatTime(unix, "Jan 2 15:04 MST", "Europe/Oslo") == "Jun 1 14:30 CEST")
+		assert(formatTime(unix + 0.5, "15:04:05.000") == "12:30:00.500")
+
+		assert(parseTime("2018-06-01 12:30:00", "2006-01-02 15:04:05") == unix)
+		assert(parseTime("2018-06-01 14:30:00", "2006-01-02 15:04:05", "Europe/Oslo") == unix)
+		assert(parseTime("2018-06-01T12:30:00+02:00", "2006-01-02T15:04:05Z07:00", "Europe/Oslo") == unix - 7200)
+		assert(parseTime(formatTime(unix, "Mon Jan 2 15:04:05 2006"), "Mon Jan 2 15:04:05 2006") == unix)
+
+		-- Failures
+		local result, err = parseTime("yesterday", "2006-01-02")
+		assert(result == nil and err ~= nil)
+		result, err = formatTime(unix, "2006", "Nowhere/Missing")
+		assert(result == nil and err ~= nil)
+		result, err = parseTime("2018", "2006", "Nowhere/Missing")
+		assert(result == nil and err ~= nil)
+	`)
+	assert.Equal(t, err, nil)
+}
+
+// postJSON posts the given body to testdata/echojson.lua, with the given
+// size limit in MiB, if not empty. Returns the response and the body.
+func postJSON(t *testing.T, body, limit string) (*http.Response, string) {
+	ac := &Config{luapool: pool.New()}
+	defer ac.luapool.Shutdown()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		ac.FilePage(w, req, "testdata/echojson.lua", "")
+	}))
+	defer server.Close()
+
+	req, err := http.NewRequest("POST", server.URL, strings.NewReader(body))
+	assert.Equal(t, err, nil)
+	req.Header.Set("Content-Type", "application/json")
+	if limit != "" {
+		req.Header.Set("X-Limit", limit)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	assert.Equal(t, err, nil)
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(resp.Body)
+	assert.Equal(t, err, nil)
+	return resp, string(data)
+}
+
+func TestRequestJSON(t *testing.T) {
+	resp, body := postJSON(t, `{"name": "algernon", "tags": ["a", "b"], "count": 3, "nested": {"ok": false}}`, "")
+	assert.Equal(t, resp.StatusCode, http.StatusOK)
+	assert.Equal(t, resp.Header.Get("Content-Type"), "application/json;charset=utf-8")
+	assert.Equal(t, body, `{"count":3,"echo":true,"name":"algernon","nested":{"ok":false},"tags":["a","b"]}`)
+}
+
+func TestRequestJSONErrors(t *testing.T) {
+	resp, body := postJSON(t, `{"name": `, "")
+	assert.Equal(t, resp.StatusCode, http.StatusBadRequest)
+	assert.Equal(t, body, "unexpected end of JSON input\n")
+
+	// 0.001 MiB is 1048 bytes
+	resp, body = postJSON(t, `{"name": "`+strings.Repeat("a", 2000)+`"}`, "0.001")
+	assert.Equal(t, resp.StatusCode, http.StatusBadRequest)
+	assert.Equal(t, body, "the request body is too large (the limit is 1 KiB)\n")
+}
+
+func TestSleep(t *testing.T) {
+	L := lua.NewState()
+	defer L.Close()
+	(&Config{}).LoadBasicSystemFunctions(L)
+
+	start := time.Now()
+	err := L.DoString(`
+		assert(sleep(0.01) == true)
+		assert(sleepms(10) == true)
+		assert(sleepms(0) == true)
+	`)
+	assert.Equal(t, err, nil)
+	assert.Equal(t, time.Since(start) >= 20*time.Millisecond, true)
+}
+
+func TestSleepCancelled(t *testing.T) {
+	L := lua.NewState()
+	defer L.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	loadSleep(L, ctx)
+
+	// The client disconnects while sleeping
+	time.AfterFunc(10*time.Millisecond, cancel)
+	start := time.Now()
+	err := L.DoString(`
+		assert(sleep(60) == false)
+		assert(sleepms(60000) == false)
+	`)
+	assert.Equal(t, err, nil)
+	assert.Equal(t, time.Since(start) < 10*time.Second, true)
+}
@@ -0,0 +1,73 @@
+package engine
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// The realm that is used for HTTP basic authentication, if none is given
+const defaultBasicAuthRealm = "Restricted"
+
+// basicAuthRule is a username and password that is required for the URL
+// paths that start with the given prefix
+type basicAuthRule struct {
+	prefix   string
+	username string
+	password string
+	realm    string
+}
+
+// equalSecret compares the given strings in constant time. The strings are
+// hashed first, so that the time does not depend on the length either.
+func equalSecret(a, b string) bool {
+	ha, hb := sha256.Sum256([]byte(a)), sha256.Sum256([]byte(b))
+	return subtle.ConstantTimeCompare(ha[:], hb[:]) == 1
+}
+
+// basicAuthRules returns the rules with the longest prefix that matches the
+// given URL path. There can be several rules, one per user, for each prefix.
+func basicAuthRules(rules []basicAuthRule, urlPath string) []basicAuthRule {
+	var matching []basicAuthRule
+	longest := -1
+	for _, rule := range rules {
+		if !strings.HasPrefix(urlPath, rule.prefix) || len(rule.prefix) < longest {
+			continue
+		}
+		if len(rule.prefix) > longest {
+			longest = len(rule.prefix)
+			matching = nil
+		}
+		matching = append(matching, rule)
+	}
+	return matching
+}
+
+// BasicAuthHandler wraps the given handler, so that requests for URL paths
+// that start with the prefix of one of the given rules require the username
+// and password of one of the rules for that prefix. Other requests are passed
+// on. Requests with missing or wrong credentials get "401 Unauthorized".
+func BasicAuthHandler(next http.Handler, rules []basicAuthRule) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		matching := basicAuthRules(rules, req.URL.Path)
+		if len(matching) == 0 {
+			next.ServeHTTP(w, req)
+			return
+		}
+		if username, password, ok := req.BasicAuth(); ok {
+			for _, rule := range matching {
+				// Compare both, even if the username is wrong
+				usernameOK := equalSecret(username, rule.username)
+				passwordOK := equalSecret(password, rule.password)
+				if usernameOK && passwordOK {
+					next.ServeHTTP(w, req)
+					return
+				}
+			}
+		}
+		w.Header().Set("WWW-Authenticate", "Basic realm="+strconv.Quote(matching[0].realm)+`, charset="UTF-8"`)
+		http.Error(w, "401 Unauthorized", http.StatusUnauthorized)
+	})
+}
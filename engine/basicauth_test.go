@@ -0,0 +1,55 @@
+package engine
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/bmizerany/assert"
+)
+
+func TestBasicAuthHandler(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte("hello"))
+	})
+	rules := []basicAuthRule{
+		{prefix: "/admin", username: "admin", password: "secret", realm: "Admin area"},
+		{prefix: "/admin", username: "bob", password: "hunter2", realm: "Admin area"},
+		{prefix: "/admin/public", username: "guest", password: "guest", realm: defaultBasicAuthRealm},
+	}
+	server := httptest.NewServer(BasicAuthHandler(handler, rules))
+	defer server.Close()
+
+	get := func(urlPath, username, password string) *http.Response {
+		req, err := http.NewRequest("GET", server.URL+urlPath, nil)
+		assert.Equal(t, err, nil)
+		if username != "" {
+			req.SetBasicAuth(username, password)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		assert.Equal(t, err, nil)
+		resp.Body.Close()
+		return resp
+	}
+
+	// Missing credentials
+	resp := get("/admin/index.lua", "", "")
+	assert.Equal(t, resp.StatusCode, http.StatusUnauthorized)
+	assert.Equal(t, resp.Header.Get("WWW-Authenticate"), `Basic realm="Admin area", charset="UTF-8"`)
+
+	// Wrong credentials
+	assert.Equal(t, get("/admin/", "admin", "wrong").StatusCode, http.StatusUnauthorized)
+	assert.Equal(t, get("/admin/", "wrong", "secret").StatusCode, http.StatusUnauthorized)
+	assert.Equal(t, get("/admin/", "admin", "hunter2").StatusCode, http.StatusUnauthorized)
+
+	// Correct credentials, for each user
+	assert.Equal(t, get("/admin/", "admin", "secret").StatusCode, http.StatusOK)
+	assert.Equal(t, get("/admin/", "bob", "hunter2").StatusCode, http.StatusOK)
+
+	// The longest matching prefix is used
+	assert.Equal(t, get("/admin/public/", "guest", "guest").StatusCode, http.StatusOK)
+	assert.Equal(t, get("/admin/public/", "admin", "secret").StatusCode, http.StatusUnauthorized)
+
+	// Other paths are public
+	assert.Equal(t, get("/", "", "").StatusCode, http.StatusOK)
+}
@@ -49,20 +49,15 @@ func (ac *Config) LoadCacheFunctions(L *lua.LState) {
 		return 1 // number of results
 	}))
 
-	// Try to load a file into the file cache, if it isn't already there
-	L.SetGlobal("preload", L.NewFunction(func(L *lua.LState) int {
-		filename := L.ToString(1)
-		if ac.cache == nil {
-			L.Push(lua.LBool(false))
-			return 1 // number of results
-		}
-		// Don't read from disk if already in cache, hence "true"
-		if _, err := ac.cache.Read(filename, true); err != nil {
-			L.Push(lua.LBool(false))
-			return 1 // number of results
-		}
-		L.Push(lua.LBool(true)) // success
-		return 1                // number of results
-	}))
+}
 
+// preloadFile tries to load a file into the file cache, if it isn't already
+// there. Returns true if successful.
+func (ac *Config) preloadFile(filename string) bool {
+	if ac.cache == nil {
+		return false
+	}
+	// Don't read from disk if already in cache, hence "true"
+	_, err := ac.cache.Read(filename, true)
+	return err == nil
 }
@@ -0,0 +1,56 @@
+package engine
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// parseTrustedProxies parses the given IP addresses and networks, like
+// "10.0.0.1" or "10.0.0.0/8", for the proxies that are trusted to set
+// X-Forwarded-For
+func parseTrustedProxies(proxies []string) ([]*net.IPNet, error) {
+	var networks []*net.IPNet
+	for _, proxy := range proxies {
+		if strings.Contains(proxy, "/") {
+			_, network, err := net.ParseCIDR(proxy)
+			if err != nil {
+				return nil, err
+			}
+			networks = append(networks, network)
+			continue
+		}
+		ip := net.ParseIP(proxy)
+		if ip == nil {
+			return nil, fmt.Errorf("invalid IP address: %q", proxy)
+		}
+		bits := 8 * net.IPv6len
+		if ip4 := ip.To4(); ip4 != nil {
+			ip, bits = ip4, 8*net.IPv4len
+		}
+		networks = append(networks, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+	}
+	return networks, nil
+}
+
+// isTrustedProxy checks if the given IP address is one of the trusted proxies
+// given with --trusted-proxies or SetTrustedProxies
+func (ac *Config) isTrustedProxy(ip net.IP) bool {
+	if ip == nil {
+		return false
+	}
+	for _, network := range ac.trustedProxies {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// requestClientIP returns the IP address of the client that sent the given
+// request. X-Forwarded-For is only used if the request comes from one of the
+// trusted proxies.
+func (ac *Config) requestClientIP(req *http.Request) string {
+	return forwardedClientIP(req, ac.isTrustedProxy)
+}
@@ -0,0 +1,74 @@
+package engine
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/bmizerany/assert"
+	"github.com/xyproto/algernon/lua/pool"
+)
+
+func TestParseTrustedProxies(t *testing.T) {
+	networks, err := parseTrustedProxies([]string{"10.0.0.0/8", "192.0.2.1", "::1"})
+	assert.Equal(t, err, nil)
+	assert.Equal(t, len(networks), 3)
+	assert.Equal(t, networks[0].String(), "10.0.0.0/8")
+	assert.Equal(t, networks[1].String(), "192.0.2.1/32")
+	assert.Equal(t, networks[2].String(), "::1/128")
+
+	for _, proxy := range []string{"10.0.0.0/33", "localhost", ""} {
+		_, err := parseTrustedProxies([]string{proxy})
+		assert.NotEqual(t, err, nil)
+	}
+}
+
+// requestInfo requests testdata/requestinfo.lua with the given
+// X-Forwarded-For header and returns the output
+func requestInfo(t *testing.T, ac *Config, forwardedFor string) string {
+	ac.luapool = pool.New()
+	defer ac.luapool.Shutdown()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		ac.FilePage(w, req, "testdata/requestinfo.lua", "")
+	}))
+	defer server.Close()
+
+	req, err := http.NewRequest("POST", server.URL+"/info?x=1", strings.NewReader("data"))
+	assert.Equal(t, err, nil)
+	req.Header.Set("X-Test", "hello")
+	req.Header.Set("User-Agent", "tester/1.0")
+	if forwardedFor != "" {
+		req.Header.Set("X-Forwarded-For", forwardedFor)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	assert.Equal(t, err, nil)
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	assert.Equal(t, err, nil)
+	return string(body)
+}
+
+func TestRequestInfo(t *testing.T) {
+	assert.Equal(t, requestInfo(t, &Config{}, ""), "POST\t/info\thello\ttester/1.0\t127.0.0.1\n")
+}
+
+func TestClientIPForwarded(t *testing.T) {
+	// A spoofed X-Forwarded-For is ignored when no proxies are trusted,
+	// even for requests from the same host
+	assert.Equal(t, strings.HasSuffix(requestInfo(t, &Config{}, "198.51.100.1"), "\t127.0.0.1\n"), true)
+
+	// And when the request does not come from one of the trusted proxies
+	proxies, err := parseTrustedProxies([]string{"10.0.0.0/8"})
+	assert.Equal(t, err, nil)
+	assert.Equal(t, strings.HasSuffix(requestInfo(t, &Config{trustedProxies: proxies}, "198.51.100.1"), "\t127.0.0.1\n"), true)
+
+	// From a trusted proxy, the last address that was not added by a
+	// trusted proxy is used
+	proxies, err = parseTrustedProxies([]string{"127.0.0.1", "10.0.0.0/8"})
+	assert.Equal(t, err, nil)
+	ac := &Config{trustedProxies: proxies}
+	assert.Equal(t, strings.HasSuffix(requestInfo(t, ac, "198.51.100.1"), "\t198.51.100.1\n"), true)
+	assert.Equal(t, strings.HasSuffix(requestInfo(t, ac, "192.0.2.9, 198.51.100.1, 10.0.0.2"), "\t198.51.100.1\n"), true)
+}
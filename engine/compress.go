@@ -0,0 +1,226 @@
+package engine
+
+import (
+	"bufio"
+	"compress/flate"
+	"compress/gzip"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// Responses that are smaller than this are not compressed
+const compressionThreshold = 1024
+
+// compressor is a gzip or deflate writer
+type compressor interface {
+	io.WriteCloser
+	Flush() error
+}
+
+// acceptedEncoding returns "gzip" or "deflate", if the given Accept-Encoding
+// header value accepts one of them, or an empty string. gzip is preferred.
+func acceptedEncoding(acceptEncoding string) string {
+	// The quality value for each encoding, like 0.5 for "gzip;q=0.5"
+	qvalues := make(map[string]float64)
+	for _, part := range strings.Split(acceptEncoding, ",") {
+		fields := strings.Split(part, ";")
+		q := 1.0
+		for _, param := range fields[1:] {
+			param = strings.TrimSpace(param)
+			if strings.HasPrefix(param, "q=") {
+				if value, err := strconv.ParseFloat(param[2:], 64); err == nil {
+					q = value
+				}
+			}
+		}
+		qvalues[strings.ToLower(strings.TrimSpace(fields[0]))] = q
+	}
+	for _, encoding := range []string{"gzip", "deflate"} {
+		q, ok := qvalues[encoding]
+		if !ok {
+			q, ok = qvalues["*"]
+		}
+		if ok && q > 0 {
+			return encoding
+		}
+	}
+	return ""
+}
+
+// compressible checks if responses with the given content type are worth
+// compressing. Images, audio, video, fonts and archives are usually
+// compressed already.
+func compressible(contentType string) bool {
+	contentType = strings.ToLower(contentType)
+	if i := strings.Index(contentType, ";"); i >= 0 {
+		contentType = contentType[:i]
+	}
+	contentType = strings.TrimSpace(contentType)
+	switch {
+	case contentType == "image/svg+xml":
+		return true
+	case strings.HasPrefix(contentType, "image/"),
+		strings.HasPrefix(contentType, "audio/"),
+		strings.HasPrefix(contentType, "video/"),
+		strings.HasPrefix(contentType, "font/woff"):
+		return false
+	}
+	switch contentType {
+	case "application/zip", "application/gzip", "application/x-gzip", "application/x-bzip2",
+		"application/x-xz", "application/x-7z-compressed", "application/x-rar-compressed",
+		"application/pdf", "application/octet-stream", "application/wasm":
+		return false
+	}
+	return true
+}
+
+// compressWriter is a http.ResponseWriter that compresses the response with
+// gzip or deflate. The start of the response is buffered, until it is clear
+// if the response is large enough to be compressed.
+type compressWriter struct {
+	http.ResponseWriter
+	encoding string // "gzip", "deflate" or "" if the client does not accept compression
+	code     int
+	buf      []byte
+	decided  bool // if the header has been written
+	c        compressor
+}
+
+// newCompressWriter returns a compressWriter for the given encoding, as
+// returned by acceptedEncoding
+func newCompressWriter(w http.ResponseWriter, encoding string) *compressWriter {
+	return &compressWriter{ResponseWriter: w, encoding: encoding, code: http.StatusOK}
+}
+
+// WriteHeader stores the status code until the response is written.
+// Informational responses, like "103 Early Hints", are written right away.
+func (cw *compressWriter) WriteHeader(code int) {
+	if code < 200 || cw.decided {
+		cw.ResponseWriter.WriteHeader(code)
+		return
+	}
+	cw.code = code
+}
+
+// Write buffers the start of the response, then writes it compressed or
+// uncompressed
+func (cw *compressWriter) Write(b []byte) (int, error) {
+	if cw.decided {
+		if cw.c != nil {
+			return cw.c.Write(b)
+		}
+		return cw.ResponseWriter.Write(b)
+	}
+	cw.buf = append(cw.buf, b...)
+	if len(cw.buf) >= compressionThreshold {
+		if err := cw.decide(); err != nil {
+			return 0, err
+		}
+	}
+	return len(b), nil
+}
+
+// decide checks if the response should be compressed, writes the header and
+// then the buffered data
+func (cw *compressWriter) decide() error {
+	cw.decided = true
+	header := cw.Header()
+	if header.Get("Content-Type") == "" && len(cw.buf) > 0 {
+		// Detect the content type before the data is compressed
+		header.Set("Content-Type", http.DetectContentType(cw.buf))
+	}
+	eligible := len(cw.buf) >= compressionThreshold &&
+		header.Get("Content-Encoding") == "" &&
+		header.Get("Content-Range") == "" &&
+		cw.code != http.StatusNoContent && cw.code != http.StatusNotModified && cw.code != http.StatusPartialContent &&
+		compressible(header.Get("Content-Type"))
+	if eligible {
+		// The response depends on the Accept-Encoding header of the request
+		header.Add("Vary", "Accept-Encoding")
+	}
+	if eligible && cw.encoding != "" {
+		header.Set("Content-Encoding", cw.encoding)
+		header.Del("Content-Length")
+		if cw.encoding == "gzip" {
+			cw.c = gzip.NewWriter(cw.ResponseWriter)
+		} else {
+			cw.c, _ = flate.NewWriter(cw.ResponseWriter, flate.DefaultCompression)
+		}
+	}
+	cw.ResponseWriter.WriteHeader(cw.code)
+	buf := cw.buf
+	cw.buf = nil
+	if len(buf) == 0 {
+		return nil
+	}
+	var err error
+	if cw.c != nil {
+		_, err = cw.c.Write(buf)
+	} else {
+		_, err = cw.ResponseWriter.Write(buf)
+	}
+	return err
+}
+
+// Flush writes the buffered data and flushes the response
+func (cw *compressWriter) Flush() {
+	if !cw.decided {
+		cw.decide()
+	}
+	if cw.c != nil {
+		cw.c.Flush()
+	}
+	if flusher, ok := cw.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// Close writes the rest of the response
+func (cw *compressWriter) Close() error {
+	if !cw.decided {
+		if cw.code == http.StatusOK && len(cw.buf) == 0 {
+			// Nothing has been written, let the server handle the response
+			cw.decided = true
+			return nil
+		}
+		if err := cw.decide(); err != nil {
+			return err
+		}
+	}
+	if cw.c != nil {
+		return cw.c.Close()
+	}
+	return nil
+}
+
+// Hijack lets the caller take over the connection, for WebSockets.
+// The response is not compressed after this.
+func (cw *compressWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hijacker, ok := cw.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("the ResponseWriter does not support hijacking")
+	}
+	cw.decided = true
+	return hijacker.Hijack()
+}
+
+// Unwrap returns the wrapped ResponseWriter, for use with http.ResponseController
+func (cw *compressWriter) Unwrap() http.ResponseWriter {
+	return cw.ResponseWriter
+}
+
+// CompressionHandler wraps the given handler, so that responses are
+// compressed with gzip or deflate, if the client accepts it. Small responses
+// and content types that are usually compressed already, like images, are not
+// compressed.
+func CompressionHandler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		cw := newCompressWriter(w, acceptedEncoding(req.Header.Get("Accept-Encoding")))
+		defer cw.Close()
+		next.ServeHTTP(cw, req)
+	})
+}
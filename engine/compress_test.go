@@ -0,0 +1,112 @@
+package engine
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/bmizerany/assert"
+)
+
+func TestAcceptedEncoding(t *testing.T) {
+	assert.Equal(t, acceptedEncoding("gzip, deflate, br"), "gzip")
+	assert.Equal(t, acceptedEncoding("deflate"), "deflate")
+	assert.Equal(t, acceptedEncoding("gzip;q=0, deflate;q=0.5"), "deflate")
+	assert.Equal(t, acceptedEncoding("*"), "gzip")
+	assert.Equal(t, acceptedEncoding("*, gzip;q=0"), "deflate")
+	assert.Equal(t, acceptedEncoding("identity"), "")
+	assert.Equal(t, acceptedEncoding(""), "")
+
+	assert.Equal(t, compressible("text/html; charset=utf-8"), true)
+	assert.Equal(t, compressible("image/svg+xml"), true)
+	assert.Equal(t, compressible("image/png"), false)
+	assert.Equal(t, compressible("video/mp4"), false)
+}
+
+// compressionGet requests the given path from a server with compression,
+// with the given Accept-Encoding header
+func compressionGet(t *testing.T, handler http.HandlerFunc, path, acceptEncoding string) (*http.Response, []byte) {
+	server := httptest.NewServer(CompressionHandler(handler))
+	defer server.Close()
+	req, err := http.NewRequest("GET", server.URL+path, nil)
+	assert.Equal(t, err, nil)
+	if acceptEncoding != "" {
+		req.Header.Set("Accept-Encoding", acceptEncoding)
+	}
+	// Use a transport that does not decompress the response
+	resp, err := (&http.Transport{DisableCompression: true}).RoundTrip(req)
+	assert.Equal(t, err, nil)
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	assert.Equal(t, err, nil)
+	return resp, body
+}
+
+func TestCompressionHandler(t *testing.T) {
+	large := strings.Repeat("<p>Hello, World!</p>\n", 200)
+	handler := func(w http.ResponseWriter, req *http.Request) {
+		switch req.URL.Path {
+		case "/large":
+			w.Header().Set("Content-Type", "text/html;charset=utf-8")
+			// Written in several parts
+			for i := 0; i < len(large); i += 100 {
+				end := i + 100
+				if end > len(large) {
+					end = len(large)
+				}
+				w.Write([]byte(large[i:end]))
+			}
+		case "/small":
+			w.Write([]byte("<p>Hello, World!</p>"))
+		case "/image":
+			w.Header().Set("Content-Type", "image/png")
+			w.Write([]byte(large))
+		case "/notfound":
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(large))
+		}
+	}
+
+	// Compressed with gzip
+	resp, body := compressionGet(t, handler, "/large", "gzip, deflate")
+	assert.Equal(t, resp.Header.Get("Content-Encoding"), "gzip")
+	assert.Equal(t, resp.Header.Get("Vary"), "Accept-Encoding")
+	assert.Equal(t, resp.Header.Get("Content-Type"), "text/html;charset=utf-8")
+	assert.Equal(t, len(body) < len(large), true)
+	gz, err := gzip.NewReader(bytes.NewReader(body))
+	assert.Equal(t, err, nil)
+	data, err := ioutil.ReadAll(gz)
+	assert.Equal(t, err, nil)
+	assert.Equal(t, string(data), large)
+
+	// Compressed with deflate, and the status code is kept
+	resp, body = compressionGet(t, handler, "/notfound", "deflate")
+	assert.Equal(t, resp.StatusCode, http.StatusNotFound)
+	assert.Equal(t, resp.Header.Get("Content-Encoding"), "deflate")
+	data, err = ioutil.ReadAll(flate.NewReader(bytes.NewReader(body)))
+	assert.Equal(t, err, nil)
+	assert.Equal(t, string(data), large)
+
+	// Not compressed, if the client does not accept it
+	resp, body = compressionGet(t, handler, "/large", "")
+	assert.Equal(t, resp.Header.Get("Content-Encoding"), "")
+	assert.Equal(t, resp.Header.Get("Vary"), "Accept-Encoding")
+	assert.Equal(t, string(body), large)
+
+	// Small responses are not compressed
+	resp, body = compressionGet(t, handler, "/small", "gzip")
+	assert.Equal(t, resp.Header.Get("Content-Encoding"), "")
+	assert.Equal(t, resp.Header.Get("Vary"), "")
+	assert.Equal(t, resp.Header.Get("Content-Type"), "text/html; charset=utf-8")
+	assert.Equal(t, string(body), "<p>Hello, World!</p>")
+
+	// Images are not compressed
+	resp, body = compressionGet(t, handler, "/image", "gzip")
+	assert.Equal(t, resp.Header.Get("Content-Encoding"), "")
+	assert.Equal(t, string(body), large)
+}
@@ -5,8 +5,10 @@ import (
 	"bytes"
 	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
 	internallog "log"
+	"net"
 	"net/http"
 	"os"
 	"path/filepath"
@@ -21,6 +23,7 @@ import (
 	"github.com/mitchellh/colorstring"
 	log "github.com/sirupsen/logrus"
 	"github.com/xyproto/algernon/cachemode"
+	"github.com/xyproto/algernon/lua/httpclient"
 	"github.com/xyproto/algernon/lua/pool"
 	"github.com/xyproto/algernon/platformdep"
 	"github.com/xyproto/algernon/utils"
@@ -41,10 +44,33 @@ const (
 type Config struct {
 
 	// For convenience. Set in the main function.
-	serverHost      string
-	dbName          string
-	refreshDuration time.Duration // for the auto-refresh feature
-	shutdownTimeout time.Duration
+	serverHost        string
+	dbName            string
+	refreshDuration   time.Duration  // for the auto-refresh feature
+	shutdownTimeout   time.Duration  // how long to wait for requests to complete when shutting down
+	httpClientTimeout time.Duration  // default timeout for HTTP requests sent from Lua
+	servers           []*http.Server // for shutting down gracefully
+	handleSignals     sync.Once      // for handling SIGINT and SIGTERM once
+	reloadMut         sync.RWMutex   // for replacing the handler and permissions on SIGHUP
+	servedHandler     http.Handler   // the handler that is being served, guarded by reloadMut
+
+	// Custom error pages per HTTP status code, guarded by reloadMut.
+	// The error pages from reloading the configuration are collected in
+	// reloadedErrorPages, until the reloading is done.
+	errorPages, reloadedErrorPages map[int]errorPage
+
+	// Request counts and durations for --metrics, nil if disabled
+	metrics *serverMetrics
+	// Only serve the metrics to logged in administrators
+	metricsAdminOnly bool
+
+	// Where /healthz and /readyz are served, for --health. Empty if disabled.
+	healthPath string
+
+	// Functions from BeforeRequest and AfterRequest, guarded by reloadMut.
+	// The functions from reloading the configuration are collected in
+	// reloadedRequestHooks, until the reloading is done.
+	requestHooks, reloadedRequestHooks *requestHooks
 
 	defaultWebColonPort       string
 	defaultRedisColonPort     string
@@ -78,6 +104,9 @@ type Config struct {
 	// List of configuration filenames to check
 	serverConfigurationFilenames []string
 
+	// TOML or JSON file with settings, for the flags that are not given
+	configFilename string
+
 	// Configuration that is exposed to the server configuration script(s)
 	serverDirOrFilename, serverAddr, serverCert, serverKey, serverConfScript, internalLogFilename, serverLogFile string
 
@@ -87,6 +116,15 @@ type Config struct {
 	// If only QUIC
 	serveJustQUIC bool
 
+	// Fetch TLS certificates from Let's Encrypt for the given domains,
+	// and cache them in the given directory
+	autoTLS         bool
+	autoTLSDomains  []string
+	autoTLSCacheDir string
+
+	// If a TLS certificate or key has been given (not the defaults)
+	serverCertGiven bool
+
 	// If only using the Lua REPL
 	serveNothing bool
 
@@ -97,6 +135,12 @@ type Config struct {
 	// Server modes
 	debugMode, verboseMode, productionMode, serverMode bool
 
+	// Don't show error details to clients, only log them
+	hideErrors bool
+
+	// Allow Lua scripts to run external commands with exec
+	allowExec bool
+
 	// For the Server-Sent Event (SSE) server
 	eventAddr    string // Host and port to serve Server-Sent Events on
 	eventRefresh string // The duration of an event cycle
@@ -122,6 +166,16 @@ type Config struct {
 	postgresDatabase   string // database name
 	redisAddr          string
 	redisDBindex       int
+	redisPassword      string
+	redisPoolSize      int // 0 is the default size
+	redisTLS           bool
+	redisTLSCert       string // client certificate
+	redisTLSKey        string // client key
+	redisCA            string // certificate authority
+	redisTLSSkipVerify bool
+	redisSentinels     []string     // Redis Sentinel addresses, for finding the master
+	redisMasterName    string       // the name of the master, for Redis Sentinel
+	redisTunnel        net.Listener // for forwarding connections to Redis over TLS or to the current master
 	redisAddrSpecified bool
 
 	limitRequests       int64 // rate limit to this many requests per client per second
@@ -130,6 +184,7 @@ type Config struct {
 	// Access logs
 	commonAccessLogFilename   string // NCSA access log
 	combinedAccessLogFilename string // CLF access log
+	accessLog                 *accessLogWriter
 
 	// For the version flag
 	showVersion bool
@@ -146,16 +201,55 @@ type Config struct {
 	// Large file support (threshold for not reading into memory)
 	largeFileSize uint64
 
-	// Timeout when writing to a client, in seconds
-	writeTimeout uint64
+	// File extensions that are allowed to be served (all, if empty)
+	servableExtensions []string
+
+	// Timeouts for reading a request, writing a response and waiting for the
+	// next request on a keep-alive connection. 0 is no timeout.
+	readTimeout  time.Duration
+	writeTimeout time.Duration
+	idleTimeout  time.Duration
 
 	// HTTP headers
 	noHeaders       bool
 	stricterHeaders bool
 
+	// Compress responses with gzip or deflate, if the client accepts it
+	compressResponses bool
+
+	// Allow cross-origin requests from these origins ("*" for all),
+	// with these methods (or the default methods, if empty)
+	corsOrigins []string
+	corsMethods []string
+
+	// Usernames and passwords for HTTP basic authentication, per URL prefix
+	basicAuth []basicAuthRule
+
+	// Forward the requests for some URL prefixes to other servers
+	reverseProxies []*reverseProxy
+
+	// URL paths and patterns that are handled by Lua functions, from Handle
+	routes []*route
+
+	// Limit each client IP address to this many requests per minute (0 is off)
+	rateLimit int
+
+	// Proxies that are trusted to set X-Forwarded-For, for the clientIP function
+	trustedProxies []*net.IPNet
+
+	// Add ETag and Last-Modified headers, and answer conditional requests
+	// with "304 Not Modified"
+	etagCaching bool
+
+	// How long sessions last without changes
+	sessionTimeout time.Duration
+
 	// Output
-	quietMode bool
-	noBanner  bool
+	quietMode   bool
+	noBanner    bool
+	startupJSON bool   // output a line of JSON when ready, instead of the banner
+	logLevel    string // debug, info, warn or error
+	logFormat   string // text or json, or blank for the default
 
 	// If a single Lua file is provided, or Server() is used.
 	luaServerFilename string
@@ -206,13 +300,40 @@ type Config struct {
 	// Temporary directory
 	serverTempDir string
 
+	// List the contents of directories without an index file
+	dirListing bool
+
+	// Filenames that are served for directory requests, tried in order,
+	// instead of the default ones
+	indexFilenames []string
+
+	// File permissions for uploaded files that are saved, given with
+	// --uploadperm. 0 is the default.
+	uploadPermissions os.FileMode
+
+	// Directory for temporary files, given with --tmpdir or SetTempDir.
+	// The default is os.TempDir().
+	tempDir string
+
 	// REPL
 	ctrldTwice bool
 
+	// Don't use colors in the terminal output
+	noColor bool
+
 	// State and caching
 	perm    pinterface.IPermissions
 	luapool *pool.LStatePool
-	cache   *datablock.FileCache
+
+	// The maximum number of pooled Lua states (0 is unlimited), and if
+	// requests should wait for a Lua state when all of them are in use,
+	// instead of creating a new one
+	luaPoolSize  int
+	luaPoolBlock bool
+
+	// When the server was started, for reporting the uptime
+	startTime time.Time
+	cache     *datablock.FileCache
 
 	// Default program for opening files and URLs in the current OS
 	defaultOpenExecutable string
@@ -248,12 +369,21 @@ var (
 	ErrDatabase = errors.New("could not find a usable database backend")
 )
 
+// BuildDate is shown together with the version, if it is set when building:
+// go build -ldflags "-X github.com/xyproto/algernon/engine.BuildDate=$(date +%F)"
+var BuildDate string
+
 // New creates a new server configuration based using the default values
 func New(versionString, description string) (*Config, error) {
 	ac := &Config{
 		curlSupport: true,
 
-		shutdownTimeout: 10 * time.Second,
+		shutdownTimeout:   10 * time.Second,
+		httpClientTimeout: httpclient.DefaultTimeout,
+
+		readTimeout:  30 * time.Second,
+		writeTimeout: 30 * time.Second,
+		idleTimeout:  120 * time.Second,
 
 		defaultWebColonPort:       ":3000",
 		defaultRedisColonPort:     ":6379",
@@ -341,11 +471,20 @@ func (ac *Config) initFilesAndCache() error {
 	// Set several configuration variables, based on the given flags and arguments
 	ac.handleFlags(ac.serverTempDir)
 
+	// Use the directory given with --tmpdir for the temporary directory
+	if ac.tempDir != "" {
+		if err := ac.moveServerTempDir(); err != nil {
+			os.RemoveAll(ac.serverTempDir)
+			return err
+		}
+	}
+
 	// Version (--version)
 	if ac.showVersion {
 		if !ac.quietMode {
-			fmt.Println(ac.versionString)
+			fmt.Println(ac.versionInfo())
 		}
+		os.RemoveAll(ac.serverTempDir)
 		return ErrVersion
 	}
 
@@ -419,6 +558,11 @@ func (ac *Config) initFilesAndCache() error {
 		}
 		f.Close()
 	}
+	// Write the access logs in the background
+	if ac.commonAccessLogFilename != "" || ac.combinedAccessLogFilename != "" {
+		ac.accessLog = newAccessLogWriter()
+		AtShutdown(ac.accessLog.close)
+	}
 
 	// Create a cache struct for reading files (contains functions that can
 	// be used for reading files, also when caching is disabled).
@@ -427,20 +571,51 @@ func (ac *Config) initFilesAndCache() error {
 	return nil
 }
 
+// parseLogLevel returns the logrus log level for the given name, which can be
+// "debug", "info", "warn" or "error"
+func parseLogLevel(name string) (log.Level, error) {
+	switch strings.ToLower(name) {
+	case "debug":
+		return log.DebugLevel, nil
+	case "info":
+		return log.InfoLevel, nil
+	case "warn", "warning":
+		return log.WarnLevel, nil
+	case "error":
+		return log.ErrorLevel, nil
+	}
+	return log.InfoLevel, fmt.Errorf("invalid log level: %q (must be debug, info, warn or error)", name)
+}
+
+// logFormatter returns the logrus formatter for the --logformat flag.
+// If no format has been given, JSON is used if defaultJSON is true.
+func (ac *Config) logFormatter(defaultJSON bool) log.Formatter {
+	if ac.logFormat == "json" || (ac.logFormat == "" && defaultJSON) {
+		return &log.JSONFormatter{}
+	}
+	return &log.TextFormatter{DisableColors: ac.noColor}
+}
+
 func (ac *Config) setupLogging() {
-	// Log to a file as JSON, if a log file has been specified
+	if level, err := parseLogLevel(ac.logLevel); err == nil {
+		log.SetLevel(level)
+	}
+	// Log to a file (as JSON by default), if a log file has been specified
 	if ac.serverLogFile != "" {
 		f, errJSONLog := os.OpenFile(ac.serverLogFile, os.O_WRONLY|os.O_CREATE|os.O_APPEND, ac.defaultPermissions)
 		if errJSONLog != nil {
 			log.Warnf("Could not log to %s: %s", ac.serverLogFile, errJSONLog)
 		} else {
 			// Log to the given log filename
-			log.SetFormatter(&log.JSONFormatter{})
+			log.SetFormatter(ac.logFormatter(true))
 			log.SetOutput(f)
 		}
 	} else if ac.quietMode {
 		// If quiet mode is enabled and no log file has been specified, disable logging
 		log.SetOutput(ioutil.Discard)
+	} else if ac.noColor || ac.logFormat != "" {
+		// Log without colors, or in the given format
+		log.SetFormatter(ac.logFormatter(false))
 	}
 	// Close stdout and stderr if quite mode has been enabled
 	if ac.quietMode {
@@ -449,9 +624,12 @@ func (ac *Config) setupLogging() {
 	}
 }
 
-// Close removes the temporary directory
+// Close removes the temporary directory and closes the Redis TLS tunnel, if any
 func (ac *Config) Close() {
 	os.RemoveAll(ac.serverTempDir)
+	if ac.redisTunnel != nil {
+		ac.redisTunnel.Close()
+	}
 }
 
 // Fatal exit
@@ -462,8 +640,8 @@ func (ac *Config) fatalExit(err error) {
 	}
 	// Then switch to stderr and log the message there as well
 	log.SetOutput(os.Stderr)
-	// Use the standard formatter
-	log.SetFormatter(&log.TextFormatter{})
+	// Use the standard formatter, or the one given with --logformat
+	log.SetFormatter(ac.logFormatter(false))
 	// Log and exit
 	log.Fatalln(err)
 }
@@ -476,8 +654,8 @@ func (ac *Config) abruptExit(msg string) {
 	}
 	// Then switch to stderr and log the message there as well
 	log.SetOutput(os.Stderr)
-	// Use the standard formatter
-	log.SetFormatter(&log.TextFormatter{})
+	// Use the standard formatter, or the one given with --logformat
+	log.SetFormatter(ac.logFormatter(false))
 	// Log and exit
 	log.Info(msg)
 	os.Exit(0)
@@ -558,6 +736,23 @@ func unique(sl []string) []string {
 	return nl
 }
 
+// printBanner writes the colorful logo, or just the version and the time if
+// the logo can not be shown, to the given writer. Nothing is written in
+// quiet mode or with --nobanner.
+func (ac *Config) printBanner(w io.Writer) {
+	if ac.quietMode || ac.noBanner {
+		return
+	}
+	if !ac.singleFileMode && !ac.simpleMode && !ac.serveNothing && !ac.noColor {
+		// Output a colorful ansi logo if a proper terminal is available
+		fmt.Fprintln(w, platformdep.Banner(ac.versionString, ac.description))
+		return
+	}
+	colors := colorstring.Colorize{Colors: colorstring.DefaultColors, Reset: true, Disable: ac.noColor}
+	timestamp := time.Now().Format("2006-01-02 15:04")
+	fmt.Fprintln(w, colors.Color("[cyan]"+ac.versionString+"[dark_gray] - "+timestamp+"[reset]"))
+}
+
 // MustServe sets up a server with handlers
 func (ac *Config) MustServe(mux *http.ServeMux) error {
 	var err error
@@ -634,18 +829,15 @@ func (ac *Config) MustServe(mux *http.ServeMux) error {
 
 	// Make a few changes to the defaults if we are serving a single file
 	if ac.singleFileMode {
-		ac.debugMode = true
+		ac.debugMode = !ac.hideErrors
 		ac.serveJustHTTP = true
 	}
 
+	// For colorizing the console output, unless colors are disabled
+	colors := colorstring.Colorize{Colors: colorstring.DefaultColors, Reset: true, Disable: ac.noColor}
+
 	// Console output
-	if !ac.quietMode && !ac.singleFileMode && !ac.simpleMode && !ac.noBanner {
-		// Output a colorful ansi logo if a proper terminal is available
-		fmt.Println(platformdep.Banner(ac.versionString, ac.description))
-	} else if !ac.quietMode {
-		timestamp := time.Now().Format("2006-01-02 15:04")
-		colorstring.Println("[cyan]" + ac.versionString + "[dark_gray] - " + timestamp + "[reset]")
-	}
+	ac.printBanner(os.Stdout)
 
 	// Disable the database backend if the BoltDB filename is the /dev/null file (or OS equivalent)
 	if ac.boltFilename == os.DevNull {
@@ -660,8 +852,11 @@ func (ac *Config) MustServe(mux *http.ServeMux) error {
 		}
 	}
 
+	ac.startTime = time.Now()
+
 	// Lua LState pool
 	ac.luapool = pool.New()
+	ac.luapool.SetSize(ac.luaPoolSize, ac.luaPoolBlock)
 	AtShutdown(func() {
 		// TODO: Why not defer?
 		ac.luapool.Shutdown()
@@ -693,10 +888,10 @@ func (ac *Config) MustServe(mux *http.ServeMux) error {
 
 	// Create a Colorize struct that will not reset colors after colorizing
 	// strings meant for the terminal.
-	c := colorstring.Colorize{Colors: colorstring.DefaultColors, Reset: false}
+	c := colorstring.Colorize{Colors: colorstring.DefaultColors, Reset: false, Disable: ac.noColor}
 
 	if (len(ac.serverConfigurationFilenames) > 0) && !ac.quietMode && !ac.serveNothing {
-		fmt.Println(colorstring.Color(dashLineColor + repeat("-", 49) + "[reset]"))
+		fmt.Println(colors.Color(dashLineColor + repeat("-", 49) + "[reset]"))
 	}
 
 	// Read server configuration script, if present.
@@ -707,7 +902,7 @@ func (ac *Config) MustServe(mux *http.ServeMux) error {
 			// Dividing line between the banner and output from any of the configuration scripts
 			if !ac.quietMode && !ac.serveNothing {
 				// Output the configuration filename
-				colorstring.Println(arrowColor + "-> " + filenameColor + filename + "[reset]")
+				fmt.Println(colors.Color(arrowColor + "-> " + filenameColor + filename + "[reset]"))
 				fmt.Print(c.Color(luaOutputColor))
 			} else if ac.verboseMode {
 				log.Info("Running Lua configuration file: " + filename)
@@ -738,7 +933,7 @@ func (ac *Config) MustServe(mux *http.ServeMux) error {
 		// Run the Lua server file and set up handlers
 		if !ac.quietMode && !ac.serveNothing {
 			// Output the configuration filename
-			colorstring.Println(arrowColor + "-> " + filenameColor + ac.luaServerFilename + "[reset]")
+			fmt.Println(colors.Color(arrowColor + "-> " + filenameColor + ac.luaServerFilename + "[reset]"))
 			fmt.Print(c.Color(luaOutputColor))
 		} else if ac.verboseMode {
 			fmt.Println("Running Lua configuration file: " + ac.luaServerFilename)
@@ -774,7 +969,7 @@ func (ac *Config) MustServe(mux *http.ServeMux) error {
 	// Separator between the output of the configuration scripts and
 	// the rest of the server output.
 	if ranServerReadyFunction && (len(ac.serverConfigurationFilenames) > 0) && !ac.quietMode && !ac.serveNothing {
-		fmt.Println(colorstring.Color(dashLineColor + repeat("-", 49) + "[reset]"))
+		fmt.Println(colors.Color(dashLineColor + repeat("-", 49) + "[reset]"))
 	}
 
 	// Direct internal logging elsewhere
@@ -820,6 +1015,15 @@ func (ac *Config) MustServe(mux *http.ServeMux) error {
 		}
 	}
 
+	// Reload the Lua scripts when they change, in development mode
+	if ac.devMode {
+		if stopWatching, err := ac.watchLuaScripts(ac.serverDirOrFilename); err != nil {
+			log.Warn("Not reloading changed Lua scripts: ", err)
+		} else {
+			AtShutdown(stopWatching)
+		}
+	}
+
 	// For communicating to and from the REPL
 	ready := make(chan bool) // for when the server is up and running
 	done := make(chan bool)  // for when the user wish to quit the server
@@ -834,8 +1038,11 @@ func (ac *Config) MustServe(mux *http.ServeMux) error {
 	}
 
 	// Run the shutdown functions if graceful does not
-	defer ac.GenerateShutdownFunction(nil, nil)()
+	defer ac.GenerateShutdownFunction(false, nil)()
+
+	// Reload the server configuration when SIGHUP is received
+	AtShutdown(ac.handleSIGHUP())
 
 	// Serve HTTP, HTTP/2 and/or HTTPS
-	return ac.Serve(mux, done, ready)
+	return ac.Serve(ac.reloadableHandler(mux), done, ready)
 }
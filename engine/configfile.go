@@ -0,0 +1,202 @@
+package engine
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// readConfigFile reads settings from a TOML or JSON file, depending on the
+// filename extension. The keys are the same as the names of the flags, like
+// "addr" or "redis", and the values are returned as strings.
+func readConfigFile(filename string) (map[string]string, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	switch strings.ToLower(filepath.Ext(filename)) {
+	case ".toml":
+		return parseTOML(data)
+	case ".json":
+		return parseJSONConfig(data)
+	}
+	return nil, fmt.Errorf("%s: the configuration file must be a .toml or .json file", filename)
+}
+
+// parseJSONConfig parses a JSON object with strings, numbers and booleans
+func parseJSONConfig(data []byte) (map[string]string, error) {
+	var values map[string]interface{}
+	if err := json.Unmarshal(data, &values); err != nil {
+		return nil, err
+	}
+	settings := make(map[string]string, len(values))
+	for key, value := range values {
+		switch v := value.(type) {
+		case string:
+			settings[key] = v
+		case float64:
+			settings[key] = strconv.FormatFloat(v, 'f', -1, 64)
+		case bool:
+			settings[key] = strconv.FormatBool(v)
+		default:
+			return nil, fmt.Errorf("%s: only strings, numbers and booleans are supported", key)
+		}
+	}
+	return settings, nil
+}
+
+// parseTOML parses the subset of TOML that is needed for configuration
+// files: comments and key/value pairs with strings, numbers and booleans.
+// Tables and arrays are not supported.
+func parseTOML(data []byte) (map[string]string, error) {
+	settings := make(map[string]string)
+	for i, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if strings.HasPrefix(line, "[") {
+			return nil, fmt.Errorf("line %d: tables are not supported", i+1)
+		}
+		pos := strings.Index(line, "=")
+		if pos == -1 {
+			return nil, fmt.Errorf("line %d: expected key = value", i+1)
+		}
+		key := strings.TrimSpace(line[:pos])
+		if unquoted, err := strconv.Unquote(key); err == nil {
+			key = unquoted
+		}
+		value, err := parseTOMLValue(strings.TrimSpace(line[pos+1:]))
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %s", i+1, err)
+		}
+		if key == "" {
+			return nil, fmt.Errorf("line %d: empty key", i+1)
+		}
+		settings[key] = value
+	}
+	return settings, nil
+}
+
+// parseTOMLValue parses a TOML string, number or boolean, followed by an
+// optional comment
+func parseTOMLValue(s string) (string, error) {
+	switch {
+	case strings.HasPrefix(s, `"`):
+		// Find the closing quote, skipping escaped characters
+		for i := 1; i < len(s); i++ {
+			if s[i] == '\\' {
+				i++
+			} else if s[i] == '"' {
+				if err := checkTOMLComment(s[i+1:]); err != nil {
+					return "", err
+				}
+				return strconv.Unquote(s[:i+1])
+			}
+		}
+		return "", errors.New("missing closing quote")
+	case strings.HasPrefix(s, "'"):
+		end := strings.Index(s[1:], "'")
+		if end == -1 {
+			return "", errors.New("missing closing quote")
+		}
+		if err := checkTOMLComment(s[end+2:]); err != nil {
+			return "", err
+		}
+		return s[1 : end+1], nil
+	}
+	if pos := strings.Index(s, "#"); pos != -1 {
+		s = strings.TrimSpace(s[:pos])
+	}
+	if s == "true" || s == "false" {
+		return s, nil
+	}
+	if _, err := strconv.ParseFloat(strings.Replace(s, "_", "", -1), 64); err != nil {
+		return "", fmt.Errorf("invalid value: %s", s)
+	}
+	return strings.Replace(s, "_", "", -1), nil
+}
+
+// checkTOMLComment checks that only whitespace and an optional comment
+// follows a value
+func checkTOMLComment(rest string) error {
+	rest = strings.TrimSpace(rest)
+	if rest != "" && !strings.HasPrefix(rest, "#") {
+		return fmt.Errorf("unexpected text after value: %s", rest)
+	}
+	return nil
+}
+
+// applySettings sets the flags in the given flag set that have not been given
+// on the command line, from the given settings. source is used in the log
+// messages. Unknown keys and invalid values are logged as warnings.
+// Returns the unknown keys.
+func applySettings(flags *flag.FlagSet, settings map[string]string, source string) []string {
+	given := make(map[string]bool)
+	flags.Visit(func(f *flag.Flag) {
+		given[f.Name] = true
+	})
+	var unknown []string
+	for key, value := range settings {
+		if flags.Lookup(key) == nil || key == "config" {
+			unknown = append(unknown, key)
+			continue
+		}
+		if given[key] {
+			// Flags on the command line take precedence
+			continue
+		}
+		if err := flags.Set(key, value); err != nil {
+			log.Warnf("%s: invalid value for %s: %s", source, key, err)
+		}
+	}
+	sort.Strings(unknown)
+	for _, key := range unknown {
+		log.Warnf("%s: unknown setting: %s", source, key)
+	}
+	return unknown
+}
+
+// envName returns the name of the environment variable for the given flag,
+// like ALGERNON_ADDR for "addr" or ALGERNON_SHUTDOWN_TIMEOUT for
+// "shutdown-timeout"
+func envName(flagName string) string {
+	return "ALGERNON_" + strings.ToUpper(strings.Replace(flagName, "-", "_", -1))
+}
+
+// applyEnvironment sets the flags in the given flag set that have not been
+// given on the command line, from the corresponding ALGERNON_* environment
+// variables. Invalid values are logged as warnings.
+// Returns the names of the flags that were set.
+func applyEnvironment(flags *flag.FlagSet) []string {
+	given := make(map[string]bool)
+	flags.Visit(func(f *flag.Flag) {
+		given[f.Name] = true
+	})
+	var applied []string
+	flags.VisitAll(func(f *flag.Flag) {
+		if given[f.Name] {
+			// Flags on the command line take precedence
+			return
+		}
+		value, ok := os.LookupEnv(envName(f.Name))
+		if !ok {
+			return
+		}
+		if err := flags.Set(f.Name, value); err != nil {
+			log.Warnf("%s: invalid value: %s", envName(f.Name), err)
+			return
+		}
+		applied = append(applied, f.Name)
+	})
+	return applied
+}
@@ -0,0 +1,151 @@
+package engine
+
+import (
+	"flag"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/bmizerany/assert"
+)
+
+// testFlags returns a flag set with some of the flags that are used by
+// handleFlags, and the values they are parsed into
+func testFlags() (*flag.FlagSet, *Config) {
+	ac := &Config{}
+	flags := flag.NewFlagSet("algernon", flag.ContinueOnError)
+	flags.StringVar(&ac.serverDirOrFilename, "dir", ".", "")
+	flags.StringVar(&ac.serverAddr, "addr", "", "")
+	flags.StringVar(&ac.redisAddr, "redis", "", "")
+	flags.IntVar(&ac.redisDBindex, "dbindex", 0, "")
+	flags.StringVar(&ac.internalLogFilename, "internal", os.DevNull, "")
+	flags.BoolVar(&ac.debugMode, "debug", false, "")
+	flags.DurationVar(&ac.shutdownTimeout, "shutdown-timeout", 10*time.Second, "")
+	return flags, ac
+}
+
+func writeTempFile(t *testing.T, dir, filename, contents string) string {
+	path := filepath.Join(dir, filename)
+	assert.Equal(t, ioutil.WriteFile(path, []byte(contents), 0600), nil)
+	return path
+}
+
+func TestConfigFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "algernon")
+	assert.Equal(t, err, nil)
+	defer os.RemoveAll(dir)
+
+	tomlFile := writeTempFile(t, dir, "algernon.toml", `
+# Algernon configuration
+dir = "/srv/www"   # the server directory
+addr = ':8080'
+redis = "localhost:6380"
+dbindex = 3
+debug = true
+"shutdown-timeout" = "1m"
+internal = "http2 # log.txt"
+colour = "blue"
+`)
+	jsonFile := writeTempFile(t, dir, "algernon.json", `{
+	"dir": "/srv/www",
+	"addr": ":8080",
+	"redis": "localhost:6380",
+	"dbindex": 3,
+	"debug": true,
+	"shutdown-timeout": "1m",
+	"internal": "http2 # log.txt",
+	"colour": "blue"
+}`)
+
+	for _, filename := range []string{tomlFile, jsonFile} {
+		settings, err := readConfigFile(filename)
+		assert.Equal(t, err, nil)
+
+		flags, ac := testFlags()
+		// Flags on the command line take precedence over the file
+		assert.Equal(t, flags.Parse([]string{"--addr=:9000"}), nil)
+		unknown := applySettings(flags, settings, filename)
+		assert.Equal(t, unknown, []string{"colour"})
+
+		assert.Equal(t, ac.serverDirOrFilename, "/srv/www")
+		assert.Equal(t, ac.serverAddr, ":9000")
+		assert.Equal(t, ac.redisAddr, "localhost:6380")
+		assert.Equal(t, ac.redisDBindex, 3)
+		assert.Equal(t, ac.debugMode, true)
+		assert.Equal(t, ac.shutdownTimeout, time.Minute)
+		assert.Equal(t, ac.internalLogFilename, "http2 # log.txt")
+	}
+
+	// Settings that are not in the file keep the default values
+	flags, ac := testFlags()
+	assert.Equal(t, flags.Parse(nil), nil)
+	applySettings(flags, map[string]string{"addr": ":8080"}, "test")
+	assert.Equal(t, ac.serverDirOrFilename, ".")
+	assert.Equal(t, ac.internalLogFilename, os.DevNull)
+}
+
+func TestConfigFileErrors(t *testing.T) {
+	dir, err := ioutil.TempDir("", "algernon")
+	assert.Equal(t, err, nil)
+	defer os.RemoveAll(dir)
+
+	for filename, contents := range map[string]string{
+		"table.toml":    "[server]\naddr = \":80\"",
+		"novalue.toml":  "addr",
+		"unquoted.toml": "addr = :80",
+		"open.toml":     "addr = \":80",
+		"trailing.toml": "addr = \":80\" x",
+		"array.json":    `{"addr": [":80"]}`,
+		"invalid.json":  `{"addr": `,
+		"config.yml":    "addr: :80",
+	} {
+		_, err := readConfigFile(writeTempFile(t, dir, filename, contents))
+		assert.NotEqual(t, err, nil)
+	}
+	_, err = readConfigFile(filepath.Join(dir, "missing.toml"))
+	assert.NotEqual(t, err, nil)
+}
+
+func TestEnvironmentVariables(t *testing.T) {
+	assert.Equal(t, envName("addr"), "ALGERNON_ADDR")
+	assert.Equal(t, envName("shutdown-timeout"), "ALGERNON_SHUTDOWN_TIMEOUT")
+
+	env := map[string]string{
+		"ALGERNON_ADDR":             ":8080",
+		"ALGERNON_REDIS":            "redis:6379",
+		"ALGERNON_DBINDEX":          "2",
+		"ALGERNON_DEBUG":            "true",
+		"ALGERNON_SHUTDOWN_TIMEOUT": "30s",
+	}
+	for key, value := range env {
+		os.Setenv(key, value)
+		defer os.Unsetenv(key)
+	}
+
+	flags, ac := testFlags()
+	// Flags on the command line take precedence over the environment
+	assert.Equal(t, flags.Parse([]string{"--redis=localhost:6380"}), nil)
+	applied := applyEnvironment(flags)
+	assert.Equal(t, applied, []string{"addr", "dbindex", "debug", "shutdown-timeout"})
+	// The environment takes precedence over the configuration file
+	applySettings(flags, map[string]string{"addr": ":9000", "dir": "/srv/www"}, "test")
+
+	assert.Equal(t, ac.serverAddr, ":8080")
+	assert.Equal(t, ac.redisAddr, "localhost:6380")
+	assert.Equal(t, ac.redisDBindex, 2)
+	assert.Equal(t, ac.debugMode, true)
+	assert.Equal(t, ac.shutdownTimeout, 30*time.Second)
+	assert.Equal(t, ac.serverDirOrFilename, "/srv/www")
+	// Flags that are not set anywhere keep the default values
+	assert.Equal(t, ac.internalLogFilename, os.DevNull)
+
+	// Invalid values are ignored
+	os.Setenv("ALGERNON_DBINDEX", "two")
+	flags, ac = testFlags()
+	assert.Equal(t, flags.Parse(nil), nil)
+	applyEnvironment(flags)
+	assert.Equal(t, ac.redisDBindex, 0)
+	assert.Equal(t, ac.serverAddr, ":8080")
+}
@@ -0,0 +1,282 @@
+package engine
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"os/signal"
+	"reflect"
+	"syscall"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/xyproto/gopher-lua"
+	redis "github.com/xyproto/permissions2"
+	"github.com/xyproto/pinterface"
+)
+
+// The default URL path prefixes, the same as in the permission packages
+var (
+	defaultAdminPrefixes  = []string{"/admin"}
+	defaultUserPrefixes   = []string{"/repo", "/data"}
+	defaultPublicPrefixes = []string{"/", "/login", "/register", "/favicon.ico", "/style", "/img", "/js", "/favicon.ico", "/robots.txt", "/sitemap_index.xml"}
+)
+
+// permissionRecorder keeps track of the permission changes that are made by
+// the configuration scripts, so that they can be applied all at once.
+// The user state is the one from the permissions that are in use.
+type permissionRecorder struct {
+	pinterface.IPermissions
+	admin, user, public []string
+	denied              http.HandlerFunc
+}
+
+// newPermissionRecorder starts out with the default permissions, or with
+// only the public path prefixes if the defaults should be cleared
+func newPermissionRecorder(perm pinterface.IPermissions, clearDefaults bool) *permissionRecorder {
+	pr := &permissionRecorder{
+		IPermissions: perm,
+		admin:        append([]string{}, defaultAdminPrefixes...),
+		user:         append([]string{}, defaultUserPrefixes...),
+		public:       append([]string{}, defaultPublicPrefixes...),
+		denied:       redis.PermissionDenied,
+	}
+	if clearDefaults {
+		pr.Clear()
+	}
+	return pr
+}
+
+func (pr *permissionRecorder) SetDenyFunction(f http.HandlerFunc) { pr.denied = f }
+func (pr *permissionRecorder) DenyFunction() http.HandlerFunc     { return pr.denied }
+func (pr *permissionRecorder) Clear()                             { pr.admin, pr.user = []string{}, []string{} }
+func (pr *permissionRecorder) AddAdminPath(prefix string)         { pr.admin = append(pr.admin, prefix) }
+func (pr *permissionRecorder) AddUserPath(prefix string)          { pr.user = append(pr.user, prefix) }
+func (pr *permissionRecorder) AddPublicPath(prefix string)        { pr.public = append(pr.public, prefix) }
+func (pr *permissionRecorder) SetAdminPath(prefixes []string)     { pr.admin = prefixes }
+func (pr *permissionRecorder) SetUserPath(prefixes []string)      { pr.user = prefixes }
+func (pr *permissionRecorder) SetPublicPath(prefixes []string)    { pr.public = prefixes }
+
+// apply replaces the path prefixes and the "permission denied" handler of
+// the given permissions with the recorded ones
+func (pr *permissionRecorder) apply(perm pinterface.IPermissions) {
+	perm.SetAdminPath(pr.admin)
+	perm.SetUserPath(pr.user)
+	perm.SetPublicPath(pr.public)
+	perm.SetDenyFunction(pr.denied)
+}
+
+// startupSettings are the settings that are only used when the server starts
+type startupSettings struct {
+	serverAddrLua             string
+	autoTLS                   bool
+	autoTLSDomains            []string
+	basicAuth                 []basicAuthRule
+	reverseProxies            []*reverseProxy
+	routes                    []*route
+	compressResponses         bool
+	corsOrigins, corsMethods  []string
+	rateLimit                 int
+	readTimeout, writeTimeout time.Duration
+	perm                      pinterface.IPermissions
+}
+
+func (ac *Config) currentStartupSettings() startupSettings {
+	return startupSettings{
+		serverAddrLua:     ac.serverAddrLua,
+		autoTLS:           ac.autoTLS,
+		autoTLSDomains:    ac.autoTLSDomains,
+		basicAuth:         ac.basicAuth,
+		reverseProxies:    ac.reverseProxies,
+		routes:            ac.routes,
+		compressResponses: ac.compressResponses,
+		corsOrigins:       ac.corsOrigins,
+		corsMethods:       ac.corsMethods,
+		rateLimit:         ac.rateLimit,
+		readTimeout:       ac.readTimeout,
+		writeTimeout:      ac.writeTimeout,
+		perm:              ac.perm,
+	}
+}
+
+func (ac *Config) restoreStartupSettings(s startupSettings) {
+	ac.serverAddrLua = s.serverAddrLua
+	ac.autoTLS = s.autoTLS
+	ac.autoTLSDomains = s.autoTLSDomains
+	ac.basicAuth = s.basicAuth
+	ac.reverseProxies = s.reverseProxies
+	ac.routes = s.routes
+	ac.compressResponses = s.compressResponses
+	ac.corsOrigins = s.corsOrigins
+	ac.corsMethods = s.corsMethods
+	ac.rateLimit = s.rateLimit
+	ac.readTimeout = s.readTimeout
+	ac.writeTimeout = s.writeTimeout
+	ac.perm = s.perm
+}
+
+// proxyPrefixes returns the URL path prefixes of the given reverse proxies
+func proxyPrefixes(reverseProxies []*reverseProxy) []string {
+	var prefixes []string
+	for _, rp := range reverseProxies {
+		prefixes = append(prefixes, rp.prefix)
+	}
+	return prefixes
+}
+
+// routePaths returns the URL paths of the given routes
+func routePaths(routes []*route) []string {
+	var paths []string
+	for _, rt := range routes {
+		paths = append(paths, rt.path)
+	}
+	return paths
+}
+
+// changed returns the names of the settings that differ
+func (s startupSettings) changed(other startupSettings) []string {
+	var names []string
+	for _, setting := range []struct {
+		name    string
+		was, is interface{}
+	}{
+		{"server address", s.serverAddrLua, other.serverAddrLua},
+		{"automatic TLS", fmt.Sprint(s.autoTLS, s.autoTLSDomains), fmt.Sprint(other.autoTLS, other.autoTLSDomains)},
+		{"basic authentication", s.basicAuth, other.basicAuth},
+		{"reverse proxies", proxyPrefixes(s.reverseProxies), proxyPrefixes(other.reverseProxies)},
+		{"routes", routePaths(s.routes), routePaths(other.routes)},
+		{"compression", s.compressResponses, other.compressResponses},
+		{"CORS", fmt.Sprint(s.corsOrigins, s.corsMethods), fmt.Sprint(other.corsOrigins, other.corsMethods)},
+		{"rate limit", s.rateLimit, other.rateLimit},
+		{"timeouts", fmt.Sprint(s.readTimeout, s.writeTimeout), fmt.Sprint(other.readTimeout, other.writeTimeout)},
+		{"Redis connection", fmt.Sprintf("%p", s.perm), fmt.Sprintf("%p", other.perm)},
+	} {
+		if !reflect.DeepEqual(setting.was, setting.is) {
+			names = append(names, setting.name)
+		}
+	}
+	return names
+}
+
+// reloadableHandler returns a handler that serves the given handler, until
+// it is replaced by reloading the server configuration
+func (ac *Config) reloadableHandler(handler http.Handler) http.Handler {
+	ac.reloadMut.Lock()
+	ac.servedHandler = handler
+	ac.reloadMut.Unlock()
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		ac.reloadMut.RLock()
+		handler := ac.servedHandler
+		ac.reloadMut.RUnlock()
+		handler.ServeHTTP(w, req)
+	})
+}
+
+// runReloadedConfiguration runs the server configuration scripts, and then
+// the Lua server file or the handlers for the server directory, with the
+// given mux and permissions. Each script runs in a new Lua state.
+func (ac *Config) runReloadedConfiguration(mux *http.ServeMux, perm pinterface.IPermissions) error {
+	run := func(filename string) error {
+		L := lua.NewState()
+		if err := ac.runConfiguration(L, filename, mux, true, perm); err != nil {
+			L.Close()
+			return err
+		}
+		// The Lua state is kept, for the handlers that were registered
+		return nil
+	}
+	for _, filename := range ac.serverConfigurationFilenames {
+		if !ac.fs.Exists(filename) {
+			continue
+		}
+		if err := run(filename); err != nil {
+			return err
+		}
+	}
+	if ac.luaServerFilename != "" {
+		return run(ac.luaServerFilename)
+	}
+	ac.RegisterHandlers(mux, "/", ac.serverDirOrFilename, ac.serverAddDomain)
+	return nil
+}
+
+// reloadServerConfiguration runs the server configuration scripts again. The
+// permissions, the error pages, the request hooks and the handlers are
+// replaced all at once, and only if all the scripts ran without errors.
+// Settings that are only used when the server starts, like the server
+// address, are kept as they are, with a warning.
+func (ac *Config) reloadServerConfiguration() error {
+	if ac.perm == nil {
+		return errors.New("the server configuration can only be reloaded when a database backend is in use")
+	}
+
+	before := ac.currentStartupSettings()
+	// The scripts add these from scratch
+	ac.basicAuth, ac.reverseProxies, ac.routes = nil, nil, nil
+
+	mut.Lock()
+	shutdownFunctionCount := len(shutdownFunctions)
+	mut.Unlock()
+
+	// Collect the error pages and request hooks separately, until the
+	// reloading is done
+	ac.reloadMut.Lock()
+	ac.reloadedErrorPages = make(map[int]errorPage)
+	ac.reloadedRequestHooks = &requestHooks{}
+	ac.reloadMut.Unlock()
+
+	perm := newPermissionRecorder(ac.perm, ac.clearDefaultPathPrefixes)
+	mux := http.NewServeMux()
+	err := ac.runReloadedConfiguration(mux, perm)
+
+	// The OnShutdown functions from when the server started are kept
+	mut.Lock()
+	shutdownFunctions = shutdownFunctions[:shutdownFunctionCount]
+	mut.Unlock()
+
+	for _, name := range before.changed(ac.currentStartupSettings()) {
+		log.Warnf("Changing the %s requires a restart", name)
+	}
+	ac.restoreStartupSettings(before)
+
+	ac.reloadMut.Lock()
+	errorPages, hooks := ac.reloadedErrorPages, ac.reloadedRequestHooks
+	ac.reloadedErrorPages, ac.reloadedRequestHooks = nil, nil
+	if err == nil {
+		perm.apply(ac.perm)
+		ac.servedHandler = mux
+		ac.errorPages = errorPages
+		ac.requestHooks = hooks
+	}
+	ac.reloadMut.Unlock()
+	if err != nil {
+		return err
+	}
+
+	// Use new Lua states and read the files again for the next requests
+	ac.luapool.Clear()
+	if ac.cache != nil {
+		ac.cache.Clear()
+	}
+	return nil
+}
+
+// handleSIGHUP reloads the server configuration whenever SIGHUP is received.
+// Returns a function for no longer handling SIGHUP.
+func (ac *Config) handleSIGHUP() func() {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP)
+	go func() {
+		for range signals {
+			log.Info("Reloading the server configuration")
+			if err := ac.reloadServerConfiguration(); err != nil {
+				log.Error("Could not reload the server configuration: ", err)
+			}
+		}
+	}()
+	return func() {
+		signal.Stop(signals)
+		close(signals)
+	}
+}
@@ -0,0 +1,129 @@
+package engine
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/bmizerany/assert"
+	log "github.com/sirupsen/logrus"
+	"github.com/xyproto/algernon/lua/pool"
+	"github.com/xyproto/datablock"
+	bolt "github.com/xyproto/permissionbolt"
+)
+
+// newReloadConfig returns a configuration that serves an empty directory,
+// with a server configuration script that contains the given Lua code
+func newReloadConfig(t *testing.T, code string) (*Config, http.Handler, func()) {
+	dir, err := ioutil.TempDir("", "algernon_reload")
+	assert.Equal(t, err, nil)
+	confFilename := filepath.Join(dir, "serverconf.lua")
+	assert.Equal(t, ioutil.WriteFile(confFilename, []byte(code), 0644), nil)
+
+	ac := &Config{
+		luapool:                      pool.New(),
+		fs:                           datablock.NewFileStat(false, time.Minute),
+		serverDirOrFilename:          dir,
+		serverConfigurationFilenames: []string{confFilename},
+		disableRateLimiting:          true,
+		noHeaders:                    true,
+	}
+	ac.perm, err = bolt.NewWithConf(filepath.Join(dir, "algernon.db"))
+	assert.Equal(t, err, nil)
+
+	mux := http.NewServeMux()
+	assert.Equal(t, ac.RunConfiguration(confFilename, mux, true), nil)
+	ac.RegisterHandlers(mux, "/", dir, false)
+	return ac, ac.reloadableHandler(mux), func() {
+		os.RemoveAll(dir)
+	}
+}
+
+// statusCode returns the HTTP status code for the given URL path
+func statusCode(handler http.Handler, urlpath string) int {
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest("GET", urlpath, nil))
+	return rec.Code
+}
+
+func TestReloadOnSIGHUP(t *testing.T) {
+	ac, handler, cleanup := newReloadConfig(t, `AddAdminPrefix("/secret")`)
+	defer cleanup()
+	stopHandling := ac.handleSIGHUP()
+	defer stopHandling()
+
+	assert.Equal(t, statusCode(handler, "/secret"), http.StatusForbidden)
+	assert.Equal(t, statusCode(handler, "/private"), http.StatusNotFound)
+
+	// Change the admin prefix and ask the server to reload the configuration
+	confFilename := ac.serverConfigurationFilenames[0]
+	assert.Equal(t, ioutil.WriteFile(confFilename, []byte(`AddAdminPrefix("/private")`), 0644), nil)
+	assert.Equal(t, syscall.Kill(os.Getpid(), syscall.SIGHUP), nil)
+
+	for i := 0; i < 100 && statusCode(handler, "/private") != http.StatusForbidden; i++ {
+		time.Sleep(20 * time.Millisecond)
+	}
+	assert.Equal(t, statusCode(handler, "/private"), http.StatusForbidden)
+	assert.Equal(t, statusCode(handler, "/secret"), http.StatusNotFound)
+}
+
+func TestReloadHandlers(t *testing.T) {
+	ac, handler, cleanup := newReloadConfig(t, `handle("/hello", function() print("hello") end)`)
+	defer cleanup()
+
+	confFilename := ac.serverConfigurationFilenames[0]
+	assert.Equal(t, ioutil.WriteFile(confFilename, []byte(`handle("/hi", function() print("hi") end)`), 0644), nil)
+	assert.Equal(t, ac.reloadServerConfiguration(), nil)
+
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest("GET", "/hi", nil))
+	assert.Equal(t, rec.Body.String(), "hi\n")
+	assert.Equal(t, statusCode(handler, "/hello"), http.StatusNotFound)
+}
+
+func TestReloadFailure(t *testing.T) {
+	ac, handler, cleanup := newReloadConfig(t, `AddAdminPrefix("/secret")`)
+	defer cleanup()
+
+	// Nothing is changed if a script fails
+	confFilename := ac.serverConfigurationFilenames[0]
+	assert.Equal(t, ioutil.WriteFile(confFilename, []byte(`ClearPermissions() error("oops")`), 0644), nil)
+	err := ac.reloadServerConfiguration()
+	assert.NotEqual(t, err, nil)
+	assert.Equal(t, strings.Contains(err.Error(), "oops"), true)
+	assert.Equal(t, statusCode(handler, "/secret"), http.StatusForbidden)
+	assert.Equal(t, statusCode(handler, "/admin"), http.StatusForbidden)
+}
+
+func TestReloadRequiresRestart(t *testing.T) {
+	var logbuf bytes.Buffer
+	defer log.SetOutput(log.StandardLogger().Out)
+	log.SetOutput(&logbuf)
+
+	ac, _, cleanup := newReloadConfig(t, `SetAddr(":3000") BasicAuth("bob", "hunter2") RateLimit(10)`)
+	defer cleanup()
+
+	// The same settings do not result in warnings
+	assert.Equal(t, ac.reloadServerConfiguration(), nil)
+	assert.Equal(t, logbuf.String(), "")
+	assert.Equal(t, len(ac.basicAuth), 1)
+
+	confFilename := ac.serverConfigurationFilenames[0]
+	assert.Equal(t, ioutil.WriteFile(confFilename, []byte(`SetAddr(":4000") BasicAuth("bob", "hunter2") RateLimit(20)`), 0644), nil)
+	assert.Equal(t, ac.reloadServerConfiguration(), nil)
+	assert.Equal(t, strings.Contains(logbuf.String(), "Changing the server address requires a restart"), true)
+	assert.Equal(t, strings.Contains(logbuf.String(), "Changing the rate limit requires a restart"), true)
+	assert.Equal(t, strings.Contains(logbuf.String(), "basic authentication"), false)
+
+	// The settings that are in use are kept
+	assert.Equal(t, ac.serverAddrLua, ":3000")
+	assert.Equal(t, ac.rateLimit, 10)
+	assert.Equal(t, len(ac.basicAuth), 1)
+}
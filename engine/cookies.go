@@ -0,0 +1,80 @@
+package engine
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/xyproto/gopher-lua"
+)
+
+// sameSiteModes maps the values for the "samesite" cookie option to
+// SameSite modes
+var sameSiteModes = map[string]http.SameSite{
+	"default": http.SameSiteDefaultMode,
+	"lax":     http.SameSiteLaxMode,
+	"strict":  http.SameSiteStrictMode,
+	"none":    http.SameSiteNoneMode,
+}
+
+// newCookie creates a cookie with the given name and value. The options table
+// may be nil, or contain "maxage", "path", "httponly", "secure" and "samesite".
+// Returns an error message if the cookie or the options are invalid.
+func newCookie(name, value string, options *lua.LTable) (*http.Cookie, string) {
+	cookie := &http.Cookie{Name: name, Value: value}
+	if options != nil {
+		if maxAge, ok := options.RawGetString("maxage").(lua.LNumber); ok {
+			cookie.MaxAge = int(maxAge)
+		}
+		if cookiePath, ok := options.RawGetString("path").(lua.LString); ok {
+			cookie.Path = string(cookiePath)
+		}
+		cookie.HttpOnly = lua.LVAsBool(options.RawGetString("httponly"))
+		cookie.Secure = lua.LVAsBool(options.RawGetString("secure"))
+		if sameSite, ok := options.RawGetString("samesite").(lua.LString); ok {
+			mode, ok := sameSiteModes[strings.ToLower(string(sameSite))]
+			if !ok {
+				return nil, "invalid samesite value: " + string(sameSite)
+			}
+			cookie.SameSite = mode
+		}
+	}
+	if cookie.String() == "" {
+		return nil, "invalid cookie name: " + name
+	}
+	return cookie, ""
+}
+
+// LoadCookieFunctions makes functions for getting and setting cookies
+// available to the given Lua state
+func (ac *Config) LoadCookieFunctions(w http.ResponseWriter, req *http.Request, L *lua.LState) {
+
+	// Return the value of the cookie with the given name, or an empty string
+	L.SetGlobal("GetCookie", L.NewFunction(func(L *lua.LState) int {
+		cookie, err := req.Cookie(L.ToString(1))
+		if err != nil {
+			L.Push(lua.LString(""))
+			return 1 // number of results
+		}
+		L.Push(lua.LString(cookie.Value))
+		return 1 // number of results
+	}))
+
+	// Set a cookie, given a name, a value and an optional table with options.
+	// Returns true if successful, or false and an error message.
+	L.SetGlobal("SetCookie", L.NewFunction(func(L *lua.LState) int {
+		cookie, errMsg := newCookie(L.ToString(1), L.ToString(2), L.OptTable(3, nil))
+		if errMsg != "" {
+			L.Push(lua.LBool(false))
+			L.Push(lua.LString(errMsg))
+			return 2 // number of results
+		}
+		if !changeHeader(w, "SetCookie", "Set-Cookie", cookie.String(), true) {
+			L.Push(lua.LBool(false))
+			L.Push(lua.LString("the header has already been sent"))
+			return 2 // number of results
+		}
+		L.Push(lua.LBool(true))
+		return 1 // number of results
+	}))
+
+}
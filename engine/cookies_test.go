@@ -0,0 +1,29 @@
+package engine
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/bmizerany/assert"
+	"github.com/xyproto/algernon/lua/pool"
+)
+
+func TestCookies(t *testing.T) {
+	ac := &Config{}
+
+	// Lua LState pool
+	ac.luapool = pool.New()
+	defer ac.luapool.Shutdown()
+
+	req := httptest.NewRequest("GET", "/", nil)
+	req.AddCookie(&http.Cookie{Name: "theme", Value: "dark"})
+	recorder := httptest.NewRecorder()
+	ac.FilePage(recorder, req, "testdata/cookies.lua", "")
+
+	assert.Equal(t, recorder.Body.String(), "dark\ntrue\n")
+	assert.Equal(t, recorder.HeaderMap["Set-Cookie"], []string{
+		"session=abc123; Path=/; Max-Age=3600; HttpOnly; Secure; SameSite=Strict",
+		"plain=1",
+	})
+}
@@ -0,0 +1,71 @@
+package engine
+
+import (
+	"net/http"
+	"strings"
+)
+
+// The methods that are allowed for cross-origin requests, if none are given
+var defaultCORSMethods = []string{"GET", "HEAD", "POST", "PUT", "PATCH", "DELETE", "OPTIONS"}
+
+// The request headers that are allowed for cross-origin requests, if the
+// preflight request does not ask for any
+const defaultCORSHeaders = "Content-Type, Authorization"
+
+// allowedOrigin returns the value of the Access-Control-Allow-Origin header
+// for the given Origin header value, or an empty string if the origin is not
+// allowed. "*" in the list of origins allows all origins.
+func allowedOrigin(origins []string, origin string) string {
+	for _, allowed := range origins {
+		if allowed == "*" {
+			return "*"
+		}
+		if strings.EqualFold(strings.TrimSuffix(allowed, "/"), origin) {
+			// Echo back the matching origin
+			return origin
+		}
+	}
+	return ""
+}
+
+// CORSHandler wraps the given handler, so that cross-origin requests from the
+// given origins are allowed, for the given methods. Preflight requests are
+// answered with "204 No Content" without calling the wrapped handler.
+func CORSHandler(next http.Handler, origins, methods []string) http.Handler {
+	if len(methods) == 0 {
+		methods = defaultCORSMethods
+	}
+	allowMethods := strings.ToUpper(strings.Join(methods, ", "))
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		origin := req.Header.Get("Origin")
+		if origin == "" {
+			// Not a cross-origin request
+			next.ServeHTTP(w, req)
+			return
+		}
+		header := w.Header()
+		allowOrigin := allowedOrigin(origins, origin)
+		if allowOrigin != "*" {
+			// The response depends on the Origin header of the request
+			header.Add("Vary", "Origin")
+		}
+		if allowOrigin == "" {
+			// Let the browser reject the request
+			next.ServeHTTP(w, req)
+			return
+		}
+		header.Set("Access-Control-Allow-Origin", allowOrigin)
+		header.Set("Access-Control-Allow-Methods", allowMethods)
+		if requestHeaders := req.Header.Get("Access-Control-Request-Headers"); requestHeaders != "" {
+			header.Set("Access-Control-Allow-Headers", requestHeaders)
+		} else {
+			header.Set("Access-Control-Allow-Headers", defaultCORSHeaders)
+		}
+		if req.Method == "OPTIONS" && req.Header.Get("Access-Control-Request-Method") != "" {
+			// Answer the preflight request
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		next.ServeHTTP(w, req)
+	})
+}
@@ -0,0 +1,64 @@
+package engine
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/bmizerany/assert"
+)
+
+// corsRequest sends a request with the given method and Origin header to a
+// server that allows cross-origin requests from the given origins
+func corsRequest(t *testing.T, origins []string, method, origin string) (*http.Response, string) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte("hello"))
+	})
+	server := httptest.NewServer(CORSHandler(handler, origins, []string{"GET", "POST"}))
+	defer server.Close()
+	req, err := http.NewRequest(method, server.URL, nil)
+	assert.Equal(t, err, nil)
+	req.Header.Set("Origin", origin)
+	if method == "OPTIONS" {
+		req.Header.Set("Access-Control-Request-Method", "POST")
+		req.Header.Set("Access-Control-Request-Headers", "X-Token")
+	}
+	resp, err := http.DefaultClient.Do(req)
+	assert.Equal(t, err, nil)
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	assert.Equal(t, err, nil)
+	return resp, string(body)
+}
+
+func TestCORSHandler(t *testing.T) {
+	origins := []string{"https://example.com", "https://app.example.com/"}
+
+	// Preflight request
+	resp, body := corsRequest(t, origins, "OPTIONS", "https://app.example.com")
+	assert.Equal(t, resp.StatusCode, http.StatusNoContent)
+	assert.Equal(t, resp.Header.Get("Access-Control-Allow-Origin"), "https://app.example.com")
+	assert.Equal(t, resp.Header.Get("Access-Control-Allow-Methods"), "GET, POST")
+	assert.Equal(t, resp.Header.Get("Access-Control-Allow-Headers"), "X-Token")
+	assert.Equal(t, resp.Header.Get("Vary"), "Origin")
+	assert.Equal(t, body, "")
+
+	// Simple cross-origin request
+	resp, body = corsRequest(t, origins, "GET", "https://example.com")
+	assert.Equal(t, resp.StatusCode, http.StatusOK)
+	assert.Equal(t, resp.Header.Get("Access-Control-Allow-Origin"), "https://example.com")
+	assert.Equal(t, resp.Header.Get("Access-Control-Allow-Headers"), defaultCORSHeaders)
+	assert.Equal(t, body, "hello")
+
+	// Origins that are not in the list are not allowed
+	resp, body = corsRequest(t, origins, "GET", "https://example.org")
+	assert.Equal(t, resp.Header.Get("Access-Control-Allow-Origin"), "")
+	assert.Equal(t, body, "hello")
+
+	// All origins are allowed with a wildcard
+	resp, body = corsRequest(t, []string{"*"}, "GET", "https://example.org")
+	assert.Equal(t, resp.Header.Get("Access-Control-Allow-Origin"), "*")
+	assert.Equal(t, resp.Header.Get("Vary"), "")
+	assert.Equal(t, body, "hello")
+}
@@ -0,0 +1,86 @@
+package engine
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/xyproto/recwatch"
+)
+
+// Several changes to Lua scripts within this duration results in one reload
+const reloadDebounce = 100 * time.Millisecond
+
+// isTempFile checks if the given filename looks like a temporary file or a
+// swap file from an editor, like ".index.lua.swp", "index.lua~" or "#index.lua#"
+func isTempFile(filename string) bool {
+	name := filepath.Base(filename)
+	switch {
+	case strings.HasPrefix(name, "."), strings.HasPrefix(name, "#"), strings.HasSuffix(name, "~"):
+		return true
+	}
+	switch filepath.Ext(name) {
+	case ".swp", ".swo", ".swx", ".tmp", ".bak":
+		return true
+	}
+	return false
+}
+
+// isScript checks if the given filename is a Lua script, and not a
+// temporary file
+func isScript(filename string) bool {
+	return strings.ToLower(filepath.Ext(filename)) == ".lua" && !isTempFile(filename)
+}
+
+// reloadLuaScripts clears the Lua state pool and the file cache, so that the
+// next requests use the changed Lua scripts and not the state from earlier runs
+func (ac *Config) reloadLuaScripts() {
+	log.Debug("The Lua scripts have changed, reloading")
+	ac.luapool.Clear()
+	if ac.cache != nil {
+		ac.cache.Clear()
+	}
+}
+
+// watchLuaScripts watches the given directory recursively, and reloads the Lua
+// scripts when they change. Returns a function for stopping the watcher.
+func (ac *Config) watchLuaScripts(dir string) (func(), error) {
+	if fi, err := os.Stat(dir); err == nil && !fi.IsDir() {
+		// Serving a single file, watch the directory of the file
+		dir = filepath.Dir(dir)
+	}
+	watcher, err := recwatch.NewRecursiveWatcher(dir)
+	if err != nil {
+		return nil, err
+	}
+	go func() {
+		var timer *time.Timer
+		for {
+			select {
+			case ev, ok := <-watcher.Events:
+				if !ok {
+					return
+				}
+				if !isScript(ev.Name) {
+					continue
+				}
+				// Wait for the changes to settle before reloading
+				if timer == nil {
+					timer = time.AfterFunc(reloadDebounce, ac.reloadLuaScripts)
+				} else {
+					timer.Reset(reloadDebounce)
+				}
+			case err, ok := <-watcher.Errors:
+				if !ok {
+					return
+				}
+				log.Error(err)
+			}
+		}
+	}()
+	return func() {
+		watcher.Close()
+	}, nil
+}
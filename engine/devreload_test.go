@@ -0,0 +1,64 @@
+package engine
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/bmizerany/assert"
+	"github.com/xyproto/algernon/lua/pool"
+)
+
+func TestScriptChanges(t *testing.T) {
+	for _, filename := range []string{".index.lua.swp", "index.lua~", "#index.lua#", "index.lua.tmp", "/srv/.#index.lua"} {
+		assert.Equal(t, isTempFile(filename), true)
+	}
+	assert.Equal(t, isScript("/srv/index.lua"), true)
+	assert.Equal(t, isScript("/srv/INDEX.LUA"), true)
+	assert.Equal(t, isScript("/srv/style.css"), false)
+	assert.Equal(t, isScript("/srv/.index.lua.swp"), false)
+	assert.Equal(t, isScript("/srv/.#index.lua"), false)
+}
+
+func TestReloadLuaScripts(t *testing.T) {
+	dir, err := ioutil.TempDir("", "algernon")
+	assert.Equal(t, err, nil)
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, "index.lua")
+
+	// The global variable is kept in the Lua state between requests
+	assert.Equal(t, ioutil.WriteFile(filename, []byte(`greeting = greeting or "old" print(greeting)`), 0644), nil)
+
+	ac := &Config{luapool: pool.New()}
+	stopWatching, err := ac.watchLuaScripts(dir)
+	assert.Equal(t, err, nil)
+	defer stopWatching()
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		ac.FilePage(w, req, filename, "")
+	}))
+	defer server.Close()
+	get := func() string {
+		resp, err := http.Get(server.URL)
+		assert.Equal(t, err, nil)
+		defer resp.Body.Close()
+		body, err := ioutil.ReadAll(resp.Body)
+		assert.Equal(t, err, nil)
+		return string(body)
+	}
+	assert.Equal(t, get(), "old\n")
+	assert.Equal(t, get(), "old\n")
+
+	// Changing the script resets the Lua states
+	assert.Equal(t, ioutil.WriteFile(filename, []byte(`greeting = greeting or "new" print(greeting)`), 0644), nil)
+	body := get()
+	for i := 0; i < 100 && body != "new\n"; i++ {
+		time.Sleep(20 * time.Millisecond)
+		body = get()
+	}
+	assert.Equal(t, body, "new\n")
+}
@@ -4,8 +4,14 @@ package engine
 
 import (
 	"bytes"
+	"errors"
+	"fmt"
+	"html"
 	"net/http"
+	"net/url"
+	"os"
 	"path/filepath"
+	"sort"
 	"strings"
 
 	"github.com/go-gcfg/gcfg"
@@ -34,7 +40,18 @@ type DirConfig struct {
 	}
 }
 
-// DirectoryListing serves the given directory as a web page with links the the contents
+// insideDir checks if the given path is the given root directory, or is
+// within it
+func insideDir(rootdir, path string) bool {
+	rel, err := filepath.Rel(rootdir, path)
+	if err != nil {
+		return false
+	}
+	return rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+// DirectoryListing serves the given directory as a web page with links the the contents,
+// together with the sizes and modification times
 func (ac *Config) DirectoryListing(w http.ResponseWriter, req *http.Request, rootdir, dirname, theme string) {
 	var (
 		buf          bytes.Buffer
@@ -43,30 +60,50 @@ func (ac *Config) DirectoryListing(w http.ResponseWriter, req *http.Request, roo
 		title        = dirname
 	)
 
+	// Never list directories outside of the server directory
+	if !insideDir(rootdir, dirname) {
+		w.WriteHeader(http.StatusForbidden)
+		w.Write(themes.MessagePageBytes("Forbidden", []byte("The directory is outside of the server directory."), theme))
+		return
+	}
+
 	// Fill the coming HTML body with a list of all the filenames in `dirname`
-	for _, filename := range utils.GetFilenames(dirname) {
+	filenames := utils.GetFilenames(dirname)
+	sort.Strings(filenames)
+	for _, filename := range filenames {
 
-		if filename == dirconfFilename {
-			// Skip
+		// Skip dotfiles, like ".algernon" and ".git"
+		if strings.HasPrefix(filename, ".") || deniedFilename(filename) {
 			continue
 		}
 
 		// Find the full name
-		fullFilename = dirname
+		fullFilename = filepath.Join(dirname, filename)
 
-		// Add a "/" after the directory name, if missing
-		if !strings.HasSuffix(fullFilename, utils.Pathsep) {
-			fullFilename += utils.Pathsep
+		// Skip files that are not servable
+		isDir := ac.fs.IsDir(fullFilename)
+		if !isDir && !ac.servableExtension(filename) {
+			continue
 		}
 
-		// Add the filename at the end
-		fullFilename += filename
+		fi, err := os.Stat(fullFilename)
+		if err != nil {
+			continue
+		}
+		size, modified := "-", fi.ModTime().Format("2006-01-02 15:04")
+		if !isDir {
+			size = utils.DescribeBytes(fi.Size())
+		}
 
 		// Remove the root directory from the link path
-		URLpath = fullFilename[len(rootdir)+1:]
+		rel, err := filepath.Rel(rootdir, fullFilename)
+		if err != nil {
+			continue
+		}
+		URLpath = (&url.URL{Path: "/" + filepath.ToSlash(rel)}).EscapedPath()
 
 		// Output different entries for files and directories
-		buf.WriteString(themes.HTMLLink(filename, URLpath, ac.fs.IsDir(fullFilename)))
+		buf.WriteString(themes.HTMLDirEntry(filename, URLpath, isDir, size, modified))
 	}
 
 	// Read directory configuration, if present
@@ -93,11 +130,14 @@ func (ac *Config) DirectoryListing(w http.ResponseWriter, req *http.Request, roo
 	}
 
 	// Check if the current page contents are empty
+	var body []byte
 	if buf.Len() == 0 {
-		buf.WriteString("Empty directory")
+		body = []byte("Empty directory")
+	} else {
+		body = themes.HTMLDirTable(buf.Bytes())
 	}
 
-	htmldata := themes.MessagePageBytes(title, buf.Bytes(), theme)
+	htmldata := themes.MessagePageBytes(html.EscapeString(title), body, theme)
 
 	// If the auto-refresh feature has been enabled
 	if ac.autoRefresh {
@@ -110,6 +150,29 @@ func (ac *Config) DirectoryListing(w http.ResponseWriter, req *http.Request, roo
 	ac.DataToClient(w, req, dirname, htmldata)
 }
 
+// checkIndexFiles checks that the given index filenames are plain filenames,
+// like "index.html", and not paths
+func checkIndexFiles(filenames []string) error {
+	if len(filenames) == 0 {
+		return errors.New("no index filenames given")
+	}
+	for _, filename := range filenames {
+		if filename == "" || filename == "." || filename == ".." || strings.ContainsAny(filename, "/\\") {
+			return fmt.Errorf("invalid index filename: %q", filename)
+		}
+	}
+	return nil
+}
+
+// indexFiles returns the filenames that are served for directory requests,
+// given with --index or SetIndexFiles, or the default ones
+func (ac *Config) indexFiles() []string {
+	if len(ac.indexFilenames) > 0 {
+		return ac.indexFilenames
+	}
+	return indexFilenames
+}
+
 // DirPage serves a directory, using index.* files, if present.
 // The directory must exist.
 // rootdir is the base directory (can be ".")
@@ -133,14 +196,21 @@ func (ac *Config) DirPage(w http.ResponseWriter, req *http.Request, rootdir, dir
 
 	// Handle the serving of index files, if needed
 	var filename string
-	for _, indexfile := range indexFilenames {
+	for _, indexfile := range ac.indexFiles() {
 		filename = filepath.Join(dirname, indexfile)
-		if ac.fs.Exists(filename) {
+		if ac.fs.Exists(filename) && ac.servableExtension(filename) {
 			ac.FilePage(w, req, filename, ac.defaultLuaDataFilename)
 			return
 		}
 	}
 
+	// Directory listings must be enabled with --dirlist or SetDirListing
+	if !ac.dirListing {
+		w.WriteHeader(http.StatusForbidden)
+		w.Write(themes.MessagePageBytes("Forbidden", []byte("Directory listing is disabled."), theme))
+		return
+	}
+
 	// Serve a directory listing if no index file is found
 	ac.DirectoryListing(w, req, rootdir, dirname, theme)
 }
@@ -0,0 +1,163 @@
+package engine
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bmizerany/assert"
+	"github.com/xyproto/algernon/utils"
+	"github.com/xyproto/datablock"
+	"github.com/xyproto/gopher-lua"
+	bolt "github.com/xyproto/permissionbolt"
+)
+
+// dirListingTest serves a directory with a few files, and returns the status
+// code and the body for the given path
+func dirListingTest(t *testing.T, dirListing bool, path string) (int, string) {
+	dir, err := ioutil.TempDir("", "algernon_dirlist")
+	assert.Equal(t, err, nil)
+	defer os.RemoveAll(dir)
+	assert.Equal(t, os.Mkdir(filepath.Join(dir, "sub dir"), 0755), nil)
+	for filename, size := range map[string]int{
+		"notes.txt":           2048,
+		"<i>.txt":             1,
+		".secret":             1,
+		"sub dir/nested.html": 1,
+	} {
+		assert.Equal(t, ioutil.WriteFile(filepath.Join(dir, filename), make([]byte, size), 0644), nil)
+	}
+
+	ac := &Config{
+		disableRateLimiting: true,
+		dirListing:          dirListing,
+		largeFileSize:       42 * utils.MiB,
+	}
+	ac.initializeMime()
+	ac.fs = datablock.NewFileStat(false, time.Minute)
+	ac.cache = datablock.NewFileCache(1*utils.MiB, false, 64*utils.KiB, false, 0)
+
+	mux := http.NewServeMux()
+	ac.RegisterHandlers(mux, "/", dir, false)
+
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+	return w.Code, w.Body.String()
+}
+
+func TestDirListingOff(t *testing.T) {
+	code, body := dirListingTest(t, false, "/")
+	assert.Equal(t, code, http.StatusForbidden)
+	assert.Equal(t, strings.Contains(body, "notes.txt"), false)
+
+	// Files are still served
+	code, _ = dirListingTest(t, false, "/notes.txt")
+	assert.Equal(t, code, http.StatusOK)
+}
+
+func TestDirListingOn(t *testing.T) {
+	code, body := dirListingTest(t, true, "/")
+	assert.Equal(t, code, http.StatusOK)
+	assert.Equal(t, strings.Contains(body, `<a href="/notes.txt">notes.txt</a></td><td>2 KiB</td>`), true)
+	assert.Equal(t, strings.Contains(body, `<a href="/sub%20dir/">sub dir/</a>`), true)
+	assert.Equal(t, strings.Contains(body, "&lt;i&gt;.txt"), true)
+	assert.Equal(t, strings.Contains(body, "<i>.txt"), false)
+	assert.Equal(t, strings.Contains(body, ".secret"), false)
+	assert.Equal(t, strings.Index(body, "notes.txt") < strings.Index(body, "sub dir"), true)
+
+	code, body = dirListingTest(t, true, "/sub%20dir/")
+	assert.Equal(t, code, http.StatusOK)
+	assert.Equal(t, strings.Contains(body, `<a href="/sub%20dir/nested.html">nested.html</a>`), true)
+
+	// Paths with ".." never leave the server directory
+	code, _ = dirListingTest(t, true, "/sub%20dir/../../")
+	assert.NotEqual(t, code, http.StatusOK)
+}
+
+func TestInsideDir(t *testing.T) {
+	assert.Equal(t, insideDir("/srv", "/srv"), true)
+	assert.Equal(t, insideDir("/srv", "/srv/a/b"), true)
+	assert.Equal(t, insideDir("/srv", "/srv/..a"), true)
+	assert.Equal(t, insideDir("/srv", "/"), false)
+	assert.Equal(t, insideDir("/srv", "/srv2"), false)
+	assert.Equal(t, insideDir("/srv", "/srv/../etc"), false)
+}
+
+// indexFilesTest serves a directory with the given files, and returns the
+// body for "/"
+func indexFilesTest(t *testing.T, indexFiles []string, files map[string]string) string {
+	dir, err := ioutil.TempDir("", "algernon_index")
+	assert.Equal(t, err, nil)
+	defer os.RemoveAll(dir)
+	for filename, contents := range files {
+		assert.Equal(t, ioutil.WriteFile(filepath.Join(dir, filename), []byte(contents), 0644), nil)
+	}
+
+	ac := &Config{
+		disableRateLimiting: true,
+		indexFilenames:      indexFiles,
+		largeFileSize:       42 * utils.MiB,
+	}
+	ac.initializeMime()
+	ac.fs = datablock.NewFileStat(false, time.Minute)
+	ac.cache = datablock.NewFileCache(1*utils.MiB, false, 64*utils.KiB, false, 0)
+
+	mux := http.NewServeMux()
+	ac.RegisterHandlers(mux, "/", dir, false)
+
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+	return w.Body.String()
+}
+
+func TestIndexFiles(t *testing.T) {
+	files := map[string]string{
+		"index.html": "<p>html</p>",
+		"index.txt":  "text",
+		"README.md":  "# Readme",
+	}
+
+	// The default index files
+	assert.Equal(t, indexFilesTest(t, nil, files), "<p>html</p>")
+
+	// The first candidate is missing, so the next one is used
+	body := indexFilesTest(t, []string{"index.lua", "README.md", "index.html"}, files)
+	assert.Equal(t, strings.Contains(body, "Readme</h1>"), true)
+	assert.Equal(t, indexFilesTest(t, []string{"index.lua", "index.txt", "README.md"}, files), "text")
+
+	// None of the candidates exist
+	assert.Equal(t, strings.Contains(indexFilesTest(t, []string{"index.lua"}, files), "Directory listing is disabled"), true)
+}
+
+func TestCheckIndexFiles(t *testing.T) {
+	assert.Equal(t, checkIndexFiles([]string{"index.lua", "README.md"}), nil)
+	assert.NotEqual(t, checkIndexFiles(nil), nil)
+	assert.NotEqual(t, checkIndexFiles([]string{"index.html", "../secret.html"}), nil)
+	assert.NotEqual(t, checkIndexFiles([]string{"docs/index.html"}), nil)
+	assert.NotEqual(t, checkIndexFiles([]string{".."}), nil)
+}
+
+func TestSetIndexFiles(t *testing.T) {
+	boltFile, err := ioutil.TempFile("", "algernon_index")
+	assert.Equal(t, err, nil)
+	boltFile.Close()
+	defer os.Remove(boltFile.Name())
+
+	ac := &Config{}
+	ac.perm, err = bolt.NewWithConf(boltFile.Name())
+	assert.Equal(t, err, nil)
+
+	L := lua.NewState()
+	defer L.Close()
+	assert.Equal(t, ac.LoadServerConfigFunctions(L, "serverconf.lua"), nil)
+	assert.Equal(t, ac.indexFiles(), indexFilenames)
+	assert.Equal(t, L.DoString(`assert(SetIndexFiles({"index.lua", "README.md"}))`), nil)
+	assert.Equal(t, ac.indexFiles(), []string{"index.lua", "README.md"})
+	assert.NotEqual(t, L.DoString(`assert(SetIndexFiles({"../index.html"}))`), nil)
+	assert.Equal(t, ac.indexFiles(), []string{"index.lua", "README.md"})
+}
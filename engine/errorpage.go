@@ -0,0 +1,176 @@
+package engine
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/xyproto/algernon/utils"
+	"github.com/xyproto/gopher-lua"
+)
+
+// errorPage writes a custom response for the given HTTP status code.
+// Returns an error if no response was written.
+type errorPage func(w http.ResponseWriter, req *http.Request, code int) error
+
+// errorPageWriter is a http.ResponseWriter that holds back responses with a
+// status code that has a custom error page, so that the error page can be
+// served instead
+type errorPageWriter struct {
+	http.ResponseWriter
+	pages       map[int]errorPage
+	wroteHeader bool
+	code        int
+	page        errorPage    // the error page for the response, if any
+	header      http.Header  // the headers of the response that was held back
+	body        bytes.Buffer // the body of the response that was held back
+}
+
+// WriteHeader holds back the response if there is an error page for the
+// given status code
+func (ew *errorPageWriter) WriteHeader(code int) {
+	if code < 200 {
+		// Informational responses, like "103 Early Hints"
+		ew.ResponseWriter.WriteHeader(code)
+		return
+	}
+	if ew.wroteHeader {
+		return
+	}
+	ew.wroteHeader = true
+	ew.code = code
+	if page, ok := ew.pages[code]; ok {
+		ew.page = page
+		ew.header = ew.ResponseWriter.Header().Clone()
+		return
+	}
+	ew.ResponseWriter.WriteHeader(code)
+}
+
+// Write writes the response, or holds it back if it is going to be
+// replaced by an error page
+func (ew *errorPageWriter) Write(b []byte) (int, error) {
+	if !ew.wroteHeader {
+		ew.WriteHeader(http.StatusOK)
+	}
+	if ew.page != nil {
+		return ew.body.Write(b)
+	}
+	return ew.ResponseWriter.Write(b)
+}
+
+// Flush flushes the response, unless it is held back
+func (ew *errorPageWriter) Flush() {
+	if ew.page != nil {
+		return
+	}
+	if flusher, ok := ew.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// Hijack lets the caller take over the connection, for WebSockets
+func (ew *errorPageWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hijacker, ok := ew.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("the ResponseWriter does not support hijacking")
+	}
+	ew.wroteHeader = true
+	return hijacker.Hijack()
+}
+
+// Unwrap returns the wrapped ResponseWriter, for use with http.ResponseController
+func (ew *errorPageWriter) Unwrap() http.ResponseWriter {
+	return ew.ResponseWriter
+}
+
+// serveErrorPage serves the error page instead of the response that was held
+// back. If the error page fails, the response that was held back is written.
+func (ew *errorPageWriter) serveErrorPage(req *http.Request) {
+	w := ew.ResponseWriter
+	// The error page sets its own content type
+	w.Header().Del("Content-Type")
+	w.Header().Del("Content-Length")
+	w.Header().Del("X-Content-Type-Options")
+	err := ew.page(w, req, ew.code)
+	if err == nil {
+		return
+	}
+	log.Errorf("The error page for %d failed: %s", ew.code, err)
+	for key, values := range ew.header {
+		w.Header()[key] = values
+	}
+	w.WriteHeader(ew.code)
+	ew.body.WriteTo(w)
+}
+
+// errorPageHandler wraps the given handler, so that responses with a status
+// code that has been given to the ErrorHandler Lua function are replaced with
+// the output of the Lua function
+func (ac *Config) errorPageHandler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		ac.reloadMut.RLock()
+		pages := ac.errorPages
+		ac.reloadMut.RUnlock()
+		if len(pages) == 0 {
+			next.ServeHTTP(w, req)
+			return
+		}
+		ew := &errorPageWriter{ResponseWriter: w, pages: pages}
+		next.ServeHTTP(ew, req)
+		if ew.page != nil {
+			ew.serveErrorPage(req)
+		}
+	})
+}
+
+// setErrorPage sets the error page for the given status code. While the
+// server configuration is being reloaded, the error page is used when the
+// reloading is done.
+func (ac *Config) setErrorPage(code int, page errorPage) {
+	ac.reloadMut.Lock()
+	defer ac.reloadMut.Unlock()
+	target := &ac.errorPages
+	if ac.reloadedErrorPages != nil {
+		target = &ac.reloadedErrorPages
+	}
+	// Copy the map, since it may be in use by errorPageHandler
+	pages := make(map[int]errorPage, len(*target)+1)
+	for k, v := range *target {
+		pages[k] = v
+	}
+	pages[code] = page
+	*target = pages
+}
+
+// luaErrorPage returns an error page that calls the given Lua function with
+// the status code. The Lua function has access to the same functions as
+// the Lua handlers, and its output is buffered.
+func (ac *Config) luaErrorPage(L *lua.LState, filename string, luaErrorFunc *lua.LFunction) errorPage {
+	var mut sync.Mutex
+	return func(w http.ResponseWriter, req *http.Request, code int) error {
+		mut.Lock()
+		defer mut.Unlock()
+		recorder := httptest.NewRecorder()
+		httpStatus := &FutureStatus{}
+		ac.LoadCommonFunctions(recorder, req, filename, L, nil, httpStatus, newEarlyHints(recorder, req, false))
+		L.Push(luaErrorFunc)
+		L.Push(lua.LNumber(code))
+		if err := L.PCall(1, 0, nil); err != nil {
+			return err
+		}
+		// Use the status code from the Lua function, if it sets one
+		if httpStatus.code != 0 {
+			code = httpStatus.code
+		}
+		utils.CopyRecorderHeaders(w, recorder)
+		w.WriteHeader(code)
+		recorder.Body.WriteTo(w)
+		return nil
+	}
+}
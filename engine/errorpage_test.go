@@ -0,0 +1,93 @@
+package engine
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/bmizerany/assert"
+	"github.com/xyproto/algernon/lua/pool"
+	"github.com/xyproto/gopher-lua"
+	bolt "github.com/xyproto/permissionbolt"
+)
+
+// get requests the given URL path from the given handler
+func get(handler http.Handler, urlpath string) *httptest.ResponseRecorder {
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest("GET", urlpath, nil))
+	return rec
+}
+
+func TestErrorHandler(t *testing.T) {
+	ac, handler, cleanup := newReloadConfig(t, `
+		assert(ErrorHandler(404, function(code)
+			content("text/plain")
+			print("custom " .. code .. " " .. urlpath())
+		end))
+	`)
+	defer cleanup()
+	assert.Equal(t, ioutil.WriteFile(filepath.Join(ac.serverDirOrFilename, "hello.txt"), []byte("hello"), 0644), nil)
+	handler = ac.errorPageHandler(handler)
+
+	rec := get(handler, "/missing")
+	assert.Equal(t, rec.Code, http.StatusNotFound)
+	assert.Equal(t, rec.Header().Get("Content-Type"), "text/plain")
+	assert.Equal(t, rec.Body.String(), "custom 404 /missing\n")
+
+	// Other responses are not changed
+	rec = get(handler, "/hello.txt")
+	assert.Equal(t, rec.Code, http.StatusOK)
+	assert.Equal(t, rec.Body.String(), "hello")
+
+	// Reloading the configuration without the error handler gives the default page
+	confFilename := ac.serverConfigurationFilenames[0]
+	assert.Equal(t, ioutil.WriteFile(confFilename, []byte(`-- no error handlers`), 0644), nil)
+	assert.Equal(t, ac.reloadServerConfiguration(), nil)
+	rec = get(handler, "/missing")
+	assert.Equal(t, rec.Code, http.StatusNotFound)
+	assert.Equal(t, strings.Contains(rec.Body.String(), "custom"), false)
+}
+
+func TestErrorHandlerFallback(t *testing.T) {
+	boltFile, err := ioutil.TempFile("", "algernon_errorpage")
+	assert.Equal(t, err, nil)
+	boltFile.Close()
+	defer os.Remove(boltFile.Name())
+
+	ac := &Config{luapool: pool.New()}
+	ac.perm, err = bolt.NewWithConf(boltFile.Name())
+	assert.Equal(t, err, nil)
+
+	L := lua.NewState()
+	defer L.Close()
+	assert.Equal(t, ac.LoadServerConfigFunctions(L, "serverconf.lua"), nil)
+	assert.Equal(t, L.DoString(`
+		local ok, err = ErrorHandler(200, function() end)
+		assert(not ok)
+		assert(err == "the status code must be from 400 to 599")
+		assert(ErrorHandler(503, function() undefined_function() end))
+	`), nil)
+
+	handler := ac.errorPageHandler(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path == "/busy" {
+			http.Error(w, "busy", http.StatusServiceUnavailable)
+			return
+		}
+		http.Error(w, "boom", http.StatusInternalServerError)
+	}))
+
+	// There is no error handler for 500
+	rec := get(handler, "/")
+	assert.Equal(t, rec.Code, http.StatusInternalServerError)
+	assert.Equal(t, rec.Body.String(), "boom\n")
+
+	// The error handler for 503 fails, so the original response is used
+	rec = get(handler, "/busy")
+	assert.Equal(t, rec.Code, http.StatusServiceUnavailable)
+	assert.Equal(t, rec.Header().Get("Content-Type"), "text/plain; charset=utf-8")
+	assert.Equal(t, rec.Body.String(), "busy\n")
+}
@@ -0,0 +1,151 @@
+package engine
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// weakETag returns a weak ETag for the given response body
+func weakETag(body []byte) string {
+	sum := sha256.Sum256(body)
+	return `W/"` + hex.EncodeToString(sum[:16]) + `"`
+}
+
+// etagMatches checks if the given If-None-Match header value matches the
+// given ETag, with the weak comparison that is used for If-None-Match
+func etagMatches(ifNoneMatch, etag string) bool {
+	etag = strings.TrimPrefix(etag, "W/")
+	for _, candidate := range strings.Split(ifNoneMatch, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" || strings.TrimPrefix(candidate, "W/") == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// notModifiedSince checks if the If-Modified-Since header of the given
+// request is at or after the given modification time. If-Modified-Since is
+// ignored if If-None-Match is given.
+func notModifiedSince(req *http.Request, modTime time.Time) bool {
+	if req.Method != "GET" && req.Method != "HEAD" {
+		return false
+	}
+	if req.Header.Get("If-None-Match") != "" {
+		return false
+	}
+	since, err := http.ParseTime(req.Header.Get("If-Modified-Since"))
+	if err != nil {
+		return false
+	}
+	// The header has a resolution of one second
+	return !modTime.Truncate(time.Second).After(since)
+}
+
+// checkLastModified sets the Last-Modified header for the given modification
+// time, and writes "304 Not Modified" if the client already has the latest
+// version, in which case true is returned
+func checkLastModified(w http.ResponseWriter, req *http.Request, modTime time.Time) bool {
+	if modTime.IsZero() || modTime.Unix() <= 0 {
+		return false
+	}
+	w.Header().Set("Last-Modified", modTime.UTC().Format(http.TimeFormat))
+	if notModifiedSince(req, modTime) {
+		w.WriteHeader(http.StatusNotModified)
+		return true
+	}
+	return false
+}
+
+// etagWriter is a http.ResponseWriter that buffers the response, so that a
+// weak ETag can be computed from the body when the response is done. If the
+// client already has a response with the same ETag, "304 Not Modified" is
+// written instead. Responses are streamed without an ETag if they are
+// flushed, if the status code is not "200 OK" or if the Cache-Control header
+// contains "no-store".
+type etagWriter struct {
+	http.ResponseWriter
+	req       *http.Request
+	code      int
+	buf       []byte
+	streaming bool
+}
+
+// newETagWriter returns an etagWriter for the response to the given request
+func newETagWriter(w http.ResponseWriter, req *http.Request) *etagWriter {
+	return &etagWriter{ResponseWriter: w, req: req, code: http.StatusOK}
+}
+
+// WriteHeader stores the status code until the response is done.
+// Informational responses, like "103 Early Hints", are written right away.
+func (ew *etagWriter) WriteHeader(code int) {
+	if code < 200 || ew.streaming {
+		ew.ResponseWriter.WriteHeader(code)
+		return
+	}
+	ew.code = code
+}
+
+// Write buffers the response, unless it is being streamed
+func (ew *etagWriter) Write(b []byte) (int, error) {
+	if ew.streaming {
+		return ew.ResponseWriter.Write(b)
+	}
+	ew.buf = append(ew.buf, b...)
+	return len(b), nil
+}
+
+// stream writes the header and the buffered data, and then writes the rest of
+// the response directly
+func (ew *etagWriter) stream() error {
+	ew.streaming = true
+	ew.ResponseWriter.WriteHeader(ew.code)
+	buf := ew.buf
+	ew.buf = nil
+	if len(buf) == 0 {
+		return nil
+	}
+	_, err := ew.ResponseWriter.Write(buf)
+	return err
+}
+
+// Flush sends the response so far, without an ETag
+func (ew *etagWriter) Flush() {
+	if !ew.streaming {
+		ew.stream()
+	}
+	if flusher, ok := ew.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// Close sets the ETag and writes the response, or writes "304 Not Modified"
+func (ew *etagWriter) Close() error {
+	if ew.streaming {
+		return nil
+	}
+	header := ew.Header()
+	cacheable := ew.code == http.StatusOK &&
+		(ew.req.Method == "GET" || ew.req.Method == "HEAD") &&
+		!strings.Contains(strings.ToLower(header.Get("Cache-Control")), "no-store")
+	if cacheable && header.Get("ETag") == "" {
+		header.Set("ETag", weakETag(ew.buf))
+	}
+	if cacheable && etagMatches(ew.req.Header.Get("If-None-Match"), header.Get("ETag")) {
+		ew.streaming = true
+		for _, key := range []string{"Content-Type", "Content-Length", "Content-Encoding"} {
+			header.Del(key)
+		}
+		ew.ResponseWriter.WriteHeader(http.StatusNotModified)
+		return nil
+	}
+	return ew.stream()
+}
+
+// Unwrap returns the wrapped ResponseWriter, for use with http.ResponseController
+func (ew *etagWriter) Unwrap() http.ResponseWriter {
+	return ew.ResponseWriter
+}
@@ -0,0 +1,121 @@
+package engine
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/bmizerany/assert"
+	"github.com/xyproto/algernon/lua/pool"
+	"github.com/xyproto/algernon/utils"
+	"github.com/xyproto/datablock"
+)
+
+func TestETagMatches(t *testing.T) {
+	etag := weakETag([]byte("hello"))
+	assert.Equal(t, etag[:3], `W/"`)
+	assert.NotEqual(t, weakETag([]byte("hello!")), etag)
+	assert.Equal(t, etagMatches(etag, etag), true)
+	assert.Equal(t, etagMatches(`"abc", `+etag[2:], etag), true)
+	assert.Equal(t, etagMatches("*", etag), true)
+	assert.Equal(t, etagMatches(`"abc"`, etag), false)
+	assert.Equal(t, etagMatches("", etag), false)
+}
+
+// conditionalGet requests the given URL, with the given If-None-Match and
+// If-Modified-Since headers, if they are not empty
+func conditionalGet(t *testing.T, url, ifNoneMatch, ifModifiedSince string) (*http.Response, string) {
+	req, err := http.NewRequest("GET", url, nil)
+	assert.Equal(t, err, nil)
+	if ifNoneMatch != "" {
+		req.Header.Set("If-None-Match", ifNoneMatch)
+	}
+	if ifModifiedSince != "" {
+		req.Header.Set("If-Modified-Since", ifModifiedSince)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	assert.Equal(t, err, nil)
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	assert.Equal(t, err, nil)
+	return resp, string(body)
+}
+
+func TestETagCaching(t *testing.T) {
+	dir, err := ioutil.TempDir("", "algernon_etag")
+	assert.Equal(t, err, nil)
+	defer os.RemoveAll(dir)
+	script := filepath.Join(dir, "index.lua")
+	nostore := filepath.Join(dir, "nostore.lua")
+	assert.Equal(t, ioutil.WriteFile(script, []byte(`print("version 1")`), 0644), nil)
+	assert.Equal(t, ioutil.WriteFile(nostore, []byte(`setheader("Cache-Control", "no-store") print("hi")`), 0644), nil)
+
+	for _, debugMode := range []bool{false, true} {
+		ac := &Config{debugMode: debugMode, etagCaching: true}
+		ac.luapool = pool.New()
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			ac.FilePage(w, req, filepath.Join(dir, req.URL.Path), "")
+		}))
+
+		resp, body := conditionalGet(t, server.URL+"/index.lua", "", "")
+		assert.Equal(t, resp.StatusCode, http.StatusOK)
+		assert.Equal(t, body, "version 1\n")
+		etag := resp.Header.Get("ETag")
+		assert.Equal(t, etag, weakETag([]byte("version 1\n")))
+
+		// The same content, with a matching ETag
+		resp, body = conditionalGet(t, server.URL+"/index.lua", etag, "")
+		assert.Equal(t, resp.StatusCode, http.StatusNotModified)
+		assert.Equal(t, body, "")
+
+		// New content gives a new ETag
+		assert.Equal(t, ioutil.WriteFile(script, []byte(`print("version 2")`), 0644), nil)
+		resp, body = conditionalGet(t, server.URL+"/index.lua", etag, "")
+		assert.Equal(t, resp.StatusCode, http.StatusOK)
+		assert.Equal(t, body, "version 2\n")
+		assert.NotEqual(t, resp.Header.Get("ETag"), etag)
+		assert.Equal(t, ioutil.WriteFile(script, []byte(`print("version 1")`), 0644), nil)
+
+		// Pages can opt out with Cache-Control: no-store
+		resp, body = conditionalGet(t, server.URL+"/nostore.lua", "*", "")
+		assert.Equal(t, resp.StatusCode, http.StatusOK)
+		assert.Equal(t, resp.Header.Get("ETag"), "")
+		assert.Equal(t, body, "hi\n")
+
+		server.Close()
+		ac.luapool.Shutdown()
+	}
+}
+
+func TestLastModified(t *testing.T) {
+	ac := &Config{etagCaching: true, largeFileSize: 42 * utils.MiB}
+	ac.initializeMime()
+	ac.fs = datablock.NewFileStat(false, time.Minute)
+	ac.cache = datablock.NewFileCache(1*utils.MiB, false, 64*utils.KiB, false, 0)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		ac.FilePage(w, req, "testdata/servable/notes.txt", "")
+	}))
+	defer server.Close()
+
+	fi, err := os.Stat("testdata/servable/notes.txt")
+	assert.Equal(t, err, nil)
+	lastModified := fi.ModTime().UTC().Format(http.TimeFormat)
+
+	resp, body := conditionalGet(t, server.URL, "", "")
+	assert.Equal(t, resp.StatusCode, http.StatusOK)
+	assert.Equal(t, resp.Header.Get("Last-Modified"), lastModified)
+	assert.Equal(t, body, "hello\n")
+
+	resp, body = conditionalGet(t, server.URL, "", lastModified)
+	assert.Equal(t, resp.StatusCode, http.StatusNotModified)
+	assert.Equal(t, body, "")
+
+	// Modified after the given time
+	earlier := fi.ModTime().Add(-time.Hour).UTC().Format(http.TimeFormat)
+	resp, _ = conditionalGet(t, server.URL, "", earlier)
+	assert.Equal(t, resp.StatusCode, http.StatusOK)
+}
@@ -0,0 +1,71 @@
+package engine
+
+import (
+	"bytes"
+	"net/http"
+	"strings"
+
+	"github.com/xyproto/gopher-lua"
+)
+
+// eventMessage returns a Server-Sent Events message with the given event
+// name and data. The event name may be empty, for "message" events.
+// Data with several lines is sent as several data fields.
+func eventMessage(eventName, data string) []byte {
+	var buf bytes.Buffer
+	if eventName = strings.NewReplacer("\r", "", "\n", "").Replace(eventName); eventName != "" {
+		buf.WriteString("event: " + eventName + "\n")
+	}
+	data = strings.Replace(data, "\r\n", "\n", -1)
+	for _, line := range strings.Split(data, "\n") {
+		buf.WriteString("data: " + line + "\n")
+	}
+	buf.WriteString("\n")
+	return buf.Bytes()
+}
+
+// LoadEventSourceFunctions makes functions for sending Server-Sent Events
+// available to the given Lua state
+func (ac *Config) LoadEventSourceFunctions(w http.ResponseWriter, req *http.Request, L *lua.LState, flushFunc func()) {
+
+	// Send any buffered output to the client
+	flush := func() {
+		if flushFunc != nil {
+			flushFunc()
+			return
+		}
+		flushResponse(w)
+	}
+
+	// Start a stream of Server-Sent Events, by sending the headers.
+	// Returns false if the headers have already been sent.
+	L.SetGlobal("eventSource", L.NewFunction(func(L *lua.LState) int {
+		if !changeHeader(w, "eventSource", "Content-Type", "text/event-stream", false) {
+			L.Push(lua.LBool(false))
+			return 1 // number of results
+		}
+		w.Header().Set("Cache-Control", "no-cache")
+		// Ask proxies like nginx to not buffer the events
+		w.Header().Set("X-Accel-Buffering", "no")
+		flush()
+		L.Push(lua.LBool(true))
+		return 1 // number of results
+	}))
+
+	// Send an event with the given name and data. The name may be empty.
+	// Returns false if the client has disconnected.
+	L.SetGlobal("emit", L.NewFunction(func(L *lua.LState) int {
+		if req.Context().Err() != nil {
+			L.Push(lua.LBool(false))
+			return 1 // number of results
+		}
+		if _, err := w.Write(eventMessage(L.ToString(1), L.ToString(2))); err != nil {
+			L.Push(lua.LBool(false))
+			return 1 // number of results
+		}
+		flush()
+		L.Push(lua.LBool(req.Context().Err() == nil))
+		return 1 // number of results
+	}))
+
+}
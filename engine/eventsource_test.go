@@ -0,0 +1,55 @@
+package engine
+
+import (
+	"bufio"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/bmizerany/assert"
+	"github.com/xyproto/algernon/lua/pool"
+)
+
+func TestEventMessage(t *testing.T) {
+	assert.Equal(t, string(eventMessage("tick", "1")), "event: tick\ndata: 1\n\n")
+	assert.Equal(t, string(eventMessage("", "a\r\nb")), "data: a\ndata: b\n\n")
+}
+
+func TestEventSource(t *testing.T) {
+	for _, debugMode := range []bool{false, true} {
+		ac := &Config{debugMode: debugMode}
+		ac.luapool = pool.New()
+		done := make(chan bool, 1)
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			ac.FilePage(w, req, "testdata/events.lua", "")
+			done <- true
+		}))
+
+		resp, err := http.Get(server.URL)
+		assert.Equal(t, err, nil)
+		assert.Equal(t, resp.Header.Get("Content-Type"), "text/event-stream")
+		assert.Equal(t, resp.Header.Get("Cache-Control"), "no-cache")
+
+		// Receive two events
+		r := bufio.NewReader(resp.Body)
+		var lines []string
+		for len(lines) < 6 {
+			line, err := r.ReadString('\n')
+			assert.Equal(t, err, nil)
+			lines = append(lines, line)
+		}
+		assert.Equal(t, lines, []string{"event: tick\n", "data: event 1\n", "\n", "event: tick\n", "data: event 2\n", "\n"})
+
+		// The script stops when the client disconnects
+		resp.Body.Close()
+		select {
+		case <-done:
+		case <-time.After(5 * time.Second):
+			t.Error("the script did not stop after the client disconnected")
+		}
+
+		server.Close()
+		ac.luapool.Shutdown()
+	}
+}
@@ -0,0 +1,53 @@
+package engine
+
+import (
+	"bytes"
+	"os/exec"
+
+	"github.com/xyproto/gopher-lua"
+)
+
+// runCommand runs the given command in the given directory, and returns the
+// standard output, standard error and exit code. If the command could not be
+// started, the error message is returned as the standard error and the exit
+// code is -1.
+func runCommand(dir, command string, args ...string) (string, string, int) {
+	var stdout, stderr bytes.Buffer
+	cmd := exec.Command(command, args...)
+	cmd.Dir = dir
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		if exitErr, ok := err.(*exec.ExitError); ok {
+			return stdout.String(), stderr.String(), exitErr.ExitCode()
+		}
+		return stdout.String(), err.Error(), -1
+	}
+	return stdout.String(), stderr.String(), 0
+}
+
+// LoadExecFunctions makes the exec function available to the given Lua state.
+// Commands are run in the given script directory. Running commands must be
+// enabled with --allow-exec.
+func (ac *Config) LoadExecFunctions(L *lua.LState, scriptdir string) {
+
+	// Run a command with the given arguments, without using a shell.
+	// Returns the standard output, standard error and exit code.
+	L.SetGlobal("exec", L.NewFunction(func(L *lua.LState) int {
+		if !ac.allowExec {
+			L.RaiseError("exec is disabled, use --allow-exec to enable it")
+			return 0 // number of results
+		}
+		command := L.CheckString(1)
+		var args []string
+		for i := 2; i <= L.GetTop(); i++ {
+			args = append(args, L.ToString(i))
+		}
+		stdout, stderr, exitCode := runCommand(scriptdir, command, args...)
+		L.Push(lua.LString(stdout))
+		L.Push(lua.LString(stderr))
+		L.Push(lua.LNumber(exitCode))
+		return 3 // number of results
+	}))
+
+}
@@ -0,0 +1,50 @@
+package engine
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/bmizerany/assert"
+	"github.com/xyproto/gopher-lua"
+)
+
+func TestExec(t *testing.T) {
+	dir, err := ioutil.TempDir("", "algernon")
+	assert.Equal(t, err, nil)
+	defer os.RemoveAll(dir)
+	dir, err = filepath.EvalSymlinks(dir)
+	assert.Equal(t, err, nil)
+
+	L := lua.NewState()
+	defer L.Close()
+	(&Config{allowExec: true}).LoadExecFunctions(L, dir)
+
+	err = L.DoString(`
+		-- A successful command, run in the script directory
+		stdout, stderr, code = exec("pwd")
+		assert(stderr == "" and code == 0)
+
+		-- A failing command
+		local stdout, stderr, code = exec("sh", "-c", "echo out; echo err >&2; exit 3")
+		assert(stdout == "out\n" and stderr == "err\n" and code == 3)
+
+		-- A missing command
+		stdout, stderr, code = exec("algernon-missing-command")
+		assert(stdout == "" and stderr ~= "" and code == -1)
+	`)
+	assert.Equal(t, err, nil)
+	assert.Equal(t, strings.TrimSpace(L.GetGlobal("stdout").String()), dir)
+}
+
+func TestExecDisabled(t *testing.T) {
+	L := lua.NewState()
+	defer L.Close()
+	(&Config{}).LoadExecFunctions(L, ".")
+
+	err := L.DoString(`exec("pwd")`)
+	assert.NotEqual(t, err, nil)
+	assert.Equal(t, strings.Contains(err.Error(), "--allow-exec"), true)
+}
@@ -0,0 +1,154 @@
+package engine
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/xyproto/gopher-lua"
+)
+
+// serverRoot returns the directory that is being served. If a single file is
+// being served, the directory of that file is returned. If no directory has
+// been configured, the given script directory is returned.
+func (ac *Config) serverRoot(scriptdir string) string {
+	if ac.serverDirOrFilename == "" {
+		return scriptdir
+	}
+	if fi, err := os.Stat(ac.serverDirOrFilename); err == nil && !fi.IsDir() {
+		return filepath.Dir(ac.serverDirOrFilename)
+	}
+	return ac.serverDirOrFilename
+}
+
+// scriptPath returns the full path of the given filename, relative to the
+// given script directory. Returns an error if the path is outside of the
+// directory that is being served.
+func (ac *Config) scriptPath(scriptdir, filename string) (string, error) {
+	root, err := filepath.Abs(ac.serverRoot(scriptdir))
+	if err != nil {
+		return "", err
+	}
+	fullPath, err := filepath.Abs(filepath.Join(scriptdir, filename))
+	if err != nil {
+		return "", err
+	}
+	if rel, err := filepath.Rel(root, fullPath); err != nil || !filepath.IsLocal(rel) {
+		return "", fmt.Errorf("%s is outside of the server directory", filename)
+	}
+	return fullPath, nil
+}
+
+// LoadFileFunctions makes functions for reading and writing files, relative
+// to the given script directory, available to the given Lua state
+func (ac *Config) LoadFileFunctions(L *lua.LState, scriptdir string) {
+
+	// Read a file, given a filename relative to the script directory.
+	// Returns the contents, or nil and an error message.
+	L.SetGlobal("ReadFile", L.NewFunction(func(L *lua.LState) int {
+		fullPath, err := ac.scriptPath(scriptdir, L.ToString(1))
+		if err != nil {
+			log.Error(err)
+			L.Push(lua.LNil)
+			L.Push(lua.LString(err.Error()))
+			return 2 // number of results
+		}
+		data, err := ioutil.ReadFile(fullPath)
+		if err != nil {
+			L.Push(lua.LNil)
+			L.Push(lua.LString(err.Error()))
+			return 2 // number of results
+		}
+		L.Push(lua.LString(data))
+		return 1 // number of results
+	}))
+
+	// Write a string to a file, given a filename relative to the script
+	// directory. The file is created or overwritten.
+	// Returns true, or false and an error message.
+	L.SetGlobal("WriteFile", L.NewFunction(func(L *lua.LState) int {
+		fullPath, err := ac.scriptPath(scriptdir, L.ToString(1))
+		if err != nil {
+			log.Error(err)
+			L.Push(lua.LBool(false))
+			L.Push(lua.LString(err.Error()))
+			return 2 // number of results
+		}
+		if err := ioutil.WriteFile(fullPath, []byte(L.ToString(2)), ac.defaultPermissions); err != nil {
+			L.Push(lua.LBool(false))
+			L.Push(lua.LString(err.Error()))
+			return 2 // number of results
+		}
+		L.Push(lua.LBool(true))
+		return 1 // number of results
+	}))
+
+}
+
+// statusWriter is a http.ResponseWriter that keeps track of the status code
+type statusWriter struct {
+	http.ResponseWriter
+	code int
+}
+
+// WriteHeader stores the status code and writes the header
+func (sw *statusWriter) WriteHeader(code int) {
+	sw.code = code
+	sw.ResponseWriter.WriteHeader(code)
+}
+
+// serveFile serves the given file with http.ServeContent, which sets the
+// content type and handles conditional requests and byte ranges. Any output
+// that is written afterwards is discarded.
+func serveFile(w http.ResponseWriter, req *http.Request, f *os.File, fi os.FileInfo, httpStatus *FutureStatus) {
+	sw := &statusWriter{w, http.StatusOK}
+	http.ServeContent(sw, req, fi.Name(), fi.ModTime(), f)
+	if httpStatus != nil {
+		// The status code must be written first, if the output is buffered
+		httpStatus.code = sw.code
+	}
+	if hw, ok := w.(*hintsWriter); ok {
+		hw.hints.completed = true
+	}
+}
+
+// LoadServeFileFunction makes the ServeFile function available to the given Lua
+// state, for serving a file relative to the given script directory
+func (ac *Config) LoadServeFileFunction(w http.ResponseWriter, req *http.Request, L *lua.LState, scriptdir string, httpStatus *FutureStatus) {
+
+	// Serve the given file, with the content type set and with support for
+	// conditional requests and byte ranges. Output that is written afterwards
+	// is discarded. Returns true, or false and an error message.
+	L.SetGlobal("ServeFile", L.NewFunction(func(L *lua.LState) int {
+		fullPath, err := ac.scriptPath(scriptdir, L.CheckString(1))
+		if err != nil {
+			log.Error(err)
+			L.Push(lua.LBool(false))
+			L.Push(lua.LString(err.Error()))
+			return 2 // number of results
+		}
+		f, err := os.Open(fullPath)
+		if err != nil {
+			L.Push(lua.LBool(false))
+			L.Push(lua.LString(err.Error()))
+			return 2 // number of results
+		}
+		defer f.Close()
+		fi, err := f.Stat()
+		if err == nil && fi.IsDir() {
+			err = fmt.Errorf("%s is a directory", L.ToString(1))
+		}
+		if err != nil {
+			L.Push(lua.LBool(false))
+			L.Push(lua.LString(err.Error()))
+			return 2 // number of results
+		}
+		serveFile(w, req, f, fi, httpStatus)
+		L.Push(lua.LBool(true))
+		return 1 // number of results
+	}))
+
+}
@@ -0,0 +1,106 @@
+package engine
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/bmizerany/assert"
+	"github.com/xyproto/algernon/lua/pool"
+	"github.com/xyproto/gopher-lua"
+)
+
+func TestReadWriteFile(t *testing.T) {
+	root, err := ioutil.TempDir("", "algernon")
+	assert.Equal(t, err, nil)
+	defer os.RemoveAll(root)
+	scriptdir := filepath.Join(root, "scripts")
+	assert.Equal(t, os.Mkdir(scriptdir, 0755), nil)
+
+	ac := &Config{serverDirOrFilename: root, defaultPermissions: 0640}
+
+	L := lua.NewState()
+	defer L.Close()
+	ac.LoadFileFunctions(L, scriptdir)
+
+	err = L.DoString(`
+		assert(WriteFile("notes.txt", "hello\n"))
+		assert(ReadFile("notes.txt") == "hello\n")
+
+		-- Files elsewhere in the server directory can be used
+		assert(WriteFile("../shared.txt", "shared"))
+		assert(ReadFile("../shared.txt") == "shared")
+
+		-- Missing files
+		local data, err = ReadFile("missing.txt")
+		assert(data == nil and err ~= nil)
+
+		-- Files outside of the server directory can not be used
+		data, err = ReadFile("../../outside.txt")
+		assert(data == nil and err ~= nil)
+		local ok, err = WriteFile("../../outside.txt", "escaped")
+		assert(not ok and err ~= nil)
+		ok, err = WriteFile("/../../outside.txt", "escaped")
+		assert(not ok and err ~= nil)
+	`)
+	assert.Equal(t, err, nil)
+
+	data, err := ioutil.ReadFile(filepath.Join(scriptdir, "notes.txt"))
+	assert.Equal(t, err, nil)
+	assert.Equal(t, string(data), "hello\n")
+	fi, err := os.Stat(filepath.Join(scriptdir, "notes.txt"))
+	assert.Equal(t, err, nil)
+	assert.Equal(t, fi.Mode().Perm(), os.FileMode(0640))
+	_, err = os.Stat(filepath.Join(filepath.Dir(root), "outside.txt"))
+	assert.Equal(t, os.IsNotExist(err), true)
+}
+
+func TestServeFile(t *testing.T) {
+	for _, debugMode := range []bool{false, true} {
+		ac := &Config{debugMode: debugMode}
+		ac.luapool = pool.New()
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			ac.FilePage(w, req, "testdata/servefile.lua", "")
+		}))
+
+		get := func(file, byteRange string) (*http.Response, string) {
+			req, err := http.NewRequest("GET", server.URL+"/?file="+file, nil)
+			assert.Equal(t, err, nil)
+			if byteRange != "" {
+				req.Header.Set("Range", byteRange)
+			}
+			resp, err := http.DefaultClient.Do(req)
+			assert.Equal(t, err, nil)
+			defer resp.Body.Close()
+			body, err := ioutil.ReadAll(resp.Body)
+			assert.Equal(t, err, nil)
+			return resp, string(body)
+		}
+
+		// The whole file, without any output from after ServeFile
+		resp, body := get("servable/notes.txt", "")
+		assert.Equal(t, resp.StatusCode, http.StatusOK)
+		assert.Equal(t, strings.HasPrefix(resp.Header.Get("Content-Type"), "text/plain"), true)
+		assert.Equal(t, resp.Header.Get("Accept-Ranges"), "bytes")
+		assert.Equal(t, body, "hello\n")
+
+		// A range of the file
+		resp, body = get("servable/notes.txt", "bytes=1-3")
+		assert.Equal(t, resp.StatusCode, http.StatusPartialContent)
+		assert.Equal(t, resp.Header.Get("Content-Range"), "bytes 1-3/6")
+		assert.Equal(t, body, "ell")
+
+		// Files outside of the server directory can not be served
+		resp, body = get("../serve.go", "")
+		assert.Equal(t, strings.HasPrefix(body, "error: "), true)
+		assert.Equal(t, strings.Contains(body, "package engine"), false)
+		assert.Equal(t, strings.Contains(body, "not sent"), true)
+
+		server.Close()
+		ac.luapool.Shutdown()
+	}
+}
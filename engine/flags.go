@@ -8,12 +8,25 @@ import (
 	"runtime"
 	"strconv"
 	"strings"
+	"time"
 
+	"github.com/chzyer/readline"
+	log "github.com/sirupsen/logrus"
 	"github.com/xyproto/algernon/cachemode"
 	"github.com/xyproto/algernon/themes"
 	"github.com/xyproto/datablock"
 )
 
+// versionInfo returns the version string, followed by a line with the Go
+// version, the platform and the build date, if available
+func (ac *Config) versionInfo() string {
+	info := ac.versionString + "\n" + runtime.Version() + " " + runtime.GOOS + "/" + runtime.GOARCH
+	if BuildDate != "" {
+		info += ", built " + BuildDate
+	}
+	return info
+}
+
 func generateUsageFunction(ac *Config) func() {
 	return func() {
 		fmt.Println("\n" + ac.versionString + "\n\n" + ac.description)
@@ -27,11 +40,16 @@ Syntax:
 
 Available flags:
   -h, --help                   This help text
-  -v, --version                Application name and version
+  -v, --version                Application name and version, together with
+                               the Go version and the build date, if set.
   --dir=DIRECTORY              Set the server directory
   --addr=[HOST][:PORT]         Server host and port ("` + ac.defaultWebColonPort + `" is default)
+                               Can also be a Unix domain socket, like
+                               "unix:/run/algernon.sock" or "/run/algernon.sock".
+                               Several addresses can be given, like ":80,:8080".
   -e, --dev                    Development mode: Enables Debug mode, uses
-                               regular HTTP, Bolt and sets cache mode "dev".
+                               regular HTTP, Bolt, debug logging and no cache.
+                               Reloads Lua scripts when they change.
   -p, --prod                   Serve HTTP/2+HTTPS on port 443. Serve regular
                                HTTP on port 80. Uses /srv/algernon for files.
                                Disables debug mode. Disables auto-refresh.
@@ -50,18 +68,67 @@ Available flags:
   --nocache                    Another way to disable the caching.
   --noheaders                  Don't use the security-related HTTP headers.
   --stricter                   Stricter HTTP headers (same origin policy).
-  -n, --nobanner               Don't display a colorful banner at start.
+  -n, --nobanner               Don't display a banner at start.
+  --startup-json               Output a single line of JSON with the version,
+                               listen address, Redis address and PID when
+                               the server is ready, instead of the banner.
   --ctrld                      Press ctrl-d twice to exit the REPL.
+  --no-color                   Don't use colors in the terminal output.
+                               Colors are also disabled if the output
+                               is not a terminal.
   --rawcache                   Disable cache compression.
   --watchdir=DIRECTORY         Enables auto-refresh for only this directory.
   --cert=FILENAME              TLS certificate, if using HTTPS.
   --key=FILENAME               TLS key, if using HTTPS.
+  --autotls                    Fetch and renew TLS certificates from Let's
+                               Encrypt. Serves HTTPS + HTTP/2 on port 443 and
+                               the HTTP-01 challenges on port 80. Can not be
+                               combined with --cert or --key.
+  --domains=DOMAINS            Comma separated list of domains to fetch
+                               certificates for, with --autotls.
+  --autotls-cache=DIRECTORY    Where to store the certificates from Let's
+                               Encrypt. The default is a directory in the
+                               user cache directory.
   -d, --debug                  Enable debug mode (show errors in the browser).
+  --hide-errors                Serve a generic "500 Internal Server Error"
+                               page when a handler fails, and only log the
+                               error details. Overrides debug mode.
+  --compress                   Compress responses with gzip or deflate, if
+                               the client accepts it. Small responses and
+                               images, audio and video are not compressed.
+  --cors=ORIGINS               Comma separated list of origins that are
+                               allowed to make cross-origin requests, or "*"
+                               for all origins.
+  --allow-exec                 Allow Lua scripts to run external commands
+                               with the exec function.
   -b, --bolt                   Use "` + ac.defaultBoltFilename + `" for the Bolt database.
   --boltdb=FILENAME            Use a specific file for the Bolt database
   --redis=[HOST][:PORT]        Use "` + ac.defaultRedisColonPort + `" for the Redis database.
   --dbindex=INDEX              Redis database index (0 is default).
+  --redispass=PASSWORD         Password for the Redis server. Can also be
+                               given with the REDIS_PASSWORD environment
+                               variable, to keep it out of the process list.
+  --redispool=N                Maximum number of idle and active connections
+                               in the Redis connection pool. There is one
+                               pool, used for the database index given with
+                               --dbindex.
+  --redistls                   Connect to the Redis server over TLS.
+  --redistlscert=FILENAME      Client certificate for Redis over TLS.
+  --redistlskey=FILENAME       Client key for Redis over TLS.
+  --redisca=FILENAME           Certificate authority for verifying the
+                               certificate of the Redis server.
+  --redistlsskipverify         Do not verify the certificate of the Redis
+                               server. Only for testing self-signed setups.
+  --redis-sentinel=ADDR[,ADDR] Comma separated list of Redis Sentinel
+                               addresses, for connecting to the current Redis
+                               master and following a failover.
+  --redis-master=NAME          The name of the Redis master that is monitored
+                               by Redis Sentinel (the default is "mymaster").
   --conf=FILENAME              Lua script with additional configuration.
+  --config=FILENAME            TOML or JSON file with settings, where the keys
+                               are the names of the flags, like "addr" or
+                               "redis". Flags on the command line and
+                               environment variables take precedence.
   --log=FILENAME               Log to a file instead of to the console.
   --internal=FILENAME          Internal log file (can be a bit verbose).
   -t, --httponly               Serve regular HTTP.
@@ -72,19 +139,74 @@ Available flags:
   --postgresdb=NAME            Use the given PostgreSQL database name.
   --clear                      Clear the default URI prefixes that are used
                                when handling permissions.
-  -V, --verbose                Slightly more verbose logging.
+  -V, --verbose                Slightly more verbose logging. Same as
+                               --loglevel=debug.
+  --loglevel=LEVEL             Log level: debug, info, warn or error.
+                               The default is info.
+  --logformat=FORMAT           Log format: text or json. The default is text
+                               for the console and json for log files.
   --eventserver=[HOST][:PORT]  SSE server address (for filesystem changes).
   --eventrefresh=DURATION      How often the event server should refresh
                                (the default is "` + ac.defaultEventRefresh + `").
   --limit=N                    Limit clients to N requests per second
                                (the default is ` + ac.defaultLimitString + `).
   --nolimit                    Disable rate limiting.
+  --ratelimit=N                Limit each client IP address to N requests per
+                               minute, and respond with "429 Too Many
+                               Requests" when the limit is exceeded.
+                               X-Forwarded-For is used for requests from
+                               loopback or private addresses.
+  --index=NAMES                Comma separated list of filenames to serve
+                               for directory requests, tried in order, like
+                               "index.lua,index.html,README.md".
+  --metrics                    Serve request counts, status codes, request
+                               durations, open connections and Lua states
+                               at /metrics, in the Prometheus text format.
+  --metrics-admin              Like --metrics, but only for logged in
+                               administrators.
+  --health                     Serve a liveness check at /healthz and a
+                               readiness check at /readyz, which fails if
+                               Redis does not reply to PING.
+  --health-path=PATH           Serve the health checks below PATH instead
+                               of /, like /status/healthz. Enables --health.
+  --uploadperm=MODE            File permissions for uploaded files that are
+                               saved by Lua scripts, as an octal number like
+                               0600. The default is 0660.
+  --dirlist                    List the files in directories that have no
+                               index file, with sizes and modification times.
+                               Disabled by default.
+  --tmpdir=DIRECTORY           Directory for temporary files, like uploaded
+                               files that are too large to keep in memory.
+                               The default is the system temporary directory.
+  --trusted-proxies=LIST       Comma separated list of IP addresses and
+                               networks, like "10.0.0.0/8", of proxies that
+                               are trusted to set X-Forwarded-For for the
+                               clientIP Lua function.
+  --luapool=N                  Keep at most N Lua states for running scripts.
+                               When all are in use, new Lua states are
+                               created and discarded after use. The default
+                               is 0, which is unlimited.
+  --luapoolblock               Wait for a Lua state to become available when
+                               all N are in use, instead of creating more.
   --nodb                       No database backend. (same as --boltdb=` + os.DevNull + `).
   --largesize=N                Threshold for not reading static files into memory, in bytes.
-  --timeout=N                  Timeout when serving files, in seconds.
+  --read-timeout=DURATION      How long a client may take to send a request,
+                               like "30s" (the default). 0 is no timeout.
+  --write-timeout=DURATION     How long it may take to send a response, like
+                               "30s" (the default). 0 is no timeout. This is
+                               also the maximum duration of Server-Sent Events.
+  --idle-timeout=DURATION      How long to keep idle keep-alive connections
+                               open, like "120s" (the default). 0 is no timeout.
+  --timeout=N                  The same as --write-timeout, in seconds.
+  --shutdown-timeout=DURATION  How long to wait for requests to complete when
+                               shutting down, like "10s" (the default).
+  --http-client-timeout=DURATION
+                               Default timeout for HTTP requests that are
+                               sent from Lua (the default is "10s").
   -l, --lua                    Don't serve anything, just present the Lua REPL.
   -s, --server                 Server mode (disable debug + interactive mode).
   -q, --quiet                  Don't output anything to stdout or stderr.
+                               Only log errors, if --log is given.
   --servername=TEXT            Custom HTTP header value for the Server field.
   -o, --open=EXECUTABLE        Open the served URL with ` + ac.defaultOpenExecutable + `, or with the
                                given application.
@@ -121,10 +243,39 @@ Example usage:
   Serve the current directory over HTTP, port 3000. No limits, cache,
   permissions or database connections:
     algernon -x
+
+Environment variables:
+  All flags can also be given as environment variables, like ALGERNON_ADDR
+  for --addr or ALGERNON_SHUTDOWN_TIMEOUT for --shutdown-timeout.
+  Flags on the command line take precedence.
 `)
 	}
 }
 
+// parseFileMode parses file permissions given as an octal number, like "0600"
+func parseFileMode(s string) (os.FileMode, error) {
+	mode, err := strconv.ParseUint(s, 8, 32)
+	if err != nil {
+		return 0, fmt.Errorf("%q is not an octal number", s)
+	}
+	if mode == 0 || mode > uint64(os.ModePerm) {
+		return 0, fmt.Errorf("%q is not a file mode between 0001 and 0777", s)
+	}
+	return os.FileMode(mode), nil
+}
+
+// healthPathPrefix returns the given --health-path with a leading and a
+// trailing slash, like "/status/"
+func healthPathPrefix(s string) string {
+	if !strings.HasPrefix(s, "/") {
+		s = "/" + s
+	}
+	if !strings.HasSuffix(s, "/") {
+		s += "/"
+	}
+	return s
+}
+
 // Parse the flags, return the default hostname
 func (ac *Config) handleFlags(serverTempDir string) {
 	var (
@@ -140,6 +291,24 @@ func (ac *Config) handleFlags(serverTempDir string) {
 		rawCache bool
 		// Used if disabling the database backend
 		noDatabase bool
+		// Comma separated list of domains, for --autotls
+		domains string
+		// Comma separated list of Redis Sentinel addresses, for --redis-sentinel
+		redisSentinels string
+		// The write timeout in seconds, for --timeout
+		timeoutSeconds uint64
+		// Comma separated list of origins, for --cors
+		corsOrigins string
+		// Comma separated list of IP addresses and networks, for --trusted-proxies
+		trustedProxies string
+		// Comma separated list of filenames, for --index
+		indexFiles string
+		// Octal file permissions, for --uploadperm
+		uploadPermissions string
+		// Serve metrics at /metrics, for --metrics
+		serveMetrics bool
+		// Serve health checks, for --health
+		serveHealth bool
 	)
 
 	// The usage function that provides more help (for --help or -h)
@@ -162,16 +331,44 @@ func (ac *Config) handleFlags(serverTempDir string) {
 	flag.StringVar(&ac.serverAddr, "addr", "", "Server [host][:port] (ie \":443\")")
 	flag.StringVar(&ac.serverCert, "cert", "cert.pem", "Server certificate")
 	flag.StringVar(&ac.serverKey, "key", "key.pem", "Server key")
+	flag.BoolVar(&ac.autoTLS, "autotls", false, "Fetch TLS certificates from Let's Encrypt")
+	flag.StringVar(&domains, "domains", "", "Domains to fetch TLS certificates for")
+	flag.StringVar(&ac.autoTLSCacheDir, "autotls-cache", "", "Directory for the certificates from Let's Encrypt")
 	flag.StringVar(&ac.redisAddr, "redis", "", "Redis [host][:port] (ie \""+ac.defaultRedisColonPort+"\")")
 	flag.IntVar(&ac.redisDBindex, "dbindex", 0, "Redis database index")
+	flag.StringVar(&ac.redisPassword, "redispass", "", "Redis password")
+	flag.IntVar(&ac.redisPoolSize, "redispool", 0, "Redis connection pool size")
+	flag.BoolVar(&ac.redisTLS, "redistls", false, "Connect to Redis over TLS")
+	flag.StringVar(&ac.redisTLSCert, "redistlscert", "", "Redis TLS client certificate")
+	flag.StringVar(&ac.redisTLSKey, "redistlskey", "", "Redis TLS client key")
+	flag.StringVar(&ac.redisCA, "redisca", "", "Redis TLS certificate authority")
+	flag.BoolVar(&ac.redisTLSSkipVerify, "redistlsskipverify", false, "Do not verify the Redis TLS certificate")
+	flag.StringVar(&redisSentinels, "redis-sentinel", "", "Redis Sentinel addresses")
+	flag.StringVar(&ac.redisMasterName, "redis-master", defaultRedisMasterName, "Redis master name, for Redis Sentinel")
 	flag.StringVar(&ac.serverConfScript, "conf", "serverconf.lua", "Server configuration")
+	flag.StringVar(&ac.configFilename, "config", "", "TOML or JSON file with settings")
 	flag.StringVar(&ac.serverLogFile, "log", "", "Server log file")
 	flag.StringVar(&ac.internalLogFilename, "internal", os.DevNull, "Internal log file")
+	flag.StringVar(&ac.tempDir, "tmpdir", "", "Directory for temporary files")
+	flag.StringVar(&uploadPermissions, "uploadperm", "", "File permissions for saved uploads, like 0600")
+	flag.BoolVar(&serveMetrics, "metrics", false, "Serve metrics at /metrics, in the Prometheus text format")
+	flag.BoolVar(&ac.metricsAdminOnly, "metrics-admin", false, "Only serve the metrics to administrators")
+	flag.BoolVar(&serveHealth, "health", false, "Serve health checks at /healthz and /readyz")
+	flag.StringVar(&ac.healthPath, "health-path", "", "Path to serve the health checks below")
+	flag.BoolVar(&ac.dirListing, "dirlist", false, "List the contents of directories without an index file")
+	flag.StringVar(&indexFiles, "index", "", "Filenames to serve for directories, tried in order")
 	flag.BoolVar(&ac.serveJustHTTP2, "http2only", false, "Serve HTTP/2, not HTTPS + HTTP/2")
 	flag.BoolVar(&ac.serveJustHTTP, "httponly", false, "Serve plain old HTTP")
 	flag.BoolVar(&ac.productionMode, "prod", false, "Production mode")
 	flag.BoolVar(&ac.debugMode, "debug", false, "Debug mode")
+	flag.BoolVar(&ac.hideErrors, "hide-errors", false, "Don't show error details to clients")
+	flag.BoolVar(&ac.compressResponses, "compress", false, "Compress responses with gzip or deflate")
+	flag.StringVar(&corsOrigins, "cors", "", "Origins that are allowed to make cross-origin requests")
+	flag.StringVar(&trustedProxies, "trusted-proxies", "", "Proxies that are trusted to set X-Forwarded-For")
+	flag.BoolVar(&ac.allowExec, "allow-exec", false, "Allow Lua scripts to run external commands")
 	flag.BoolVar(&ac.verboseMode, "verbose", false, "Verbose logging")
+	flag.StringVar(&ac.logLevel, "loglevel", "", "Log level (debug, info, warn or error)")
+	flag.StringVar(&ac.logFormat, "logformat", "", "Log format (text or json)")
 	flag.BoolVar(&ac.autoRefresh, "autorefresh", false, "Enable the auto-refresh feature")
 	flag.StringVar(&ac.autoRefreshDir, "watchdir", "", "Directory to watch (also enables auto-refresh)")
 	flag.StringVar(&ac.eventAddr, "eventserver", "", "SSE [host][:port] (ie \""+ac.defaultEventColonPort+"\")")
@@ -185,12 +382,20 @@ func (ac *Config) handleFlags(serverTempDir string) {
 	flag.StringVar(&ac.boltFilename, "boltdb", "", "Bolt database filename")
 	flag.Int64Var(&ac.limitRequests, "limit", ac.defaultLimit, "Limit clients to a number of requests per second")
 	flag.BoolVar(&ac.disableRateLimiting, "nolimit", false, "Disable rate limiting")
+	flag.IntVar(&ac.rateLimit, "ratelimit", 0, "Limit each client IP address to a number of requests per minute")
+	flag.IntVar(&ac.luaPoolSize, "luapool", 0, "Maximum number of pooled Lua states")
+	flag.BoolVar(&ac.luaPoolBlock, "luapoolblock", false, "Wait for a pooled Lua state when all are in use")
 	flag.BoolVar(&ac.devMode, "dev", false, "Development mode")
 	flag.BoolVar(&ac.showVersion, "version", false, "Version")
 	flag.StringVar(&cacheModeString, "cache", "", "Cache everything but Amber, Lua, GCSS and Markdown")
 	flag.Uint64Var(&ac.cacheSize, "cachesize", ac.defaultCacheSize, "Cache size, in bytes")
 	flag.Uint64Var(&ac.largeFileSize, "largesize", ac.defaultLargeFileSize, "Threshold for not reading static files into memory, in bytes")
-	flag.Uint64Var(&ac.writeTimeout, "timeout", 10, "Timeout when writing to a client, in seconds")
+	flag.Uint64Var(&timeoutSeconds, "timeout", 0, "Timeout when writing to a client, in seconds")
+	flag.DurationVar(&ac.readTimeout, "read-timeout", ac.readTimeout, "Timeout when reading a request")
+	flag.DurationVar(&ac.writeTimeout, "write-timeout", ac.writeTimeout, "Timeout when writing a response")
+	flag.DurationVar(&ac.idleTimeout, "idle-timeout", ac.idleTimeout, "Timeout for idle keep-alive connections")
+	flag.DurationVar(&ac.shutdownTimeout, "shutdown-timeout", ac.shutdownTimeout, "How long to wait for requests to complete when shutting down")
+	flag.DurationVar(&ac.httpClientTimeout, "http-client-timeout", ac.httpClientTimeout, "Default timeout for HTTP requests sent from Lua")
 	flag.BoolVar(&ac.quietMode, "quiet", false, "Quiet")
 	flag.BoolVar(&rawCache, "rawcache", false, "Disable cache compression")
 	flag.StringVar(&ac.serverHeaderName, "servername", ac.versionString, "Server header name")
@@ -207,7 +412,9 @@ func (ac *Config) handleFlags(serverTempDir string) {
 	flag.BoolVar(&ac.stricterHeaders, "stricter", false, "Stricter HTTP headers")
 	flag.StringVar(&ac.defaultTheme, "theme", themes.DefaultTheme, "Theme for Markdown and directory listings")
 	flag.BoolVar(&ac.noBanner, "nobanner", false, "Don't show a banner at start")
+	flag.BoolVar(&ac.startupJSON, "startup-json", false, "Output startup info as JSON")
 	flag.BoolVar(&ac.ctrldTwice, "ctrld", false, "Press ctrl-d twice to exit")
+	flag.BoolVar(&ac.noColor, "no-color", false, "Don't use colors in the terminal output")
 	flag.BoolVar(&ac.serveJustQUIC, "quic", false, "Serve just QUIC")
 	flag.BoolVar(&noDatabase, "nodb", false, "No database backend")
 	flag.BoolVar(&ac.serveNothing, "lua", false, "Only present the Lua REPL")
@@ -237,6 +444,29 @@ func (ac *Config) handleFlags(serverTempDir string) {
 
 	flag.Parse()
 
+	// Use the ALGERNON_* environment variables, for the flags that are not
+	// given on the command line
+	applyEnvironment(flag.CommandLine)
+
+	// Use the settings from the configuration file, for the flags that are
+	// neither given on the command line nor in the environment
+	if ac.configFilename != "" {
+		settings, err := readConfigFile(ac.configFilename)
+		if err != nil {
+			ac.fatalExit(err)
+		}
+		applySettings(flag.CommandLine, settings, ac.configFilename)
+	}
+
+	// --timeout=N is the same as --write-timeout=Ns, for backward compatibility
+	given := make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) {
+		given[f.Name] = true
+	})
+	if given["timeout"] && !given["write-timeout"] {
+		ac.writeTimeout = time.Duration(timeoutSeconds) * time.Second
+	}
+
 	// Accept both long and short versions of some flags
 	ac.serveJustHTTP = ac.serveJustHTTP || serveJustHTTPShort
 	ac.autoRefresh = ac.autoRefresh || autoRefreshShort
@@ -252,7 +482,7 @@ func (ac *Config) handleFlags(serverTempDir string) {
 	ac.openURLAfterServing = ac.openURLAfterServing || (ac.openExecutable != "")
 	ac.quitAfterFirstRequest = ac.quitAfterFirstRequest || quitAfterFirstRequestShort
 	ac.verboseMode = ac.verboseMode || verboseModeShort
-	ac.noBanner = ac.noBanner || noBannerShort
+	ac.noBanner = ac.noBanner || noBannerShort || ac.startupJSON
 	ac.serveJustQUIC = ac.serveJustQUIC || serveJustQUICShort
 	ac.serveNothing = ac.serveNothing || serveNothingShort // "Lua mode"
 
@@ -263,9 +493,8 @@ func (ac *Config) handleFlags(serverTempDir string) {
 		ac.quitAfterFirstRequest = true
 	}
 
-	// If only using the Lua REPL, don't include the banner, and don't serve anything
+	// If only using the Lua REPL, don't serve anything
 	if ac.serveNothing {
-		ac.noBanner = true
 		ac.debugMode = true
 		ac.serverConfScript = ""
 	}
@@ -279,19 +508,52 @@ func (ac *Config) handleFlags(serverTempDir string) {
 		ac.ctrldTwice = true
 	}
 
+	// Disable colors if the output is piped to a file or another program
+	if !readline.IsTerminal(int(os.Stdout.Fd())) {
+		ac.noColor = true
+	}
+
 	// Disable verbose mode if quiet mode has been enabled
 	if ac.quietMode {
 		ac.verboseMode = false
 	}
 
+	// Quiet mode only logs errors and verbose mode logs everything,
+	// unless a log level is given
+	if ac.logLevel == "" {
+		switch {
+		case ac.quietMode:
+			ac.logLevel = "error"
+		case ac.verboseMode, ac.devMode:
+			ac.logLevel = "debug"
+		default:
+			ac.logLevel = "info"
+		}
+	}
+	if _, err := parseLogLevel(ac.logLevel); err != nil {
+		ac.fatalExit(err)
+	}
+	ac.logFormat = strings.ToLower(ac.logFormat)
+	if ac.logFormat != "" && ac.logFormat != "text" && ac.logFormat != "json" {
+		ac.fatalExit(fmt.Errorf("invalid log format: %q (must be text or json)", ac.logFormat))
+	}
+
 	// Enable cache compression unless raw cache is specified
 	ac.cacheCompression = !rawCache
 
-	ac.redisAddrSpecified = ac.redisAddr != ""
+	ac.redisSentinels = splitDomains(redisSentinels)
+	ac.redisAddrSpecified = ac.redisAddr != "" || len(ac.redisSentinels) > 0
 	if ac.redisAddr == "" {
 		// The default host and port
 		ac.redisAddr = host + ac.defaultRedisColonPort
 	}
+	if ac.redisPassword == "" {
+		ac.redisPassword = os.Getenv("REDIS_PASSWORD")
+	}
+	if ac.redisPoolSize < 0 {
+		log.Warnf("The Redis connection pool size must be positive, using the default size instead of %d", ac.redisPoolSize)
+		ac.redisPoolSize = 0
+	}
 
 	// May be overridden by devMode
 	if ac.serverMode {
@@ -324,7 +586,9 @@ func (ac *Config) handleFlags(serverTempDir string) {
 		if ac.limitRequests == ac.defaultLimit {
 			ac.limitRequests = 700 // Increase the rate limit considerably
 		}
-		ac.cacheMode = cachemode.Development
+		// Disable caching, so that changes are served right away
+		ac.cacheMode = cachemode.Off
+		ac.cacheFileStat = false
 	case ac.simpleMode:
 		ac.useBolt = true
 		ac.boltFilename = os.DevNull
@@ -335,7 +599,7 @@ func (ac *Config) handleFlags(serverTempDir string) {
 		ac.disableRateLimiting = true
 		ac.clearDefaultPathPrefixes = true
 		ac.noHeaders = true
-		ac.writeTimeout = 3600 * 24
+		ac.writeTimeout = 24 * time.Hour
 	}
 
 	// If a watch directory is given, enable the auto refresh feature
@@ -424,10 +688,12 @@ func (ac *Config) handleFlags(serverTempDir string) {
 			ac.serverAddr = ":" + secondArg
 		} else if len(flag.Args()) >= 3-shift {
 			ac.serverCert = flag.Args()[2-shift]
+			ac.serverCertGiven = true
 		}
 	}
 	if len(flag.Args()) >= 4-shift {
 		ac.serverKey = flag.Args()[3-shift]
+		ac.serverCertGiven = true
 	}
 	if len(flag.Args()) >= 5-shift {
 		ac.redisAddr = flag.Args()[4-shift]
@@ -441,6 +707,52 @@ func (ac *Config) handleFlags(serverTempDir string) {
 		}
 	}
 
+	// Check if a TLS certificate or key has been given, since they can not be
+	// combined with certificates from Let's Encrypt
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == "cert" || f.Name == "key" {
+			ac.serverCertGiven = true
+		}
+	})
+	ac.autoTLSDomains = splitDomains(domains)
+	ac.corsOrigins = splitDomains(corsOrigins)
+	proxies, err := parseTrustedProxies(splitDomains(trustedProxies))
+	if err != nil {
+		ac.fatalExit(fmt.Errorf("Invalid --trusted-proxies: %s", err))
+	}
+	ac.trustedProxies = proxies
+	if serveMetrics || ac.metricsAdminOnly {
+		ac.metrics = newServerMetrics()
+	}
+	if serveHealth && ac.healthPath == "" {
+		ac.healthPath = defaultHealthPath
+	}
+	if ac.healthPath != "" {
+		ac.healthPath = healthPathPrefix(ac.healthPath)
+	}
+	if uploadPermissions != "" {
+		fperm, err := parseFileMode(uploadPermissions)
+		if err != nil {
+			ac.fatalExit(fmt.Errorf("Invalid --uploadperm: %s", err))
+		}
+		ac.uploadPermissions = fperm
+	}
+	if indexFiles != "" {
+		filenames := splitDomains(indexFiles)
+		if err := checkIndexFiles(filenames); err != nil {
+			ac.fatalExit(fmt.Errorf("Invalid --index: %s", err))
+		}
+		ac.indexFilenames = filenames
+	}
+	if ac.tempDir != "" {
+		if err := ac.setTempDir(ac.tempDir); err != nil {
+			ac.fatalExit(fmt.Errorf("Invalid --tmpdir: %s", err))
+		}
+	}
+	if ac.autoTLS && ac.serverCertGiven {
+		ac.fatalExit(errAutoTLSWithCert)
+	}
+
 	// Use the default openExecutable if none is set
 	if ac.openURLAfterServing && ac.openExecutable == "" {
 		ac.openExecutable = ac.defaultOpenExecutable
@@ -451,6 +763,19 @@ func (ac *Config) handleFlags(serverTempDir string) {
 		ac.serverConfigurationFilenames = append(ac.serverConfigurationFilenames, ac.serverConfScript, filepath.Join(ac.serverDirOrFilename, ac.serverConfScript))
 	}
 
+	// Fail early if the server or Redis address has an invalid port
+	if err := checkAddr(ac.serverAddr); err != nil {
+		ac.fatalExit(fmt.Errorf("--addr: %s", err))
+	}
+	if err := checkAddr(ac.redisAddr); err != nil {
+		ac.fatalExit(fmt.Errorf("--redis: %s", err))
+	}
+	for _, sentinel := range ac.redisSentinels {
+		if err := checkAddr(sentinel); err != nil {
+			ac.fatalExit(fmt.Errorf("--redis-sentinel: %s", err))
+		}
+	}
+
 	ac.serverHost = host
 }
 
@@ -461,6 +786,9 @@ func (ac *Config) finalConfiguration(host string) bool {
 	// Set the server host and port (commandline flags overrides Lua configuration)
 	if ac.serverAddr == "" {
 		if ac.serverAddrLua != "" {
+			if err := checkAddr(ac.serverAddrLua); err != nil {
+				ac.fatalExit(fmt.Errorf("SetAddr: %s", err))
+			}
 			ac.serverAddr = ac.serverAddrLua
 		} else {
 			ac.serverAddr = host + ac.defaultWebColonPort
@@ -478,6 +806,11 @@ func (ac *Config) finalConfiguration(host string) bool {
 		ac.debugMode = false
 	}
 
+	// Turn off debug mode if errors should be hidden from clients
+	if ac.hideErrors {
+		ac.debugMode = false
+	}
+
 	hasReadyFunction := ac.serverReadyFunctionLua != nil
 
 	// Run the Lua function specified with the OnReady function, if available
@@ -0,0 +1,92 @@
+package engine
+
+import (
+	"bytes"
+	"flag"
+	"io/ioutil"
+	"os"
+	"runtime"
+	"strings"
+	"testing"
+
+	"github.com/bmizerany/assert"
+)
+
+// newWithArgs calls New with the given command line arguments, and returns
+// what was written to stdout
+func newWithArgs(t *testing.T, args ...string) (string, error) {
+	origArgs, origCommandLine, origStdout := os.Args, flag.CommandLine, os.Stdout
+	defer func() {
+		os.Args, flag.CommandLine, os.Stdout = origArgs, origCommandLine, origStdout
+	}()
+	os.Args = append([]string{"algernon"}, args...)
+	flag.CommandLine = flag.NewFlagSet("algernon", flag.ContinueOnError)
+
+	r, w, err := os.Pipe()
+	assert.Equal(t, err, nil)
+	os.Stdout = w
+	_, err = New("Algernon 1.2.3", "Web Server")
+	w.Close()
+	output, readErr := ioutil.ReadAll(r)
+	assert.Equal(t, readErr, nil)
+	return string(output), err
+}
+
+func TestVersionFlag(t *testing.T) {
+	for _, args := range [][]string{
+		{"--version"},
+		{"-v"},
+		{"--nodb", "--version", "--httponly", "."},
+	} {
+		output, err := newWithArgs(t, args...)
+		assert.Equal(t, err, ErrVersion)
+		lines := strings.Split(strings.TrimSpace(output), "\n")
+		assert.Equal(t, len(lines), 2)
+		assert.Equal(t, lines[0], "Algernon 1.2.3")
+		assert.Equal(t, strings.HasPrefix(lines[1], runtime.Version()+" "), true)
+	}
+
+	// Nothing is written in quiet mode
+	output, err := newWithArgs(t, "--version", "-q")
+	assert.Equal(t, err, ErrVersion)
+	assert.Equal(t, output, "")
+}
+
+func TestVersionInfoBuildDate(t *testing.T) {
+	defer func(orig string) { BuildDate = orig }(BuildDate)
+	BuildDate = "2020-01-02"
+	ac := &Config{versionString: "Algernon 1.2.3"}
+	assert.Equal(t, strings.HasSuffix(ac.versionInfo(), ", built 2020-01-02"), true)
+}
+
+func TestParseFileMode(t *testing.T) {
+	fperm, err := parseFileMode("0600")
+	assert.Equal(t, err, nil)
+	assert.Equal(t, fperm, os.FileMode(0600))
+	fperm, err = parseFileMode("640")
+	assert.Equal(t, err, nil)
+	assert.Equal(t, fperm, os.FileMode(0640))
+	for _, s := range []string{"", "0", "0800", "1777", "rw-r--r--"} {
+		_, err = parseFileMode(s)
+		assert.NotEqual(t, err, nil)
+	}
+}
+
+func TestNoBanner(t *testing.T) {
+	var buf bytes.Buffer
+	ac := &Config{versionString: "Algernon 1.2.3", noColor: true}
+	ac.printBanner(&buf)
+	assert.Equal(t, strings.HasPrefix(buf.String(), "Algernon 1.2.3 - "), true)
+
+	// Nothing is written with --nobanner, --startup-json or in quiet mode
+	for _, ac := range []*Config{
+		{versionString: "Algernon 1.2.3", noBanner: true},
+		{versionString: "Algernon 1.2.3", noBanner: true, noColor: true},
+		{versionString: "Algernon 1.2.3", quietMode: true},
+	} {
+		buf.Reset()
+		ac.printBanner(&buf)
+		ac.printStartupInfo(&buf)
+		assert.Equal(t, buf.String(), "")
+	}
+}
@@ -0,0 +1,71 @@
+package engine
+
+import (
+	"bufio"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/bmizerany/assert"
+	"github.com/xyproto/algernon/lua/pool"
+	"github.com/xyproto/algernon/utils"
+	"github.com/xyproto/datablock"
+)
+
+func TestFlush(t *testing.T) {
+	dir, err := ioutil.TempDir("", "algernon_flush")
+	assert.Equal(t, err, nil)
+	defer os.RemoveAll(dir)
+	assert.Equal(t, ioutil.WriteFile(filepath.Join(dir, "index.lua"), []byte(`
+		print("first")
+		flush()
+		sleep(0.5)
+		print("second")
+	`), 0644), nil)
+
+	for _, debugMode := range []bool{false, true} {
+		ac := &Config{
+			debugMode:           debugMode,
+			disableRateLimiting: true,
+			largeFileSize:       42 * utils.MiB,
+			luapool:             pool.New(),
+		}
+		ac.initializeMime()
+		ac.fs = datablock.NewFileStat(false, time.Minute)
+		ac.cache = datablock.NewFileCache(1*utils.MiB, false, 64*utils.KiB, false, 0)
+		mux := http.NewServeMux()
+		ac.RegisterHandlers(mux, "/", dir, false)
+		done := make(chan struct{})
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			mux.ServeHTTP(w, req)
+			close(done)
+		}))
+
+		resp, err := http.Get(server.URL + "/")
+		assert.Equal(t, err, nil)
+		r := bufio.NewReader(resp.Body)
+		line, err := r.ReadString('\n')
+		assert.Equal(t, err, nil)
+		assert.Equal(t, line, "first\n")
+
+		// The first line is received while the script is sleeping
+		select {
+		case <-done:
+			t.Error("the output was not flushed before the script was done")
+		default:
+		}
+
+		line, err = r.ReadString('\n')
+		assert.Equal(t, err, nil)
+		assert.Equal(t, line, "second\n")
+		resp.Body.Close()
+		<-done
+
+		server.Close()
+		ac.luapool.Shutdown()
+	}
+}
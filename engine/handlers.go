@@ -17,7 +17,6 @@ import (
 	"github.com/xyproto/algernon/themes"
 	"github.com/xyproto/algernon/utils"
 	"github.com/xyproto/datablock"
-	"github.com/xyproto/recwatch"
 	"github.com/xyproto/sheepcounter"
 	"github.com/xyproto/unzip"
 )
@@ -42,6 +41,16 @@ func (ac *Config) ClientCanGzip(req *http.Request) bool {
 	return true
 }
 
+// flushResponse sends the output so far to the client. Does nothing if the
+// ResponseWriter can not be flushed.
+func flushResponse(w http.ResponseWriter) {
+	if sc, ok := w.(*sheepcounter.SheepCounter); ok {
+		// The byte counter for the access log can not flush or be unwrapped
+		w = sc.ResponseWriter()
+	}
+	http.NewResponseController(w).Flush()
+}
+
 // PongoHandler renders and serves a Pongo2 template
 func (ac *Config) PongoHandler(w http.ResponseWriter, req *http.Request, filename, ext string) {
 	w.Header().Add("Content-Type", "text/html;charset=utf-8")
@@ -80,6 +89,8 @@ func (ac *Config) PongoHandler(w http.ResponseWriter, req *http.Request, filenam
 				}
 				// Use the Lua filename as the title
 				ac.PrettyError(w, req, luafilename, luablock.MustData(), err.Error(), "lua")
+			} else if ac.hideErrors {
+				ac.HiddenError(w, luafilename, err.Error())
 			} else {
 				log.Error(err)
 			}
@@ -198,6 +209,8 @@ func (ac *Config) FilePage(w http.ResponseWriter, req *http.Request, filename, d
 				if ac.debugMode {
 					// Use the Lua filename as the title
 					ac.PrettyError(w, req, luafilename, luablock.MustData(), err.Error(), "lua")
+				} else if ac.hideErrors {
+					ac.HiddenError(w, luafilename, err.Error())
 				} else {
 					log.Error(err)
 				}
@@ -243,11 +256,21 @@ func (ac *Config) FilePage(w http.ResponseWriter, req *http.Request, filename, d
 		return
 
 	case ".lua":
+		if ac.etagCaching {
+			// Buffer the output, for adding an ETag and answering
+			// If-None-Match with "304 Not Modified"
+			ew := newETagWriter(w, req)
+			defer ew.Close()
+			w = ew
+		}
+
 		// If in debug mode, let the Lua script print to a buffer first, in
-		// case there are errors that should be displayed instead.
+		// case there are errors that should be displayed instead. The same
+		// goes for when errors are hidden, so that a generic error page can
+		// be displayed instead of partial output.
 
-		// If debug mode is enabled
-		if ac.debugMode {
+		// If debug mode is enabled, or errors are hidden
+		if ac.debugMode || ac.hideErrors {
 			// Use a buffered ResponseWriter for delaying the output
 			recorder := httptest.NewRecorder()
 			// Create a new struct for keeping an optional http header status
@@ -255,10 +278,10 @@ func (ac *Config) FilePage(w http.ResponseWriter, req *http.Request, filename, d
 			// The flush function writes the ResponseRecorder to the ResponseWriter
 			flushFunc := func() {
 				utils.WriteRecorder(w, recorder)
-				recwatch.Flush(w)
+				flushResponse(w)
 			}
 			// Run the lua script, without the possibility to flush
-			if err := ac.RunLua(recorder, req, filename, flushFunc, httpStatus); err != nil {
+			if err := ac.RunLua(recorder, req, filename, flushFunc, httpStatus, false); err != nil {
 				errortext := err.Error()
 				fileblock, err := ac.cache.Read(filename, ac.shouldCache(ext))
 				if err != nil {
@@ -273,6 +296,8 @@ func (ac *Config) FilePage(w http.ResponseWriter, req *http.Request, filename, d
 				// If things went well, check if there is a status code we should write first
 				// (especially for the case of a redirect)
 				if httpStatus.code != 0 {
+					// The headers, like Location, must be set first
+					utils.CopyRecorderHeaders(w, recorder)
 					w.WriteHeader(httpStatus.code)
 				}
 				// Then write to the ResponseWriter
@@ -281,16 +306,12 @@ func (ac *Config) FilePage(w http.ResponseWriter, req *http.Request, filename, d
 		} else {
 			// The flush function just flushes the ResponseWriter
 			flushFunc := func() {
-				recwatch.Flush(w)
+				flushResponse(w)
 			}
 			// Run the lua script, with the flush feature
-			if err := ac.RunLua(w, req, filename, flushFunc, nil); err != nil {
+			if err := ac.RunLua(w, req, filename, flushFunc, nil, true); err != nil {
 				// Output the non-fatal error message to the log
-				if strings.HasPrefix(err.Error(), filename) {
-					log.Error("Error at " + err.Error())
-				} else {
-					log.Error("Error in " + filename + ": " + err.Error())
-				}
+				logError(filename, err.Error())
 			}
 		}
 		return
@@ -398,6 +419,11 @@ func (ac *Config) FilePage(w http.ResponseWriter, req *http.Request, filename, d
 		return
 	}
 
+	// Answer If-Modified-Since with "304 Not Modified", if the file has not changed
+	if ac.etagCaching && checkLastModified(w, req, fInfo.ModTime()) {
+		return
+	}
+
 	// Read the file (possibly in compressed format, straight from the cache)
 	if dataBlock, err := ac.ReadAndLogErrors(w, filename, ext); err == nil { // if no error
 		// Serve the file
@@ -440,11 +466,16 @@ func (ac *Config) RegisterHandlers(mux *http.ServeMux, handlePath, servedir stri
 		// Rejecting requests is handled by the permission system, which
 		// in turn requires a database backend.
 		if ac.perm != nil {
-			if ac.perm.Rejected(w, req) {
+			// The permissions may be replaced when the configuration is reloaded
+			ac.reloadMut.RLock()
+			rejected := ac.perm.Rejected(w, req)
+			denyFunction := ac.perm.DenyFunction()
+			ac.reloadMut.RUnlock()
+			if rejected {
 				// Prepare to count bytes written
 				sc := sheepcounter.New(w)
-				// Get and call the Permission Denied function
-				ac.perm.DenyFunction()(sc, req)
+				// Call the Permission Denied function
+				denyFunction(sc, req)
 				// Log the response
 				ac.LogAccess(req, http.StatusForbidden, sc.Counter())
 				// Reject the request by just returning
@@ -476,6 +507,12 @@ func (ac *Config) RegisterHandlers(mux *http.ServeMux, handlePath, servedir stri
 			ac.ServerHeaders(w)
 		}
 
+		// Never serve files like ".env" or directories like ".git", and only
+		// serve files with the extensions given to SetServableExtensions, if any
+		if deniedURLPath(urlpath) || (!hasdir && hasfile && !ac.servableFile(noslash)) {
+			hasdir, hasfile = false, false
+		}
+
 		// Share the directory or file
 		if hasdir {
 			// Prepare to count bytes written
@@ -0,0 +1,79 @@
+package engine
+
+import (
+	"errors"
+	"net/http"
+	"time"
+
+	redigo "github.com/gomodule/redigo/redis"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// defaultHealthPath is where /healthz and /readyz are served, with --health
+	defaultHealthPath = "/"
+
+	// readyTimeout is how long the readiness check waits for Redis to reply
+	readyTimeout = 2 * time.Second
+)
+
+// errReadyTimeout is returned when Redis does not reply in time
+var errReadyTimeout = errors.New("no reply from Redis within " + readyTimeout.String())
+
+// pingRedis checks that the Redis server replies to PING. Returns nil if
+// Redis is not used as the database backend.
+func (ac *Config) pingRedis() error {
+	pool, ok := ac.redisPool()
+	if !ok {
+		return nil
+	}
+	result := make(chan error, 1)
+	go func() {
+		// Connecting may also hang, so the PING runs in a goroutine
+		conn := pool.Get(ac.redisDBindex)
+		defer conn.Close()
+		_, err := redigo.DoWithTimeout(conn, readyTimeout, "PING")
+		result <- err
+	}()
+	select {
+	case err := <-result:
+		return err
+	case <-time.After(readyTimeout):
+		return errReadyTimeout
+	}
+}
+
+// serveReady replies with "200 OK" if the server is ready to handle
+// requests, or "503 Service Unavailable" if Redis is down
+func (ac *Config) serveReady(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Cache-Control", "no-store")
+	if err := ac.pingRedis(); err != nil {
+		log.Warn("The readiness check failed: ", err)
+		http.Error(w, http.StatusText(http.StatusServiceUnavailable), http.StatusServiceUnavailable)
+		return
+	}
+	w.Write([]byte("ok\n"))
+}
+
+// serveLive replies with "200 OK" for as long as the server is running
+func serveLive(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Cache-Control", "no-store")
+	w.Write([]byte("ok\n"))
+}
+
+// healthHandler wraps the given handler, so that the liveness check is
+// served at healthz and the readiness check at readyz, below --health-path
+func (ac *Config) healthHandler(next http.Handler) http.Handler {
+	livePath := ac.healthPath + "healthz"
+	readyPath := ac.healthPath + "readyz"
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		switch req.URL.Path {
+		case livePath:
+			serveLive(w, req)
+		case readyPath:
+			ac.serveReady(w, req)
+		default:
+			next.ServeHTTP(w, req)
+		}
+	})
+}
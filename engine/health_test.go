@@ -0,0 +1,92 @@
+package engine
+
+import (
+	"net"
+	"net/http"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/bmizerany/assert"
+)
+
+// hangingListener returns connections that stop replying while hanging is set
+type hangingListener struct {
+	net.Listener
+	hanging *int32
+}
+
+func (l *hangingListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &hangingConn{Conn: conn, hanging: l.hanging}, nil
+}
+
+// hangingConn discards the replies while hanging is set
+type hangingConn struct {
+	net.Conn
+	hanging *int32
+}
+
+func (c *hangingConn) Write(b []byte) (int, error) {
+	if atomic.LoadInt32(c.hanging) != 0 {
+		return len(b), nil
+	}
+	return c.Conn.Write(b)
+}
+
+func TestHealthWithoutRedis(t *testing.T) {
+	ac := &Config{healthPath: healthPathPrefix("status")}
+	handler := ac.healthHandler(http.NotFoundHandler())
+
+	rec := get(handler, "/status/healthz")
+	assert.Equal(t, rec.Code, http.StatusOK)
+	assert.Equal(t, rec.Body.String(), "ok\n")
+
+	// Without Redis, the server is always ready
+	rec = get(handler, "/status/readyz")
+	assert.Equal(t, rec.Code, http.StatusOK)
+
+	// Other paths are passed on
+	rec = get(handler, "/healthz")
+	assert.Equal(t, rec.Code, http.StatusNotFound)
+}
+
+func TestHealthWithRedis(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Equal(t, err, nil)
+	defer listener.Close()
+	var hanging int32
+	serveRedis(&hangingListener{Listener: listener, hanging: &hanging}, "hunter2")
+
+	ac := &Config{
+		redisAddr:     listener.Addr().String(),
+		redisPassword: "hunter2",
+		healthPath:    defaultHealthPath,
+	}
+	ac.perm, err = ac.connectRedis()
+	assert.Equal(t, err, nil)
+	handler := ac.healthHandler(http.NotFoundHandler())
+
+	rec := get(handler, "/readyz")
+	assert.Equal(t, rec.Code, http.StatusOK)
+
+	// Redis no longer replies, so the readiness check times out
+	atomic.StoreInt32(&hanging, 1)
+	start := time.Now()
+	rec = get(handler, "/readyz")
+	assert.Equal(t, rec.Code, http.StatusServiceUnavailable)
+	assert.Equal(t, time.Since(start) < readyTimeout+time.Second, true)
+
+	// The liveness check does not depend on Redis
+	rec = get(handler, "/healthz")
+	assert.Equal(t, rec.Code, http.StatusOK)
+}
+
+func TestHealthPathPrefix(t *testing.T) {
+	assert.Equal(t, healthPathPrefix("/"), "/")
+	assert.Equal(t, healthPathPrefix("status"), "/status/")
+	assert.Equal(t, healthPathPrefix("/status/"), "/status/")
+}
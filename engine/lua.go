@@ -10,18 +10,29 @@ import (
 	"github.com/xyproto/algernon/lua/codelib"
 	"github.com/xyproto/algernon/lua/convert"
 	"github.com/xyproto/algernon/lua/datastruct"
+	"github.com/xyproto/algernon/lua/httpclient"
 	"github.com/xyproto/algernon/lua/jnode"
 	"github.com/xyproto/algernon/lua/onthefly"
+	"github.com/xyproto/algernon/lua/passwords"
 	"github.com/xyproto/algernon/lua/pure"
+	"github.com/xyproto/algernon/lua/regex"
+	"github.com/xyproto/algernon/lua/sitemap"
 	"github.com/xyproto/algernon/lua/upload"
 	"github.com/xyproto/algernon/lua/users"
 	"github.com/xyproto/algernon/utils"
 	"github.com/xyproto/gopher-lua"
+	"github.com/xyproto/pinterface"
+	"github.com/xyproto/simpleredis"
 )
 
 // LoadCommonFunctions adds most of the available Lua functions in algernon to
-// the given Lua state struct
-func (ac *Config) LoadCommonFunctions(w http.ResponseWriter, req *http.Request, filename string, L *lua.LState, flushFunc func(), httpStatus *FutureStatus) {
+// the given Lua state struct. hints is used for keeping track of when the
+// response is started, and if early hints can be sent.
+func (ac *Config) LoadCommonFunctions(w http.ResponseWriter, req *http.Request, filename string, L *lua.LState, flushFunc func(), httpStatus *FutureStatus, hints *earlyHints) {
+
+	// Write through the ResponseWriter that keeps track of the response
+	w = hints.writer
+	flushFunc = hints.trackFlush(flushFunc)
 
 	// Make basic functions, like print, available to the Lua script.
 	// Only exports functions that can relate to HTTP responses or requests.
@@ -30,6 +41,9 @@ func (ac *Config) LoadCommonFunctions(w http.ResponseWriter, req *http.Request,
 	// Make other basic functions available
 	ac.LoadBasicSystemFunctions(L)
 
+	// Stop sleeping if the client disconnects
+	loadSleep(L, req.Context())
+
 	// Functions for rendering markdown or amber
 	ac.LoadRenderFunctions(w, req, L)
 
@@ -55,6 +69,18 @@ func (ac *Config) LoadCommonFunctions(w http.ResponseWriter, req *http.Request,
 		datastruct.LoadSet(L, creator)
 		datastruct.LoadHash(L, creator)
 		datastruct.LoadKeyValue(L, creator)
+		datastruct.LoadSortedSet(L)
+		datastruct.LoadPipeline(L)
+		datastruct.LoadNames(L)
+
+		// Statistics for the Redis backend, and publish and subscribe
+		if pool, ok := ac.redisPool(); ok {
+			datastruct.LoadRedis(L, pool, ac.redisDBindex)
+			datastruct.LoadPubSub(L, req.Context())
+		}
+
+		// Sessions, stored in a hash map
+		ac.LoadSessionFunction(w, req, L, creator)
 
 		// For saving and loading Lua functions
 		codelib.Load(L, creator)
@@ -65,9 +91,30 @@ func (ac *Config) LoadCommonFunctions(w http.ResponseWriter, req *http.Request,
 	ac.LoadJFile(L, filepath.Dir(filename))
 	jnode.Load(L)
 
+	// Reading and writing files
+	ac.LoadFileFunctions(L, filepath.Dir(filename))
+
+	// Running external commands
+	ac.LoadExecFunctions(L, filepath.Dir(filename))
+
+	// Rendering html/template templates
+	ac.LoadTemplateFunctions(L, filepath.Dir(filename))
+
 	// Extras
 	pure.Load(L)
 
+	// Password hashing
+	passwords.Load(L)
+
+	// Sitemaps
+	sitemap.Load(L)
+
+	// Sending HTTP requests
+	httpclient.Load(L, ac.httpClientTimeout)
+
+	// Regular expressions
+	regex.Load(L)
+
 	// pprint
 	//exportREPL(L)
 
@@ -77,17 +124,46 @@ func (ac *Config) LoadCommonFunctions(w http.ResponseWriter, req *http.Request,
 	// Cache
 	ac.LoadCacheFunctions(L)
 
+	// Preloading files and URLs
+	ac.LoadPreloadFunctions(L, hints)
+
+	// Cookies
+	ac.LoadCookieFunctions(w, req, L)
+
+	// Serving files
+	ac.LoadServeFileFunction(w, req, L, filepath.Dir(filename), httpStatus)
+
+	// Server-Sent Events
+	ac.LoadEventSourceFunctions(w, req, L, flushFunc)
+
+	// HTTP/2 server push
+	ac.LoadPushFunction(w, req, L)
+
 	// Pages and Tags
 	onthefly.Load(L)
 
 	// File uploads
-	upload.Load(L, w, req, filepath.Dir(filename))
+	upload.Load(L, w, req, filepath.Dir(filename), ac.uploadPermissions)
+}
+
+// redisPool returns the Redis connection pool, if Redis is the database backend
+func (ac *Config) redisPool() (*simpleredis.ConnectionPool, bool) {
+	if ac.perm == nil {
+		return nil, false
+	}
+	userstate, ok := ac.perm.UserState().(interface {
+		Pool() *simpleredis.ConnectionPool
+	})
+	if !ok {
+		return nil, false
+	}
+	return userstate.Pool(), true
 }
 
 // RunLua uses a Lua file as the HTTP handler. Also has access to the userstate
 // and permissions. Returns an error if there was a problem with running the lua
-// script, otherwise nil.
-func (ac *Config) RunLua(w http.ResponseWriter, req *http.Request, filename string, flushFunc func(), fust *FutureStatus) error {
+// script, otherwise nil. earlyHints should be false if w is buffered.
+func (ac *Config) RunLua(w http.ResponseWriter, req *http.Request, filename string, flushFunc func(), fust *FutureStatus, earlyHints bool) error {
 
 	// Retrieve a Lua state
 	L := ac.luapool.Get()
@@ -132,7 +208,7 @@ func (ac *Config) RunLua(w http.ResponseWriter, req *http.Request, filename stri
 
 	// Export functions to the Lua state
 	// Flush can be an uninitialized channel, it is handled in the function.
-	ac.LoadCommonFunctions(w, req, filename, L, flushFunc, fust)
+	ac.LoadCommonFunctions(w, req, filename, L, flushFunc, fust, newEarlyHints(w, req, earlyHints))
 
 	// Run the script and return the error value.
 	// Logging and/or HTTP response is handled elsewhere.
@@ -153,17 +229,36 @@ func (ac *Config) RunConfiguration(filename string, mux *http.ServeMux, withHand
 	// Retrieve a Lua state
 	L := ac.luapool.Get()
 
+	if err := ac.runConfiguration(L, filename, mux, withHandlerFunctions, ac.perm); err != nil {
+		// Close the Lua state
+		L.Close()
+
+		// Logging and/or HTTP response is handled elsewhere
+		return err
+	}
+
+	// Only put the Lua state back if there were no errors
+	ac.luapool.Put(L)
+
+	return nil
+}
+
+// runConfiguration runs a Lua file as a configuration script in the given Lua
+// state. The permission functions in the script use the given perm, which
+// can be nil.
+func (ac *Config) runConfiguration(L *lua.LState, filename string, mux *http.ServeMux, withHandlerFunctions bool, perm pinterface.IPermissions) error {
+
 	// Basic system functions, like log()
 	ac.LoadBasicSystemFunctions(L)
 
 	// If there is a database backend
-	if ac.perm != nil {
+	if perm != nil {
 
 		// Retrieve the userstate
-		userstate := ac.perm.UserState()
+		userstate := perm.UserState()
 
 		// Server configuration functions
-		ac.LoadServerConfigFunctions(L, filename)
+		ac.loadServerConfigFunctions(L, filename, perm)
 
 		creator := userstate.Creator()
 
@@ -172,6 +267,14 @@ func (ac *Config) RunConfiguration(filename string, mux *http.ServeMux, withHand
 		datastruct.LoadSet(L, creator)
 		datastruct.LoadHash(L, creator)
 		datastruct.LoadKeyValue(L, creator)
+		datastruct.LoadSortedSet(L)
+		datastruct.LoadPipeline(L)
+		datastruct.LoadNames(L)
+
+		// Statistics for the Redis backend
+		if pool, ok := ac.redisPool(); ok {
+			datastruct.LoadRedis(L, pool, ac.redisDBindex)
+		}
 
 		// For saving and loading Lua functions
 		codelib.Load(L, creator)
@@ -182,15 +285,39 @@ func (ac *Config) RunConfiguration(filename string, mux *http.ServeMux, withHand
 	ac.LoadJFile(L, filepath.Dir(filename))
 	jnode.Load(L)
 
+	// Reading and writing files
+	ac.LoadFileFunctions(L, filepath.Dir(filename))
+
+	// Running external commands
+	ac.LoadExecFunctions(L, filepath.Dir(filename))
+
+	// Rendering html/template templates
+	ac.LoadTemplateFunctions(L, filepath.Dir(filename))
+
 	// Extras
 	pure.Load(L)
 
+	// Password hashing
+	passwords.Load(L)
+
+	// Sitemaps
+	sitemap.Load(L)
+
+	// Sending HTTP requests
+	httpclient.Load(L, ac.httpClientTimeout)
+
+	// Regular expressions
+	regex.Load(L)
+
 	// Plugins
 	ac.LoadPluginFunctions(L, nil)
 
 	// Cache
 	ac.LoadCacheFunctions(L)
 
+	// Preloading files into the cache
+	ac.LoadPreloadFunctions(L, nil)
+
 	// Pages and Tags
 	onthefly.Load(L)
 
@@ -200,18 +327,7 @@ func (ac *Config) RunConfiguration(filename string, mux *http.ServeMux, withHand
 	}
 
 	// Run the script
-	if err := L.DoFile(filename); err != nil {
-		// Close the Lua state
-		L.Close()
-
-		// Logging and/or HTTP response is handled elsewhere
-		return err
-	}
-
-	// Only put the Lua state back if there were no errors
-	ac.luapool.Put(L)
-
-	return nil
+	return L.DoFile(filename)
 }
 
 /*LuaFunctionMap returns the functions available in the given Lua code as
@@ -233,7 +349,9 @@ func (ac *Config) LuaFunctionMap(w http.ResponseWriter, req *http.Request, luada
 	funcs := make(template.FuncMap)
 
 	// Give no filename (an empty string will be handled correctly by the function).
-	ac.LoadCommonFunctions(w, req, filename, L, nil, nil)
+	// The functions may be called while the response is being written, so
+	// early hints are not sent.
+	ac.LoadCommonFunctions(w, req, filename, L, nil, nil, newEarlyHints(w, req, false))
 
 	// Run the script
 	if err := L.DoString(string(luadata)); err != nil {
@@ -289,7 +407,7 @@ func (ac *Config) LuaFunctionMap(w http.ResponseWriter, req *http.Request, luada
 					defer L2.Close()
 
 					// Set up a new Lua state with the current http.ResponseWriter and *http.Request
-					ac.LoadCommonFunctions(w, req, filename, L2, nil, nil)
+					ac.LoadCommonFunctions(w, req, filename, L2, nil, nil, newEarlyHints(w, req, false))
 
 					// Push the Lua function to run
 					L2.Push(luaFunc)
@@ -1,12 +1,15 @@
 package engine
 
 import (
+	"fmt"
 	"net/http"
 	"path/filepath"
+	"strings"
 	"sync"
 
 	"github.com/didip/tollbooth"
 	log "github.com/sirupsen/logrus"
+	"github.com/xyproto/algernon/lua/sitemap"
 	"github.com/xyproto/algernon/themes"
 	"github.com/xyproto/gopher-lua"
 )
@@ -17,6 +20,18 @@ func (ac *Config) LoadLuaHandlerFunctions(L *lua.LState, filename string, mux *h
 
 	luahandlermutex := &sync.RWMutex{}
 
+	// Register a handler, with rate limiting if it is enabled
+	registerHandler := func(handlePath string, handlerFunc http.HandlerFunc) {
+		if ac.disableRateLimiting {
+			mux.HandleFunc(handlePath, handlerFunc)
+		} else {
+			limiter := tollbooth.NewLimiter(float64(ac.limitRequests), nil)
+			limiter.SetMessage(themes.MessagePage("Rate-limit exceeded", "<div style='color:red'>You have reached the maximum request limit.</div>", theme))
+			limiter.SetMessageContentType("text/html;charset=utf-8")
+			mux.Handle(handlePath, tollbooth.LimitFuncHandler(limiter, handlerFunc))
+		}
+	}
+
 	L.SetGlobal("handle", L.NewFunction(func(L *lua.LState) int {
 
 		handlePath := L.ToString(1)
@@ -29,7 +44,7 @@ func (ac *Config) LoadLuaHandlerFunctions(L *lua.LState, filename string, mux *h
 
 			// Set up a new Lua state with the current http.ResponseWriter and *http.Request
 			luahandlermutex.Lock()
-			ac.LoadCommonFunctions(w, req, filename, L, nil, httpStatus)
+			ac.LoadCommonFunctions(w, req, filename, L, nil, httpStatus, newEarlyHints(w, req, true))
 			luahandlermutex.Unlock()
 
 			// Then run the given Lua function
@@ -45,16 +60,81 @@ func (ac *Config) LoadLuaHandlerFunctions(L *lua.LState, filename string, mux *h
 			}
 		}
 
-		// Handle requests differently depending on if rate limiting is enabled or not
-		if ac.disableRateLimiting {
-			mux.HandleFunc(handlePath, wrappedHandleFunc)
-		} else {
-			limiter := tollbooth.NewLimiter(float64(ac.limitRequests), nil)
-			limiter.SetMessage(themes.MessagePage("Rate-limit exceeded", "<div style='color:red'>You have reached the maximum request limit.</div>", theme))
-			limiter.SetMessageContentType("text/html;charset=utf-8")
-			mux.Handle(handlePath, tollbooth.LimitFuncHandler(limiter, wrappedHandleFunc))
+		registerHandler(handlePath, wrappedHandleFunc)
+
+		return 0 // number of results
+	}))
+
+	// Serve a sitemap with the given URLs, at /sitemap.xml or at the given
+	// path. If there are more URLs than fits in one sitemap, or than the
+	// optional maximum number of URLs per sitemap, the URLs are split into
+	// several sitemaps (sitemap-1.xml, sitemap-2.xml etc.) and a sitemap index
+	// is served instead. Returns true, or false and an error message.
+	L.SetGlobal("servesitemap", L.NewFunction(func(L *lua.LState) int {
+		urls := sitemap.Table2URLs(L.CheckTable(1))
+		sitemapPath := L.OptString(2, "/sitemap.xml")
+		maxURLs := L.OptInt(3, sitemap.MaxURLs)
+
+		parts := sitemap.Split(urls, maxURLs)
+		pages := make([][]byte, len(parts))
+		for i, part := range parts {
+			data, err := sitemap.Render(part)
+			if err != nil {
+				L.Push(lua.LBool(false))
+				L.Push(lua.LString(err.Error()))
+				return 2 // number of results
+			}
+			pages[i] = data
+		}
+
+		if len(pages) == 1 {
+			registerHandler(sitemapPath, xmlHandler(pages[0]))
+			L.Push(lua.LBool(true))
+			return 1 // number of results
 		}
 
+		// Serve the parts, and a sitemap index that refers to them
+		var pagePaths []string
+		for i, data := range pages {
+			pagePath := fmt.Sprintf("%s-%d.xml", strings.TrimSuffix(sitemapPath, ".xml"), i+1)
+			registerHandler(pagePath, xmlHandler(data))
+			pagePaths = append(pagePaths, pagePath)
+		}
+		registerHandler(sitemapPath, func(w http.ResponseWriter, req *http.Request) {
+			// The locations in a sitemap index must be absolute URLs
+			scheme := "http://"
+			if req.TLS != nil {
+				scheme = "https://"
+			}
+			sitemaps := make([]sitemap.Sitemap, len(pagePaths))
+			for i, pagePath := range pagePaths {
+				sitemaps[i] = sitemap.Sitemap{Loc: scheme + req.Host + pagePath}
+			}
+			data, err := sitemap.RenderIndex(sitemaps)
+			if err != nil {
+				log.Error("Could not render the sitemap index: ", err)
+				http.Error(w, "Could not render the sitemap index", http.StatusInternalServerError)
+				return
+			}
+			xmlHandler(data)(w, req)
+		})
+		L.Push(lua.LBool(true))
+		return 1 // number of results
+	}))
+
+	// Handle WebSocket connections at the given path with the given function,
+	// which is called with a connection that has send, receive and close
+	// methods. Each connection runs the function in a separate Lua state.
+	L.SetGlobal("WebSocketHandler", L.NewFunction(func(L *lua.LState) int {
+		handlePath := L.CheckString(1)
+		handleFunc := L.CheckFunction(2)
+		if handleFunc.Proto == nil {
+			L.ArgError(2, "Lua function expected")
+		}
+		if handleFunc.Proto.NumUpvalues > 0 {
+			L.ArgError(2, errWebSocketUpvalues.Error())
+		}
+		registerHandler(handlePath, ac.webSocketHandler(handlePath, handleFunc))
 		return 0 // number of results
 	}))
 
@@ -69,3 +149,11 @@ func (ac *Config) LoadLuaHandlerFunctions(L *lua.LState, filename string, mux *h
 	}))
 
 }
+
+// xmlHandler returns a handler that serves the given XML document
+func xmlHandler(data []byte) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "application/xml;charset=utf-8")
+		w.Write(data)
+	}
+}
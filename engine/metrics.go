@@ -0,0 +1,147 @@
+package engine
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// metricsPath is the URL path where the metrics are served, with --metrics
+const metricsPath = "/metrics"
+
+// durationBuckets are the upper bounds of the request duration histogram,
+// in seconds. These are the same as the default buckets in Prometheus.
+var durationBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// serverMetrics keeps track of the requests, for the metrics endpoint
+type serverMetrics struct {
+	mut               sync.Mutex
+	requests          uint64
+	responses         map[int]uint64 // per status code
+	durationBuckets   []uint64       // per upper bound in durationBuckets
+	durationSum       float64        // in seconds
+	uploadedBytes     int64          // from the Content-Length of the requests
+	activeConnections int64
+}
+
+func newServerMetrics() *serverMetrics {
+	return &serverMetrics{
+		responses:       make(map[int]uint64),
+		durationBuckets: make([]uint64, len(durationBuckets)),
+	}
+}
+
+// observe counts a request, with the status code of the response and how
+// long it took to handle the request
+func (m *serverMetrics) observe(req *http.Request, code int, duration time.Duration) {
+	seconds := duration.Seconds()
+	m.mut.Lock()
+	defer m.mut.Unlock()
+	m.requests++
+	m.responses[code]++
+	m.durationSum += seconds
+	for i, upperBound := range durationBuckets {
+		if seconds <= upperBound {
+			m.durationBuckets[i]++
+		}
+	}
+	if req.ContentLength > 0 {
+		m.uploadedBytes += req.ContentLength
+	}
+}
+
+// connState keeps track of the number of open connections, for use as
+// http.Server.ConnState
+func (m *serverMetrics) connState(conn net.Conn, state http.ConnState) {
+	m.mut.Lock()
+	defer m.mut.Unlock()
+	switch state {
+	case http.StateNew:
+		m.activeConnections++
+	case http.StateHijacked, http.StateClosed:
+		m.activeConnections--
+	}
+}
+
+// writeMetric writes a metric with a single value, in the Prometheus text format
+func writeMetric(w io.Writer, name, kind, help string, value interface{}) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n%s %v\n", name, help, name, kind, name, value)
+}
+
+// formatFloat formats a float the way Prometheus does
+func formatFloat(f float64) string {
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
+// writeMetrics writes the metrics in the Prometheus text format
+func (ac *Config) writeMetrics(w io.Writer) {
+	m := ac.metrics
+	m.mut.Lock()
+	defer m.mut.Unlock()
+
+	writeMetric(w, "algernon_requests_total", "counter", "The number of handled HTTP requests.", m.requests)
+
+	fmt.Fprint(w, "# HELP algernon_responses_total The number of HTTP responses, per status code.\n# TYPE algernon_responses_total counter\n")
+	codes := make([]int, 0, len(m.responses))
+	for code := range m.responses {
+		codes = append(codes, code)
+	}
+	sort.Ints(codes)
+	for _, code := range codes {
+		fmt.Fprintf(w, "algernon_responses_total{code=\"%d\"} %d\n", code, m.responses[code])
+	}
+
+	fmt.Fprint(w, "# HELP algernon_request_duration_seconds How long it took to handle the HTTP requests.\n# TYPE algernon_request_duration_seconds histogram\n")
+	for i, upperBound := range durationBuckets {
+		fmt.Fprintf(w, "algernon_request_duration_seconds_bucket{le=\"%s\"} %d\n", formatFloat(upperBound), m.durationBuckets[i])
+	}
+	fmt.Fprintf(w, "algernon_request_duration_seconds_bucket{le=\"+Inf\"} %d\n", m.requests)
+	fmt.Fprintf(w, "algernon_request_duration_seconds_sum %s\n", formatFloat(m.durationSum))
+	fmt.Fprintf(w, "algernon_request_duration_seconds_count %d\n", m.requests)
+
+	writeMetric(w, "algernon_uploaded_bytes_total", "counter", "The number of bytes in the bodies of the HTTP requests, according to Content-Length.", m.uploadedBytes)
+	writeMetric(w, "algernon_active_connections", "gauge", "The number of open HTTP connections.", m.activeConnections)
+
+	if ac.luapool != nil {
+		stats := ac.luapool.Stats()
+		writeMetric(w, "algernon_lua_states_in_use", "gauge", "The number of Lua states that are in use.", stats.InUse)
+		writeMetric(w, "algernon_lua_states_idle", "gauge", "The number of Lua states that are ready to be used.", stats.Idle)
+		writeMetric(w, "algernon_lua_pool_size", "gauge", "The maximum number of Lua states, 0 is unlimited.", stats.Size)
+	}
+}
+
+// serveMetrics serves the metrics in the Prometheus text format. With
+// --metrics-admin, only logged in administrators can see the metrics.
+func (ac *Config) serveMetrics(w http.ResponseWriter, req *http.Request) {
+	if ac.metricsAdminOnly {
+		if ac.perm == nil || !ac.perm.UserState().AdminRights(req) {
+			http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+			return
+		}
+	}
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	ac.writeMetrics(w)
+}
+
+// metricsHandler wraps the given handler, so that the requests are counted
+// and the metrics are served at /metrics
+func (ac *Config) metricsHandler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path == metricsPath {
+			ac.serveMetrics(w, req)
+			return
+		}
+		start := time.Now()
+		cw := &codeWriter{ResponseWriter: w}
+		next.ServeHTTP(cw, req)
+		if cw.code == 0 {
+			cw.code = http.StatusOK
+		}
+		ac.metrics.observe(req, cw.code, time.Since(start))
+	})
+}
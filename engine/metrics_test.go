@@ -0,0 +1,79 @@
+package engine
+
+import (
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/bmizerany/assert"
+	"github.com/xyproto/algernon/lua/pool"
+)
+
+// scrape returns the metrics from the given server address
+func scrape(t *testing.T, addr string) string {
+	resp, err := http.Get("http://" + addr + metricsPath)
+	assert.Equal(t, err, nil)
+	defer resp.Body.Close()
+	assert.Equal(t, resp.StatusCode, http.StatusOK)
+	assert.Equal(t, strings.HasPrefix(resp.Header.Get("Content-Type"), "text/plain; version=0.0.4"), true)
+	body, err := ioutil.ReadAll(resp.Body)
+	assert.Equal(t, err, nil)
+	return string(body)
+}
+
+func TestMetrics(t *testing.T) {
+	ac := &Config{metrics: newServerMetrics(), luapool: pool.New()}
+	defer ac.luapool.Shutdown()
+	mux := http.NewServeMux()
+	mux.HandleFunc("/hello", func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte("hello"))
+	})
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Equal(t, err, nil)
+	server := ac.NewGracefulServer(mux, false, listener.Addr().String())
+	go server.Serve(listener)
+	defer server.Close()
+	addr := listener.Addr().String()
+
+	before := scrape(t, addr)
+	assert.Equal(t, strings.Contains(before, "algernon_requests_total 0\n"), true)
+	assert.Equal(t, strings.Contains(before, "algernon_lua_states_in_use 0\n"), true)
+
+	for _, urlpath := range []string{"/hello", "/hello", "/missing"} {
+		resp, err := http.Get("http://" + addr + urlpath)
+		assert.Equal(t, err, nil)
+		ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+	}
+	resp, err := http.Post("http://"+addr+"/hello", "text/plain", strings.NewReader("12345"))
+	assert.Equal(t, err, nil)
+	resp.Body.Close()
+
+	// The scraping itself is not counted
+	after := scrape(t, addr)
+	for _, line := range []string{
+		"# TYPE algernon_requests_total counter\nalgernon_requests_total 4\n",
+		`algernon_responses_total{code="200"} 3` + "\n",
+		`algernon_responses_total{code="404"} 1` + "\n",
+		`algernon_request_duration_seconds_bucket{le="10"} 4` + "\n",
+		`algernon_request_duration_seconds_bucket{le="+Inf"} 4` + "\n",
+		"algernon_request_duration_seconds_count 4\n",
+		"algernon_uploaded_bytes_total 5\n",
+	} {
+		assert.Equal(t, strings.Contains(after, line), true)
+	}
+	// The client keeps the connection open
+	assert.Equal(t, strings.Contains(after, "algernon_active_connections 1\n"), true)
+}
+
+func TestMetricsAdminOnly(t *testing.T) {
+	ac := &Config{metrics: newServerMetrics(), metricsAdminOnly: true}
+	rec := httptest.NewRecorder()
+	ac.metricsHandler(http.NotFoundHandler()).ServeHTTP(rec, httptest.NewRequest("GET", metricsPath, nil))
+	assert.Equal(t, rec.Code, http.StatusForbidden)
+	assert.Equal(t, strings.Contains(rec.Body.String(), "algernon_"), false)
+}
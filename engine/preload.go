@@ -0,0 +1,190 @@
+package engine
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/xyproto/gopher-lua"
+)
+
+// linkEscaper percent-escapes the characters that would otherwise end the
+// URL part of a Link header value, or split it into several links
+var linkEscaper = strings.NewReplacer(
+	"<", "%3C",
+	">", "%3E",
+	";", "%3B",
+	",", "%2C",
+	"\"", "%22",
+	" ", "%20",
+)
+
+// isToken checks if the given string is a non-empty HTTP token, as used for
+// the "as" parameter in a Link header
+func isToken(s string) bool {
+	if s == "" {
+		return false
+	}
+	for _, r := range s {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9':
+		case strings.ContainsRune("!#$%&'*+-.^_`|~", r):
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// linkPreloadValue returns a value for the Link header that asks the client
+// to preload the given URL, for instance "</style.css>; rel=preload; as=style".
+// Returns false if the URL is empty or contains control characters, or if the
+// type is not empty and not a valid token.
+func linkPreloadValue(url, asType string) (string, bool) {
+	if url == "" || strings.IndexFunc(url, func(r rune) bool { return r < ' ' || r == 0x7f }) != -1 {
+		return "", false
+	}
+	value := "<" + linkEscaper.Replace(url) + ">; rel=preload"
+	if asType == "" {
+		return value, true
+	}
+	if !isToken(asType) {
+		return "", false
+	}
+	return value + "; as=" + asType, true
+}
+
+// earlyHints keeps track of the Link headers and "103 Early Hints" responses
+// for a single request
+type earlyHints struct {
+	w       http.ResponseWriter
+	writer  http.ResponseWriter // w, wrapped in a hintsWriter
+	allowed bool                // can informational responses be written to w
+	started bool                // has the final response header or body been written
+	// has the response been completed by a redirect or by serving a file,
+	// after which any other output is discarded
+	completed bool
+}
+
+// newEarlyHints wraps the given ResponseWriter in a ResponseWriter that keeps
+// track of when the final response is started. "103 Early Hints" responses are
+// only sent if allowed is true and the client supports it. allowed should be
+// false if the response is buffered, or might already have been started.
+func newEarlyHints(w http.ResponseWriter, req *http.Request, allowed bool) *earlyHints {
+	hints := &earlyHints{
+		w:       w,
+		allowed: allowed && req.ProtoAtLeast(1, 1),
+	}
+	hints.writer = &hintsWriter{w, hints}
+	return hints
+}
+
+// trackFlush returns a flush function that also marks the response as started
+func (hints *earlyHints) trackFlush(flushFunc func()) func() {
+	if flushFunc == nil {
+		return nil
+	}
+	return func() {
+		hints.started = true
+		flushFunc()
+	}
+}
+
+// headerSent checks if the response header has already been sent to the
+// client, after which it is too late to change the headers. Buffered
+// responses are sent later on, so they can always be changed.
+func (hints *earlyHints) headerSent() bool {
+	if _, buffered := hints.w.(*httptest.ResponseRecorder); buffered {
+		return false
+	}
+	return hints.started
+}
+
+// preload adds a Link header for preloading the given URL to the response.
+// If the final response has not been started yet, a "103 Early Hints" response
+// with only the new Link header is sent as well. Returns false if the given URL
+// or type are invalid.
+func (hints *earlyHints) preload(url, asType string) bool {
+	value, ok := linkPreloadValue(url, asType)
+	if !ok {
+		return false
+	}
+	header := hints.w.Header()
+	if hints.allowed && !hints.started {
+		// All headers in the header map are sent with an informational
+		// response, so set the new Link header aside and restore the rest.
+		saved := make(http.Header, len(header))
+		for key, values := range header {
+			saved[key] = values
+			delete(header, key)
+		}
+		header.Set("Link", value)
+		hints.w.WriteHeader(http.StatusEarlyHints)
+		delete(header, "Link")
+		for key, values := range saved {
+			header[key] = values
+		}
+	}
+	header.Add("Link", value)
+	return true
+}
+
+// hintsWriter is a http.ResponseWriter that marks the response as started
+// when the final header or any of the body is written
+type hintsWriter struct {
+	http.ResponseWriter
+	hints *earlyHints
+}
+
+// WriteHeader marks the response as started, unless the status code is for an
+// informational response. Does nothing after a redirect or a served file.
+func (hw *hintsWriter) WriteHeader(code int) {
+	if hw.hints.completed {
+		return
+	}
+	if code >= 200 {
+		hw.hints.started = true
+	}
+	hw.ResponseWriter.WriteHeader(code)
+}
+
+// Write marks the response as started and writes to the ResponseWriter.
+// The output is discarded after a redirect or a served file.
+func (hw *hintsWriter) Write(b []byte) (int, error) {
+	if hw.hints.completed {
+		return len(b), nil
+	}
+	hw.hints.started = true
+	return hw.ResponseWriter.Write(b)
+}
+
+// Unwrap returns the wrapped ResponseWriter, for use with http.ResponseController
+func (hw *hintsWriter) Unwrap() http.ResponseWriter {
+	return hw.ResponseWriter
+}
+
+// LoadPreloadFunctions makes the preload function available to the given Lua
+// state. With one argument, the given file is loaded into the file cache.
+// With two arguments, a "Link: rel=preload" header is added to the response.
+// hints may be nil, if there is no response, as is the case for
+// configuration scripts and the REPL.
+func (ac *Config) LoadPreloadFunctions(L *lua.LState, hints *earlyHints) {
+
+	// Load a file into the file cache, or preload the given URL by adding a
+	// Link header to the response, and possibly sending early hints.
+	L.SetGlobal("preload", L.NewFunction(func(L *lua.LState) int {
+		if L.GetTop() < 2 {
+			L.Push(lua.LBool(ac.preloadFile(L.ToString(1))))
+			return 1 // number of results
+		}
+		if hints == nil {
+			log.Warn("preload: there is no response to add a Link header to")
+			L.Push(lua.LBool(false))
+			return 1 // number of results
+		}
+		L.Push(lua.LBool(hints.preload(L.ToString(1), L.ToString(2))))
+		return 1 // number of results
+	}))
+
+}
@@ -0,0 +1,101 @@
+package engine
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/http/httptrace"
+	"net/textproto"
+	"testing"
+
+	"github.com/bmizerany/assert"
+	"github.com/xyproto/algernon/lua/pool"
+)
+
+// preloadTest serves testdata/preload.lua and returns the final response,
+// together with the Link headers of every "103 Early Hints" response
+func preloadTest(t *testing.T, debugMode bool) (*http.Response, [][]string) {
+	ac := &Config{debugMode: debugMode}
+
+	// Lua LState pool
+	ac.luapool = pool.New()
+	defer ac.luapool.Shutdown()
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		ac.FilePage(w, req, "testdata/preload.lua", "")
+	}))
+	defer server.Close()
+
+	var hints [][]string
+	trace := &httptrace.ClientTrace{
+		Got1xxResponse: func(code int, header textproto.MIMEHeader) error {
+			if code == http.StatusEarlyHints {
+				// Only the Link header should be sent with early hints
+				assert.Equal(t, header.Get("X-Preload-Test"), "")
+				hints = append(hints, header["Link"])
+			}
+			return nil
+		},
+	}
+	req, err := http.NewRequest("GET", server.URL, nil)
+	assert.Equal(t, err, nil)
+	req = req.WithContext(httptrace.WithClientTrace(req.Context(), trace))
+
+	resp, err := http.DefaultClient.Do(req)
+	assert.Equal(t, err, nil)
+	resp.Body.Close()
+
+	return resp, hints
+}
+
+func TestPreload(t *testing.T) {
+	resp, hints := preloadTest(t, false)
+	assert.Equal(t, resp.StatusCode, http.StatusOK)
+	assert.Equal(t, resp.Header.Get("X-Preload-Test"), "1")
+
+	// The Link headers added before the output started
+	assert.Equal(t, resp.Header["Link"], []string{
+		"</style.css>; rel=preload; as=style",
+		"</app.js>; rel=preload; as=script",
+	})
+
+	// One early hint per preload, each with only the new Link header
+	assert.Equal(t, hints, [][]string{
+		{"</style.css>; rel=preload; as=style"},
+		{"</app.js>; rel=preload; as=script"},
+	})
+}
+
+func TestPreloadDebugMode(t *testing.T) {
+	resp, hints := preloadTest(t, true)
+	assert.Equal(t, resp.StatusCode, http.StatusOK)
+	assert.Equal(t, resp.Header.Get("X-Preload-Test"), "1")
+
+	// The response is buffered, so all Link headers are kept
+	assert.Equal(t, resp.Header["Link"], []string{
+		"</style.css>; rel=preload; as=style",
+		"</app.js>; rel=preload; as=script",
+		"</late.png>; rel=preload; as=image",
+	})
+
+	// No early hints are sent for buffered responses
+	assert.Equal(t, len(hints), 0)
+}
+
+func TestLinkPreloadValue(t *testing.T) {
+	value, ok := linkPreloadValue("/style.css", "style")
+	assert.Equal(t, ok, true)
+	assert.Equal(t, value, "</style.css>; rel=preload; as=style")
+
+	value, ok = linkPreloadValue("/a>; rel=next, </b", "")
+	assert.Equal(t, ok, true)
+	assert.Equal(t, value, "</a%3E%3B%20rel=next%2C%20%3C/b>; rel=preload")
+
+	_, ok = linkPreloadValue("/style.css", "style; rel=next")
+	assert.Equal(t, ok, false)
+
+	_, ok = linkPreloadValue("/style.css\r\nX-Test: 1", "style")
+	assert.Equal(t, ok, false)
+
+	_, ok = linkPreloadValue("", "style")
+	assert.Equal(t, ok, false)
+}
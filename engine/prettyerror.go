@@ -6,6 +6,7 @@ import (
 	"strconv"
 	"strings"
 
+	log "github.com/sirupsen/logrus"
 	"github.com/xyproto/algernon/utils"
 )
 
@@ -34,11 +35,35 @@ func errorPageTitle(lang string) string {
 	}
 }
 
+// logError logs an error message that is related to the given file
+func logError(filename, errormessage string) {
+	if strings.HasPrefix(errormessage, filename) {
+		log.Error("Error at " + errormessage)
+	} else {
+		log.Error("Error in " + filename + ": " + errormessage)
+	}
+}
+
+// HiddenError logs the error message and serves a generic error page,
+// without any details that could reveal the internals of the server.
+// Used instead of PrettyError when --hide-errors is given.
+func (ac *Config) HiddenError(w http.ResponseWriter, filename, errormessage string) {
+	logError(filename, errormessage)
+	http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+}
+
 // PrettyError serves an informative error page to the user
 // Takes a ResponseWriter, title (can be empty), filename, filebytes, errormessage and
 // programming/scripting/template language (i.e. "lua". Can be empty).
+// If --hide-errors is given, a generic error page is served instead.
 func (ac *Config) PrettyError(w http.ResponseWriter, req *http.Request, filename string, filebytes []byte, errormessage, lang string) {
 
+	if ac.hideErrors {
+		ac.HiddenError(w, filename, errormessage)
+		return
+	}
+	logError(filename, errormessage)
+
 	// HTTP status
 	//w.WriteHeader(http.StatusInternalServerError)
 	w.WriteHeader(http.StatusOK)
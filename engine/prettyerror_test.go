@@ -0,0 +1,64 @@
+package engine
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bmizerany/assert"
+	log "github.com/sirupsen/logrus"
+	"github.com/xyproto/algernon/lua/pool"
+	"github.com/xyproto/algernon/utils"
+	"github.com/xyproto/datablock"
+)
+
+// failingScript serves testdata/errors/fail.lua with the given settings.
+// Returns the response and the log output.
+func failingScript(debugMode, hideErrors bool) (*httptest.ResponseRecorder, string) {
+	ac := &Config{
+		debugMode:           debugMode,
+		hideErrors:          hideErrors,
+		disableRateLimiting: true,
+		largeFileSize:       42 * utils.MiB,
+		luapool:             pool.New(),
+	}
+	defer ac.luapool.Shutdown()
+	ac.initializeMime()
+	ac.fs = datablock.NewFileStat(false, time.Minute)
+	ac.cache = datablock.NewFileCache(1*utils.MiB, false, 64*utils.KiB, false, 0)
+
+	var logbuf bytes.Buffer
+	defer log.SetOutput(log.StandardLogger().Out)
+	log.SetOutput(&logbuf)
+
+	mux := http.NewServeMux()
+	ac.RegisterHandlers(mux, "/", "testdata/errors", false)
+
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, httptest.NewRequest("GET", "/fail.lua", nil))
+	return w, logbuf.String()
+}
+
+func TestHideErrors(t *testing.T) {
+	// The client only gets a generic error message
+	w, logged := failingScript(false, true)
+	assert.Equal(t, w.Code, http.StatusInternalServerError)
+	assert.Equal(t, strings.TrimSpace(w.Body.String()), http.StatusText(http.StatusInternalServerError))
+	assert.Equal(t, strings.Contains(logged, "attempt to index"), true)
+
+	// Hiding errors takes precedence over debug mode
+	w, logged = failingScript(true, true)
+	assert.Equal(t, w.Code, http.StatusInternalServerError)
+	assert.Equal(t, strings.Contains(w.Body.String(), "attempt to index"), false)
+	assert.Equal(t, strings.Contains(logged, "attempt to index"), true)
+}
+
+func TestShowErrors(t *testing.T) {
+	// In debug mode, the client gets the details
+	w, logged := failingScript(true, false)
+	assert.Equal(t, strings.Contains(w.Body.String(), "attempt to index"), true)
+	assert.Equal(t, strings.Contains(logged, "attempt to index"), true)
+}
@@ -0,0 +1,89 @@
+package engine
+
+import (
+	"errors"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/xyproto/gopher-lua"
+)
+
+// The request headers that are passed on to pushed requests
+var pushHeaders = []string{"Accept-Encoding", "Accept-Language", "Cookie"}
+
+// findPusher unwraps the given ResponseWriter until one that supports
+// HTTP/2 server push is found. Returns nil if server push is not supported,
+// for instance for HTTP/1.1 or when the output is buffered.
+func findPusher(w http.ResponseWriter) http.Pusher {
+	for {
+		if pusher, ok := w.(http.Pusher); ok {
+			return pusher
+		}
+		unwrapper, ok := w.(interface{ Unwrap() http.ResponseWriter })
+		if !ok {
+			return nil
+		}
+		w = unwrapper.Unwrap()
+	}
+}
+
+// pushPath checks that the given URL path is absolute and does not leave the
+// served directory, for instance "/style.css?v=2"
+func pushPath(target string) error {
+	if !strings.HasPrefix(target, "/") || strings.HasPrefix(target, "//") {
+		return errors.New("the path must start with a single /")
+	}
+	u, err := url.Parse(target)
+	if err != nil {
+		return err
+	}
+	for _, segment := range strings.Split(u.Path, "/") {
+		if segment == ".." {
+			return errors.New("the path must be within the served directory")
+		}
+	}
+	return nil
+}
+
+// LoadPushFunction makes the Push function available to the given Lua state
+func (ac *Config) LoadPushFunction(w http.ResponseWriter, req *http.Request, L *lua.LState) {
+
+	// Push the given URL path to the client with HTTP/2 server push, for
+	// instance a CSS or JavaScript file that the page is going to need.
+	// Returns false if server push is not supported by the connection, or
+	// false and an error message if the path is invalid or the push failed.
+	L.SetGlobal("Push", L.NewFunction(func(L *lua.LState) int {
+		target := L.CheckString(1)
+		if err := pushPath(target); err != nil {
+			L.Push(lua.LBool(false))
+			L.Push(lua.LString(err.Error()))
+			return 2 // number of results
+		}
+		pusher := findPusher(w)
+		if pusher == nil {
+			// Not HTTP/2, nothing to do
+			L.Push(lua.LBool(false))
+			return 1 // number of results
+		}
+		header := make(http.Header)
+		for _, key := range pushHeaders {
+			if value := req.Header.Get(key); value != "" {
+				header.Set(key, value)
+			}
+		}
+		if err := pusher.Push(target, &http.PushOptions{Header: header}); err != nil {
+			if err == http.ErrNotSupported {
+				// The client has disabled server push
+				L.Push(lua.LBool(false))
+				return 1 // number of results
+			}
+			L.Push(lua.LBool(false))
+			L.Push(lua.LString(err.Error()))
+			return 2 // number of results
+		}
+		L.Push(lua.LBool(true))
+		return 1 // number of results
+	}))
+
+}
@@ -0,0 +1,149 @@
+package engine
+
+import (
+	"bytes"
+	"crypto/tls"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bmizerany/assert"
+	"github.com/xyproto/algernon/lua/pool"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/hpack"
+)
+
+func TestPushPath(t *testing.T) {
+	for _, target := range []string{"/style.css", "/js/app.js?v=2", "/"} {
+		assert.Equal(t, pushPath(target), nil)
+	}
+	for _, target := range []string{"", "style.css", "//example.com/x.js", "/../secret", "/js/../../secret", "/%2e%2e/secret"} {
+		assert.NotEqual(t, pushPath(target), nil)
+	}
+}
+
+// newPushServer returns a handler that runs testdata/push.lua for "/page"
+// and serves a small stylesheet for "/style.css"
+func newPushServer() (*Config, http.Handler) {
+	ac := &Config{}
+	ac.luapool = pool.New()
+	mux := http.NewServeMux()
+	mux.HandleFunc("/page", func(w http.ResponseWriter, req *http.Request) {
+		ac.FilePage(w, req, "testdata/push.lua", "")
+	})
+	mux.HandleFunc("/style.css", func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "text/css")
+		w.Write([]byte("body { color: red; }"))
+	})
+	return ac, mux
+}
+
+func TestPushHTTP1(t *testing.T) {
+	ac, mux := newPushServer()
+	defer ac.luapool.Shutdown()
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	for target, expected := range map[string]string{
+		"/style.css": "false nil\n",
+		"/../secret": "false the path must be within the served directory\n",
+	} {
+		resp, err := http.Get(server.URL + "/page?path=" + target)
+		assert.Equal(t, err, nil)
+		body, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		assert.Equal(t, err, nil)
+		assert.Equal(t, string(body), expected)
+	}
+}
+
+func TestPushHTTP2(t *testing.T) {
+	ac, mux := newPushServer()
+	defer ac.luapool.Shutdown()
+	server := httptest.NewUnstartedServer(mux)
+	server.EnableHTTP2 = true
+	server.StartTLS()
+	defer server.Close()
+
+	// The HTTP/2 client in net/http does not accept pushed streams,
+	// so speak HTTP/2 directly
+	conn, err := tls.Dial("tcp", server.Listener.Addr().String(), &tls.Config{
+		InsecureSkipVerify: true,
+		NextProtos:         []string{"h2"},
+	})
+	assert.Equal(t, err, nil)
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+	_, err = conn.Write([]byte(http2.ClientPreface))
+	assert.Equal(t, err, nil)
+
+	framer := http2.NewFramer(conn, conn)
+	framer.ReadMetaHeaders = hpack.NewDecoder(4096, nil)
+	assert.Equal(t, framer.WriteSettings(http2.Setting{ID: http2.SettingEnablePush, Val: 1}), nil)
+
+	var headerBlock bytes.Buffer
+	encoder := hpack.NewEncoder(&headerBlock)
+	for _, field := range [][2]string{
+		{":method", "GET"},
+		{":scheme", "https"},
+		{":authority", server.Listener.Addr().String()},
+		{":path", "/page?path=/style.css"},
+	} {
+		encoder.WriteField(hpack.HeaderField{Name: field[0], Value: field[1]})
+	}
+	assert.Equal(t, framer.WriteHeaders(http2.HeadersFrameParam{
+		StreamID:      1,
+		BlockFragment: headerBlock.Bytes(),
+		EndStream:     true,
+		EndHeaders:    true,
+	}), nil)
+
+	var (
+		pushedPath     string
+		pushedStreamID uint32
+		bodies         = make(map[uint32]*bytes.Buffer)
+		ended          = make(map[uint32]bool)
+	)
+	for !(ended[1] && pushedStreamID != 0 && ended[pushedStreamID]) {
+		frame, err := framer.ReadFrame()
+		if err != nil {
+			t.Fatal(err)
+		}
+		switch f := frame.(type) {
+		case *http2.SettingsFrame:
+			if !f.IsAck() {
+				framer.WriteSettingsAck()
+			}
+		case *http2.PushPromiseFrame:
+			pushedStreamID = f.PromiseID
+			decoder := hpack.NewDecoder(4096, func(field hpack.HeaderField) {
+				if field.Name == ":path" {
+					pushedPath = field.Value
+				}
+			})
+			_, err := decoder.Write(f.HeaderBlockFragment())
+			assert.Equal(t, err, nil)
+		case *http2.MetaHeadersFrame:
+			if f.StreamEnded() {
+				ended[f.StreamID] = true
+			}
+		case *http2.DataFrame:
+			if bodies[f.StreamID] == nil {
+				bodies[f.StreamID] = &bytes.Buffer{}
+			}
+			bodies[f.StreamID].Write(f.Data())
+			if f.StreamEnded() {
+				ended[f.StreamID] = true
+			}
+		case *http2.GoAwayFrame:
+			t.Fatalf("the server sent GOAWAY: %v", f.ErrCode)
+		}
+	}
+
+	assert.Equal(t, pushedPath, "/style.css")
+	assert.Equal(t, bodies[pushedStreamID].String(), "body { color: red; }")
+	assert.Equal(t, strings.TrimSpace(bodies[1].String()), "true nil")
+}
@@ -0,0 +1,130 @@
+package engine
+
+import (
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// How often idle token buckets are removed
+const rateLimitCleanupInterval = time.Minute
+
+// tokenBucket holds the tokens for one client. One token is used per request.
+type tokenBucket struct {
+	tokens float64
+	last   time.Time // when the tokens were last refilled
+}
+
+// rateLimiter limits the number of requests per minute for each client,
+// with one token bucket per client IP address
+type rateLimiter struct {
+	mu          sync.Mutex
+	perMinute   float64
+	buckets     map[string]*tokenBucket
+	lastCleanup time.Time
+	now         func() time.Time
+}
+
+// newRateLimiter returns a rate limiter that allows the given number of
+// requests per minute per client, in bursts of up to the same number
+func newRateLimiter(perMinute int) *rateLimiter {
+	return &rateLimiter{
+		perMinute:   float64(perMinute),
+		buckets:     make(map[string]*tokenBucket),
+		lastCleanup: time.Now(),
+		now:         time.Now,
+	}
+}
+
+// allow checks if the client with the given key may make another request.
+// If not, the time until the next request is allowed is returned.
+func (rl *rateLimiter) allow(key string) (bool, time.Duration) {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	now := rl.now()
+	perSecond := rl.perMinute / 60
+
+	// Remove the buckets that have been idle long enough to be full again,
+	// so that the memory usage is bounded by the number of recent clients
+	if now.Sub(rl.lastCleanup) >= rateLimitCleanupInterval {
+		for k, b := range rl.buckets {
+			if b.tokens+now.Sub(b.last).Seconds()*perSecond >= rl.perMinute {
+				delete(rl.buckets, k)
+			}
+		}
+		rl.lastCleanup = now
+	}
+
+	b, ok := rl.buckets[key]
+	if !ok {
+		b = &tokenBucket{tokens: rl.perMinute, last: now}
+		rl.buckets[key] = b
+	}
+	b.tokens = math.Min(rl.perMinute, b.tokens+now.Sub(b.last).Seconds()*perSecond)
+	b.last = now
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0
+	}
+	return false, time.Duration((1 - b.tokens) / perSecond * float64(time.Second))
+}
+
+// trustedProxy checks if the given IP address is a loopback or private
+// address, for a reverse proxy that can be trusted to set X-Forwarded-For
+func trustedProxy(ip net.IP) bool {
+	return ip != nil && (ip.IsLoopback() || ip.IsPrivate())
+}
+
+// clientIP returns the IP address of the client. X-Forwarded-For is only used
+// if the request comes from a trusted proxy, and then the last address that
+// was not added by a trusted proxy is used.
+func clientIP(req *http.Request) string {
+	return forwardedClientIP(req, trustedProxy)
+}
+
+// forwardedClientIP returns the IP address of the client, where the given
+// function decides which proxies can be trusted to set X-Forwarded-For
+func forwardedClientIP(req *http.Request, trusted func(net.IP) bool) string {
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		host = req.RemoteAddr
+	}
+	if !trusted(net.ParseIP(host)) {
+		return host
+	}
+	forwarded := strings.Split(strings.Join(req.Header.Values("X-Forwarded-For"), ","), ",")
+	for i := len(forwarded) - 1; i >= 0; i-- {
+		addr := strings.TrimSpace(forwarded[i])
+		if addr == "" {
+			continue
+		}
+		host = addr
+		if !trusted(net.ParseIP(addr)) {
+			break
+		}
+	}
+	return host
+}
+
+// RateLimitHandler wraps the given handler, so that each client IP address
+// can make the given number of requests per minute. Requests over the limit
+// get "429 Too Many Requests" and a Retry-After header.
+func RateLimitHandler(next http.Handler, perMinute int) http.Handler {
+	return rateLimitHandler(next, newRateLimiter(perMinute))
+}
+
+// rateLimitHandler wraps the given handler with the given rate limiter
+func rateLimitHandler(next http.Handler, rl *rateLimiter) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if ok, wait := rl.allow(clientIP(req)); !ok {
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+			http.Error(w, "429 Too Many Requests", http.StatusTooManyRequests)
+			return
+		}
+		next.ServeHTTP(w, req)
+	})
+}
@@ -0,0 +1,66 @@
+package engine
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/bmizerany/assert"
+)
+
+func TestClientIP(t *testing.T) {
+	req := httptest.NewRequest("GET", "/", nil)
+	req.RemoteAddr = "203.0.113.7:1234"
+	req.Header.Set("X-Forwarded-For", "198.51.100.1")
+	// X-Forwarded-For is not trusted from public addresses
+	assert.Equal(t, clientIP(req), "203.0.113.7")
+
+	// But it is from a proxy on the same host or on the local network
+	req.RemoteAddr = "127.0.0.1:1234"
+	assert.Equal(t, clientIP(req), "198.51.100.1")
+	req.Header.Set("X-Forwarded-For", "192.0.2.9, 198.51.100.1, 10.0.0.2")
+	assert.Equal(t, clientIP(req), "198.51.100.1")
+	req.Header.Del("X-Forwarded-For")
+	assert.Equal(t, clientIP(req), "127.0.0.1")
+}
+
+func TestRateLimitHandler(t *testing.T) {
+	now := time.Now()
+	rl := newRateLimiter(3)
+	rl.now = func() time.Time { return now }
+	handler := rateLimitHandler(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte("hello"))
+	}), rl)
+
+	get := func(remoteAddr string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.RemoteAddr = remoteAddr
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, req)
+		return recorder
+	}
+
+	// Up to the limit
+	for i := 0; i < 3; i++ {
+		assert.Equal(t, get("203.0.113.7:1234").Code, http.StatusOK)
+	}
+
+	// Over the limit
+	recorder := get("203.0.113.7:5678")
+	assert.Equal(t, recorder.Code, http.StatusTooManyRequests)
+	assert.Equal(t, recorder.Header().Get("Retry-After"), "20")
+
+	// Other clients have their own limit
+	assert.Equal(t, get("203.0.113.8:1234").Code, http.StatusOK)
+
+	// One request is allowed again after a third of a minute
+	now = now.Add(20 * time.Second)
+	assert.Equal(t, get("203.0.113.7:1234").Code, http.StatusOK)
+	assert.Equal(t, get("203.0.113.7:1234").Code, http.StatusTooManyRequests)
+
+	// Idle buckets are removed, once they are full again
+	now = now.Add(time.Minute)
+	assert.Equal(t, get("203.0.113.9:1234").Code, http.StatusOK)
+	assert.Equal(t, len(rl.buckets), 1)
+}
@@ -0,0 +1,201 @@
+package engine
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	redigo "github.com/gomodule/redigo/redis"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// The default name of the Redis master, for --redis-master
+	defaultRedisMasterName = "mymaster"
+
+	// The default port for Redis Sentinel
+	defaultRedisSentinelPort = "26379"
+
+	// How long to wait for a reply from a Redis Sentinel
+	redisSentinelTimeout = 2 * time.Second
+
+	// How often Redis Sentinel is asked for the current master, for
+	// discovering a failover while the connections to the old master still work
+	redisSentinelCheckInterval = time.Second
+)
+
+// resolveRedisMaster asks the given Redis Sentinels, in order, for the
+// address of the current master with the given name. Returns the address of
+// the master from the first Sentinel that knows about it.
+func resolveRedisMaster(sentinels []string, masterName string) (string, error) {
+	var errs []string
+	for _, sentinel := range sentinels {
+		addr, err := askRedisSentinel(sentinel, masterName)
+		if err == nil {
+			return addr, nil
+		}
+		errs = append(errs, sentinel+": "+err.Error())
+	}
+	if len(errs) == 0 {
+		return "", errors.New("no Redis Sentinel addresses are given")
+	}
+	return "", fmt.Errorf("could not find the Redis master %q with Redis Sentinel (%s)", masterName, strings.Join(errs, ", "))
+}
+
+// askRedisSentinel asks the given Redis Sentinel for the address of the
+// current master with the given name
+func askRedisSentinel(sentinel, masterName string) (string, error) {
+	if _, _, err := net.SplitHostPort(sentinel); err != nil {
+		sentinel = net.JoinHostPort(sentinel, defaultRedisSentinelPort)
+	}
+	conn, err := redigo.Dial("tcp", sentinel,
+		redigo.DialConnectTimeout(redisSentinelTimeout),
+		redigo.DialReadTimeout(redisSentinelTimeout),
+		redigo.DialWriteTimeout(redisSentinelTimeout))
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+	reply, err := redigo.Strings(conn.Do("SENTINEL", "get-master-addr-by-name", masterName))
+	if err == redigo.ErrNil {
+		return "", errors.New("unknown master")
+	}
+	if err != nil {
+		return "", err
+	}
+	if len(reply) != 2 {
+		return "", fmt.Errorf("unexpected reply: %v", reply)
+	}
+	return net.JoinHostPort(reply[0], reply[1]), nil
+}
+
+// redisSentinelDialer connects to the current Redis master, as given by Redis
+// Sentinel, and closes the connections to the previous master after a failover
+type redisSentinelDialer struct {
+	sentinels  []string
+	masterName string
+	tlsConfig  *tls.Config // nil if TLS is not used
+
+	mut    sync.Mutex
+	master string                // the last known master address
+	conns  map[net.Conn]struct{} // connections to the last known master
+}
+
+// setMaster records the given master address. If the master has changed, the
+// connections to the previous master are closed, so that the connection pool
+// connects again, to the new master.
+func (sd *redisSentinelDialer) setMaster(master string) {
+	sd.mut.Lock()
+	defer sd.mut.Unlock()
+	if master == sd.master {
+		return
+	}
+	if sd.master != "" {
+		log.Warnf("Redis Sentinel reports a new master for %q: %s (was %s)", sd.masterName, master, sd.master)
+	}
+	for conn := range sd.conns {
+		conn.Close()
+	}
+	sd.master = master
+	sd.conns = make(map[net.Conn]struct{})
+}
+
+// dial connects to the current master
+func (sd *redisSentinelDialer) dial() (net.Conn, error) {
+	master, err := resolveRedisMaster(sd.sentinels, sd.masterName)
+	if err != nil {
+		return nil, err
+	}
+	sd.setMaster(master)
+	dialer := &net.Dialer{Timeout: redisTLSTimeout}
+	var conn net.Conn
+	if sd.tlsConfig != nil {
+		tlsConfig := sd.tlsConfig.Clone()
+		if host, _, err := net.SplitHostPort(master); err == nil {
+			tlsConfig.ServerName = host
+		}
+		conn, err = tls.DialWithDialer(dialer, "tcp", master, tlsConfig)
+	} else {
+		conn, err = dialer.Dial("tcp", master)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("could not connect to the Redis master at %s: %s", master, err)
+	}
+	sd.mut.Lock()
+	defer sd.mut.Unlock()
+	if master != sd.master {
+		// There was a failover while connecting
+		conn.Close()
+		return nil, errors.New("the Redis master changed while connecting to " + master)
+	}
+	sd.conns[conn] = struct{}{}
+	return &trackedConn{conn, sd}, nil
+}
+
+// forget stops keeping track of the given connection, when it is closed
+func (sd *redisSentinelDialer) forget(conn net.Conn) {
+	sd.mut.Lock()
+	defer sd.mut.Unlock()
+	delete(sd.conns, conn)
+}
+
+// watch asks Redis Sentinel for the current master at regular intervals,
+// until done is closed
+func (sd *redisSentinelDialer) watch(done <-chan struct{}) {
+	ticker := time.NewTicker(redisSentinelCheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			if master, err := resolveRedisMaster(sd.sentinels, sd.masterName); err == nil {
+				sd.setMaster(master)
+			}
+		}
+	}
+}
+
+// trackedConn is a connection to a Redis master that is forgotten by the
+// dialer when it is closed
+type trackedConn struct {
+	net.Conn
+	sd *redisSentinelDialer
+}
+
+// Close closes the connection
+func (tc *trackedConn) Close() error {
+	tc.sd.forget(tc.Conn)
+	return tc.Conn.Close()
+}
+
+// startRedisSentinelTunnel listens on a local address and forwards each
+// connection to the current Redis master, as given by the Redis Sentinels in
+// ac.redisSentinels. The connection pool that is used for the database
+// backend only connects to a fixed address, so this makes it follow a
+// failover. tlsConfig is used for connecting to the master, if not nil.
+// Any previously started tunnel is closed. Returns the local address.
+func (ac *Config) startRedisSentinelTunnel(tlsConfig *tls.Config) (string, error) {
+	sd := &redisSentinelDialer{
+		sentinels:  ac.redisSentinels,
+		masterName: ac.redisMasterName,
+		tlsConfig:  tlsConfig,
+	}
+	// Check that the master can be found before starting the tunnel
+	master, err := resolveRedisMaster(sd.sentinels, sd.masterName)
+	if err != nil {
+		return "", err
+	}
+	sd.setMaster(master)
+	done := make(chan struct{})
+	addr, err := ac.startRedisTunnel(sd.dial, func() { close(done) })
+	if err != nil {
+		return "", err
+	}
+	go sd.watch(done)
+	return addr, nil
+}
@@ -0,0 +1,174 @@
+package engine
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/bmizerany/assert"
+	redis "github.com/xyproto/permissions2"
+)
+
+// countingListener counts the accepted connections
+type countingListener struct {
+	net.Listener
+	accepted int64
+}
+
+func (cl *countingListener) Accept() (net.Conn, error) {
+	conn, err := cl.Listener.Accept()
+	if err == nil {
+		atomic.AddInt64(&cl.accepted, 1)
+	}
+	return conn, err
+}
+
+// countingRedis starts a server that behaves like the one from passwordRedis,
+// and counts the accepted connections
+func countingRedis(t *testing.T, password string) *countingListener {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cl := &countingListener{Listener: listener}
+	serveRedis(cl, password)
+	return cl
+}
+
+// mockSentinel is a Redis Sentinel that monitors one master
+type mockSentinel struct {
+	masterName string
+	mut        sync.Mutex
+	master     string
+}
+
+// setMaster changes the address of the master, like after a failover
+func (ms *mockSentinel) setMaster(addr string) {
+	ms.mut.Lock()
+	defer ms.mut.Unlock()
+	ms.master = addr
+}
+
+// serve replies to SENTINEL get-master-addr-by-name. Returns the address of
+// the Sentinel.
+func (ms *mockSentinel) serve(t *testing.T) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func(conn net.Conn) {
+				defer conn.Close()
+				r := bufio.NewReader(conn)
+				for {
+					// Read a command, sent as an array of bulk strings
+					line, err := r.ReadString('\n')
+					if err != nil {
+						return
+					}
+					n, _ := strconv.Atoi(strings.TrimSpace(line[1:]))
+					args := make([]string, n)
+					for i := range args {
+						if _, err := r.ReadString('\n'); err != nil {
+							return
+						}
+						arg, err := r.ReadString('\n')
+						if err != nil {
+							return
+						}
+						args[i] = strings.TrimSpace(arg)
+					}
+					if len(args) != 3 || strings.ToUpper(args[0]) != "SENTINEL" || args[1] != "get-master-addr-by-name" {
+						io.WriteString(conn, "-ERR unknown command\r\n")
+						continue
+					}
+					if args[2] != ms.masterName {
+						io.WriteString(conn, "*-1\r\n")
+						continue
+					}
+					ms.mut.Lock()
+					host, port, _ := net.SplitHostPort(ms.master)
+					ms.mut.Unlock()
+					io.WriteString(conn, "*2\r\n$"+strconv.Itoa(len(host))+"\r\n"+host+"\r\n$"+strconv.Itoa(len(port))+"\r\n"+port+"\r\n")
+				}
+			}(conn)
+		}
+	}()
+	return listener.Addr().String()
+}
+
+// unusedAddr returns a local address that nothing listens on
+func unusedAddr(t *testing.T) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := listener.Addr().String()
+	listener.Close()
+	return addr
+}
+
+func TestResolveRedisMaster(t *testing.T) {
+	ms := &mockSentinel{masterName: "mymaster", master: "10.0.0.1:6379"}
+	sentinel := ms.serve(t)
+
+	// The first Sentinel is down
+	master, err := resolveRedisMaster([]string{unusedAddr(t), sentinel}, "mymaster")
+	assert.Equal(t, err, nil)
+	assert.Equal(t, master, "10.0.0.1:6379")
+
+	_, err = resolveRedisMaster([]string{sentinel}, "othermaster")
+	assert.NotEqual(t, err, nil)
+	assert.Equal(t, strings.Contains(err.Error(), "unknown master"), true)
+
+	_, err = resolveRedisMaster(nil, "mymaster")
+	assert.NotEqual(t, err, nil)
+}
+
+func TestRedisSentinel(t *testing.T) {
+	master1 := countingRedis(t, "hunter2")
+	defer master1.Close()
+	master2 := countingRedis(t, "hunter2")
+	defer master2.Close()
+	ms := &mockSentinel{masterName: "mymaster", master: master1.Addr().String()}
+
+	ac := &Config{
+		redisSentinels:  []string{ms.serve(t)},
+		redisMasterName: "mymaster",
+		redisPassword:   "hunter2",
+	}
+	defer ac.Close()
+	perm, err := ac.connectRedis()
+	assert.Equal(t, err, nil)
+	pool := perm.UserState().(*redis.UserState).Pool()
+	assert.Equal(t, pool.Ping(), nil)
+	assert.NotEqual(t, atomic.LoadInt64(&master1.accepted), int64(0))
+	assert.Equal(t, atomic.LoadInt64(&master2.accepted), int64(0))
+
+	// After a failover, the connections to the old master are closed and
+	// the pool connects to the new master
+	ms.setMaster(master2.Addr().String())
+	deadline := time.Now().Add(5 * time.Second)
+	for atomic.LoadInt64(&master2.accepted) == 0 && time.Now().Before(deadline) {
+		pool.Ping()
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.NotEqual(t, atomic.LoadInt64(&master2.accepted), int64(0))
+	assert.Equal(t, pool.Ping(), nil)
+
+	// The master must be known
+	ac.redisMasterName = "othermaster"
+	_, err = ac.connectRedis()
+	assert.NotEqual(t, err, nil)
+}
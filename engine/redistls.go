@@ -0,0 +1,123 @@
+package engine
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"time"
+
+	redigo "github.com/gomodule/redigo/redis"
+	log "github.com/sirupsen/logrus"
+)
+
+// How long to wait when connecting to a Redis server over TLS
+const redisTLSTimeout = 7 * time.Second
+
+// redisTLSConfig returns the TLS configuration for connecting to the Redis
+// server, with the client certificate and certificate authority, if given
+func (ac *Config) redisTLSConfig() (*tls.Config, error) {
+	tlsConfig := &tls.Config{InsecureSkipVerify: ac.redisTLSSkipVerify}
+	if host, _, err := net.SplitHostPort(ac.redisAddr); err == nil {
+		tlsConfig.ServerName = host
+	}
+	if ac.redisTLSCert != "" || ac.redisTLSKey != "" {
+		cert, err := tls.LoadX509KeyPair(ac.redisTLSCert, ac.redisTLSKey)
+		if err != nil {
+			return nil, fmt.Errorf("could not load the Redis TLS certificate and key: %s", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	if ac.redisCA != "" {
+		pemData, err := ioutil.ReadFile(ac.redisCA)
+		if err != nil {
+			return nil, fmt.Errorf("could not read the Redis certificate authority: %s", err)
+		}
+		certPool := x509.NewCertPool()
+		if !certPool.AppendCertsFromPEM(pemData) {
+			return nil, errors.New("found no certificates in " + ac.redisCA)
+		}
+		tlsConfig.RootCAs = certPool
+	}
+	return tlsConfig, nil
+}
+
+// checkRedisTLS connects to the Redis server over TLS and authenticates, if
+// a password is set. TLS handshake failures and authentication failures
+// give different error messages.
+func (ac *Config) checkRedisTLS(tlsConfig *tls.Config) error {
+	conn, err := redigo.Dial("tcp", ac.redisAddr,
+		redigo.DialUseTLS(true),
+		redigo.DialTLSConfig(tlsConfig),
+		redigo.DialConnectTimeout(redisTLSTimeout),
+		redigo.DialReadTimeout(redisTLSTimeout),
+		redigo.DialWriteTimeout(redisTLSTimeout))
+	if err != nil {
+		return fmt.Errorf("TLS handshake with the Redis server at %s failed: %s", ac.redisAddr, err)
+	}
+	defer conn.Close()
+	if ac.redisPassword != "" {
+		if _, err := conn.Do("AUTH", ac.redisPassword); err != nil {
+			return fmt.Errorf("could not authenticate with the Redis server at %s: %s", ac.redisAddr, err)
+		}
+	}
+	return nil
+}
+
+// startRedisTLSTunnel listens on a local address and forwards each
+// connection to the Redis server over TLS, since the Redis connection pool
+// that is used for the database backend only supports plain TCP. Any
+// previously started tunnel is closed. Returns the local address.
+func (ac *Config) startRedisTLSTunnel(tlsConfig *tls.Config) (string, error) {
+	remoteAddr := ac.redisAddr
+	return ac.startRedisTunnel(func() (net.Conn, error) {
+		dialer := &net.Dialer{Timeout: redisTLSTimeout}
+		conn, err := tls.DialWithDialer(dialer, "tcp", remoteAddr, tlsConfig)
+		if err != nil {
+			return nil, fmt.Errorf("could not connect to the Redis server at %s over TLS: %s", remoteAddr, err)
+		}
+		return conn, nil
+	}, nil)
+}
+
+// startRedisTunnel listens on a local address and forwards each connection
+// to the connection that is returned by dial. closed is called, if not nil,
+// when the tunnel is closed. Any previously started tunnel is closed.
+// Returns the local address.
+func (ac *Config) startRedisTunnel(dial func() (net.Conn, error), closed func()) (string, error) {
+	if ac.redisTunnel != nil {
+		ac.redisTunnel.Close()
+	}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return "", err
+	}
+	ac.redisTunnel = listener
+	go func() {
+		for {
+			localConn, err := listener.Accept()
+			if err != nil {
+				// The tunnel has been closed
+				if closed != nil {
+					closed()
+				}
+				return
+			}
+			go func() {
+				defer localConn.Close()
+				remoteConn, err := dial()
+				if err != nil {
+					log.Errorf("Could not forward a connection to Redis: %s", err)
+					return
+				}
+				defer remoteConn.Close()
+				go io.Copy(remoteConn, localConn)
+				io.Copy(localConn, remoteConn)
+			}()
+		}
+	}()
+	return listener.Addr().String(), nil
+}
@@ -833,6 +833,69 @@ func (ac *Config) HyperAppPage(w http.ResponseWriter, req *http.Request, filenam
 	}
 }
 
+// renderTemplate renders the given html/template source with the given Lua
+// value as the data. Values in the output are escaped by html/template.
+func renderTemplate(name, templateString string, data lua.LValue) (string, error) {
+	tpl, err := template.New(name).Parse(templateString)
+	if err != nil {
+		return "", err
+	}
+	var buf bytes.Buffer
+	if err := tpl.Execute(&buf, convert.Value2interface(data)); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
+
+// LoadTemplateFunctions makes functions for rendering html/template templates
+// available to the given Lua state. Template files are read relative to the
+// given script directory.
+func (ac *Config) LoadTemplateFunctions(L *lua.LState, scriptdir string) {
+
+	// Render a html/template template, given as a string, with the given
+	// data table. Returns the result, or nil and an error message.
+	// Not named "render", since that function renders files in the
+	// script directory.
+	L.SetGlobal("renderTemplate", L.NewFunction(func(L *lua.LState) int {
+		result, err := renderTemplate("renderTemplate", L.CheckString(1), L.Get(2))
+		if err != nil {
+			L.Push(lua.LNil)
+			L.Push(lua.LString(err.Error()))
+			return 2 // number of results
+		}
+		L.Push(lua.LString(result))
+		return 1 // number of results
+	}))
+
+	// Render a html/template template file, relative to the script
+	// directory, with the given data table. Returns the result, or nil and
+	// an error message.
+	L.SetGlobal("renderTemplateFile", L.NewFunction(func(L *lua.LState) int {
+		filename := L.CheckString(1)
+		fullPath, err := ac.scriptPath(scriptdir, filename)
+		if err != nil {
+			L.Push(lua.LNil)
+			L.Push(lua.LString(err.Error()))
+			return 2 // number of results
+		}
+		templateData, err := ioutil.ReadFile(fullPath)
+		if err != nil {
+			L.Push(lua.LNil)
+			L.Push(lua.LString(err.Error()))
+			return 2 // number of results
+		}
+		result, err := renderTemplate(filepath.Base(filename), string(templateData), L.Get(2))
+		if err != nil {
+			L.Push(lua.LNil)
+			L.Push(lua.LString(err.Error()))
+			return 2 // number of results
+		}
+		L.Push(lua.LString(result))
+		return 1 // number of results
+	}))
+
+}
+
 // SCSSPage writes the given source bytes (in SCSS) converted to CSS, to a writer.
 // The filename is only used in the error message, if any.
 func (ac *Config) SCSSPage(w http.ResponseWriter, req *http.Request, filename string, scssdata []byte) {
@@ -0,0 +1,37 @@
+package engine
+
+import (
+	"testing"
+
+	"github.com/bmizerany/assert"
+	"github.com/xyproto/gopher-lua"
+)
+
+func TestRenderTemplate(t *testing.T) {
+	L := lua.NewState()
+	defer L.Close()
+	(&Config{serverDirOrFilename: "testdata"}).LoadTemplateFunctions(L, "testdata")
+
+	err := L.DoString(`
+		assert(renderTemplate("Hello, {{.name}}!", {name = "Bob"}) == "Hello, Bob!")
+
+		-- Range over a slice
+		assert(renderTemplate("{{range .}}[{{.}}]{{end}}", {"a", "b", "c"}) == "[a][b][c]")
+
+		-- Values are escaped
+		assert(renderTemplate("<p>{{.}}</p>", "<script>") == "<p>&lt;script&gt;</p>")
+
+		-- Invalid templates
+		local result, err = renderTemplate("{{.name", {})
+		assert(result == nil and err ~= nil)
+
+		-- Template files, relative to the script directory
+		result = renderTemplateFile("templates/list.tmpl", {title = "Fruit", items = {"apple", "banana & cherry"}})
+		assert(result == "<h1>Fruit</h1>\n<ul><li>apple</li><li>banana &amp; cherry</li></ul>\n", result)
+		result, err = renderTemplateFile("templates/missing.tmpl", {})
+		assert(result == nil and err ~= nil)
+		result, err = renderTemplateFile("../basic.go", {})
+		assert(result == nil and err ~= nil)
+	`)
+	assert.Equal(t, err, nil)
+}
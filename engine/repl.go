@@ -1,13 +1,17 @@
 package engine
 
 import (
+	"bufio"
 	"bytes"
 	"fmt"
 	"io"
 	"os"
 	"path/filepath"
 	"runtime"
+	"sort"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/chzyer/readline"
 	"github.com/mitchellh/go-homedir"
@@ -15,9 +19,14 @@ import (
 	"github.com/xyproto/algernon/lua/codelib"
 	"github.com/xyproto/algernon/lua/convert"
 	"github.com/xyproto/algernon/lua/datastruct"
+	"github.com/xyproto/algernon/lua/httpclient"
 	"github.com/xyproto/algernon/lua/jnode"
+	"github.com/xyproto/algernon/lua/passwords"
 	"github.com/xyproto/algernon/lua/pure"
+	"github.com/xyproto/algernon/lua/regex"
+	"github.com/xyproto/algernon/lua/sitemap"
 	"github.com/xyproto/gopher-lua"
+	"github.com/xyproto/gopher-lua/parse"
 	"github.com/xyproto/term"
 )
 
@@ -37,10 +46,26 @@ set:del(string)
 set:has(string) -> bool
 // Get all members of the set
 set:getall() -> table
+// Get the number of elements in the set. Returns 0 if there were errors.
+set:size() -> number
+// Remove and return a random member of the set. Requires Redis.
+set:pop() -> string
+// Return a random member of the set, without removing it. Requires Redis.
+set:random() -> string
+// Get the members that are in this set or the set with the given name.
+// Requires Redis.
+set:union(string) -> table
+// Get the members that are in both this set and the set with the given name.
+// Requires Redis.
+set:intersect(string) -> table
 // Remove the set itself. Returns true if successful.
 set:remove() -> bool
 // Clear the set. Returns true if successful.
 set:clear() -> bool
+// Return the members as a JSON list, for backups.
+set:export() -> string
+// Replace the members with the ones in the given JSON list. Returns true if successful.
+set:import(string) -> bool
 
 // Get or create a database-backed List (takes a name, returns a list object)
 List(string) -> userdata
@@ -52,12 +77,26 @@ list:getall() -> table
 list:getlast() -> string
 // Get the N last elements of the list
 list:getlastn(number) -> table
+// Get the elements from start to stop, both inclusive. -1 is the last element.
+list:range(number, number) -> table
+// Remove and return the first element of the list. Requires Redis.
+list:pop() -> string
+// Remove and return the last element of the list. Requires Redis.
+list:poplast() -> string
+// Remove and return the first element, waiting for up to N seconds. Requires Redis.
+list:bpop(number) -> string
+// Only keep the elements from start to stop, both inclusive. Requires Redis.
+list:trim(number, number) -> bool
 // Remove the list itself. Returns true if successful.
 list:remove() -> bool
 // Clear the list. Returns true if successful.
 list:clear() -> bool
 // Return all list elements (expected to be JSON strings) as a JSON list
 list:json() -> string
+// Return the elements as a JSON list of strings, for backups.
+list:export() -> string
+// Replace the elements with the ones in the given JSON list. Returns true if successful.
+list:import(string) -> bool
 
 // Get or create a database-backed HashMap
 // (takes a name, returns a hash map object)
@@ -68,12 +107,25 @@ hash:set(string, string, string) -> bool
 // For a given element id (for instance a user id), and a key, return a value.
 hash:get(string, string) -> string
 // For a given element id (for instance a user id), and a key,
+// increase the number by one and return it. Starts at "1".
+hash:inc(string, string) -> string
+// For a given element id (for instance a user id), and a key,
 // check if the key exists in the hash map.
 hash:has(string, string) -> bool
 // For a given element id (for instance a user id), check if it exists.
 hash:exists(string) -> bool
 // Get all keys of the hash map
 hash:getall() -> table
+// For a given element id (for instance a user id), get all keys and values.
+hash:getmap(string) -> table
+// For a given element id (for instance a user id), get all keys.
+hash:fields(string) -> table
+// Remove the whole element after the given number of seconds. Requires Redis.
+hash:expire(string, number) -> bool
+// Seconds until the element expires. -1 if it does not expire, -2 if it does not exist.
+hash:ttl(string) -> number
+// Remove the expiry of the element. Requires Redis.
+hash:persist(string) -> bool
 // Remove a key for an entry in a hash map. Returns true if successful
 hash:delkey(string, string) -> bool
 // Remove an element (for instance a user). Returns true if successful
@@ -82,6 +134,10 @@ hash:del(string) -> bool
 hash:remove() -> bool
 // Clear the hash map. Returns true if successful.
 hash:clear() -> bool
+// Return the elements as a JSON object, for backups.
+hash:export() -> string
+// Replace the elements with the ones in the given JSON object. Returns true if successful.
+hash:import(string) -> bool
 
 // Get or create a database-backed KeyValue collection
 // (takes a name, returns a key/value object)
@@ -90,15 +146,80 @@ KeyValue(string) -> userdata
 kv:set(string, string) -> bool
 // Takes a key, returns a value. May return an empty string.
 kv:get(string) -> string
+// Takes a table with keys, returns a table with the keys that exist and their values.
+kv:mget(table) -> table
+// Takes a table with keys and values, and sets them. Returns true if successful.
+kv:mset(table) -> bool
+// Set a key and value that expires after the given number of seconds.
+// Returns true if successful. Requires Redis.
+kv:setexpire(string, string, number) -> bool
+// Takes a key, returns the number of seconds until it expires.
+// Returns -1 if the key does not expire and -2 if it does not exist.
+kv:ttl(string) -> number
 // Takes a key, returns the value+1.
 // Creates a key/value and returns "1" if it did not already exist.
 kv:inc(string) -> string
+// Takes a key, returns the value-1.
+// Creates a key/value and returns "-1" if it did not already exist.
+kv:dec(string) -> string
 // Remove a key. Returns true if successful.
 kv:del(string) -> bool
 // Remove the KeyValue itself. Returns true if successful.
 kv:remove() -> bool
 // Clear the KeyValue. Returns true if successful.
 kv:clear() -> bool
+// Return the keys and values as a JSON object, for backups. Requires Redis.
+kv:export() -> string
+// Replace the keys and values with the ones in the given JSON object. Returns true if successful.
+kv:import(string) -> bool
+
+// Get or create a Redis-backed sorted set (takes a name, returns a sorted set object)
+SortedSet(string) -> userdata
+// Add a member with the given score. Returns true if successful.
+zset:add(string, number) -> bool
+// Get the score of a member, or nil.
+zset:score(string) -> number
+// Get the position of a member, from the highest score if the optional argument is true.
+zset:rank(string[, bool]) -> number
+// Get the members from start to stop, from the highest score if the optional argument is true.
+zset:range(number, number[, bool]) -> table
+// Get the members with scores between min and max, both inclusive.
+zset:rangebyscore(number, number) -> table
+// Remove a member. Returns true if successful.
+zset:remove(string) -> bool
+
+// Get the sorted names of the stored data structures (requires Redis)
+ListLists() -> table
+ListSets() -> table
+ListSortedSets() -> table
+ListHashMaps() -> table
+ListKeyValues() -> table
+
+// Get the session for the current visitor. The session and the session
+// cookie are created the first time a value is stored.
+session() -> userdata
+// Set a key and value in the session. Returns true if successful.
+session():set(string, string) -> bool
+// Takes a key, returns a value. May return an empty string.
+session():get(string) -> string
+// Remove the session data and the session cookie. Returns true if successful.
+session():destroy() -> bool
+// Return the session ID, or an empty string if there is no session yet.
+session():id() -> string
+// Only available when Redis is the database backend. Returns a table with
+// size, active, idle, maxidle, maxactive and latency (PING, in milliseconds).
+redis.stats() -> table
+// Only available when Redis is the database backend. Returns true if Redis
+// can be reached. Methods return nil and "Redis is unreachable" if it can not.
+RedisAlive() -> bool
+// Call the given function, while buffering the commands that modify data
+// structures, and send them to Redis in one go. Returns true if successful.
+pipeline(function) -> bool
+// Publish a message on a channel. Returns the number of receivers. Requires Redis.
+publish(string, string) -> number
+// Call the given function for each message on a channel, until it returns false
+// or the client disconnects. Requires Redis.
+subscribe(string, function) -> bool
 
 Live server configuration
 
@@ -110,9 +231,65 @@ AddAdminPrefix(string)
 AddUserPrefix(string)
 // Provide a lua function that will be used as the permission denied handler.
 DenyHandler(function)
+// Provide a lua function that serves a custom page for the given HTTP status
+// code, like 404 or 500. The function is given the status code.
+// Returns true if successful, or false and an error message.
+ErrorHandler(number, function) -> bool
+// Run a function before every request, with a table with the method, path and
+// clientIP. Returning false rejects the request with "403 Forbidden".
+BeforeRequest(function)
+// Run a function after every request, with a table with the method, path and
+// clientIP, the status code and the duration in seconds.
+AfterRequest(function)
+// Require HTTP basic authentication with the given username and password,
+// with an optional realm, for all URL paths or for the given URL prefix.
+BasicAuth(string, string[, string][, string])
+// Forward the requests for the given URL prefix to the given upstream URL.
+// Returns true if successful, or false and an error message.
+ReverseProxy(string, string) -> bool
+// Handle the given URL path, or a pattern like "/user/:id", with the given
+// function, which is called with a table of the parameters in the path.
+Handle(string, function)
+// Limit each client IP address to the given number of requests per minute.
+RateLimit(number)
+// Set the proxies that are trusted to set X-Forwarded-For, like {"10.0.0.0/8"}.
+// Returns true if successful, or false and an error message.
+SetTrustedProxies(table) -> bool
+// Set the filenames that are served for directories, tried in order.
+// Returns true if successful, or false and an error message.
+SetIndexFiles(table) -> bool
+// Enable or disable listing the files in directories without an index file.
+SetDirListing(bool)
+// Set the directory for temporary files, like large uploaded files.
+// Returns true if successful, or false and an error message.
+SetTempDir(string) -> bool
+// Enable or disable ETag and Last-Modified headers, for answering
+// conditional requests with "304 Not Modified".
+SetCaching(bool)
+// Set the number of seconds a session lasts since it was last modified.
+SetSessionTimeout(number)
+// Set the maximum number of pooled Lua states, 0 is unlimited. If the second
+// argument is true, wait for a Lua state when all are in use, instead of
+// creating more.
+SetLuaPoolSize(number[, bool])
+// Set how long a client may take to send a request, in seconds. 0 is no timeout.
+SetReadTimeout(number)
+// Set how long it may take to send a response, in seconds. 0 is no timeout.
+SetWriteTimeout(number)
 // Direct the logging to the given filename. If the filename is an empty
 // string, direct logging to stderr. Returns true if successful.
 LogTo(string) -> bool
+// Fetch and renew TLS certificates from Let's Encrypt for the given domains.
+// Returns true if successful, or false and an error message.
+EnableAutoTLS(table) -> bool
+// Enable or disable compression of the responses with gzip or deflate.
+SetCompression(bool)
+// Allow cross-origin requests from the given origins ({"*"} for all),
+// with the given methods, if any.
+SetCORS(table[, table])
+// Set the log level to "debug", "info", "warn" or "error".
+// Returns true if successful, or false and an error message.
+SetLogLevel(string) -> bool
 
 Output
 
@@ -136,6 +313,11 @@ hprint(...)
 jprint(...)
 // Output a Pongo2 template and key/value table as rendered HTML. Use "{{ key }}" to insert a key.
 poprint(string[, table])
+// Render a Go html/template template with a data table. Use "{{.key}}" to insert a value.
+// Returns nil and an error message on failure.
+renderTemplate(string[, table]) -> string
+// Render a Go html/template template file, relative to the script directory.
+renderTemplateFile(string[, table]) -> string
 // Output a simple HTML page with a message, title and theme.
 msgpage(string[, string][, string])
 
@@ -163,8 +345,10 @@ jfile:add([string, ]string) -> bool
 // Removes a key in a map in a JSON document. Returns true if successful.
 jfile:delkey(string) -> bool
 // Convert a Lua table with strings or ints to JSON.
-// Takes an optional number of spaces to indent the JSON data.
-json(table[, number]) -> string
+// Takes an optional number of spaces, or a string, to indent the JSON data.
+json(table[, number|string]) -> string
+// Convert JSON to a Lua table. Returns nil and an error message on failure.
+JSONDecode(string) -> table
 // Create a JSON document node.
 JNode() -> userdata
 // Add JSON data to a node. The first argument is an optional JSON path.
@@ -233,18 +417,91 @@ codelib:clear() -> bool
 
 Various
 
-// Return a string with various server information
-ServerInfo() -> string
+// Return a string with various server information and runtime statistics.
+// Takes an optional format, "text" or "json".
+ServerInfo([string]) -> string
 // Return the version string for the server
 version() -> string
 // Tries to extract and print the contents of the given Lua values
 pprint(...)
-// Sleep the given number of seconds (can be a float)
-sleep(number)
+// Sleep the given number of seconds (can be a float). Returns true if not interrupted.
+sleep(number) -> bool
+// Sleep the given number of milliseconds. Returns true if not interrupted.
+sleepms(number) -> bool
 // Return the number of nanoseconds from 1970 ("Unix time")
 unixnano() -> number
-// Convert Markdown to HTML
-markdown(string) -> string
+// Return the number of seconds from 1970 ("Unix time")
+now() -> number
+// Format a Unix time with a Go time layout, like "2006-01-02 15:04:05".
+// Takes an optional time zone, like "Europe/Oslo". The default is UTC.
+formatTime(number, string[, string]) -> string
+// Parse a time with a Go time layout and return the Unix time.
+// Takes an optional time zone. Returns nil and an error message on failure.
+parseTime(string, string[, string]) -> number
+// Return a random (version 4) UUID
+uuid() -> string
+// Return a random string of the given length, with URL-safe characters
+randomString(number) -> string
+// Encode or decode base64. URL-safe base64 is used if the second argument is true.
+base64encode(string[, bool]) -> string
+base64decode(string[, bool]) -> string
+// Encode or decode hexadecimal strings
+hexencode(string) -> string
+hexdecode(string) -> string
+// Encode or decode a string for use in a URL query
+urlencode(string) -> string
+urldecode(string) -> string
+// Parse a URL query string to a table. Keys with several values have a table.
+parseQuery(string) -> table
+// Describe a number of bytes as KiB or MiB
+humanBytes(number) -> string
+// Return the value of an environment variable, or an empty string
+getenv(string) -> string
+// Set an environment variable, for the running process only
+setenv(string, string) -> bool
+// Return a table with all the environment variables
+environ() -> table
+// Convert Markdown to HTML. Raw HTML is left out. Takes an optional table with
+// options, like {tables=false, autolink=false, unsafe=true}.
+markdown(string[, table]) -> string
+
+Passwords
+
+// Hash a password with Argon2id. Returns an encoded hash that includes the
+// salt and the parameters that were used.
+argon2hash(string) -> string
+// Check if a password matches an encoded Argon2id hash.
+argon2verify(string, string) -> bool
+// Hash a password with bcrypt, with an optional cost (the default is 10).
+bcrypt(string[, number]) -> string
+// Check if a password matches a bcrypt hash.
+bcryptMatch(string, string) -> bool
+
+Sitemaps
+
+// Render a sitemap.xml from a table of URLs. Each URL is either a string or a
+// table with loc and the optional lastmod, changefreq and priority.
+sitemap(table) -> string
+// Render a sitemap index from a table of sitemap URLs.
+sitemapindex(table) -> string
+
+Regular expressions
+
+// Check if a string matches a regular expression
+regexMatch(string, string) -> bool
+// Find the first match. Returns a table with the captured groups, or nil.
+regexFind(string, string) -> table
+// Replace all matches. The replacement may refer to groups with $1 or ${name}.
+regexReplace(string, string, string) -> string
+
+HTTP requests
+
+// Send a GET request. Returns the response body and status code,
+// or an empty string, 0 and an error message.
+HTTPGet(string) -> string, number
+// Send an HTTP request, given a table with url, method, headers, body and
+// timeout (in seconds). Returns the response body and status code.
+HTTPRequest(table) -> string, number
 
 Extra
 
@@ -254,6 +511,9 @@ py(string) -> table
 // Takes one or more system commands (possibly separated by ";") and runs them.
 // Returns the output lines as a table.
 run(string) -> table
+// Run a command with the given arguments, without using a shell. Returns the
+// standard output, standard error and exit code. Requires --allow-exec.
+exec(string[, ...]) -> string, string, number
 // Lists the keys and values of a Lua table. Returns a string.
 // Lists the contents of the global namespace "_G" if no arguments are given.
 dir([table]) -> string
@@ -262,6 +522,9 @@ dir([table]) -> string
 Type "webhelp" for an overview of functions that are available when
 handling requests. Or "confighelp" for an overview of functions that are
 available when configuring an Algernon application.
+Use ":load filename" to run a Lua file and ":reload" to run it again.
+Use ":time on" to output how long each statement takes to run.
+Use ":globals" to list the global variables that have been defined.
 `
 	webHelpText = `Available functions:
 
@@ -386,6 +649,29 @@ uploadedfile:save([string]) -> bool
 // Save the uploaded data as the client-provided filename, in the specified
 // directory. Takes a relative or absolute path. Returns true on success.
 uploadedfile:savein(string)  -> bool
+// Discard the uploaded data, to free the memory early. Saving it then fails.
+uploadedfile:discard()
+// Read at most the given number of bytes. Returns nil when done.
+uploadedfile:read(number) -> string
+// Call the given function with each line. Stops if the function returns false.
+// Returns the number of lines, or nil and an error message.
+uploadedfile:lines(function) -> number
+// Decode the uploaded data as a JSON array, and call the given function with
+// each element. Returns the number of elements, or nil and an error message.
+uploadedfile:jsonstream(function) -> number
+
+Reading and writing files
+
+// Read a file, relative to the script directory. Returns the contents,
+// or nil and an error message.
+ReadFile(string) -> string
+// Write a string to a file, relative to the script directory.
+// Returns true, or false and an error message.
+WriteFile(string, string) -> bool
+// Serve a file, relative to the script directory. Supports conditional and
+// range requests. Any output after this is discarded.
+// Returns true, or false and an error message.
+ServeFile(string) -> bool
 
 Handling requests
 
@@ -397,15 +683,37 @@ method() -> string
 print(...)
 // Return the requested URL path.
 urlpath() -> string
+// Return the requested URL path (same as urlpath).
+path() -> string
 // Return the HTTP header in the request, for a given key, or an empty string.
 header(string) -> string
-// Set an HTTP header given a key and a value.
-setheader(string, string)
+// Return the User-Agent header in the request.
+useragent() -> string
+// Return the IP address of the client. X-Forwarded-For is only used for
+// requests from the proxies given with --trusted-proxies or SetTrustedProxies.
+clientIP() -> string
+// Set an HTTP header given a key and a value. Must come before any output.
+setheader(string, string) -> bool
+// Add an HTTP header given a key and a value. Must come before any output.
+addheader(string, string) -> bool
+// Return the value of the cookie with the given name, or an empty string.
+GetCookie(string) -> string
+// Set a cookie given a name, a value and an optional table with options
+// (maxage, path, httponly, secure and samesite).
+SetCookie(string, string[, table]) -> bool
+// Add a "Link: rel=preload" header, given an URL and a type (like "style").
+// Also sends "103 Early Hints", if possible. Returns true if the URL is valid.
+preload(string, string) -> bool
 // Return the HTTP headers, as a table.
 headers() -> table
 // Return the HTTP body in the request
 // (will only read the body once, since it's streamed).
 body() -> string
+// Read the HTTP body in the request as JSON, with an optional size limit in MiB.
+// Returns a table, or nil and an error message.
+requestJSON([number]) -> table
+// Write the given table as JSON, with the Content-Type set to application/json.
+respondJSON(table) -> bool
 // Set a HTTP status code (like 200 or 404).
 // Must be used before other functions that writes to the client!
 status(number)
@@ -429,19 +737,34 @@ render(string) -> string
 // Return a table with keys and values as given in a posted form, or as given
 // in the URL ("/some/page?x=7" makes "x" with the value "7" available).
 formdata() -> table
+// Return the first value for the given key in a posted form or in the URL.
+formValue(string) -> string
 // Redirect to an absolute or relative URL. Also takes a HTTP status code.
+// The default is 302. Output that is written after redirecting is discarded.
 redirect(string[, number])
-// Permanently redirect to an absolute or relative URL. Uses status code 302.
+// Permanently redirect to an absolute or relative URL. Uses status code 301.
 permanent_redirect(string)
-// Transmit what has been outputted so far, to the client.
+// Transmit what has been outputted so far, to the client, while the script
+// is still running.
 flush()
+// Start a stream of Server-Sent Events. Returns false if the headers have
+// already been sent.
+eventSource() -> bool
+// Send a Server-Sent Event with the given event name and data.
+// Returns false if the client has disconnected.
+emit(string, string) -> bool
+// Push the given URL path to the client with HTTP/2 server push.
+// Returns false if server push is not supported by the connection.
+Push(string) -> bool
 `
 	configHelpText = `Available functions:
 
 Only available when used in serverconf.lua
 
-// Set the default address for the server on the form [host][:port].
-SetAddr(string)
+// Set the default address for the server on the form [host][:port],
+// or a Unix domain socket, like "unix:/run/algernon.sock". Several addresses
+// can be given as a table or as a comma separated string.
+SetAddr(string|table)
 // Reset the URL prefixes and make everything *public*.
 ClearPermissions()
 // Add an URL prefix that will have *admin* rights.
@@ -450,9 +773,71 @@ AddAdminPrefix(string)
 AddUserPrefix(string)
 // Provide a lua function that will be used as the permission denied handler.
 DenyHandler(function)
+// Provide a lua function that serves a custom page for the given HTTP status
+// code, like 404 or 500. The function is given the status code.
+// Returns true if successful, or false and an error message.
+ErrorHandler(number, function) -> bool
+// Run a function before every request, with a table with the method, path and
+// clientIP. Returning false rejects the request with "403 Forbidden".
+BeforeRequest(function)
+// Run a function after every request, with a table with the method, path and
+// clientIP, the status code and the duration in seconds.
+AfterRequest(function)
+// Require HTTP basic authentication with the given username and password,
+// with an optional realm, for all URL paths or for the given URL prefix.
+BasicAuth(string, string[, string][, string])
+// Forward the requests for the given URL prefix to the given upstream URL.
+// Returns true if successful, or false and an error message.
+ReverseProxy(string, string) -> bool
+// Handle the given URL path, or a pattern like "/user/:id", with the given
+// function, which is called with a table of the parameters in the path.
+Handle(string, function)
+// Limit each client IP address to the given number of requests per minute.
+RateLimit(number)
+// Set the proxies that are trusted to set X-Forwarded-For, like {"10.0.0.0/8"}.
+// Returns true if successful, or false and an error message.
+SetTrustedProxies(table) -> bool
+// Set the filenames that are served for directories, tried in order.
+// Returns true if successful, or false and an error message.
+SetIndexFiles(table) -> bool
+// Enable or disable listing the files in directories without an index file.
+SetDirListing(bool)
+// Set the directory for temporary files, like large uploaded files.
+// Returns true if successful, or false and an error message.
+SetTempDir(string) -> bool
+// Enable or disable ETag and Last-Modified headers, for answering
+// conditional requests with "304 Not Modified".
+SetCaching(bool)
+// Set the number of seconds a session lasts since it was last modified.
+SetSessionTimeout(number)
+// Set the maximum number of pooled Lua states, 0 is unlimited. If the second
+// argument is true, wait for a Lua state when all are in use, instead of
+// creating more.
+SetLuaPoolSize(number[, bool])
+// Set how long a client may take to send a request, in seconds. 0 is no timeout.
+SetReadTimeout(number)
+// Set how long it may take to send a response, in seconds. 0 is no timeout.
+SetWriteTimeout(number)
+// Set the password for the Redis server, and connect again if Redis is the
+// database backend. Returns true if successful.
+SetRedisPassword(string) -> bool
+// Enable or disable TLS for the Redis connection, and connect again if Redis
+// is the database backend. Returns true if successful.
+SetRedisTLS(bool) -> bool
+// Use Redis Sentinel for finding the Redis master with the given name, given a
+// table of Sentinel addresses, and connect to it. Returns true if successful.
+SetRedisSentinel(table, string) -> bool
+// Set the maximum number of idle and active connections in the Redis
+// connection pool. Returns true if successful.
+SetRedisPoolSize(number) -> bool
+// Only serve files with the given extensions, like {".html", ".css", ".lua"}.
+// Other files results in a 404. An empty table allows all files.
+SetServableExtensions(table)
 // Provide a lua function that will be run once,
 // when the server is ready to start serving.
 OnReady(function)
+// Provide a lua function that will be run when the server shuts down.
+OnShutdown(function)
 // Use a Lua file for setting up HTTP handlers instead of using the directory structure.
 ServerFile(string) -> bool
 `
@@ -588,18 +973,196 @@ func outputHelpAbout(o *term.TextOutput, helpText, topic string) {
 	o.Println(o.DarkGray("Found no help for: ") + o.White(topic))
 }
 
-// Take all functions mentioned in the given help text string and add them to the readline completer
-func addFunctionsFromHelptextToCompleter(helpText string, completer *readline.PrefixCompleter) {
-	for _, line := range strings.Split(helpText, "\n") {
-		if !strings.HasPrefix(line, "//") && strings.Contains(line, "(") {
-			parts := strings.Split(line, "(")
-			if strings.Contains(line, "()") {
-				completer.Children = append(completer.Children, &readline.PrefixCompleter{Name: []rune(parts[0] + "()")})
-			} else {
-				completer.Children = append(completer.Children, &readline.PrefixCompleter{Name: []rune(parts[0] + "(")})
+// incompleteLua checks if the given Lua code is an incomplete chunk that may
+// become valid when more lines are added, like "function f()" or "if x then"
+func incompleteLua(code string) bool {
+	_, err := parse.Parse(strings.NewReader(code), "<repl>")
+	if err == nil {
+		return false
+	}
+	msg := err.Error()
+	// Unterminated single-line strings can not be continued on the next line
+	return strings.Contains(msg, " at EOF:") && !strings.Contains(msg, "unterminated string")
+}
+
+// luaInput collects lines of Lua code until they form a complete chunk
+type luaInput struct {
+	lines []string
+}
+
+// add adds a line to the collected lines. Returns the collected code and true
+// if the code is complete, or an empty string and false if more lines are needed.
+func (li *luaInput) add(line string) (string, bool) {
+	li.lines = append(li.lines, line)
+	code := strings.Join(li.lines, "\n")
+	if incompleteLua(code) {
+		return "", false
+	}
+	li.lines = nil
+	return code, true
+}
+
+// pending checks if there are collected lines that are not complete yet
+func (li *luaInput) pending() bool {
+	return len(li.lines) > 0
+}
+
+// evalREPL runs the given Lua code. If the code is an expression, the
+// resulting values are pretty printed to the given writer. Statements, like
+// assignments, are run as they are.
+func evalREPL(w io.Writer, L *lua.LState, code string) error {
+	// Check if the code is an expression, by compiling it as a return statement
+	fn, err := L.LoadString("return " + code)
+	if err != nil {
+		// Not an expression, run it as a statement
+		return L.DoString(code)
+	}
+	top := L.GetTop()
+	L.Push(fn)
+	if err := L.PCall(0, lua.MultRet, nil); err != nil {
+		return err
+	}
+	// Pretty print the returned values, if any
+	if results := L.GetTop() - top; results > 0 {
+		var buf bytes.Buffer
+		for i := 1; i <= results; i++ {
+			convert.PprintToWriter(&buf, L.Get(top+i))
+			if i != results {
+				buf.WriteString("\t")
 			}
 		}
+		L.Pop(results)
+		fmt.Fprintln(w, buf.String())
+	}
+	return nil
+}
+
+// globalsSnapshot returns a copy of the global variables in the given Lua state
+func globalsSnapshot(L *lua.LState) map[lua.LValue]lua.LValue {
+	snapshot := make(map[lua.LValue]lua.LValue)
+	L.G.Global.ForEach(func(key, value lua.LValue) {
+		snapshot[key] = value
+	})
+	return snapshot
+}
+
+// loadLuaFile runs the given Lua file in the given Lua state. Returns the
+// number of global variables that were added, changed or removed.
+func loadLuaFile(L *lua.LState, filename string) (int, error) {
+	before := globalsSnapshot(L)
+	if err := L.DoFile(filename); err != nil {
+		return 0, err
+	}
+	changed := 0
+	after := globalsSnapshot(L)
+	for key, value := range after {
+		if before[key] != value {
+			changed++
+		}
+	}
+	for key := range before {
+		if _, ok := after[key]; !ok {
+			changed++
+		}
 	}
+	return changed, nil
+}
+
+// replSettings are settings and state that can be changed with the REPL
+// commands that start with ":"
+type replSettings struct {
+	lastLoaded string                    // the most recently loaded Lua file
+	timing     bool                      // output the execution time of each statement
+	builtins   map[lua.LValue]lua.LValue // the globals that were defined at startup
+}
+
+// userGlobals returns the sorted names of the global variables that are not
+// among the given built-in globals, or that have been changed since
+func userGlobals(L *lua.LState, builtins map[lua.LValue]lua.LValue) []string {
+	var names []string
+	L.G.Global.ForEach(func(key, value lua.LValue) {
+		name, ok := key.(lua.LString)
+		if !ok {
+			return
+		}
+		if builtin, ok := builtins[key]; ok && builtin == value {
+			return
+		}
+		names = append(names, string(name))
+	})
+	sort.Strings(names)
+	return names
+}
+
+// outputGlobals outputs the names, types and values of the global variables
+// that have been defined after startup
+func outputGlobals(L *lua.LState, o *term.TextOutput, builtins map[lua.LValue]lua.LValue) {
+	names := userGlobals(L, builtins)
+	if len(names) == 0 {
+		o.Println(o.DarkGray("No globals have been defined"))
+		return
+	}
+	for _, name := range names {
+		value := L.GetGlobal(name)
+		var buf bytes.Buffer
+		convert.PprintToWriter(&buf, value)
+		o.Println(highlight(o, name+" -> "+value.Type().String()) + " = " + buf.String())
+	}
+}
+
+// replMetaCommand handles REPL commands that start with ":", like
+// ":load filename", ":reload", ":globals" and ":time on"
+func replMetaCommand(L *lua.LState, o *term.TextOutput, line string, settings *replSettings) {
+	fields := strings.Fields(line)
+	var filename string
+	switch fields[0] {
+	case ":load":
+		if len(fields) < 2 {
+			o.Err("Usage: :load filename")
+			return
+		}
+		filename = strings.TrimSpace(strings.TrimPrefix(line, ":load"))
+	case ":reload":
+		if settings.lastLoaded == "" {
+			o.Err("No file has been loaded yet")
+			return
+		}
+		filename = settings.lastLoaded
+	case ":globals":
+		outputGlobals(L, o, settings.builtins)
+		return
+	case ":time":
+		if len(fields) != 2 || (fields[1] != "on" && fields[1] != "off") {
+			o.Err("Usage: :time on|off")
+			return
+		}
+		settings.timing = fields[1] == "on"
+		o.Println(o.DarkGray("Timing is " + fields[1]))
+		return
+	default:
+		o.Err("Unknown command: " + fields[0])
+		return
+	}
+	changed, err := loadLuaFile(L, filename)
+	if err != nil {
+		log.Error("Could not load " + filename + ": " + err.Error())
+		return
+	}
+	settings.lastLoaded = filename
+	o.Println(o.LightGreen("Loaded ") + o.White(filename) + o.DarkGray(fmt.Sprintf(" (%d globals changed)", changed)))
+}
+
+// askLine outputs a prompt and reads a line from the given reader. Unlike
+// term.Ask, reaching the end of the input is reported as io.EOF, so that
+// ctrl-d can be told apart from an empty line.
+func askLine(r *bufio.Reader, prompt string) (string, error) {
+	fmt.Print(prompt)
+	line, err := r.ReadString('\n')
+	if err == io.EOF && line != "" {
+		// The last line of the input did not end with a newline
+		return line, nil
+	}
+	return strings.TrimRight(line, "\r\n"), err
 }
 
 // LoadLuaFunctionsForREPL exports the various Lua functions that might be needed in the REPL
@@ -622,6 +1185,14 @@ func (ac *Config) LoadLuaFunctionsForREPL(L *lua.LState, o *term.TextOutput) {
 		datastruct.LoadSet(L, creator)
 		datastruct.LoadHash(L, creator)
 		datastruct.LoadKeyValue(L, creator)
+		datastruct.LoadSortedSet(L)
+		datastruct.LoadPipeline(L)
+		datastruct.LoadNames(L)
+
+		// Statistics for the Redis backend
+		if pool, ok := ac.redisPool(); ok {
+			datastruct.LoadRedis(L, pool, ac.redisDBindex)
+		}
 
 		// For saving and loading Lua functions
 		codelib.Load(L, creator)
@@ -632,9 +1203,30 @@ func (ac *Config) LoadLuaFunctionsForREPL(L *lua.LState, o *term.TextOutput) {
 	ac.LoadJFile(L, ac.serverDirOrFilename)
 	jnode.Load(L)
 
+	// Reading and writing files
+	ac.LoadFileFunctions(L, ac.serverDirOrFilename)
+
+	// Running external commands
+	ac.LoadExecFunctions(L, ac.serverDirOrFilename)
+
+	// Rendering html/template templates
+	ac.LoadTemplateFunctions(L, ac.serverDirOrFilename)
+
 	// Extras
 	pure.Load(L)
 
+	// Password hashing
+	passwords.Load(L)
+
+	// Sitemaps
+	sitemap.Load(L)
+
+	// Sending HTTP requests
+	httpclient.Load(L, ac.httpClientTimeout)
+
+	// Regular expressions
+	regex.Load(L)
+
 	// Export pprint and scriptdir
 	exportREPLSpecific(L)
 
@@ -643,6 +1235,9 @@ func (ac *Config) LoadLuaFunctionsForREPL(L *lua.LState, o *term.TextOutput) {
 
 	// Cache
 	ac.LoadCacheFunctions(L)
+
+	// Preloading files into the cache
+	ac.LoadPreloadFunctions(L, nil)
 }
 
 // REPL provides a "Read Eval Print" loop for interacting with Lua.
@@ -659,15 +1254,16 @@ func (ac *Config) REPL(ready, done chan bool) error {
 		historydir = "."
 	}
 
-	// Retrieve a Lua state
-	L := ac.luapool.Get()
+	// Create a Lua state that is not borrowed from the pool, since it is
+	// used for as long as the REPL is running
+	L := ac.luapool.New()
 	// Don't re-use the Lua state
 	defer L.Close()
 
 	// Colors and input
 	windows := (runtime.GOOS == "windows")
 	mingw := windows && strings.HasPrefix(os.Getenv("TERM"), "xterm")
-	enableColors := !windows || mingw
+	enableColors := (!windows || mingw) && !ac.noColor
 	o := term.NewTextOutput(enableColors, true)
 
 	// Command history file
@@ -683,55 +1279,87 @@ func (ac *Config) REPL(ready, done chan bool) error {
 	<-ready // Wait for the server to be ready
 
 	// Tell the user that the server is ready
-	o.Println(o.LightGreen("Ready"))
+	if !ac.noBanner {
+		o.Println(o.LightGreen("Ready"))
+	}
 
 	// Start the read, eval, print loop
 	var (
-		line     string
-		prompt   = o.LightCyan("lua> ")
-		EOF      bool
-		EOFcount int
-	)
-
-	// TODO: Automatically generate a list of all words that should be completed
-	//       based on the documentation or repl help text. Then add each word
-	//       to the completer.
-	completer := readline.NewPrefixCompleter(
-		&readline.PrefixCompleter{Name: []rune("help")},
-		&readline.PrefixCompleter{Name: []rune("webhelp")},
-		&readline.PrefixCompleter{Name: []rune("bye")},
-		&readline.PrefixCompleter{Name: []rune("quit")},
-		&readline.PrefixCompleter{Name: []rune("exit")},
-		&readline.PrefixCompleter{Name: []rune("zalgo")},
+		line               string
+		mainPrompt         = o.LightCyan("lua> ")
+		continuationPrompt = o.LightCyan(">> ")
+		prompt             = mainPrompt
+		input              luaInput
+		EOF                bool
+		EOFcount           int
+		stdin              = bufio.NewReader(os.Stdin)
+		settings           replSettings
+		goodbye            sync.Once
 	)
 
-	addFunctionsFromHelptextToCompleter(generalHelpText, completer)
+	// Remember the globals that are defined at startup, for ":globals"
+	settings.builtins = globalsSnapshot(L)
 
-	l, err := readline.NewEx(&readline.Config{
+	readlineConfig := &readline.Config{
 		Prompt:            prompt,
 		HistoryFile:       historyFilename,
-		AutoComplete:      completer,
 		InterruptPrompt:   "^C",
 		EOFPrompt:         "exit",
 		HistorySearchFold: true,
-	})
+	}
+
+	// Complete function names and methods when pressing tab, but only when
+	// running interactively
+	if readline.DefaultIsTerminal() {
+		readlineConfig.AutoComplete = &luaCompleter{L}
+	}
+
+	l, err := readline.NewEx(readlineConfig)
 	if err != nil {
 		log.Error("Could not initiate github.com/chzyer/readline: " + err.Error())
 	}
 
+	// Change the prompt, for instance when continuing a multi-line statement
+	setPrompt := func(newPrompt string) {
+		prompt = newPrompt
+		if l != nil {
+			l.SetPrompt(prompt)
+		}
+	}
+
+	// Say goodbye, but only once, both when quitting from the REPL and when
+	// the server is shut down in another way
+	sayGoodbye := func() {
+		goodbye.Do(func() {
+			o.Println(o.LightBlue(exitMessage))
+		})
+	}
+
+	// Quit the REPL and the server. The Lua state is closed by the deferred
+	// L.Close() when returning.
+	quit := func() error {
+		sayGoodbye()
+		done <- true
+		return nil
+	}
+
 	// To be run at server shutdown
 	AtShutdown(func() {
 		// Verbose mode has different log output at shutdown
 		if !ac.verboseMode {
-			o.Println(o.LightBlue(exitMessage))
+			sayGoodbye()
 		}
 	})
 	for {
 		// Retrieve user input
 		EOF = false
 		if mingw {
-			// No support for EOF
-			line = term.Ask(prompt)
+			if line, err = askLine(stdin, prompt); err != nil {
+				if err != io.EOF {
+					log.Error("Error reading line(" + err.Error() + ").")
+				}
+				EOF = true
+			}
 		} else {
 			if line, err = l.Readline(); err != nil {
 				switch {
@@ -758,12 +1386,10 @@ func (ac *Config) REPL(ready, done chan bool) error {
 					EOFcount++
 					continue
 				default:
-					done <- true
-					return nil
+					return quit()
 				}
 			} else {
-				done <- true
-				return nil
+				return quit()
 			}
 		}
 
@@ -772,54 +1398,53 @@ func (ac *Config) REPL(ready, done chan bool) error {
 			continue
 		}
 
-		switch line {
-		case "help":
-			outputHelp(o, generalHelpText)
-			continue
-		case "webhelp":
-			outputHelp(o, webHelpText)
-			continue
-		case "confighelp":
-			outputHelp(o, configHelpText)
-			continue
-		case "quit", "exit", "shutdown", "halt":
-			done <- true
-			return nil
-		case "zalgo":
-			// Easter egg
-			o.ErrExit("Ḫ̷̲̫̰̯̭̀̂̑̈ͅĚ̥̖̩̘̱͔͈͈ͬ̚ ̦̦͖̲̀ͦ͂C̜͓̲̹͐̔ͭ̏Oͭ͛͂̋ͭͬͬ͆͏̺͓̰͚͠ͅM̢͉̼̖͍̊̕Ḛ̭̭͗̉̀̆ͬ̐ͪ̒S͉̪͂͌̄")
-		default:
-			if strings.HasPrefix(line, "help(") {
-				topic := line[5:]
-				if strings.HasSuffix(topic, ")") {
-					topic = topic[:len(topic)-1]
-				}
-				outputHelpAbout(o, generalHelpText+webHelpText+configHelpText, topic)
+		// Lines that continue a multi-line statement are not commands
+		if !input.pending() {
+			switch line {
+			case "help":
+				outputHelp(o, generalHelpText)
 				continue
-			}
-		}
-
-		// If the line starts with print, don't touch it
-		if strings.HasPrefix(line, "print(") {
-			if err = L.DoString(line); err != nil {
-				// Output the error message
-				o.Err(err.Error())
-			}
-		} else {
-			// Wrap the line in "pprint"
-			if err = L.DoString("pprint(" + line + ")"); err != nil {
-				// If there was a syntax error, try again without pprint
-				if strings.Contains(err.Error(), "syntax error") {
-					if err = L.DoString(line); err != nil {
-						// Output the error message
-						o.Err(err.Error())
+			case "webhelp":
+				outputHelp(o, webHelpText)
+				continue
+			case "confighelp":
+				outputHelp(o, configHelpText)
+				continue
+			case "quit", "exit", "shutdown", "halt":
+				return quit()
+			case "zalgo":
+				// Easter egg
+				o.ErrExit("Ḫ̷̲̫̰̯̭̀̂̑̈ͅĚ̥̖̩̘̱͔͈͈ͬ̚ ̦̦͖̲̀ͦ͂C̜͓̲̹͐̔ͭ̏Oͭ͛͂̋ͭͬͬ͆͏̺͓̰͚͠ͅM̢͉̼̖͍̊̕Ḛ̭̭͗̉̀̆ͬ̐ͪ̒S͉̪͂͌̄")
+			default:
+				if strings.HasPrefix(line, ":") {
+					replMetaCommand(L, o, line, &settings)
+					continue
+				}
+				if strings.HasPrefix(line, "help(") {
+					topic := line[5:]
+					if strings.HasSuffix(topic, ")") {
+						topic = topic[:len(topic)-1]
 					}
-					// For other kinds of errors, output the error
-				} else {
-					// Output the error message
-					o.Err(err.Error())
+					outputHelpAbout(o, generalHelpText+webHelpText+configHelpText, topic)
+					continue
 				}
 			}
 		}
+
+		// Evaluate the collected lines, once they form a complete chunk
+		code, complete := input.add(line)
+		if !complete {
+			setPrompt(continuationPrompt)
+			continue
+		}
+		setPrompt(mainPrompt)
+		start := time.Now()
+		if err = evalREPL(os.Stdout, L, code); err != nil {
+			// Output the error message
+			o.Err(err.Error())
+		}
+		if settings.timing {
+			o.Println(o.DarkGray(time.Since(start).String()))
+		}
 	}
 }
@@ -0,0 +1,203 @@
+package engine
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"io/ioutil"
+	"strings"
+	"testing"
+
+	"github.com/bmizerany/assert"
+	"github.com/xyproto/gopher-lua"
+	"github.com/xyproto/term"
+)
+
+func TestIncompleteLua(t *testing.T) {
+	for _, code := range []string{"function f()", "if x then", "for i = 1, 3 do", "f(", "x = {", "s = [[abc"} {
+		assert.Equal(t, incompleteLua(code), true)
+	}
+	for _, code := range []string{"x = 1", "2 + 2", "function f() end", "s = \"abc", "end"} {
+		assert.Equal(t, incompleteLua(code), false)
+	}
+}
+
+func TestREPLMultiline(t *testing.T) {
+	L := lua.NewState()
+	defer L.Close()
+	exportREPLSpecific(L)
+
+	var input luaInput
+
+	// A function definition over several lines
+	for _, line := range []string{"function double(x)", "if x == nil then", "return 0", "end"} {
+		_, complete := input.add(line)
+		assert.Equal(t, complete, false)
+		assert.Equal(t, input.pending(), true)
+	}
+	code, complete := input.add("return x * 2 end")
+	assert.Equal(t, complete, true)
+	assert.Equal(t, input.pending(), false)
+	assert.Equal(t, evalREPL(ioutil.Discard, L, code), nil)
+
+	// Followed by a call
+	code, complete = input.add("result = double(21)")
+	assert.Equal(t, complete, true)
+	assert.Equal(t, evalREPL(ioutil.Discard, L, code), nil)
+	assert.Equal(t, L.GetGlobal("result"), lua.LNumber(42))
+}
+
+func TestLuaCompleter(t *testing.T) {
+	L := lua.NewState()
+	defer L.Close()
+	exportREPLSpecific(L)
+
+	// Register a class with methods, the same way as the data structures
+	mt := L.NewTypeMetatable("TEST")
+	mt.RawSetH(lua.LString("__index"), mt)
+	L.SetFuncs(mt, map[string]lua.LGFunction{
+		"add": func(L *lua.LState) int { return 0 },
+		"all": func(L *lua.LState) int { return 0 },
+		"del": func(L *lua.LState) int { return 0 },
+	})
+	L.SetGlobal("Test", L.NewFunction(func(L *lua.LState) int { return 0 }))
+	ud := L.NewUserData()
+	L.SetMetatable(ud, mt)
+	L.SetGlobal("myset", ud)
+
+	lc := &luaCompleter{L}
+	assert.Equal(t, lc.candidates("Tes"), []string{"Test("})
+	assert.Equal(t, lc.candidates("pp"), []string{"pprint("})
+	assert.Equal(t, lc.candidates("he"), []string{"help"})
+	assert.Equal(t, lc.candidates("myset:a"), []string{"myset:add(", "myset:all("})
+	assert.Equal(t, lc.candidates("myset:__"), []string(nil))
+	assert.Equal(t, lc.candidates("string.upp"), []string{"string.upper("})
+
+	// Completions are returned as suffixes to the word before the cursor
+	line := []rune("x = myset:de")
+	suffixes, length := lc.Do(line, len(line))
+	assert.Equal(t, suffixes, [][]rune{[]rune("l(")})
+	assert.Equal(t, length, len("myset:de"))
+}
+
+func TestAskLine(t *testing.T) {
+	r := bufio.NewReader(strings.NewReader("x = 1\n\r\nexit"))
+
+	line, err := askLine(r, "")
+	assert.Equal(t, err, nil)
+	assert.Equal(t, line, "x = 1")
+
+	// An empty line is not the end of the input
+	line, err = askLine(r, "")
+	assert.Equal(t, err, nil)
+	assert.Equal(t, line, "")
+
+	// The last line does not need to end with a newline
+	line, err = askLine(r, "")
+	assert.Equal(t, err, nil)
+	assert.Equal(t, line, "exit")
+
+	_, err = askLine(r, "")
+	assert.Equal(t, err, io.EOF)
+}
+
+func TestREPLLoad(t *testing.T) {
+	L := lua.NewState()
+	defer L.Close()
+	exportREPLSpecific(L)
+
+	// The file defines one function and one variable
+	changed, err := loadLuaFile(L, "testdata/repl_load.lua")
+	assert.Equal(t, err, nil)
+	assert.Equal(t, changed, 2)
+	assert.Equal(t, evalREPL(ioutil.Discard, L, "result = triple(14)"), nil)
+	assert.Equal(t, L.GetGlobal("result"), lua.LNumber(42))
+
+	// Loading the file again redefines the function
+	changed, err = loadLuaFile(L, "testdata/repl_load.lua")
+	assert.Equal(t, err, nil)
+	assert.Equal(t, changed, 1)
+
+	_, err = loadLuaFile(L, "testdata/nonexisting.lua")
+	assert.NotEqual(t, err, nil)
+}
+
+func TestREPLEval(t *testing.T) {
+	L := lua.NewState()
+	defer L.Close()
+	exportREPLSpecific(L)
+
+	var buf bytes.Buffer
+
+	// An assignment is run as a statement, and outputs nothing
+	assert.Equal(t, evalREPL(&buf, L, "x = 5"), nil)
+	assert.Equal(t, buf.String(), "")
+	assert.Equal(t, L.GetGlobal("x"), lua.LNumber(5))
+
+	// A bare expression outputs its value
+	assert.Equal(t, evalREPL(&buf, L, "x * 2"), nil)
+	assert.Equal(t, buf.String(), "10\n")
+	buf.Reset()
+
+	// A function call with several return values outputs all of them,
+	// and the function is only called once
+	assert.Equal(t, evalREPL(&buf, L, "function two() calls = (calls or 0) + 1; return 1, \"b\" end"), nil)
+	assert.Equal(t, evalREPL(&buf, L, "two()"), nil)
+	assert.Equal(t, buf.String(), "1\tb\n")
+	assert.Equal(t, L.GetGlobal("calls"), lua.LNumber(1))
+	buf.Reset()
+
+	// A function call without return values outputs nothing
+	assert.Equal(t, evalREPL(&buf, L, "print2 = function() end"), nil)
+	assert.Equal(t, evalREPL(&buf, L, "print2()"), nil)
+	assert.Equal(t, buf.String(), "")
+
+	// Errors are returned
+	assert.NotEqual(t, evalREPL(&buf, L, "error(\"oops\")"), nil)
+	assert.NotEqual(t, evalREPL(&buf, L, "x = = 1"), nil)
+	assert.Equal(t, L.GetTop(), 0)
+}
+
+func TestHighlightWithoutColors(t *testing.T) {
+	o := term.NewTextOutput(false, true)
+	for _, line := range strings.Split(generalHelpText+webHelpText+configHelpText, "\n") {
+		highlighted := highlight(o, line)
+		assert.Equal(t, strings.Contains(highlighted, "\x1b"), false)
+		// Only the colors are removed, not the text
+		assert.Equal(t, strings.TrimSpace(highlighted), strings.TrimSpace(line))
+	}
+}
+
+func TestREPLTime(t *testing.T) {
+	L := lua.NewState()
+	defer L.Close()
+	o := term.NewTextOutput(false, false)
+
+	var settings replSettings
+	replMetaCommand(L, o, ":time on", &settings)
+	assert.Equal(t, settings.timing, true)
+	replMetaCommand(L, o, ":time maybe", &settings)
+	assert.Equal(t, settings.timing, true)
+	replMetaCommand(L, o, ":time off", &settings)
+	assert.Equal(t, settings.timing, false)
+
+	replMetaCommand(L, o, ":load testdata/repl_load.lua", &settings)
+	assert.Equal(t, settings.lastLoaded, "testdata/repl_load.lua")
+}
+
+func TestREPLGlobals(t *testing.T) {
+	L := lua.NewState()
+	defer L.Close()
+	exportREPLSpecific(L)
+	builtins := globalsSnapshot(L)
+
+	assert.Equal(t, len(userGlobals(L, builtins)), 0)
+	assert.Equal(t, evalREPL(ioutil.Discard, L, "zeta = 1; alpha = {}; function pprint() end"), nil)
+
+	// New and redefined globals are listed alphabetically
+	assert.Equal(t, userGlobals(L, builtins), []string{"alpha", "pprint", "zeta"})
+
+	// Listing the globals does not change them
+	outputGlobals(L, term.NewTextOutput(false, false), builtins)
+	assert.Equal(t, userGlobals(L, builtins), []string{"alpha", "pprint", "zeta"})
+}
@@ -0,0 +1,111 @@
+package engine
+
+import (
+	"sort"
+	"strings"
+	"unicode"
+
+	"github.com/xyproto/gopher-lua"
+)
+
+// replCommands are the commands that are handled by the REPL itself
+var replCommands = []string{"help", "webhelp", "confighelp", "quit", "exit"}
+
+// luaCompleter is a readline.AutoCompleter that completes the names of the
+// global functions and variables in a Lua state, and the names of the methods
+// of userdata values, like "myset:ad" -> "myset:add(". Since the method names
+// are looked up in the metatables that the Load functions register the methods
+// in (like setMethods for Set), the completions are always in sync with the
+// available functions.
+type luaCompleter struct {
+	L *lua.LState
+}
+
+// isIdentRune checks if the given rune can be part of a Lua name
+func isIdentRune(r rune) bool {
+	return r == '_' || unicode.IsLetter(r) || unicode.IsDigit(r)
+}
+
+// completionName returns the name of the given value, with a "(" appended if
+// the value is a function
+func completionName(name string, value lua.LValue) string {
+	if value.Type() == lua.LTFunction {
+		return name + "("
+	}
+	return name
+}
+
+// tableNames returns the names of the keys in the given table that start with
+// the given prefix, for use as completions. Metamethods are skipped.
+func tableNames(table *lua.LTable, prefix string) []string {
+	var names []string
+	table.ForEach(func(key, value lua.LValue) {
+		name, ok := key.(lua.LString)
+		if !ok || strings.HasPrefix(string(name), "__") || !strings.HasPrefix(string(name), prefix) {
+			return
+		}
+		names = append(names, completionName(string(name), value))
+	})
+	return names
+}
+
+// methodTable returns the table with the methods of the given value, if it is
+// a userdata or table with a metatable that has an __index table
+func (lc *luaCompleter) methodTable(value lua.LValue) (*lua.LTable, bool) {
+	mt, ok := lc.L.GetMetatable(value).(*lua.LTable)
+	if !ok {
+		return nil, false
+	}
+	index, ok := mt.RawGetString("__index").(*lua.LTable)
+	return index, ok
+}
+
+// candidates returns the possible completions for the given word, like "Se",
+// "string.fo" or "myset:ad"
+func (lc *luaCompleter) candidates(word string) []string {
+	var names []string
+	if pos := strings.LastIndexAny(word, ".:"); pos != -1 {
+		// Complete the fields or methods of a global variable
+		value := lc.L.GetGlobal(word[:pos])
+		prefix := word[pos+1:]
+		var table *lua.LTable
+		if word[pos] == ':' {
+			table, _ = lc.methodTable(value)
+		} else {
+			table, _ = value.(*lua.LTable)
+		}
+		if table != nil {
+			for _, name := range tableNames(table, prefix) {
+				names = append(names, word[:pos+1]+name)
+			}
+		}
+	} else {
+		// Complete the REPL commands and the global functions and variables
+		for _, command := range replCommands {
+			if strings.HasPrefix(command, word) {
+				names = append(names, command)
+			}
+		}
+		names = append(names, tableNames(lc.L.G.Global, word)...)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Do returns the completions for the word before the cursor, as suffixes to
+// the word, together with the length of the word. Implements readline.AutoCompleter.
+func (lc *luaCompleter) Do(line []rune, pos int) ([][]rune, int) {
+	start := pos
+	for start > 0 && (isIdentRune(line[start-1]) || line[start-1] == '.' || line[start-1] == ':') {
+		start--
+	}
+	word := string(line[start:pos])
+	if word == "" {
+		return nil, 0
+	}
+	var suffixes [][]rune
+	for _, name := range lc.candidates(word) {
+		suffixes = append(suffixes, []rune(name[len(word):]))
+	}
+	return suffixes, len([]rune(word))
+}
@@ -0,0 +1,185 @@
+package engine
+
+import (
+	"bufio"
+	"errors"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/xyproto/gopher-lua"
+)
+
+// beforeHook is called before a request is handled. Returns false if the
+// request should be rejected.
+type beforeHook func(req *http.Request) (bool, error)
+
+// afterHook is called after a request has been handled, with the status code
+// and how long it took
+type afterHook func(req *http.Request, code int, duration time.Duration) error
+
+// requestHooks are the functions given to BeforeRequest and AfterRequest
+type requestHooks struct {
+	before []beforeHook
+	after  []afterHook
+}
+
+// codeWriter is a http.ResponseWriter that keeps track of the status code,
+// for the AfterRequest functions and the metrics
+type codeWriter struct {
+	http.ResponseWriter
+	code int
+}
+
+// WriteHeader stores the status code and writes the header
+func (cw *codeWriter) WriteHeader(code int) {
+	if cw.code == 0 && code >= 200 {
+		cw.code = code
+	}
+	cw.ResponseWriter.WriteHeader(code)
+}
+
+// Write writes the response, with "200 OK" if no status code has been written
+func (cw *codeWriter) Write(b []byte) (int, error) {
+	if cw.code == 0 {
+		cw.code = http.StatusOK
+	}
+	return cw.ResponseWriter.Write(b)
+}
+
+// Flush flushes the response, for Server-Sent Events
+func (cw *codeWriter) Flush() {
+	if flusher, ok := cw.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// Hijack lets the caller take over the connection, for WebSockets
+func (cw *codeWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hijacker, ok := cw.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("the ResponseWriter does not support hijacking")
+	}
+	if cw.code == 0 {
+		cw.code = http.StatusSwitchingProtocols
+	}
+	return hijacker.Hijack()
+}
+
+// Unwrap returns the wrapped ResponseWriter, for use with http.ResponseController
+func (cw *codeWriter) Unwrap() http.ResponseWriter {
+	return cw.ResponseWriter
+}
+
+// requestHookHandler wraps the given handler, so that the functions given to
+// BeforeRequest run before every request, and the functions given to
+// AfterRequest run after every request
+func (ac *Config) requestHookHandler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		ac.reloadMut.RLock()
+		hooks := ac.requestHooks
+		ac.reloadMut.RUnlock()
+		if hooks == nil {
+			next.ServeHTTP(w, req)
+			return
+		}
+		start := time.Now()
+		cw := &codeWriter{ResponseWriter: w}
+		if ac.runBeforeHooks(hooks.before, cw, req) {
+			next.ServeHTTP(cw, req)
+		}
+		if cw.code == 0 {
+			cw.code = http.StatusOK
+		}
+		duration := time.Since(start)
+		for _, hook := range hooks.after {
+			if err := hook(req, cw.code, duration); err != nil {
+				log.Error("The AfterRequest function failed: ", err)
+			}
+		}
+	})
+}
+
+// runBeforeHooks runs the given BeforeRequest functions, until one of them
+// rejects the request. Returns true if the request should be handled.
+func (ac *Config) runBeforeHooks(hooks []beforeHook, w http.ResponseWriter, req *http.Request) bool {
+	for _, hook := range hooks {
+		ok, err := hook(req)
+		if err != nil {
+			// Requests are not let through by a failing function
+			log.Error("The BeforeRequest function failed: ", err)
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return false
+		}
+		if !ok {
+			http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+			return false
+		}
+	}
+	return true
+}
+
+// addRequestHooks adds the given BeforeRequest and AfterRequest functions.
+// While the server configuration is being reloaded, the functions are used
+// when the reloading is done.
+func (ac *Config) addRequestHooks(before beforeHook, after afterHook) {
+	ac.reloadMut.Lock()
+	defer ac.reloadMut.Unlock()
+	target := &ac.requestHooks
+	if ac.reloadedRequestHooks != nil {
+		target = &ac.reloadedRequestHooks
+	}
+	// Copy the hooks, since they may be in use by requestHookHandler
+	hooks := &requestHooks{}
+	if *target != nil {
+		hooks.before = append(hooks.before, (*target).before...)
+		hooks.after = append(hooks.after, (*target).after...)
+	}
+	if before != nil {
+		hooks.before = append(hooks.before, before)
+	}
+	if after != nil {
+		hooks.after = append(hooks.after, after)
+	}
+	*target = hooks
+}
+
+// requestInfo returns a Lua table with the method, path and client IP address
+// of the given request
+func (ac *Config) requestInfo(L *lua.LState, req *http.Request) *lua.LTable {
+	table := L.NewTable()
+	table.RawSetString("method", lua.LString(req.Method))
+	table.RawSetString("path", lua.LString(req.URL.Path))
+	table.RawSetString("clientIP", lua.LString(ac.requestClientIP(req)))
+	return table
+}
+
+// luaBeforeHook returns a BeforeRequest function that calls the given Lua
+// function with a table with the method, path and client IP address. The Lua
+// function runs in the Lua state of the configuration script, one call at
+// the time.
+func (ac *Config) luaBeforeHook(L *lua.LState, mut *sync.Mutex, luaFunc *lua.LFunction) beforeHook {
+	return func(req *http.Request) (bool, error) {
+		mut.Lock()
+		defer mut.Unlock()
+		if err := L.CallByParam(lua.P{Fn: luaFunc, NRet: 1, Protect: true}, ac.requestInfo(L, req)); err != nil {
+			return false, err
+		}
+		ret := L.Get(-1)
+		L.Pop(1)
+		return ret != lua.LFalse, nil
+	}
+}
+
+// luaAfterHook returns an AfterRequest function that calls the given Lua
+// function with a table with the method, path and client IP address, the
+// status code and the duration in seconds
+func (ac *Config) luaAfterHook(L *lua.LState, mut *sync.Mutex, luaFunc *lua.LFunction) afterHook {
+	return func(req *http.Request, code int, duration time.Duration) error {
+		mut.Lock()
+		defer mut.Unlock()
+		return L.CallByParam(lua.P{Fn: luaFunc, NRet: 0, Protect: true}, ac.requestInfo(L, req), lua.LNumber(code), lua.LNumber(duration.Seconds()))
+	}
+}
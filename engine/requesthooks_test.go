@@ -0,0 +1,94 @@
+package engine
+
+import (
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/bmizerany/assert"
+	"github.com/xyproto/gopher-lua"
+	bolt "github.com/xyproto/permissionbolt"
+)
+
+func TestRequestHooks(t *testing.T) {
+	boltFile, err := ioutil.TempFile("", "algernon_hooks")
+	assert.Equal(t, err, nil)
+	boltFile.Close()
+	defer os.Remove(boltFile.Name())
+
+	ac := &Config{}
+	ac.perm, err = bolt.NewWithConf(boltFile.Name())
+	assert.Equal(t, err, nil)
+
+	L := lua.NewState()
+	defer L.Close()
+	assert.Equal(t, ac.LoadServerConfigFunctions(L, "serverconf.lua"), nil)
+	assert.Equal(t, L.DoString(`
+		log = {}
+		BeforeRequest(function(req)
+			table.insert(log, "before " .. req.method .. " " .. req.path .. " " .. req.clientIP)
+			return req.path ~= "/blocked"
+		end)
+		AfterRequest(function(req, status, duration)
+			assert(duration >= 0)
+			table.insert(log, "after " .. req.path .. " " .. status)
+		end)
+	`), nil)
+
+	handled := 0
+	handler := ac.requestHookHandler(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		handled++
+		if req.URL.Path == "/missing" {
+			http.NotFound(w, req)
+			return
+		}
+		w.Write([]byte("hello"))
+	}))
+
+	rec := get(handler, "/hello")
+	assert.Equal(t, rec.Code, http.StatusOK)
+	assert.Equal(t, rec.Body.String(), "hello")
+
+	// Returning false from the BeforeRequest function blocks the handler
+	rec = get(handler, "/blocked")
+	assert.Equal(t, rec.Code, http.StatusForbidden)
+
+	rec = get(handler, "/missing")
+	assert.Equal(t, rec.Code, http.StatusNotFound)
+	assert.Equal(t, handled, 2)
+
+	var logged []string
+	L.GetGlobal("log").(*lua.LTable).ForEach(func(_, line lua.LValue) { logged = append(logged, line.String()) })
+	assert.Equal(t, logged, []string{
+		"before GET /hello 192.0.2.1",
+		"after /hello 200",
+		"before GET /blocked 192.0.2.1",
+		"after /blocked 403",
+		"before GET /missing 192.0.2.1",
+		"after /missing 404",
+	})
+}
+
+func TestRequestHooksFailure(t *testing.T) {
+	ac, handler, cleanup := newReloadConfig(t, `
+		BeforeRequest(function(req) undefined_function() end)
+		AfterRequest(function(req, status) undefined_function() end)
+	`)
+	defer cleanup()
+	assert.Equal(t, ioutil.WriteFile(filepath.Join(ac.serverDirOrFilename, "hello.txt"), []byte("hello"), 0644), nil)
+	handler = ac.requestHookHandler(handler)
+
+	// Requests are not let through by a failing BeforeRequest function
+	rec := get(handler, "/hello.txt")
+	assert.Equal(t, rec.Code, http.StatusInternalServerError)
+
+	// Reloading the configuration without the hooks removes them
+	confFilename := ac.serverConfigurationFilenames[0]
+	assert.Equal(t, ioutil.WriteFile(confFilename, []byte(`-- no hooks`), 0644), nil)
+	assert.Equal(t, ac.reloadServerConfiguration(), nil)
+	rec = get(handler, "/hello.txt")
+	assert.Equal(t, rec.Code, http.StatusOK)
+	assert.Equal(t, rec.Body.String(), "hello")
+}
@@ -0,0 +1,76 @@
+package engine
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// reverseProxy forwards the requests for an URL path prefix to an upstream server
+type reverseProxy struct {
+	prefix string
+	proxy  *httputil.ReverseProxy
+}
+
+// newReverseProxy returns a reverse proxy that forwards the requests for the
+// given URL path prefix to the given upstream URL. The prefix is removed from
+// the path before the request is forwarded.
+func newReverseProxy(prefix, target string) (*reverseProxy, error) {
+	targetURL, err := url.Parse(target)
+	if err != nil {
+		return nil, err
+	}
+	if (targetURL.Scheme != "http" && targetURL.Scheme != "https") || targetURL.Host == "" {
+		return nil, fmt.Errorf("invalid upstream URL: %s", target)
+	}
+	prefix = "/" + strings.Trim(prefix, "/")
+	proxy := httputil.NewSingleHostReverseProxy(targetURL)
+	director := proxy.Director
+	proxy.Director = func(req *http.Request) {
+		// Let the upstream server know about the original request.
+		// X-Forwarded-For is set by the ReverseProxy.
+		scheme := "http"
+		if req.TLS != nil {
+			scheme = "https"
+		}
+		req.Header.Set("X-Forwarded-Proto", scheme)
+		req.Header.Set("X-Forwarded-Host", req.Host)
+		// Remove the prefix before the path is joined with the upstream path
+		req.URL.Path = "/" + strings.TrimPrefix(strings.TrimPrefix(req.URL.Path, prefix), "/")
+		req.URL.RawPath = ""
+		director(req)
+	}
+	proxy.ErrorHandler = func(w http.ResponseWriter, req *http.Request, err error) {
+		log.Errorf("Could not forward %s to %s: %s", req.URL.Path, targetURL.Host, err)
+		http.Error(w, "502 Bad Gateway", http.StatusBadGateway)
+	}
+	return &reverseProxy{prefix, proxy}, nil
+}
+
+// matches checks if the given URL path is the prefix, or is below it
+func (rp *reverseProxy) matches(urlPath string) bool {
+	return rp.prefix == "/" || urlPath == rp.prefix || strings.HasPrefix(urlPath, rp.prefix+"/")
+}
+
+// ReverseProxyHandler wraps the given handler, so that requests for the URL
+// path prefixes of the given reverse proxies are forwarded to their upstream
+// servers. The longest matching prefix is used. Other requests are passed on.
+func ReverseProxyHandler(next http.Handler, proxies []*reverseProxy) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		var found *reverseProxy
+		for _, rp := range proxies {
+			if rp.matches(req.URL.Path) && (found == nil || len(rp.prefix) > len(found.prefix)) {
+				found = rp
+			}
+		}
+		if found == nil {
+			next.ServeHTTP(w, req)
+			return
+		}
+		found.proxy.ServeHTTP(w, req)
+	})
+}
@@ -0,0 +1,65 @@
+package engine
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/bmizerany/assert"
+)
+
+func TestReverseProxyHandler(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("X-Upstream", "yes")
+		w.Write([]byte(req.URL.RequestURI() + " " + req.Header.Get("X-Token") + " " +
+			req.Header.Get("X-Forwarded-Proto") + " " + req.Header.Get("X-Forwarded-For")))
+	}))
+	defer upstream.Close()
+
+	// An upstream server that is not running
+	closed := httptest.NewServer(http.NotFoundHandler())
+	closed.Close()
+
+	api, err := newReverseProxy("/api/", upstream.URL+"/v1")
+	assert.Equal(t, err, nil)
+	down, err := newReverseProxy("/api/down", closed.URL)
+	assert.Equal(t, err, nil)
+	_, err = newReverseProxy("/bad", "localhost:8080")
+	assert.NotEqual(t, err, nil)
+
+	local := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte("local"))
+	})
+	server := httptest.NewServer(ReverseProxyHandler(local, []*reverseProxy{api, down}))
+	defer server.Close()
+
+	get := func(urlPath string) (*http.Response, string) {
+		req, err := http.NewRequest("GET", server.URL+urlPath, nil)
+		assert.Equal(t, err, nil)
+		req.Header.Set("X-Token", "abc")
+		resp, err := http.DefaultClient.Do(req)
+		assert.Equal(t, err, nil)
+		defer resp.Body.Close()
+		body, err := ioutil.ReadAll(resp.Body)
+		assert.Equal(t, err, nil)
+		return resp, string(body)
+	}
+
+	// The prefix is replaced with the upstream path, and headers are kept
+	resp, body := get("/api/users?id=1")
+	assert.Equal(t, resp.StatusCode, http.StatusOK)
+	assert.Equal(t, resp.Header.Get("X-Upstream"), "yes")
+	assert.Equal(t, body, "/v1/users?id=1 abc http 127.0.0.1")
+
+	_, body = get("/api")
+	assert.Equal(t, body, "/v1/ abc http 127.0.0.1")
+
+	// Paths that only start with the same letters are not forwarded
+	_, body = get("/apis")
+	assert.Equal(t, body, "local")
+
+	// Upstream connection errors give "502 Bad Gateway"
+	resp, _ = get("/api/down/users")
+	assert.Equal(t, resp.StatusCode, http.StatusBadGateway)
+}
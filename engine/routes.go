@@ -0,0 +1,124 @@
+package engine
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/xyproto/algernon/lua/convert"
+	"github.com/xyproto/gopher-lua"
+)
+
+// errRouteUpvalues is returned if a route handler function refers to local
+// variables outside of the function, which are not available in the Lua state
+// that handles the request
+var errRouteUpvalues = errors.New("a route handler can not use local variables from outside of the function")
+
+// route is an URL path, or a pattern with parameters like "/user/:id", that
+// is handled by a Lua function
+type route struct {
+	path     string
+	segments []string
+	proto    *lua.FunctionProto
+	filename string // the configuration script, for finding files
+}
+
+// pathSegments returns the parts of the given URL path, without the leading
+// and trailing slashes
+func pathSegments(urlPath string) []string {
+	return strings.Split(strings.Trim(urlPath, "/"), "/")
+}
+
+// newRoute returns a route for the given path or pattern. Segments that start
+// with ":" match any non-empty segment, and are passed on as parameters.
+func newRoute(path string, proto *lua.FunctionProto, filename string) *route {
+	return &route{
+		path:     "/" + strings.Trim(path, "/"),
+		segments: pathSegments(path),
+		proto:    proto,
+		filename: filename,
+	}
+}
+
+// match checks if the given URL path matches the route, and returns the
+// parameters, if any
+func (rt *route) match(urlPath string) (map[string]string, bool) {
+	parts := pathSegments(urlPath)
+	if len(parts) != len(rt.segments) {
+		return nil, false
+	}
+	params := make(map[string]string)
+	for i, segment := range rt.segments {
+		switch {
+		case strings.HasPrefix(segment, ":") && parts[i] != "":
+			params[segment[1:]] = parts[i]
+		case segment != parts[i]:
+			return nil, false
+		}
+	}
+	return params, true
+}
+
+// findRoute returns the route that matches the given URL path, and its
+// parameters. Routes with fewer parameters are preferred, so that "/user/new"
+// is used instead of "/user/:id". Returns nil if no route matches.
+func findRoute(routes []*route, urlPath string) (*route, map[string]string) {
+	var (
+		found       *route
+		foundParams map[string]string
+	)
+	for _, rt := range routes {
+		if params, ok := rt.match(urlPath); ok && (found == nil || len(params) < len(foundParams)) {
+			found, foundParams = rt, params
+		}
+	}
+	return found, foundParams
+}
+
+// serveRoute runs the Lua function of the given route in a Lua state from the
+// pool, with the same functions as the Lua handlers and with a table of the
+// parameters from the URL path as the argument
+func (ac *Config) serveRoute(w http.ResponseWriter, req *http.Request, rt *route, params map[string]string) {
+	// Check the permissions, like for the other handlers
+	if ac.perm != nil {
+		ac.reloadMut.RLock()
+		rejected := ac.perm.Rejected(w, req)
+		denyFunction := ac.perm.DenyFunction()
+		ac.reloadMut.RUnlock()
+		if rejected {
+			denyFunction(w, req)
+			return
+		}
+	}
+
+	// Retrieve a Lua state
+	L := ac.luapool.Get()
+	defer ac.luapool.Put(L)
+
+	flushFunc := func() {
+		flushResponse(w)
+	}
+	ac.LoadCommonFunctions(w, req, rt.filename, L, flushFunc, nil, newEarlyHints(w, req, true))
+
+	L.Push(L.NewFunctionFromProto(rt.proto))
+	L.Push(convert.Map2table(L, params))
+	if err := L.PCall(1, 0, nil); err != nil {
+		// Non-fatal error
+		log.Error("Handler for "+rt.path+" failed:", err)
+	}
+}
+
+// RouteHandler wraps the given handler, so that requests for the paths of the
+// routes given to Handle are handled by their Lua functions. Other requests
+// are passed on.
+func (ac *Config) RouteHandler(next http.Handler, routes []*route) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		rt, params := findRoute(routes, req.URL.Path)
+		if rt == nil {
+			next.ServeHTTP(w, req)
+			return
+		}
+		ac.serveRoute(w, req, rt, params)
+	})
+}
@@ -0,0 +1,142 @@
+package engine
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/bmizerany/assert"
+	"github.com/xyproto/algernon/lua/pool"
+	"github.com/xyproto/gopher-lua"
+	bolt "github.com/xyproto/permissionbolt"
+)
+
+// newRouteConfig returns a configuration with a Bolt database and a Lua
+// pool, and a function for removing them
+func newRouteConfig(t *testing.T) (*Config, func()) {
+	boltFile, err := ioutil.TempFile("", "algernon_routes")
+	assert.Equal(t, err, nil)
+	boltFile.Close()
+	ac := &Config{}
+	ac.perm, err = bolt.NewWithConf(boltFile.Name())
+	assert.Equal(t, err, nil)
+	ac.luapool = pool.New()
+	return ac, func() {
+		ac.luapool.Shutdown()
+		os.Remove(boltFile.Name())
+	}
+}
+
+// serveRoutes runs the given server configuration script, and returns a
+// server that serves the routes from Handle, and "local" for other requests
+func serveRoutes(t *testing.T, ac *Config, script string) *httptest.Server {
+	L := lua.NewState()
+	defer L.Close()
+	assert.Equal(t, ac.LoadServerConfigFunctions(L, "serverconf.lua"), nil)
+	assert.Equal(t, L.DoString(script), nil)
+
+	local := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte("local"))
+	})
+	return httptest.NewServer(ac.RouteHandler(local, ac.routes))
+}
+
+// getBody returns the status code and the body of a GET request for the given URL
+func getBody(t *testing.T, url string) (int, string) {
+	resp, err := http.Get(url)
+	assert.Equal(t, err, nil)
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	assert.Equal(t, err, nil)
+	return resp.StatusCode, strings.TrimSpace(string(body))
+}
+
+func TestHandleExactRoute(t *testing.T) {
+	ac, cleanup := newRouteConfig(t)
+	defer cleanup()
+	server := serveRoutes(t, ac, `
+		Handle("/hello", function(params)
+			content("text/plain")
+			print("hello from " .. urlpath())
+		end)
+		Handle("/admin/stats", function(params)
+			print("stats")
+		end)
+	`)
+	defer server.Close()
+
+	code, body := getBody(t, server.URL+"/hello")
+	assert.Equal(t, code, http.StatusOK)
+	assert.Equal(t, body, "hello from /hello")
+	_, body = getBody(t, server.URL+"/hello/")
+	assert.Equal(t, body, "hello from /hello/")
+
+	// Other paths are passed on
+	for _, urlPath := range []string{"/", "/hello/there", "/hellos"} {
+		_, body = getBody(t, server.URL+urlPath)
+		assert.Equal(t, body, "local")
+	}
+
+	// The permissions are checked first
+	code, body = getBody(t, server.URL+"/admin/stats")
+	assert.Equal(t, code, http.StatusForbidden)
+	assert.NotEqual(t, body, "stats")
+}
+
+func TestHandleRouteParameters(t *testing.T) {
+	ac, cleanup := newRouteConfig(t)
+	defer cleanup()
+	server := serveRoutes(t, ac, `
+		Handle("/user/:id", function(params)
+			print("user " .. params.id)
+		end)
+		Handle("/user/new", function(params)
+			print("new user")
+		end)
+		Handle("/user/:id/posts/:post", function(params)
+			print("post " .. params.post .. " by user " .. params.id)
+		end)
+	`)
+	defer server.Close()
+
+	_, body := getBody(t, server.URL+"/user/42")
+	assert.Equal(t, body, "user 42")
+	_, body = getBody(t, server.URL+"/user/alice%20b")
+	assert.Equal(t, body, "user alice b")
+	_, body = getBody(t, server.URL+"/user/42/posts/7")
+	assert.Equal(t, body, "post 7 by user 42")
+
+	// Routes without parameters are preferred
+	_, body = getBody(t, server.URL+"/user/new")
+	assert.Equal(t, body, "new user")
+
+	// Parameters do not match empty or missing segments
+	for _, urlPath := range []string{"/user", "/user/", "/user//posts/7", "/user/42/posts"} {
+		_, body = getBody(t, server.URL+urlPath)
+		assert.Equal(t, body, "local")
+	}
+}
+
+func TestHandleUpvalues(t *testing.T) {
+	ac, cleanup := newRouteConfig(t)
+	defer cleanup()
+
+	L := lua.NewState()
+	defer L.Close()
+	assert.Equal(t, ac.LoadServerConfigFunctions(L, "serverconf.lua"), nil)
+
+	// Functions that use local variables from outside of the function can
+	// not run in another Lua state
+	err := L.DoString(`
+		local greeting = "hello"
+		Handle("/hello", function(params)
+			print(greeting)
+		end)
+	`)
+	assert.NotEqual(t, err, nil)
+	assert.Equal(t, strings.Contains(err.Error(), "local variables"), true)
+	assert.Equal(t, len(ac.routes), 0)
+}
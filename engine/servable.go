@@ -0,0 +1,63 @@
+package engine
+
+import (
+	"path/filepath"
+	"strings"
+)
+
+// deniedFilenames are files and directories that are never served, since they
+// may contain passwords, keys or the history of a repository
+var deniedFilenames = []string{".env", ".git", ".hg", ".svn", ".bzr", ".htaccess", ".htpasswd", ".DS_Store"}
+
+// deniedFilename checks if the given file or directory name should never be
+// served. This includes ".env" files with a suffix, like ".env.local".
+func deniedFilename(name string) bool {
+	for _, denied := range deniedFilenames {
+		if strings.EqualFold(name, denied) {
+			return true
+		}
+	}
+	return strings.HasPrefix(strings.ToLower(name), ".env.")
+}
+
+// deniedURLPath checks if any of the parts of the given URL path should never
+// be served, like "/.git/config"
+func deniedURLPath(urlpath string) bool {
+	for _, name := range strings.FieldsFunc(urlpath, func(r rune) bool { return r == '/' || r == '\\' }) {
+		if deniedFilename(name) {
+			return true
+		}
+	}
+	return false
+}
+
+// servableExtension checks if the extension of the given filename is one of the
+// extensions given with SetServableExtensions. All extensions are servable if
+// none are given.
+func (ac *Config) servableExtension(filename string) bool {
+	if len(ac.servableExtensions) == 0 {
+		return true
+	}
+	return has(ac.servableExtensions, strings.ToLower(filepath.Ext(filename)))
+}
+
+// SetServableExtensions sets the file extensions that are allowed to be served.
+// Requests for other files results in a 404. An empty list allows all files.
+func (ac *Config) SetServableExtensions(extensions []string) {
+	ac.servableExtensions = []string{}
+	for _, ext := range extensions {
+		ext = strings.ToLower(strings.TrimSpace(ext))
+		if ext == "" {
+			continue
+		}
+		if !strings.HasPrefix(ext, ".") {
+			ext = "." + ext
+		}
+		ac.servableExtensions = append(ac.servableExtensions, ext)
+	}
+}
+
+// servableFile checks if the given file may be served, given its name
+func (ac *Config) servableFile(filename string) bool {
+	return !deniedFilename(filepath.Base(filename)) && ac.servableExtension(filename)
+}
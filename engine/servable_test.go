@@ -0,0 +1,54 @@
+package engine
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/bmizerany/assert"
+	"github.com/xyproto/algernon/utils"
+	"github.com/xyproto/datablock"
+)
+
+// servableTest serves testdata/servable and returns the status code for the given path
+func servableTest(t *testing.T, extensions []string, path string) int {
+	ac := &Config{
+		disableRateLimiting: true,
+		largeFileSize:       42 * utils.MiB,
+	}
+	ac.initializeMime()
+	ac.fs = datablock.NewFileStat(false, time.Minute)
+	ac.cache = datablock.NewFileCache(1*utils.MiB, false, 64*utils.KiB, false, 0)
+	ac.SetServableExtensions(extensions)
+
+	mux := http.NewServeMux()
+	ac.RegisterHandlers(mux, "/", "testdata/servable", false)
+
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+	return w.Code
+}
+
+func TestServableExtensions(t *testing.T) {
+	// Everything except sensitive files is served by default
+	assert.Equal(t, servableTest(t, nil, "/style.css"), http.StatusOK)
+	assert.Equal(t, servableTest(t, nil, "/notes.txt"), http.StatusOK)
+	assert.Equal(t, servableTest(t, nil, "/.env"), http.StatusNotFound)
+	assert.Equal(t, servableTest(t, nil, "/.git/config"), http.StatusNotFound)
+
+	// Only the given extensions are served
+	extensions := []string{".css", "html"}
+	assert.Equal(t, servableTest(t, extensions, "/style.css"), http.StatusOK)
+	assert.Equal(t, servableTest(t, extensions, "/notes.txt"), http.StatusNotFound)
+	assert.Equal(t, servableTest(t, extensions, "/.env"), http.StatusNotFound)
+}
+
+func TestDeniedFilename(t *testing.T) {
+	assert.Equal(t, deniedFilename(".env"), true)
+	assert.Equal(t, deniedFilename(".env.local"), true)
+	assert.Equal(t, deniedFilename(".HTPASSWD"), true)
+	assert.Equal(t, deniedFilename("environment.txt"), false)
+	assert.Equal(t, deniedURLPath("/a/.git/HEAD"), true)
+	assert.Equal(t, deniedURLPath("/a/b/style.css"), false)
+}
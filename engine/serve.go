@@ -1,16 +1,21 @@
 package engine
 
 import (
+	"context"
 	"errors"
+	"fmt"
+	"net"
 	"net/http"
 	"os"
+	"os/signal"
+	"strconv"
 	"strings"
 	"sync"
+	"syscall"
 	"time"
 
 	"github.com/lucas-clemente/quic-go/h2quic"
 	log "github.com/sirupsen/logrus"
-	"github.com/tylerb/graceful"
 	"golang.org/x/net/http2"
 )
 
@@ -29,9 +34,9 @@ func AtShutdown(shutdownFunction func()) {
 }
 
 // GenerateShutdownFunction generates a function that will run the postponed
-// shutdown functions.  Note that gracefulServer can be nil. It's only used for
-// finding out if the server was interrupted (ctrl-c or killed, SIGINT/SIGTERM)
-func (ac *Config) GenerateShutdownFunction(gracefulServer *graceful.Server, quicServer *h2quic.Server) func() {
+// shutdown functions. interrupted should be true if the server was
+// interrupted (ctrl-c or killed, SIGINT/SIGTERM), which makes the process exit.
+func (ac *Config) GenerateShutdownFunction(interrupted bool, quicServer *h2quic.Server) func() {
 	return func() {
 		mut.Lock()
 		defer mut.Unlock()
@@ -57,11 +62,8 @@ func (ac *Config) GenerateShutdownFunction(gracefulServer *graceful.Server, quic
 		}
 
 		// Forced shutdown
-		if gracefulServer != nil {
-			if gracefulServer.Interrupted {
-				//gracefulServer.Stop(forcedShutdownTimeout)
-				ac.fatalExit(errors.New("Interrupted"))
-			}
+		if interrupted {
+			ac.fatalExit(errors.New("Interrupted"))
 		}
 		// TODO: To implement
 		//if quicServer != nil {
@@ -73,35 +75,213 @@ func (ac *Config) GenerateShutdownFunction(gracefulServer *graceful.Server, quic
 	}
 }
 
-// NewGracefulServer creates a new graceful server configuration
-func (ac *Config) NewGracefulServer(mux *http.ServeMux, http2support bool, addr string) *graceful.Server {
+// NewGracefulServer creates a new server configuration. The server is shut
+// down gracefully when SIGINT or SIGTERM is received.
+func (ac *Config) NewGracefulServer(mux http.Handler, http2support bool, addr string) *http.Server {
+	if len(ac.routes) > 0 {
+		// Handle the routes from Handle with their Lua functions
+		mux = ac.RouteHandler(mux, ac.routes)
+	}
+	if len(ac.reverseProxies) > 0 {
+		// Forward the requests for the given URL prefixes
+		mux = ReverseProxyHandler(mux, ac.reverseProxies)
+	}
+	if len(ac.basicAuth) > 0 {
+		// Require a username and password for the given URL prefixes
+		mux = BasicAuthHandler(mux, ac.basicAuth)
+	}
+	// Run the functions from BeforeRequest and AfterRequest, if any
+	mux = ac.requestHookHandler(mux)
+	// Serve the custom error pages from ErrorHandler, if any
+	mux = ac.errorPageHandler(mux)
+	if ac.compressResponses {
+		// Compress the responses, if the client accepts it
+		mux = CompressionHandler(mux)
+	}
+	if len(ac.corsOrigins) > 0 {
+		// Allow cross-origin requests and answer preflight requests
+		mux = CORSHandler(mux, ac.corsOrigins, ac.corsMethods)
+	}
+	if ac.rateLimit > 0 {
+		// Limit the number of requests per minute for each client
+		mux = RateLimitHandler(mux, ac.rateLimit)
+	}
+	if ac.metrics != nil {
+		// Count the requests and serve the metrics at /metrics
+		mux = ac.metricsHandler(mux)
+	}
+	if ac.healthPath != "" {
+		// Serve the liveness and readiness checks, without rate limiting
+		mux = ac.healthHandler(mux)
+	}
 	// Server configuration
 	s := &http.Server{
 		Addr:    addr,
 		Handler: mux,
 
-		// The timeout values is also the maximum time it can take
+		// The write timeout is also the maximum time it can take
 		// for a complete page of Server-Sent Events (SSE).
-		ReadTimeout:  10 * time.Second,
-		WriteTimeout: time.Duration(ac.writeTimeout) * time.Second,
+		ReadTimeout:  ac.readTimeout,
+		WriteTimeout: ac.writeTimeout,
+		IdleTimeout:  ac.idleTimeout,
 
 		MaxHeaderBytes: 1 << 20,
 	}
+	if ac.metrics != nil {
+		s.ConnState = ac.metrics.connState
+	}
 	if http2support {
 		// Enable HTTP/2 support
 		http2.ConfigureServer(s, nil)
 	}
-	gracefulServer := &graceful.Server{
-		Server:  s,
-		Timeout: ac.shutdownTimeout,
-	}
+	mut.Lock()
+	ac.servers = append(ac.servers, s)
+	mut.Unlock()
 	// Handle ctrl-c
-	gracefulServer.ShutdownInitiated = ac.GenerateShutdownFunction(gracefulServer, nil) // for investigating gracefulServer.Interrupted
-	return gracefulServer
+	ac.handleSignals.Do(func() {
+		signals := make(chan os.Signal, 1)
+		signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+		go func() {
+			<-signals
+			log.Info("Shutting down")
+			ac.ShutdownServers()
+			// Run the shutdown functions after the requests have completed
+			ac.GenerateShutdownFunction(true, nil)()
+		}()
+	})
+	return s
+}
+
+// ShutdownServers stops the servers from accepting new connections and waits
+// for the requests that are being served to complete, for up to the shutdown
+// timeout. The remaining connections are then closed.
+func (ac *Config) ShutdownServers() {
+	mut.Lock()
+	servers := ac.servers
+	mut.Unlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), ac.shutdownTimeout)
+	defer cancel()
+
+	var wg sync.WaitGroup
+	for _, s := range servers {
+		wg.Add(1)
+		go func(s *http.Server) {
+			defer wg.Done()
+			if err := s.Shutdown(ctx); err != nil {
+				log.Warnf("Closing the remaining connections to %s: %s", s.Addr, err)
+				s.Close()
+			}
+		}(s)
+	}
+	wg.Wait()
+}
+
+// unixSocketPath returns the path to a Unix domain socket, if the given
+// address starts with "unix:" or "/"
+func unixSocketPath(addr string) (string, bool) {
+	if strings.HasPrefix(addr, "unix:") {
+		return strings.TrimPrefix(addr, "unix:"), true
+	}
+	return addr, strings.HasPrefix(addr, "/")
+}
+
+// listenUnix listens on a Unix domain socket. A socket file that is left
+// behind by an earlier server is removed first. The socket file is removed
+// again when the listener is closed.
+func listenUnix(path string) (net.Listener, error) {
+	if fi, err := os.Lstat(path); err == nil && fi.Mode()&os.ModeSocket != 0 {
+		if conn, err := net.Dial("unix", path); err == nil {
+			conn.Close()
+			return nil, errors.New(path + " is already in use")
+		}
+		if err := os.Remove(path); err != nil {
+			return nil, err
+		}
+	}
+	return net.Listen("unix", path)
+}
+
+// listenAndServe serves HTTP on the address of the given server, which can
+// be a TCP address or a Unix domain socket
+func listenAndServe(s *http.Server) error {
+	path, ok := unixSocketPath(s.Addr)
+	if !ok {
+		return s.ListenAndServe()
+	}
+	listener, err := listenUnix(path)
+	if err != nil {
+		return err
+	}
+	return s.Serve(listener)
+}
+
+// listenAndServeTLS serves HTTPS on the address of the given server, which
+// can be a TCP address or a Unix domain socket
+func listenAndServeTLS(s *http.Server, certFile, keyFile string) error {
+	path, ok := unixSocketPath(s.Addr)
+	if !ok {
+		return s.ListenAndServeTLS(certFile, keyFile)
+	}
+	listener, err := listenUnix(path)
+	if err != nil {
+		return err
+	}
+	return s.ServeTLS(listener, certFile, keyFile)
+}
+
+// splitAddrs splits a comma separated list of server addresses
+func splitAddrs(addrList string) []string {
+	var addrs []string
+	for _, addr := range strings.Split(addrList, ",") {
+		if addr = strings.TrimSpace(addr); addr != "" {
+			addrs = append(addrs, addr)
+		}
+	}
+	return addrs
+}
+
+// checkAddr checks that the given address, or comma separated list of
+// addresses, has a port number in the range 1 to 65535. Addresses with only
+// a host, like "localhost", and Unix domain sockets are also accepted.
+func checkAddr(addrList string) error {
+	for _, addr := range splitAddrs(addrList) {
+		if _, unixSocket := unixSocketPath(addr); unixSocket || net.ParseIP(addr) != nil || !strings.Contains(addr, ":") {
+			continue
+		}
+		_, port, err := net.SplitHostPort(addr)
+		if err != nil {
+			return fmt.Errorf("invalid address %q: %s", addr, err)
+		}
+		if n, err := strconv.Atoi(port); err != nil || n < 1 || n > 65535 {
+			return fmt.Errorf("invalid address %q: the port must be a number from 1 to 65535", addr)
+		}
+	}
+	return nil
+}
+
+// addrURL returns the URL for the given scheme and server address, for use
+// in log messages
+func addrURL(scheme, addr string) string {
+	if path, ok := unixSocketPath(addr); ok {
+		return "unix:" + path
+	}
+	if strings.HasPrefix(addr, ":") {
+		return scheme + "://localhost" + addr + "/"
+	}
+	return scheme + "://" + addr + "/"
+}
+
+// serveErr returns nil if the server was shut down, or else the given error
+func serveErr(err error) error {
+	if err == http.ErrServerClosed {
+		return nil
+	}
+	return err
 }
 
 // Serve HTTP, HTTP/2 and/or HTTPS. Returns an error if unable to serve, or nil when done serving.
-func (ac *Config) Serve(mux *http.ServeMux, done, ready chan bool) error {
+func (ac *Config) Serve(mux http.Handler, done, ready chan bool) error {
 
 	// If we are not writing internal logs to a file, reduce the verbosity
 	http2.VerboseLogs = (ac.internalLogFilename != os.DevNull)
@@ -112,68 +292,95 @@ func (ac *Config) Serve(mux *http.ServeMux, done, ready chan bool) error {
 		return nil    // Done
 	}
 
-	// Channel to wait and see if we should just serve regular HTTP instead
-	justServeRegularHTTP := make(chan bool)
+	// The server can listen on several addresses, like ":80,:8080"
+	addrs := splitAddrs(ac.serverAddr)
+	if len(addrs) == 0 {
+		return errors.New("no server address given")
+	}
 
 	servingHTTPS := false
 	servingHTTP := false
 
-	// Goroutine that wait for a message to just serve regular HTTP, if needed
-	go func() {
-		<-justServeRegularHTTP // Wait for a message to just serve regular HTTP
-		if strings.HasPrefix(ac.serverAddr, ":") {
-			log.Info("Serving HTTP on http://localhost" + ac.serverAddr + "/")
-		} else {
-			log.Info("Serving HTTP on http://" + ac.serverAddr + "/")
-		}
+	// Function for serving regular HTTP on the given address, for instance
+	// if serving HTTPS on that address failed
+	serveRegularHTTP := func(addr string) {
+		log.Info("Serving HTTP on " + addrURL("http", addr))
 		mut.Lock()
 		servingHTTP = true
 		mut.Unlock()
-		HTTPserver := ac.NewGracefulServer(mux, false, ac.serverAddr)
+		HTTPserver := ac.NewGracefulServer(mux, false, addr)
 		// Open the URL before the serving has started, in a short delay
-		if ac.openURLAfterServing && ac.luaServerFilename != "" {
+		if _, unixSocket := unixSocketPath(addr); ac.openURLAfterServing && ac.luaServerFilename != "" && !unixSocket && addr == addrs[0] {
 			go func() {
 				time.Sleep(delayBeforeLaunchingBrowser)
-				ac.OpenURL(ac.serverHost, ac.serverAddr, false)
+				ac.OpenURL(ac.serverHost, addr, false)
 			}()
 		}
 		// Start serving. Shut down gracefully at exit.
-		if err := HTTPserver.ListenAndServe(); err != nil {
+		if err := serveErr(listenAndServe(HTTPserver)); err != nil {
 			mut.Lock()
 			servingHTTP = false
 			mut.Unlock()
 			// If we can't serve regular HTTP on port 80, give up
 			ac.fatalExit(err)
 		}
-	}()
+	}
 
 	// Decide which protocol to listen to
 	switch {
 	case ac.serveJustQUIC: // Just serve QUIC, but fallback to HTTP
-		if strings.HasPrefix(ac.serverAddr, ":") {
-			log.Info("Serving QUIC on https://localhost" + ac.serverAddr + "/")
-		} else {
-			log.Info("Serving QUIC on https://" + ac.serverAddr + "/")
+		for _, addr := range addrs {
+			log.Info("Serving QUIC on " + addrURL("https", addr))
+			mut.Lock()
+			servingHTTPS = true
+			mut.Unlock()
+			// Start serving over QUIC
+			go func(addr string) {
+				// TODO: Handle ctrl-c by fetching the quicServer struct and passing it to GenerateShutdownFunction.
+				//       This can be done once CloseGracefully in h2quic has been implemented:
+				//       https://github.com/lucas-clemente/quic-go/blob/master/h2quic/server.go#L257
+				//
+				// ac.GenerateShutdownFunction(true, quicServer)()
+				if err := h2quic.ListenAndServe(addr, ac.serverCert, ac.serverKey, mux); err != nil {
+					log.Error("Not serving QUIC after all. Error: ", err)
+					log.Info("Use the -t flag for serving regular HTTP instead")
+					mut.Lock()
+					servingHTTPS = false
+					mut.Unlock()
+					// If QUIC failed (perhaps the key + cert are missing),
+					// serve plain HTTP instead
+					serveRegularHTTP(addr)
+				}
+			}(addr)
+		}
+	case ac.autoTLS:
+		// Listen for HTTPS+HTTP/2 requests, with certificates from Let's
+		// Encrypt, and for HTTP-01 challenges on port 80
+		m, err := ac.autocertManager()
+		if err != nil {
+			return err
 		}
+		log.Info("Serving HTTP/2 on https://" + ac.autoTLSDomains[0] + "/, with certificates from Let's Encrypt")
 		mut.Lock()
 		servingHTTPS = true
 		mut.Unlock()
-		// Start serving over QUIC
 		go func() {
-			// TODO: Handle ctrl-c by fetching the quicServer struct and passing it to GenerateShutdownFunction.
-			//       This can be done once CloseGracefully in h2quic has been implemented:
-			//       https://github.com/lucas-clemente/quic-go/blob/master/h2quic/server.go#L257
-			//
-			// gracefulServer.ShutdownInitiated = ac.GenerateShutdownFunction(nil, quicServer)
-			if err := h2quic.ListenAndServe(ac.serverAddr, ac.serverCert, ac.serverKey, mux); err != nil {
-				log.Error("Not serving QUIC after all. Error: ", err)
-				log.Info("Use the -t flag for serving regular HTTP instead")
-				// If QUIC failed (perhaps the key + cert are missing),
-				// serve plain HTTP instead
-				justServeRegularHTTP <- true
+			HTTPS2server := ac.NewGracefulServer(mux, true, ac.serverHost+":443")
+			HTTPS2server.TLSConfig = m.TLSConfig()
+			// Start serving. Shut down gracefully at exit.
+			if err := serveErr(listenAndServeTLS(HTTPS2server, "", "")); err != nil {
 				mut.Lock()
 				servingHTTPS = false
 				mut.Unlock()
+				log.Error(err)
+			}
+		}()
+		go func() {
+			// Answer the HTTP-01 challenges, and redirect the rest to HTTPS
+			HTTPserver := ac.NewGracefulServer(m.HTTPHandler(nil), false, ac.serverHost+":80")
+			if err := serveErr(listenAndServe(HTTPserver)); err != nil {
+				// Certificates can not be fetched without port 80, give up
+				ac.fatalExit(err)
 			}
 		}()
 	case ac.productionMode:
@@ -191,7 +398,7 @@ func (ac *Config) Serve(mux *http.ServeMux, done, ready chan bool) error {
 			// Listen for HTTPS + HTTP/2 requests
 			HTTPS2server := ac.NewGracefulServer(mux, true, ac.serverHost+":443")
 			// Start serving. Shut down gracefully at exit.
-			if err := HTTPS2server.ListenAndServeTLS(ac.serverCert, ac.serverKey); err != nil {
+			if err := serveErr(listenAndServeTLS(HTTPS2server, ac.serverCert, ac.serverKey)); err != nil {
 				mut.Lock()
 				servingHTTPS = false
 				mut.Unlock()
@@ -208,7 +415,7 @@ func (ac *Config) Serve(mux *http.ServeMux, done, ready chan bool) error {
 		mut.Unlock()
 		go func() {
 			HTTPserver := ac.NewGracefulServer(mux, false, ac.serverHost+":80")
-			if err := HTTPserver.ListenAndServe(); err != nil {
+			if err := serveErr(listenAndServe(HTTPserver)); err != nil {
 				mut.Lock()
 				servingHTTP = false
 				mut.Unlock()
@@ -217,64 +424,65 @@ func (ac *Config) Serve(mux *http.ServeMux, done, ready chan bool) error {
 			}
 		}()
 	case ac.serveJustHTTP2: // It's unusual to serve HTTP/2 without HTTPS
-		if strings.HasPrefix(ac.serverAddr, ":") {
-			log.Warn("Serving HTTP/2 without HTTPS (not recommended!) on http://localhost" + ac.serverAddr + "/")
-		} else {
-			log.Warn("Serving HTTP/2 without HTTPS (not recommended!) on http://" + ac.serverAddr + "/")
+		for _, addr := range addrs {
+			log.Warn("Serving HTTP/2 without HTTPS (not recommended!) on " + addrURL("http", addr))
+			mut.Lock()
+			servingHTTPS = true
+			mut.Unlock()
+			go func(addr string) {
+				// Listen for HTTP/2 requests
+				HTTP2server := ac.NewGracefulServer(mux, true, addr)
+				// Start serving. Shut down gracefully at exit.
+				if err := serveErr(listenAndServe(HTTP2server)); err != nil {
+					mut.Lock()
+					servingHTTPS = false
+					mut.Unlock()
+					log.Error(err)
+					serveRegularHTTP(addr)
+				}
+			}(addr)
 		}
-		mut.Lock()
-		servingHTTPS = true
-		mut.Unlock()
-		go func() {
-			// Listen for HTTP/2 requests
-			HTTP2server := ac.NewGracefulServer(mux, true, ac.serverAddr)
-			// Start serving. Shut down gracefully at exit.
-			if err := HTTP2server.ListenAndServe(); err != nil {
-				mut.Lock()
-				servingHTTPS = false
-				mut.Unlock()
-				justServeRegularHTTP <- true
-				log.Error(err)
-			}
-		}()
 	case !(ac.serveJustHTTP2 || ac.serveJustHTTP):
-		if strings.HasPrefix(ac.serverAddr, ":") {
-			log.Info("Serving HTTP/2 on https://localhost" + ac.serverAddr + "/")
-		} else {
-			log.Info("Serving HTTP/2 on https://" + ac.serverAddr + "/")
+		for _, addr := range addrs {
+			log.Info("Serving HTTP/2 on " + addrURL("https", addr))
+			mut.Lock()
+			servingHTTPS = true
+			mut.Unlock()
+			// Listen for HTTPS + HTTP/2 requests
+			HTTPS2server := ac.NewGracefulServer(mux, true, addr)
+			// Start serving. Shut down gracefully at exit.
+			go func(addr string) {
+				if err := serveErr(listenAndServeTLS(HTTPS2server, ac.serverCert, ac.serverKey)); err != nil {
+					log.Errorf("%s. Not serving HTTP/2.", err)
+					log.Info("Use the -t flag for serving regular HTTP.")
+					mut.Lock()
+					servingHTTPS = false
+					mut.Unlock()
+					// If HTTPS failed (perhaps the key + cert are missing),
+					// serve plain HTTP instead
+					serveRegularHTTP(addr)
+				}
+			}(addr)
 		}
-		mut.Lock()
-		servingHTTPS = true
-		mut.Unlock()
-		// Listen for HTTPS + HTTP/2 requests
-		HTTPS2server := ac.NewGracefulServer(mux, true, ac.serverAddr)
-		// Start serving. Shut down gracefully at exit.
-		go func() {
-			if err := HTTPS2server.ListenAndServeTLS(ac.serverCert, ac.serverKey); err != nil {
-				log.Errorf("%s. Not serving HTTP/2.", err)
-				log.Info("Use the -t flag for serving regular HTTP.")
-				mut.Lock()
-				servingHTTPS = false
-				mut.Unlock()
-				// If HTTPS failed (perhaps the key + cert are missing),
-				// serve plain HTTP instead
-				justServeRegularHTTP <- true
-			}
-		}()
 	default:
 		mut.Lock()
 		servingHTTP = true
 		mut.Unlock()
-		justServeRegularHTTP <- true
+		for _, addr := range addrs {
+			go serveRegularHTTP(addr)
+		}
 	}
 
 	// Wait just a tiny bit
 	time.Sleep(20 * time.Millisecond)
 
+	// Let tools that wait for the server know that it is ready
+	ac.printStartupInfo(os.Stdout)
+
 	ready <- true // Send a "ready" message to the REPL
 
-	// Open the URL, if specified
-	if ac.openURLAfterServing {
+	// Open the URL, if specified (and not serving on a Unix domain socket)
+	if _, unixSocket := unixSocketPath(addrs[0]); ac.openURLAfterServing && !unixSocket {
 		// Open the https:// URL if both http:// and https:// are being served
 		mut.Lock()
 		if (!servingHTTP) && (!servingHTTPS) {
@@ -282,7 +490,7 @@ func (ac *Config) Serve(mux *http.ServeMux, done, ready chan bool) error {
 		}
 		httpsProtocol := servingHTTPS
 		mut.Unlock()
-		ac.OpenURL(ac.serverHost, ac.serverAddr, httpsProtocol)
+		ac.OpenURL(ac.serverHost, addrs[0], httpsProtocol)
 	}
 
 	<-done // Wait for a "done" message from the REPL (or just keep waiting)
@@ -0,0 +1,282 @@
+package engine
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bmizerany/assert"
+)
+
+func TestShutdownServers(t *testing.T) {
+	ac := &Config{shutdownTimeout: 5 * time.Second, writeTimeout: 10 * time.Second}
+
+	started := make(chan bool)
+	mux := http.NewServeMux()
+	mux.HandleFunc("/slow", func(w http.ResponseWriter, req *http.Request) {
+		started <- true
+		time.Sleep(300 * time.Millisecond)
+		w.Write([]byte("done"))
+	})
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Equal(t, err, nil)
+	server := ac.NewGracefulServer(mux, false, listener.Addr().String())
+	served := make(chan error)
+	go func() {
+		served <- serveErr(server.Serve(listener))
+	}()
+
+	// Start a slow request
+	type result struct {
+		body string
+		err  error
+	}
+	results := make(chan result)
+	go func() {
+		resp, err := http.Get("http://" + listener.Addr().String() + "/slow")
+		if err != nil {
+			results <- result{"", err}
+			return
+		}
+		defer resp.Body.Close()
+		body, err := ioutil.ReadAll(resp.Body)
+		results <- result{string(body), err}
+	}()
+	<-started
+
+	// Shut down while the request is being served
+	start := time.Now()
+	ac.ShutdownServers()
+	assert.Equal(t, time.Since(start) < ac.shutdownTimeout, true)
+
+	// The request still completes
+	r := <-results
+	assert.Equal(t, r.err, nil)
+	assert.Equal(t, r.body, "done")
+	assert.Equal(t, <-served, nil)
+
+	// New connections are refused
+	_, err = http.Get("http://" + listener.Addr().String() + "/slow")
+	assert.NotEqual(t, err, nil)
+}
+
+func TestShutdownServersTimeout(t *testing.T) {
+	ac := &Config{shutdownTimeout: 100 * time.Millisecond, writeTimeout: 10 * time.Second}
+
+	started := make(chan bool)
+	mux := http.NewServeMux()
+	mux.HandleFunc("/stuck", func(w http.ResponseWriter, req *http.Request) {
+		started <- true
+		time.Sleep(2 * time.Second)
+	})
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Equal(t, err, nil)
+	server := ac.NewGracefulServer(mux, false, listener.Addr().String())
+	go server.Serve(listener)
+
+	errs := make(chan error)
+	go func() {
+		_, err := http.Get("http://" + listener.Addr().String() + "/stuck")
+		errs <- err
+	}()
+	<-started
+
+	// The connection is closed when the timeout has passed
+	start := time.Now()
+	ac.ShutdownServers()
+	assert.Equal(t, time.Since(start) < time.Second, true)
+	assert.NotEqual(t, <-errs, nil)
+}
+
+func TestUnixSocket(t *testing.T) {
+	path, ok := unixSocketPath("unix:/run/algernon.sock")
+	assert.Equal(t, ok, true)
+	assert.Equal(t, path, "/run/algernon.sock")
+	_, ok = unixSocketPath("/run/algernon.sock")
+	assert.Equal(t, ok, true)
+	_, ok = unixSocketPath("localhost:3000")
+	assert.Equal(t, ok, false)
+	assert.Equal(t, addrURL("http", ":3000"), "http://localhost:3000/")
+	assert.Equal(t, addrURL("http", "unix:/run/algernon.sock"), "unix:/run/algernon.sock")
+
+	dir, err := ioutil.TempDir("", "algernon")
+	assert.Equal(t, err, nil)
+	defer os.RemoveAll(dir)
+	socket := filepath.Join(dir, "algernon.sock")
+
+	// Leave a stale socket file behind
+	stale, err := net.ListenUnix("unix", &net.UnixAddr{Name: socket, Net: "unix"})
+	assert.Equal(t, err, nil)
+	stale.SetUnlinkOnClose(false)
+	stale.Close()
+	_, err = os.Stat(socket)
+	assert.Equal(t, err, nil)
+
+	ac := &Config{shutdownTimeout: 5 * time.Second, writeTimeout: 10 * time.Second}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte("hello over a socket"))
+	})
+	server := ac.NewGracefulServer(mux, false, "unix:"+socket)
+	served := make(chan error)
+	go func() {
+		served <- serveErr(listenAndServe(server))
+	}()
+
+	client := &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, "unix", socket)
+		},
+	}}
+	var resp *http.Response
+	for i := 0; i < 50; i++ {
+		if resp, err = client.Get("http://localhost/"); err == nil {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.Equal(t, err, nil)
+	body, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	assert.Equal(t, err, nil)
+	assert.Equal(t, string(body), "hello over a socket")
+
+	// A socket that is in use is not removed
+	_, err = listenUnix(socket)
+	assert.NotEqual(t, err, nil)
+
+	// The socket file is removed at shutdown
+	ac.ShutdownServers()
+	assert.Equal(t, <-served, nil)
+	_, err = os.Stat(socket)
+	assert.Equal(t, os.IsNotExist(err), true)
+}
+
+// freeAddr returns a local TCP address that is not in use
+func freeAddr(t *testing.T) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Equal(t, err, nil)
+	defer listener.Close()
+	return listener.Addr().String()
+}
+
+func TestServeSeveralAddresses(t *testing.T) {
+	assert.Equal(t, splitAddrs(" :80, ,:8080 "), []string{":80", ":8080"})
+	assert.Equal(t, len(splitAddrs("")), 0)
+
+	addrs := []string{freeAddr(t), freeAddr(t)}
+	ac := &Config{
+		serverAddr:          strings.Join(addrs, ","),
+		serveJustHTTP:       true,
+		internalLogFilename: os.DevNull,
+		shutdownTimeout:     5 * time.Second,
+		writeTimeout:        10 * time.Second,
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte("hello from " + req.Host))
+	})
+	done, ready := make(chan bool), make(chan bool)
+	served := make(chan error)
+	go func() {
+		served <- ac.Serve(mux, done, ready)
+	}()
+	<-ready
+
+	// Both listeners respond
+	for _, addr := range addrs {
+		var resp *http.Response
+		var err error
+		for i := 0; i < 50; i++ {
+			if resp, err = http.Get("http://" + addr + "/"); err == nil {
+				break
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		assert.Equal(t, err, nil)
+		body, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		assert.Equal(t, err, nil)
+		assert.Equal(t, string(body), "hello from "+addr)
+	}
+
+	// All listeners are shut down
+	ac.ShutdownServers()
+	for _, addr := range addrs {
+		_, err := http.Get("http://" + addr + "/")
+		assert.NotEqual(t, err, nil)
+	}
+	done <- true
+	assert.Equal(t, <-served, nil)
+}
+
+func TestCheckAddr(t *testing.T) {
+	for _, addr := range []string{
+		":3000",
+		"localhost:3000",
+		"127.0.0.1:65535",
+		"[::1]:443",
+		"localhost",
+		"::1",
+		"unix:/run/algernon.sock",
+		"/run/algernon.sock",
+		":80,:8080",
+		"",
+	} {
+		assert.Equal(t, checkAddr(addr), nil)
+	}
+	for _, addr := range []string{
+		":99999",
+		":0",
+		"localhost:abc",
+		"localhost:",
+		"localhost:-1",
+		"a:b:c",
+		":80,:99999",
+	} {
+		assert.NotEqual(t, checkAddr(addr), nil)
+	}
+}
+
+func TestReadTimeout(t *testing.T) {
+	ac := &Config{readTimeout: 200 * time.Millisecond}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Equal(t, err, nil)
+	server := ac.NewGracefulServer(http.NotFoundHandler(), false, listener.Addr().String())
+	assert.Equal(t, server.ReadTimeout, ac.readTimeout)
+	go server.Serve(listener)
+	defer server.Close()
+
+	// A slow client that never finishes sending the request headers
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	assert.Equal(t, err, nil)
+	defer conn.Close()
+	_, err = conn.Write([]byte("GET / HTTP/1.1\r\nHost: localhost\r\n"))
+	assert.Equal(t, err, nil)
+
+	// The server closes the connection after the read timeout
+	start := time.Now()
+	conn.SetReadDeadline(start.Add(5 * time.Second))
+	_, err = ioutil.ReadAll(conn)
+	assert.Equal(t, err, nil)
+	elapsed := time.Since(start)
+	assert.Equal(t, elapsed >= 150*time.Millisecond, true)
+	assert.Equal(t, elapsed < 5*time.Second, true)
+}
+
+func TestNoTimeouts(t *testing.T) {
+	ac := &Config{}
+	server := ac.NewGracefulServer(http.NotFoundHandler(), false, "127.0.0.1:0")
+	assert.Equal(t, server.ReadTimeout, time.Duration(0))
+	assert.Equal(t, server.WriteTimeout, time.Duration(0))
+	assert.Equal(t, server.IdleTimeout, time.Duration(0))
+}
@@ -1,15 +1,22 @@
 package engine
 
 import (
+	"crypto/tls"
 	"errors"
 	"fmt"
 	"io/ioutil"
 	"net/http"
 	"os"
 	"path/filepath"
+	"strconv"
 	"strings"
+	"sync"
+	"time"
 
+	redigo "github.com/gomodule/redigo/redis"
 	log "github.com/sirupsen/logrus"
+	"github.com/xyproto/algernon/lua/convert"
+	"github.com/xyproto/algernon/lua/datastruct"
 	"github.com/xyproto/algernon/utils"
 	"github.com/xyproto/gopher-lua"
 	bolt "github.com/xyproto/permissionbolt"
@@ -69,7 +76,9 @@ func (ac *Config) Info() string {
 	if ac.autoRefreshDir != "" {
 		sb.WriteString("Only watching:\t\t" + ac.autoRefreshDir + "\n")
 	}
-	if ac.redisAddr != ac.defaultRedisColonPort {
+	if len(ac.redisSentinels) > 0 {
+		sb.WriteString("Redis Sentinel:\t\t" + strings.Join(ac.redisSentinels, ", ") + " (master " + ac.redisMasterName + ")\n")
+	} else if ac.redisAddr != ac.defaultRedisColonPort || ac.dbName == "Redis" {
 		sb.WriteString("Redis address:\t\t" + ac.redisAddr + "\n")
 	}
 	if ac.disableRateLimiting {
@@ -77,14 +86,52 @@ func (ac *Config) Info() string {
 	} else {
 		sb.WriteString(fmt.Sprintf("Request limit:\t\t%d/sec per visitor\n", ac.limitRequests))
 	}
-	if ac.redisDBindex != 0 {
+	if ac.rateLimit > 0 {
+		sb.WriteString(fmt.Sprintf("Rate limit:\t\t%d/min per IP address\n", ac.rateLimit))
+	}
+	if len(ac.indexFilenames) > 0 {
+		sb.WriteString("Index files:\t\t" + strings.Join(ac.indexFilenames, ", ") + "\n")
+	}
+	if ac.dirListing {
+		sb.WriteString("Directory listing:\tEnabled\n")
+	}
+	if ac.uploadPermissions != 0 {
+		sb.WriteString(fmt.Sprintf("Upload permissions:\t%04o\n", ac.uploadPermissions))
+	}
+	if ac.tempDir != "" {
+		sb.WriteString("Temporary directory:\t" + ac.tempDir + "\n")
+	}
+	if len(ac.trustedProxies) > 0 {
+		sb.WriteString(fmt.Sprintf("Trusted proxies:\t%v\n", ac.trustedProxies))
+	}
+	if ac.redisDBindex != 0 || ac.dbName == "Redis" {
 		sb.WriteString(fmt.Sprintf("Redis database index:\t%d\n", ac.redisDBindex))
 	}
+	if ac.luapool != nil {
+		stats := ac.luapool.Stats()
+		size, behavior := "unlimited", "grow"
+		if stats.Size > 0 {
+			size = strconv.Itoa(stats.Size)
+			if stats.Block {
+				behavior = "block"
+			}
+		}
+		sb.WriteString(fmt.Sprintf("Lua pool:\t\t%d in use, %d idle, max %s (%s)\n", stats.InUse, stats.Idle, size, behavior))
+	}
+	if len(ac.servableExtensions) > 0 {
+		sb.WriteString(fmt.Sprintf("Servable extensions:\t%v\n", ac.servableExtensions))
+	}
 	if ac.largeFileSize > 0 {
 		sb.WriteString(fmt.Sprintf("Large file threshold:\t%v bytes\n", ac.largeFileSize))
 	}
+	if ac.readTimeout > 0 {
+		sb.WriteString(fmt.Sprintf("Read timeout:\t\t%v\n", ac.readTimeout))
+	}
 	if ac.writeTimeout > 0 {
-		sb.WriteString(fmt.Sprintf("Large file timeout:\t%v sec\n", ac.writeTimeout))
+		sb.WriteString(fmt.Sprintf("Write timeout:\t\t%v\n", ac.writeTimeout))
+	}
+	if ac.idleTimeout > 0 {
+		sb.WriteString(fmt.Sprintf("Idle timeout:\t\t%v\n", ac.idleTimeout))
 	}
 	if len(ac.serverConfigurationFilenames) > 0 {
 		sb.WriteString(fmt.Sprintf("Server configuration:\t%v\n", ac.serverConfigurationFilenames))
@@ -98,20 +145,130 @@ func (ac *Config) Info() string {
 // LoadServerConfigFunctions makes functions related to server configuration and
 // permissions available to the given Lua struct.
 func (ac *Config) LoadServerConfigFunctions(L *lua.LState, filename string) error {
+	return ac.loadServerConfigFunctions(L, filename, ac.perm)
+}
+
+// loadServerConfigFunctions makes the server configuration functions available
+// to the given Lua state, where the permission functions use the given perm
+func (ac *Config) loadServerConfigFunctions(L *lua.LState, filename string, perm pinterface.IPermissions) error {
 
-	if ac.perm == nil {
+	if perm == nil {
 		return errors.New("perm is nil when loading server config functions")
 	}
 
+	// For running the BeforeRequest and AfterRequest functions one at the time
+	hookMut := &sync.Mutex{}
+
 	// Set a default host and port. Maybe useful for alg applications.
 	L.SetGlobal("SetAddr", L.NewFunction(func(L *lua.LState) int {
-		ac.serverAddrLua = L.ToString(1)
+		// Several addresses can be given as a table or a comma separated string
+		if table, ok := L.Get(1).(*lua.LTable); ok {
+			ac.serverAddrLua = strings.Join(convert.Table2strings(table), ",")
+		} else {
+			ac.serverAddrLua = L.ToString(1)
+		}
+		return 0 // number of results
+	}))
+
+	// Only serve files with the given extensions, like {".html", ".css"}.
+	// Other files results in a 404. An empty table allows all extensions.
+	// Set the password for the Redis server and connect to it again, if
+	// Redis is the requested database backend. Returns true if successful,
+	// or false and an error message.
+	L.SetGlobal("SetRedisPassword", L.NewFunction(func(L *lua.LState) int {
+		ac.redisPassword = L.CheckString(1)
+		if !ac.redisAddrSpecified {
+			L.Push(lua.LBool(true))
+			return 1 // number of results
+		}
+		perm, err := ac.connectRedis()
+		if err != nil {
+			log.Errorf("Could not use Redis as database backend: %s", err)
+			L.Push(lua.LBool(false))
+			L.Push(lua.LString(err.Error()))
+			return 2 // number of results
+		}
+		ac.perm = perm
+		ac.dbName = "Redis"
+		L.Push(lua.LBool(true))
+		return 1 // number of results
+	}))
+
+	// Set the maximum number of idle and active connections in the Redis
+	// connection pool. Returns true if successful, or false and an error
+	// message if the size is not positive.
+	// Enable or disable TLS for the Redis connection, and connect again if
+	// Redis is the requested database backend. Returns true if successful,
+	// or false and an error message.
+	L.SetGlobal("SetRedisTLS", L.NewFunction(func(L *lua.LState) int {
+		ac.redisTLS = L.CheckBool(1)
+		if !ac.redisAddrSpecified {
+			L.Push(lua.LBool(true))
+			return 1 // number of results
+		}
+		perm, err := ac.connectRedis()
+		if err != nil {
+			log.Errorf("Could not use Redis as database backend: %s", err)
+			L.Push(lua.LBool(false))
+			L.Push(lua.LString(err.Error()))
+			return 2 // number of results
+		}
+		ac.perm = perm
+		ac.dbName = "Redis"
+		L.Push(lua.LBool(true))
+		return 1 // number of results
+	}))
+
+	// Use Redis Sentinel for finding the current Redis master with the given
+	// name, given a table with Sentinel addresses, and connect again.
+	// Returns true if successful, or false and an error message.
+	L.SetGlobal("SetRedisSentinel", L.NewFunction(func(L *lua.LState) int {
+		sentinels := convert.Table2strings(L.CheckTable(1))
+		masterName := L.CheckString(2)
+		if len(sentinels) == 0 {
+			L.Push(lua.LBool(false))
+			L.Push(lua.LString("no Redis Sentinel addresses are given"))
+			return 2 // number of results
+		}
+		ac.redisSentinels = sentinels
+		ac.redisMasterName = masterName
+		ac.redisAddrSpecified = true
+		perm, err := ac.connectRedis()
+		if err != nil {
+			log.Errorf("Could not use Redis as database backend: %s", err)
+			L.Push(lua.LBool(false))
+			L.Push(lua.LString(err.Error()))
+			return 2 // number of results
+		}
+		ac.perm = perm
+		ac.dbName = "Redis"
+		L.Push(lua.LBool(true))
+		return 1 // number of results
+	}))
+
+	L.SetGlobal("SetRedisPoolSize", L.NewFunction(func(L *lua.LState) int {
+		size := L.CheckInt(1)
+		if size <= 0 {
+			L.Push(lua.LBool(false))
+			L.Push(lua.LString("the Redis connection pool size must be positive"))
+			return 2 // number of results
+		}
+		ac.redisPoolSize = size
+		if pool, ok := ac.redisPool(); ok {
+			ac.setRedisPoolSize(pool)
+		}
+		L.Push(lua.LBool(true))
+		return 1 // number of results
+	}))
+
+	L.SetGlobal("SetServableExtensions", L.NewFunction(func(L *lua.LState) int {
+		ac.SetServableExtensions(convert.Table2strings(L.CheckTable(1)))
 		return 0 // number of results
 	}))
 
 	// Clear the default path prefixes. This makes everything public.
 	L.SetGlobal("ClearPermissions", L.NewFunction(func(L *lua.LState) int {
-		ac.perm.Clear()
+		perm.Clear()
 		return 0 // number of results
 	}))
 
@@ -119,7 +276,7 @@ func (ac *Config) LoadServerConfigFunctions(L *lua.LState, filename string) erro
 	// as having *user* rights.
 	L.SetGlobal("AddUserPrefix", L.NewFunction(func(L *lua.LState) int {
 		path := L.ToString(1)
-		ac.perm.AddUserPath(path)
+		perm.AddUserPath(path)
 		return 0 // number of results
 	}))
 
@@ -127,7 +284,148 @@ func (ac *Config) LoadServerConfigFunctions(L *lua.LState, filename string) erro
 	// as having *admin* rights.
 	L.SetGlobal("AddAdminPrefix", L.NewFunction(func(L *lua.LState) int {
 		path := L.ToString(1)
-		ac.perm.AddAdminPath(path)
+		perm.AddAdminPath(path)
+		return 0 // number of results
+	}))
+
+	// Require HTTP basic authentication with the given username and password,
+	// with an optional realm, for all URL paths or for the given URL prefix.
+	// Can be called several times, for several users or prefixes.
+	L.SetGlobal("BasicAuth", L.NewFunction(func(L *lua.LState) int {
+		ac.basicAuth = append(ac.basicAuth, basicAuthRule{
+			username: L.CheckString(1),
+			password: L.CheckString(2),
+			realm:    L.OptString(3, defaultBasicAuthRealm),
+			prefix:   L.OptString(4, "/"),
+		})
+		return 0 // number of results
+	}))
+
+	// Forward the requests for the given URL prefix to the given upstream URL,
+	// with the prefix removed from the path.
+	// Returns true on success, or false and an error message.
+	L.SetGlobal("ReverseProxy", L.NewFunction(func(L *lua.LState) int {
+		rp, err := newReverseProxy(L.CheckString(1), L.CheckString(2))
+		if err != nil {
+			L.Push(lua.LBool(false))
+			L.Push(lua.LString(err.Error()))
+			return 2 // number of results
+		}
+		ac.reverseProxies = append(ac.reverseProxies, rp)
+		L.Push(lua.LBool(true))
+		return 1 // number of results
+	}))
+
+	// Handle the given URL path with the given Lua function, which is called
+	// with a table of the parameters in the path. The path can be a pattern
+	// like "/user/:id", where ":id" matches any path segment. Each request
+	// runs the function in a Lua state from the pool.
+	L.SetGlobal("Handle", L.NewFunction(func(L *lua.LState) int {
+		handlePath := L.CheckString(1)
+		handleFunc := L.CheckFunction(2)
+		if handleFunc.Proto == nil {
+			L.ArgError(2, "Lua function expected")
+		}
+		if handleFunc.Proto.NumUpvalues > 0 {
+			L.ArgError(2, errRouteUpvalues.Error())
+		}
+		ac.routes = append(ac.routes, newRoute(handlePath, handleFunc.Proto, filename))
+		return 0 // number of results
+	}))
+
+	// Limit each client IP address to the given number of requests per minute.
+	// 0 disables the limit.
+	L.SetGlobal("RateLimit", L.NewFunction(func(L *lua.LState) int {
+		ac.rateLimit = L.CheckInt(1)
+		return 0 // number of results
+	}))
+
+	// Set the IP addresses and networks of the proxies that are trusted to
+	// set X-Forwarded-For, like {"10.0.0.0/8"}, for the clientIP function.
+	// Returns true on success, or false and an error message.
+	L.SetGlobal("SetTrustedProxies", L.NewFunction(func(L *lua.LState) int {
+		proxies, err := parseTrustedProxies(convert.Table2strings(L.CheckTable(1)))
+		if err != nil {
+			L.Push(lua.LBool(false))
+			L.Push(lua.LString(err.Error()))
+			return 2 // number of results
+		}
+		ac.trustedProxies = proxies
+		L.Push(lua.LBool(true))
+		return 1 // number of results
+	}))
+
+	// Enable or disable listing the contents of directories without an
+	// index file
+	L.SetGlobal("SetDirListing", L.NewFunction(func(L *lua.LState) int {
+		ac.dirListing = L.ToBool(1)
+		return 0 // number of results
+	}))
+
+	// Set the filenames that are served for directory requests, tried in
+	// order, like {"index.lua", "index.html", "README.md"}
+	L.SetGlobal("SetIndexFiles", L.NewFunction(func(L *lua.LState) int {
+		filenames := convert.Table2strings(L.CheckTable(1))
+		if err := checkIndexFiles(filenames); err != nil {
+			L.Push(lua.LBool(false))
+			L.Push(lua.LString(err.Error()))
+			return 2 // number of results
+		}
+		ac.indexFilenames = filenames
+		L.Push(lua.LBool(true))
+		return 1 // number of results
+	}))
+
+	// Set the directory for temporary files, like uploaded files that are
+	// too large to be kept in memory. Returns false and an error message if
+	// the directory does not exist or is not writable.
+	L.SetGlobal("SetTempDir", L.NewFunction(func(L *lua.LState) int {
+		if err := ac.setTempDir(L.CheckString(1)); err != nil {
+			L.Push(lua.LBool(false))
+			L.Push(lua.LString(err.Error()))
+			return 2 // number of results
+		}
+		L.Push(lua.LBool(true))
+		return 1 // number of results
+	}))
+
+	// Set how long a client may take to send a request, in seconds.
+	// 0 is no timeout.
+	L.SetGlobal("SetReadTimeout", L.NewFunction(func(L *lua.LState) int {
+		ac.readTimeout = time.Duration(float64(L.CheckNumber(1)) * float64(time.Second))
+		return 0 // number of results
+	}))
+
+	// Set how long it may take to send a response, in seconds.
+	// 0 is no timeout.
+	L.SetGlobal("SetWriteTimeout", L.NewFunction(func(L *lua.LState) int {
+		ac.writeTimeout = time.Duration(float64(L.CheckNumber(1)) * float64(time.Second))
+		return 0 // number of results
+	}))
+
+	// Set the maximum number of pooled Lua states, 0 is unlimited. If the
+	// optional argument is true, requests wait for a Lua state when all of
+	// them are in use. If not, extra Lua states are created and discarded.
+	L.SetGlobal("SetLuaPoolSize", L.NewFunction(func(L *lua.LState) int {
+		ac.luaPoolSize = L.CheckInt(1)
+		ac.luaPoolBlock = L.OptBool(2, false)
+		if ac.luapool != nil {
+			ac.luapool.SetSize(ac.luaPoolSize, ac.luaPoolBlock)
+		}
+		return 0 // number of results
+	}))
+
+	// Enable or disable ETag headers for the output of Lua scripts and
+	// Last-Modified headers for files, for answering conditional requests
+	// with "304 Not Modified"
+	L.SetGlobal("SetCaching", L.NewFunction(func(L *lua.LState) int {
+		ac.etagCaching = L.ToBool(1)
+		return 0 // number of results
+	}))
+
+	// Set how long sessions last without changes, in seconds
+	L.SetGlobal("SetSessionTimeout", L.NewFunction(func(L *lua.LState) int {
+		ac.sessionTimeout = time.Duration(float64(L.CheckNumber(1)) * float64(time.Second))
 		return 0 // number of results
 	}))
 
@@ -136,9 +434,9 @@ func (ac *Config) LoadServerConfigFunctions(L *lua.LState, filename string) erro
 		luaDenyFunc := L.ToFunction(1)
 
 		// Custom handler for when permissions are denied
-		ac.perm.SetDenyFunction(func(w http.ResponseWriter, req *http.Request) {
+		perm.SetDenyFunction(func(w http.ResponseWriter, req *http.Request) {
 			// Set up a new Lua state with the current http.ResponseWriter and *http.Request, without caching
-			ac.LoadCommonFunctions(w, req, filename, L, nil, nil)
+			ac.LoadCommonFunctions(w, req, filename, L, nil, nil, newEarlyHints(w, req, true))
 
 			// Then run the given Lua function
 			L.Push(luaDenyFunc)
@@ -153,6 +451,38 @@ func (ac *Config) LoadServerConfigFunctions(L *lua.LState, filename string) erro
 		return 0 // number of results
 	}))
 
+	// Sets a Lua function for serving a custom page for the given HTTP status
+	// code, like 404 or 500. The Lua function is given the status code.
+	// Returns true on success, or false and an error message.
+	L.SetGlobal("ErrorHandler", L.NewFunction(func(L *lua.LState) int {
+		code := L.CheckInt(1)
+		luaErrorFunc := L.CheckFunction(2)
+		if code < 400 || code > 599 {
+			L.Push(lua.LBool(false))
+			L.Push(lua.LString("the status code must be from 400 to 599"))
+			return 2 // number of results
+		}
+		ac.setErrorPage(code, ac.luaErrorPage(L, filename, luaErrorFunc))
+		L.Push(lua.LBool(true))
+		return 1 // number of results
+	}))
+
+	// Sets a Lua function to be run before every request, with a table with
+	// the method, path and clientIP of the request. If the function returns
+	// false, the request is rejected with "403 Forbidden".
+	L.SetGlobal("BeforeRequest", L.NewFunction(func(L *lua.LState) int {
+		ac.addRequestHooks(ac.luaBeforeHook(L, hookMut, L.CheckFunction(1)), nil)
+		return 0 // number of results
+	}))
+
+	// Sets a Lua function to be run after every request, with a table with
+	// the method, path and clientIP of the request, the status code and how
+	// long it took to handle the request, in seconds.
+	L.SetGlobal("AfterRequest", L.NewFunction(func(L *lua.LState) int {
+		ac.addRequestHooks(nil, ac.luaAfterHook(L, hookMut, L.CheckFunction(1)))
+		return 0 // number of results
+	}))
+
 	// Sets a Lua function to be run once the server is done parsing configuration and arguments.
 	L.SetGlobal("OnReady", L.NewFunction(func(L *lua.LState) int {
 		luaReadyFunc := L.ToFunction(1)
@@ -170,12 +500,33 @@ func (ac *Config) LoadServerConfigFunctions(L *lua.LState, filename string) erro
 		return 0 // number of results
 	}))
 
+	// Sets a Lua function to be run when the server is shutting down, for
+	// instance after receiving SIGINT or SIGTERM. Can be called several times.
+	L.SetGlobal("OnShutdown", L.NewFunction(func(L *lua.LState) int {
+		luaShutdownFunc := L.CheckFunction(1)
+
+		AtShutdown(func() {
+			// Run the given Lua function in a fresh Lua state from the pool
+			shutdownL := L
+			if ac.luapool != nil {
+				shutdownL = ac.luapool.Get()
+				defer ac.luapool.Put(shutdownL)
+			}
+			shutdownL.Push(luaShutdownFunc)
+			if err := shutdownL.PCall(0, lua.MultRet, nil); err != nil {
+				// Non-fatal error
+				log.Error("The OnShutdown function failed:", err)
+			}
+		})
+		return 0 // number of results
+	}))
+
 	// Set a access log filename. If blank, the log will go to the console (or browser, if debug mode is set).
 	L.SetGlobal("LogTo", L.NewFunction(func(L *lua.LState) int {
 		filename := L.ToString(1)
 		ac.serverLogFile = filename
-		// Log as JSON by default
-		log.SetFormatter(&log.JSONFormatter{})
+		// Log as JSON by default, unless --logformat is given
+		log.SetFormatter(ac.logFormatter(true))
 		// Log to stderr if an empty filename is given
 		if filename == "" {
 			log.SetOutput(os.Stderr)
@@ -195,6 +546,58 @@ func (ac *Config) LoadServerConfigFunctions(L *lua.LState, filename string) erro
 		return 1 // number of results
 	}))
 
+	// Fetch and renew TLS certificates from Let's Encrypt for the given
+	// domains. Returns true on success, or false and an error message.
+	L.SetGlobal("EnableAutoTLS", L.NewFunction(func(L *lua.LState) int {
+		domains := convert.Table2strings(L.CheckTable(1))
+		if len(domains) == 0 {
+			L.Push(lua.LBool(false))
+			L.Push(lua.LString("no domains given"))
+			return 2 // number of results
+		}
+		if ac.serverCertGiven {
+			L.Push(lua.LBool(false))
+			L.Push(lua.LString(errAutoTLSWithCert.Error()))
+			return 2 // number of results
+		}
+		ac.autoTLS = true
+		ac.autoTLSDomains = domains
+		L.Push(lua.LBool(true))
+		return 1 // number of results
+	}))
+
+	// Enable or disable compression of the responses with gzip or deflate
+	L.SetGlobal("SetCompression", L.NewFunction(func(L *lua.LState) int {
+		ac.compressResponses = L.ToBool(1)
+		return 0 // number of results
+	}))
+
+	// Allow cross-origin requests from the given origins ("*" for all),
+	// with the given methods, or with the default methods if none are given
+	L.SetGlobal("SetCORS", L.NewFunction(func(L *lua.LState) int {
+		ac.corsOrigins = convert.Table2strings(L.CheckTable(1))
+		ac.corsMethods = nil
+		if L.GetTop() >= 2 {
+			ac.corsMethods = convert.Table2strings(L.CheckTable(2))
+		}
+		return 0 // number of results
+	}))
+
+	// Set the log level to "debug", "info", "warn" or "error".
+	// Returns true on success, or false and an error message.
+	L.SetGlobal("SetLogLevel", L.NewFunction(func(L *lua.LState) int {
+		level, err := parseLogLevel(L.CheckString(1))
+		if err != nil {
+			L.Push(lua.LBool(false))
+			L.Push(lua.LString(err.Error()))
+			return 2 // number of results
+		}
+		ac.logLevel = strings.ToLower(L.ToString(1))
+		log.SetLevel(level)
+		L.Push(lua.LBool(true))
+		return 1 // number of results
+	}))
+
 	// Use a single Lua file as the server, instead of directory structure
 	L.SetGlobal("ServerFile", L.NewFunction(func(L *lua.LState) int {
 		givenFilename := L.ToString(1)
@@ -209,15 +612,102 @@ func (ac *Config) LoadServerConfigFunctions(L *lua.LState, filename string) erro
 		return 1 // number of results
 	}))
 
+	// Return information about the configuration and the running server.
+	// If the optional argument is "json", the information is returned as JSON.
 	L.SetGlobal("ServerInfo", L.NewFunction(func(L *lua.LState) int {
-		// Return the string, but drop the final newline
-		L.Push(lua.LString(ac.Info()))
+		switch format := L.OptString(1, "text"); format {
+		case "text":
+			L.Push(lua.LString(ac.ServerInfo()))
+		case "json":
+			s, err := ac.ServerInfoJSON()
+			if err != nil {
+				L.Push(lua.LNil)
+				L.Push(lua.LString(err.Error()))
+				return 2 // number of results
+			}
+			L.Push(lua.LString(s))
+		default:
+			L.ArgError(1, "unknown format: "+format)
+		}
 		return 1 // number of results
 	}))
 
 	return nil
 }
 
+// redisHostPort returns the given Redis host and port, prefixed with the
+// password on the form "password@host:port", if a password is set
+func (ac *Config) redisHostPort(addr string) string {
+	if ac.redisPassword == "" {
+		return addr
+	}
+	return ac.redisPassword + "@" + addr
+}
+
+// connectRedis connects to the Redis server and returns a permissions struct
+// that uses Redis as the database backend. Returns an error if the server
+// could not be reached, if the TLS handshake failed or if the password was
+// not accepted.
+func (ac *Config) connectRedis() (pinterface.IPermissions, error) {
+	var (
+		addr      = ac.redisAddr
+		tlsConfig *tls.Config
+		err       error
+	)
+	if ac.redisTLS {
+		if tlsConfig, err = ac.redisTLSConfig(); err != nil {
+			return nil, err
+		}
+	}
+	if len(ac.redisSentinels) > 0 {
+		// Connect to the current master, as given by Redis Sentinel
+		if addr, err = ac.startRedisSentinelTunnel(tlsConfig); err != nil {
+			return nil, err
+		}
+	} else if ac.redisTLS {
+		if err = ac.checkRedisTLS(tlsConfig); err != nil {
+			return nil, err
+		}
+		if addr, err = ac.startRedisTLSTunnel(tlsConfig); err != nil {
+			return nil, err
+		}
+	}
+	if err := simpleredis.TestConnectionHost(addr); err != nil {
+		return nil, err
+	}
+	// The connection test does not authenticate, so check that the password
+	// is accepted before connecting, for a clearer error message
+	pool := simpleredis.NewConnectionPoolHost(ac.redisHostPort(addr))
+	err = pool.Ping()
+	pool.Close()
+	if err != nil {
+		return nil, fmt.Errorf("could not authenticate with the Redis server at %s: %s", ac.redisAddr, err)
+	}
+	perm, err := redis.NewWithRedisConf2(ac.redisDBindex, ac.redisHostPort(addr))
+	if err != nil {
+		// The error message may contain the password, so don't include it
+		return nil, errors.New("could not connect to the Redis server at " + ac.redisAddr)
+	}
+	pool = perm.UserState().(*redis.UserState).Pool()
+	ac.setRedisPoolSize(pool)
+	// Fail right away while Redis is unreachable, and connect again with a delay
+	datastruct.ReconnectWithBackoff(pool)
+	return perm, nil
+}
+
+// setRedisPoolSize sets the maximum number of idle and active connections
+// for the given Redis connection pool, if a pool size has been configured
+func (ac *Config) setRedisPoolSize(pool *simpleredis.ConnectionPool) {
+	if ac.redisPoolSize <= 0 {
+		return
+	}
+	redisPool := (*redigo.Pool)(pool)
+	redisPool.MaxIdle = ac.redisPoolSize
+	redisPool.MaxActive = ac.redisPoolSize
+	// Wait for a connection instead of failing when all connections are in use
+	redisPool.Wait = true
+}
+
 // DatabaseBackend tries to retrieve a database backend, using one of the
 // available permission middleware packages. It assign a name to dbName
 // (used for the status output) and returns a IPermissions struct.
@@ -237,7 +727,7 @@ func (ac *Config) DatabaseBackend() (pinterface.IPermissions, error) {
 		perm, err = bolt.NewWithConf(ac.boltFilename)
 		if err != nil {
 			if err.Error() == "timeout" {
-				tempFile, errTemp := ioutil.TempFile("", "algernon")
+				tempFile, errTemp := ioutil.TempFile(ac.tempDir, "algernon")
 				if errTemp != nil {
 					log.Fatal("Unable to find a temporary file to use:", errTemp)
 				} else {
@@ -315,8 +805,8 @@ func (ac *Config) DatabaseBackend() (pinterface.IPermissions, error) {
 	}
 	if ac.dbName == "" && ac.redisAddrSpecified {
 		// New permissions middleware, using a Redis database
-		log.Info("Testing redis connection")
-		if err := simpleredis.TestConnectionHost(ac.redisAddr); err != nil {
+		log.Info("Connecting to Redis...")
+		if perm, err = ac.connectRedis(); err != nil {
 			log.Info("Redis connection failed")
 			// Only output an error when a Redis host other than the default host+port was specified
 			if ac.singleFileMode {
@@ -326,14 +816,7 @@ func (ac *Config) DatabaseBackend() (pinterface.IPermissions, error) {
 			}
 		} else {
 			log.Info("Redis connection worked out")
-			var err error
-			log.Info("Connecting to Redis...")
-			perm, err = redis.NewWithRedisConf2(ac.redisDBindex, ac.redisAddr)
-			if err != nil {
-				log.Warnf("Could not use Redis as database backend: %s", err)
-			} else {
-				ac.dbName = "Redis"
-			}
+			ac.dbName = "Redis"
 		}
 	}
 	if ac.dbName == "" && ac.boltFilename == "" {
@@ -341,7 +824,7 @@ func (ac *Config) DatabaseBackend() (pinterface.IPermissions, error) {
 		perm, err = bolt.NewWithConf(ac.boltFilename)
 		if err != nil {
 			if err.Error() == "timeout" {
-				tempFile, errTemp := ioutil.TempFile("", "algernon")
+				tempFile, errTemp := ioutil.TempFile(ac.tempDir, "algernon")
 				if errTemp != nil {
 					log.Fatal("Unable to find a temporary file to use:", errTemp)
 				} else {
@@ -0,0 +1,564 @@
+package engine
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bmizerany/assert"
+	redigo "github.com/gomodule/redigo/redis"
+	log "github.com/sirupsen/logrus"
+	"github.com/xyproto/algernon/lua/pool"
+	"github.com/xyproto/gopher-lua"
+	bolt "github.com/xyproto/permissionbolt"
+	redis "github.com/xyproto/permissions2"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// passwordRedis starts a server that only replies to commands after a
+// successful AUTH with the given password. Returns the address of the server.
+func passwordRedis(t *testing.T, password string) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	serveRedis(listener, password)
+	return listener.Addr().String()
+}
+
+// serveRedis accepts connections on the given listener, and replies with
+// PONG to all commands after a successful AUTH with the given password
+func serveRedis(listener net.Listener, password string) {
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func(conn net.Conn) {
+				defer conn.Close()
+				r := bufio.NewReader(conn)
+				authenticated := false
+				for {
+					// Read a command, sent as an array of bulk strings
+					line, err := r.ReadString('\n')
+					if err != nil {
+						return
+					}
+					n, _ := strconv.Atoi(strings.TrimSpace(line[1:]))
+					args := make([]string, n)
+					for i := range args {
+						line, err = r.ReadString('\n')
+						if err != nil {
+							return
+						}
+						length, _ := strconv.Atoi(strings.TrimSpace(line[1:]))
+						buf := make([]byte, length+2)
+						if _, err := io.ReadFull(r, buf); err != nil {
+							return
+						}
+						args[i] = string(buf[:length])
+					}
+					switch {
+					case strings.ToUpper(args[0]) == "AUTH" && args[1] == password:
+						authenticated = true
+						io.WriteString(conn, "+OK\r\n")
+					case strings.ToUpper(args[0]) == "AUTH":
+						io.WriteString(conn, "-ERR invalid password\r\n")
+					case !authenticated:
+						io.WriteString(conn, "-NOAUTH Authentication required.\r\n")
+					default:
+						io.WriteString(conn, "+PONG\r\n")
+					}
+				}
+			}(conn)
+		}
+	}()
+}
+
+func TestConnectRedisPassword(t *testing.T) {
+	ac := &Config{redisAddr: passwordRedis(t, "hunter2")}
+
+	// No password
+	_, err := ac.connectRedis()
+	assert.NotEqual(t, err, nil)
+	assert.Equal(t, strings.Contains(err.Error(), "authenticate"), true)
+
+	// Wrong password
+	ac.redisPassword = "wrong"
+	_, err = ac.connectRedis()
+	assert.NotEqual(t, err, nil)
+	assert.Equal(t, strings.Contains(err.Error(), "invalid password"), true)
+
+	// The right password
+	ac.redisPassword = "hunter2"
+	perm, err := ac.connectRedis()
+	assert.Equal(t, err, nil)
+	assert.NotEqual(t, perm, nil)
+
+	// Unreachable server
+	ac.redisAddr = "127.0.0.1:1"
+	_, err = ac.connectRedis()
+	assert.NotEqual(t, err, nil)
+}
+
+func TestRedisPoolSize(t *testing.T) {
+	ac := &Config{redisAddr: passwordRedis(t, "hunter2"), redisPassword: "hunter2"}
+
+	// The default pool size
+	perm, err := ac.connectRedis()
+	assert.Equal(t, err, nil)
+	pool := (*redigo.Pool)(perm.UserState().(*redis.UserState).Pool())
+	assert.Equal(t, pool.MaxActive, 0)
+
+	ac.redisPoolSize = 5
+	perm, err = ac.connectRedis()
+	assert.Equal(t, err, nil)
+	pool = (*redigo.Pool)(perm.UserState().(*redis.UserState).Pool())
+	assert.Equal(t, pool.MaxIdle, 5)
+	assert.Equal(t, pool.MaxActive, 5)
+	assert.Equal(t, pool.Wait, true)
+}
+
+// tlsRedis starts a Redis server that is only available over TLS, with a
+// self-signed certificate for 127.0.0.1. Returns the address of the server
+// and the filename of the certificate, in PEM format.
+func tlsRedis(t *testing.T, password string) (string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "127.0.0.1"},
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{cert}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	serveRedis(listener, password)
+
+	certFile, err := ioutil.TempFile("", "algernon_redis_ca")
+	if err != nil {
+		t.Fatal(err)
+	}
+	certFile.Write(certPEM)
+	certFile.Close()
+	return listener.Addr().String(), certFile.Name()
+}
+
+func TestRedisTLS(t *testing.T) {
+	addr, caFile := tlsRedis(t, "hunter2")
+	defer os.Remove(caFile)
+
+	ac := &Config{redisAddr: addr, redisPassword: "hunter2", redisTLS: true}
+	defer ac.Close()
+
+	// The self-signed certificate is not trusted
+	_, err := ac.connectRedis()
+	assert.NotEqual(t, err, nil)
+	assert.Equal(t, strings.HasPrefix(err.Error(), "TLS handshake"), true)
+
+	// Skip verification
+	ac.redisTLSSkipVerify = true
+	_, err = ac.connectRedis()
+	assert.Equal(t, err, nil)
+
+	// Trust the certificate
+	ac.redisTLSSkipVerify = false
+	ac.redisCA = caFile
+	perm, err := ac.connectRedis()
+	assert.Equal(t, err, nil)
+	assert.Equal(t, perm.UserState().(*redis.UserState).Pool().Ping(), nil)
+
+	// A wrong password is not reported as a TLS failure
+	ac.redisPassword = "wrong"
+	_, err = ac.connectRedis()
+	assert.NotEqual(t, err, nil)
+	assert.Equal(t, strings.HasPrefix(err.Error(), "could not authenticate"), true)
+
+	// Without TLS, the server does not reply
+	ac.redisPassword = "hunter2"
+	ac.redisTLS = false
+	_, err = ac.connectRedis()
+	assert.NotEqual(t, err, nil)
+}
+
+func TestOnShutdown(t *testing.T) {
+	boltFile, err := ioutil.TempFile("", "algernon_shutdown")
+	assert.Equal(t, err, nil)
+	boltFile.Close()
+	defer os.Remove(boltFile.Name())
+
+	ac := &Config{luapool: pool.New()}
+	ac.perm, err = bolt.NewWithConf(boltFile.Name())
+	assert.Equal(t, err, nil)
+
+	var logbuf bytes.Buffer
+	defer log.SetOutput(log.StandardLogger().Out)
+	log.SetOutput(&logbuf)
+
+	L := lua.NewState()
+	defer L.Close()
+	assert.Equal(t, ac.LoadServerConfigFunctions(L, "serverconf.lua"), nil)
+	err = L.DoString(`
+		OnShutdown(function()
+			local missing = nil
+			missing.field = 1
+		end)
+		OnShutdown(function()
+			cleanedup = true
+		end)
+	`)
+	assert.Equal(t, err, nil)
+	assert.Equal(t, L.GetGlobal("cleanedup"), lua.LNil)
+
+	// The functions run at shutdown, and a failing function is only logged
+	ac.GenerateShutdownFunction(false, nil)()
+	assert.Equal(t, L.GetGlobal("cleanedup"), lua.LTrue)
+	assert.Equal(t, strings.Contains(logbuf.String(), "The OnShutdown function failed"), true)
+}
+
+func TestSetLogLevel(t *testing.T) {
+	_, err := parseLogLevel("verbose")
+	assert.NotEqual(t, err, nil)
+	level, err := parseLogLevel("WARN")
+	assert.Equal(t, err, nil)
+	assert.Equal(t, level, log.WarnLevel)
+
+	var logbuf bytes.Buffer
+	defer log.SetOutput(log.StandardLogger().Out)
+	defer log.SetLevel(log.GetLevel())
+	log.SetOutput(&logbuf)
+
+	boltFile, err := ioutil.TempFile("", "algernon_loglevel")
+	assert.Equal(t, err, nil)
+	boltFile.Close()
+	defer os.Remove(boltFile.Name())
+
+	ac := &Config{logLevel: "error"}
+	ac.perm, err = bolt.NewWithConf(boltFile.Name())
+	assert.Equal(t, err, nil)
+	ac.setupLogging()
+	assert.Equal(t, log.GetLevel(), log.ErrorLevel)
+
+	L := lua.NewState()
+	defer L.Close()
+	ac.LoadBasicSystemFunctions(L)
+	assert.Equal(t, ac.LoadServerConfigFunctions(L, "serverconf.lua"), nil)
+	err = L.DoString(`
+		log("info message")
+		warn("warning message")
+		err("error message")
+
+		assert(SetLogLevel("warn"))
+		log("second info message")
+		warn("second warning message")
+
+		local ok, msg = SetLogLevel("loud")
+		assert(not ok and msg ~= nil)
+	`)
+	assert.Equal(t, err, nil)
+	assert.Equal(t, ac.logLevel, "warn")
+	assert.Equal(t, log.GetLevel(), log.WarnLevel)
+
+	output := logbuf.String()
+	assert.Equal(t, strings.Contains(output, "error message"), true)
+	assert.Equal(t, strings.Contains(output, "second warning message"), true)
+	assert.Equal(t, strings.Contains(output, "info message"), false)
+	assert.Equal(t, strings.Count(output, "warning message"), 1)
+}
+
+func TestLogFormat(t *testing.T) {
+	boltFile, err := ioutil.TempFile("", "algernon_logformat")
+	assert.Equal(t, err, nil)
+	boltFile.Close()
+	defer os.Remove(boltFile.Name())
+
+	var logbuf bytes.Buffer
+	defer log.SetOutput(log.StandardLogger().Out)
+	defer log.SetFormatter(log.StandardLogger().Formatter)
+	log.SetOutput(&logbuf)
+
+	ac := &Config{logFormat: "json"}
+	ac.perm, err = bolt.NewWithConf(boltFile.Name())
+	assert.Equal(t, err, nil)
+	ac.setupLogging()
+
+	L := lua.NewState()
+	defer L.Close()
+	ac.LoadBasicSystemFunctions(L)
+	assert.Equal(t, ac.LoadServerConfigFunctions(L, "serverconf.lua"), nil)
+	assert.Equal(t, L.DoString(`
+		log("info message")
+		warn("warning", "message")
+		err("error message")
+	`), nil)
+
+	// Every line is a JSON object
+	lines := strings.Split(strings.TrimSpace(logbuf.String()), "\n")
+	assert.Equal(t, len(lines), 3)
+	var entries []map[string]interface{}
+	for _, line := range lines {
+		var entry map[string]interface{}
+		assert.Equal(t, json.Unmarshal([]byte(line), &entry), nil)
+		entries = append(entries, entry)
+	}
+	assert.Equal(t, entries[0]["level"], "info")
+	assert.Equal(t, entries[0]["msg"], "info message")
+	assert.Equal(t, entries[1]["level"], "warning")
+	assert.Equal(t, entries[2]["level"], "error")
+	assert.Equal(t, entries[2]["msg"], "error message")
+
+	// LogTo uses the given format as well
+	logFile, err := ioutil.TempFile("", "algernon_logto")
+	assert.Equal(t, err, nil)
+	logFile.Close()
+	defer os.Remove(logFile.Name())
+	ac.logFormat = "text"
+	assert.Equal(t, L.DoString(`assert(LogTo("`+logFile.Name()+`"))`), nil)
+	log.Info("plain text")
+	data, err := ioutil.ReadFile(logFile.Name())
+	assert.Equal(t, err, nil)
+	assert.Equal(t, strings.Contains(string(data), `msg="plain text"`), true)
+	assert.NotEqual(t, json.Unmarshal(data, new(map[string]interface{})), nil)
+}
+
+func TestSetAddr(t *testing.T) {
+	boltFile, err := ioutil.TempFile("", "algernon_setaddr")
+	assert.Equal(t, err, nil)
+	boltFile.Close()
+	defer os.Remove(boltFile.Name())
+
+	ac := &Config{}
+	ac.perm, err = bolt.NewWithConf(boltFile.Name())
+	assert.Equal(t, err, nil)
+
+	L := lua.NewState()
+	defer L.Close()
+	assert.Equal(t, ac.LoadServerConfigFunctions(L, "serverconf.lua"), nil)
+	assert.Equal(t, L.DoString(`SetAddr(":3000")`), nil)
+	assert.Equal(t, ac.serverAddrLua, ":3000")
+	assert.Equal(t, L.DoString(`SetAddr({":80", "unix:/run/algernon.sock"})`), nil)
+	assert.Equal(t, ac.serverAddrLua, ":80,unix:/run/algernon.sock")
+	assert.Equal(t, splitAddrs(ac.serverAddrLua), []string{":80", "unix:/run/algernon.sock"})
+}
+
+func TestEnableAutoTLS(t *testing.T) {
+	assert.Equal(t, splitDomains("example.com, www.example.com,"), []string{"example.com", "www.example.com"})
+
+	boltFile, err := ioutil.TempFile("", "algernon_autotls")
+	assert.Equal(t, err, nil)
+	boltFile.Close()
+	defer os.Remove(boltFile.Name())
+	cacheDir, err := ioutil.TempDir("", "algernon_autocert")
+	assert.Equal(t, err, nil)
+	defer os.RemoveAll(cacheDir)
+
+	ac := &Config{autoTLSCacheDir: cacheDir}
+	ac.perm, err = bolt.NewWithConf(boltFile.Name())
+	assert.Equal(t, err, nil)
+
+	// At least one domain is needed
+	_, err = ac.autocertManager()
+	assert.NotEqual(t, err, nil)
+
+	L := lua.NewState()
+	defer L.Close()
+	assert.Equal(t, ac.LoadServerConfigFunctions(L, "serverconf.lua"), nil)
+	assert.Equal(t, L.DoString(`
+		local ok, err = EnableAutoTLS({})
+		assert(not ok and err ~= nil)
+		assert(EnableAutoTLS({"example.com", "www.example.com"}))
+	`), nil)
+	assert.Equal(t, ac.autoTLS, true)
+	assert.Equal(t, ac.autoTLSDomains, []string{"example.com", "www.example.com"})
+
+	// Only the given domains are accepted
+	m, err := ac.autocertManager()
+	assert.Equal(t, err, nil)
+	assert.Equal(t, m.HostPolicy(nil, "www.example.com"), nil)
+	assert.NotEqual(t, m.HostPolicy(nil, "example.org"), nil)
+	assert.Equal(t, string(m.Cache.(autocert.DirCache)), cacheDir)
+
+	// Given certificates can not be combined with Let's Encrypt
+	ac.autoTLS = false
+	ac.serverCertGiven = true
+	assert.Equal(t, L.DoString(`
+		local ok, err = EnableAutoTLS({"example.com"})
+		assert(not ok and err:find("--cert"))
+	`), nil)
+	assert.Equal(t, ac.autoTLS, false)
+}
+
+func TestSetCORS(t *testing.T) {
+	boltFile, err := ioutil.TempFile("", "algernon_cors")
+	assert.Equal(t, err, nil)
+	boltFile.Close()
+	defer os.Remove(boltFile.Name())
+
+	ac := &Config{}
+	ac.perm, err = bolt.NewWithConf(boltFile.Name())
+	assert.Equal(t, err, nil)
+
+	L := lua.NewState()
+	defer L.Close()
+	assert.Equal(t, ac.LoadServerConfigFunctions(L, "serverconf.lua"), nil)
+	assert.Equal(t, L.DoString(`SetCORS({"https://example.com"}, {"GET", "POST"})`), nil)
+	assert.Equal(t, ac.corsOrigins, []string{"https://example.com"})
+	assert.Equal(t, ac.corsMethods, []string{"GET", "POST"})
+	assert.Equal(t, L.DoString(`SetCORS({"*"})`), nil)
+	assert.Equal(t, ac.corsOrigins, []string{"*"})
+	assert.Equal(t, len(ac.corsMethods), 0)
+}
+
+func TestBasicAuth(t *testing.T) {
+	boltFile, err := ioutil.TempFile("", "algernon_basicauth")
+	assert.Equal(t, err, nil)
+	boltFile.Close()
+	defer os.Remove(boltFile.Name())
+
+	ac := &Config{}
+	ac.perm, err = bolt.NewWithConf(boltFile.Name())
+	assert.Equal(t, err, nil)
+
+	L := lua.NewState()
+	defer L.Close()
+	assert.Equal(t, ac.LoadServerConfigFunctions(L, "serverconf.lua"), nil)
+	assert.Equal(t, L.DoString(`
+		BasicAuth("admin", "secret")
+		BasicAuth("bob", "hunter2", "Bob's area", "/bob")
+	`), nil)
+	assert.Equal(t, ac.basicAuth, []basicAuthRule{
+		{prefix: "/", username: "admin", password: "secret", realm: defaultBasicAuthRealm},
+		{prefix: "/bob", username: "bob", password: "hunter2", realm: "Bob's area"},
+	})
+}
+
+func TestReverseProxy(t *testing.T) {
+	boltFile, err := ioutil.TempFile("", "algernon_reverseproxy")
+	assert.Equal(t, err, nil)
+	boltFile.Close()
+	defer os.Remove(boltFile.Name())
+
+	ac := &Config{}
+	ac.perm, err = bolt.NewWithConf(boltFile.Name())
+	assert.Equal(t, err, nil)
+
+	L := lua.NewState()
+	defer L.Close()
+	assert.Equal(t, ac.LoadServerConfigFunctions(L, "serverconf.lua"), nil)
+	assert.Equal(t, L.DoString(`
+		assert(ReverseProxy("/api", "http://localhost:8080/v1"))
+		local ok, err = ReverseProxy("/bad", "localhost:8080")
+		assert(not ok and err ~= nil)
+	`), nil)
+	assert.Equal(t, len(ac.reverseProxies), 1)
+	assert.Equal(t, ac.reverseProxies[0].prefix, "/api")
+}
+
+func TestRateLimit(t *testing.T) {
+	boltFile, err := ioutil.TempFile("", "algernon_ratelimit")
+	assert.Equal(t, err, nil)
+	boltFile.Close()
+	defer os.Remove(boltFile.Name())
+
+	ac := &Config{}
+	ac.perm, err = bolt.NewWithConf(boltFile.Name())
+	assert.Equal(t, err, nil)
+
+	L := lua.NewState()
+	defer L.Close()
+	assert.Equal(t, ac.LoadServerConfigFunctions(L, "serverconf.lua"), nil)
+	assert.Equal(t, L.DoString(`RateLimit(120)`), nil)
+	assert.Equal(t, ac.rateLimit, 120)
+	assert.Equal(t, strings.Contains(ac.Info(), "120/min"), true)
+}
+
+func TestSetLuaPoolSize(t *testing.T) {
+	boltFile, err := ioutil.TempFile("", "algernon_luapool")
+	assert.Equal(t, err, nil)
+	boltFile.Close()
+	defer os.Remove(boltFile.Name())
+
+	ac := &Config{}
+	ac.perm, err = bolt.NewWithConf(boltFile.Name())
+	assert.Equal(t, err, nil)
+	ac.luapool = pool.New()
+
+	L := lua.NewState()
+	defer L.Close()
+	assert.Equal(t, ac.LoadServerConfigFunctions(L, "serverconf.lua"), nil)
+	assert.Equal(t, strings.Contains(ac.Info(), "max unlimited (grow)"), true)
+
+	assert.Equal(t, L.DoString(`SetLuaPoolSize(4, true)`), nil)
+	assert.Equal(t, ac.luaPoolSize, 4)
+	assert.Equal(t, ac.luaPoolBlock, true)
+	stats := ac.luapool.Stats()
+	assert.Equal(t, stats.Size, 4)
+	assert.Equal(t, stats.Block, true)
+
+	// The utilization is part of the server information
+	L2 := ac.luapool.Get()
+	assert.Equal(t, L.DoString(`info = ServerInfo()`), nil)
+	assert.Equal(t, strings.Contains(L.GetGlobal("info").String(), "1 in use, 0 idle, max 4 (block)"), true)
+	ac.luapool.Put(L2)
+	assert.Equal(t, strings.Contains(ac.Info(), "0 in use, 1 idle, max 4 (block)"), true)
+}
+
+func TestSetTimeouts(t *testing.T) {
+	boltFile, err := ioutil.TempFile("", "algernon_timeouts")
+	assert.Equal(t, err, nil)
+	boltFile.Close()
+	defer os.Remove(boltFile.Name())
+
+	ac := &Config{}
+	ac.perm, err = bolt.NewWithConf(boltFile.Name())
+	assert.Equal(t, err, nil)
+
+	L := lua.NewState()
+	defer L.Close()
+	assert.Equal(t, ac.LoadServerConfigFunctions(L, "serverconf.lua"), nil)
+	assert.Equal(t, L.DoString(`SetReadTimeout(5); SetWriteTimeout(0.5)`), nil)
+	assert.Equal(t, ac.readTimeout, 5*time.Second)
+	assert.Equal(t, ac.writeTimeout, 500*time.Millisecond)
+	assert.Equal(t, strings.Contains(ac.Info(), "Read timeout:\t\t5s"), true)
+}
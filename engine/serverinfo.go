@@ -0,0 +1,136 @@
+package engine
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"runtime"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// runtimeStats contains statistics about the running server
+type runtimeStats struct {
+	uptime       time.Duration
+	goroutines   int
+	memoryInUse  uint64 // bytes allocated for heap objects
+	memoryFromOS uint64 // bytes obtained from the operating system
+}
+
+// currentRuntimeStats returns statistics about the running server
+func (ac *Config) currentRuntimeStats() runtimeStats {
+	var m runtime.MemStats
+	runtime.ReadMemStats(&m)
+	stats := runtimeStats{
+		goroutines:   runtime.NumGoroutine(),
+		memoryInUse:  m.HeapAlloc,
+		memoryFromOS: m.Sys,
+	}
+	if !ac.startTime.IsZero() {
+		stats.uptime = time.Since(ac.startTime)
+	}
+	return stats
+}
+
+// ServerInfo returns the configuration info from Info, followed by
+// statistics about the running server, as aligned key/value lines
+func (ac *Config) ServerInfo() string {
+	var sb strings.Builder
+	sb.WriteString(ac.Info() + "\n")
+	stats := ac.currentRuntimeStats()
+	if !ac.startTime.IsZero() {
+		sb.WriteString("Uptime:\t\t\t" + stats.uptime.Round(time.Second).String() + "\n")
+	}
+	sb.WriteString(fmt.Sprintf("Goroutines:\t\t%d\n", stats.goroutines))
+	sb.WriteString(fmt.Sprintf("Memory in use:\t\t%d bytes\n", stats.memoryInUse))
+	sb.WriteString(fmt.Sprintf("Memory from OS:\t\t%d bytes\n", stats.memoryFromOS))
+	return strings.TrimSpace(sb.String())
+}
+
+// ServerInfoJSON returns the main fields of ServerInfo as a JSON object
+func (ac *Config) ServerInfoJSON() (string, error) {
+	stats := ac.currentRuntimeStats()
+	info := map[string]interface{}{
+		"database":       ac.dbName,
+		"goroutines":     stats.goroutines,
+		"memory_in_use":  stats.memoryInUse,
+		"memory_from_os": stats.memoryFromOS,
+		"cache_mode":     ac.cacheMode.String(),
+		"production":     ac.productionMode,
+	}
+	if ac.singleFileMode {
+		info["filename"] = ac.serverDirOrFilename
+	} else {
+		info["server_directory"] = ac.serverDirOrFilename
+	}
+	if !ac.productionMode {
+		info["server_address"] = ac.serverAddr
+	}
+	if ac.dbName == "Redis" {
+		if len(ac.redisSentinels) > 0 {
+			info["redis_sentinels"] = ac.redisSentinels
+			info["redis_master"] = ac.redisMasterName
+		} else {
+			info["redis_address"] = ac.redisAddr
+		}
+		info["redis_dbindex"] = ac.redisDBindex
+	}
+	if ac.luapool != nil {
+		poolStats := ac.luapool.Stats()
+		info["lua_pool"] = map[string]interface{}{
+			"in_use": poolStats.InUse,
+			"idle":   poolStats.Idle,
+			"size":   poolStats.Size,
+			"block":  poolStats.Block,
+		}
+	}
+	if !ac.startTime.IsZero() {
+		info["uptime"] = stats.uptime.Seconds()
+	}
+	b, err := json.Marshal(info)
+	if err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
+
+// StartupInfoJSON returns the version, the listen address, the Redis address
+// and the process ID as a single line of JSON, for tools that wait for the
+// server to be ready
+func (ac *Config) StartupInfoJSON() (string, error) {
+	info := map[string]interface{}{
+		"version":        ac.versionString,
+		"server_address": ac.serverAddr,
+		"pid":            os.Getpid(),
+	}
+	if ac.dbName == "Redis" {
+		if len(ac.redisSentinels) > 0 {
+			info["redis_sentinels"] = ac.redisSentinels
+			info["redis_master"] = ac.redisMasterName
+		} else {
+			info["redis_address"] = ac.redisAddr
+		}
+	}
+	b, err := json.Marshal(info)
+	if err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
+
+// printStartupInfo writes the output of StartupInfoJSON to the given writer,
+// if --startup-json is given
+func (ac *Config) printStartupInfo(w io.Writer) {
+	if !ac.startupJSON {
+		return
+	}
+	info, err := ac.StartupInfoJSON()
+	if err != nil {
+		log.Error(err)
+		return
+	}
+	fmt.Fprintln(w, info)
+}
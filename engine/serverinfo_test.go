@@ -0,0 +1,71 @@
+package engine
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bmizerany/assert"
+	"github.com/xyproto/algernon/lua/pool"
+	"github.com/xyproto/gopher-lua"
+	bolt "github.com/xyproto/permissionbolt"
+)
+
+func TestServerInfo(t *testing.T) {
+	boltFile, err := ioutil.TempFile("", "algernon_serverinfo")
+	assert.Equal(t, err, nil)
+	boltFile.Close()
+	defer os.Remove(boltFile.Name())
+
+	ac := &Config{serverAddr: ":3000", dbName: "Bolt", startTime: time.Now().Add(-time.Minute)}
+	ac.perm, err = bolt.NewWithConf(boltFile.Name())
+	assert.Equal(t, err, nil)
+	ac.luapool = pool.New()
+
+	L := lua.NewState()
+	defer L.Close()
+	assert.Equal(t, ac.LoadServerConfigFunctions(L, "serverconf.lua"), nil)
+
+	assert.Equal(t, L.DoString(`info = ServerInfo()`), nil)
+	info := L.GetGlobal("info").String()
+	for _, field := range []string{"Server address:\t\t:3000", "Database:\t\tBolt", "Lua pool:", "Uptime:\t\t\t1m0s", "Goroutines:", "Memory in use:", "Memory from OS:"} {
+		assert.Equal(t, strings.Contains(info, field), true)
+	}
+
+	assert.Equal(t, L.DoString(`info = ServerInfo("json")`), nil)
+	var m map[string]interface{}
+	assert.Equal(t, json.Unmarshal([]byte(L.GetGlobal("info").String()), &m), nil)
+	assert.Equal(t, m["server_address"], ":3000")
+	assert.Equal(t, m["database"], "Bolt")
+	assert.Equal(t, m["goroutines"].(float64) > 0, true)
+	assert.Equal(t, m["memory_in_use"].(float64) > 0, true)
+	assert.Equal(t, m["uptime"].(float64) >= 60, true)
+	assert.Equal(t, m["lua_pool"].(map[string]interface{})["size"], float64(0))
+	_, hasRedis := m["redis_address"]
+	assert.Equal(t, hasRedis, false)
+
+	assert.NotEqual(t, L.DoString(`ServerInfo("xml")`), nil)
+}
+
+func TestStartupInfoJSON(t *testing.T) {
+	ac := &Config{versionString: "Algernon 1.2.3", serverAddr: ":3000", dbName: "Redis", redisAddr: "localhost:6379", startupJSON: true}
+	var buf bytes.Buffer
+	ac.printStartupInfo(&buf)
+	assert.Equal(t, strings.Count(buf.String(), "\n"), 1)
+	var m map[string]interface{}
+	assert.Equal(t, json.Unmarshal(buf.Bytes(), &m), nil)
+	assert.Equal(t, m["version"], "Algernon 1.2.3")
+	assert.Equal(t, m["server_address"], ":3000")
+	assert.Equal(t, m["redis_address"], "localhost:6379")
+	assert.Equal(t, m["pid"], float64(os.Getpid()))
+
+	// The Redis address is only included if Redis is used
+	ac.dbName = "Bolt"
+	info, err := ac.StartupInfoJSON()
+	assert.Equal(t, err, nil)
+	assert.Equal(t, strings.Contains(info, "redis"), false)
+}
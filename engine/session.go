@@ -0,0 +1,56 @@
+package engine
+
+import (
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/xyproto/algernon/lua/datastruct"
+	"github.com/xyproto/gopher-lua"
+	"github.com/xyproto/pinterface"
+)
+
+const (
+	// The name of the cookie that holds the session ID
+	sessionCookieName = "algernon_session"
+
+	// How long sessions last without changes, if not configured
+	defaultSessionTimeout = 24 * time.Hour
+)
+
+// sessionCookie returns the cookie for the given session ID, or a cookie that
+// removes the session cookie if the ID is empty
+func sessionCookie(req *http.Request, id string, timeout time.Duration) *http.Cookie {
+	cookie := &http.Cookie{
+		Name:     sessionCookieName,
+		Value:    id,
+		Path:     "/",
+		MaxAge:   int(timeout / time.Second),
+		HttpOnly: true,
+		Secure:   req.TLS != nil,
+		SameSite: http.SameSiteLaxMode,
+	}
+	if id == "" {
+		cookie.MaxAge = -1
+	}
+	return cookie
+}
+
+// LoadSessionFunction makes the session function available to the given Lua
+// state, for storing data per visitor in the database backend
+func (ac *Config) LoadSessionFunction(w http.ResponseWriter, req *http.Request, L *lua.LState, creator pinterface.ICreator) {
+	timeout := ac.sessionTimeout
+	if timeout <= 0 {
+		timeout = defaultSessionTimeout
+	}
+	id := ""
+	if cookie, err := req.Cookie(sessionCookieName); err == nil {
+		id = cookie.Value
+	}
+	datastruct.LoadSession(L, creator, id, timeout, func(id string) error {
+		if !changeHeader(w, "session", "Set-Cookie", sessionCookie(req, id, timeout).String(), true) {
+			return errors.New("the header has already been sent")
+		}
+		return nil
+	})
+}
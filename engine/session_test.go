@@ -0,0 +1,70 @@
+package engine
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"github.com/bmizerany/assert"
+	"github.com/xyproto/algernon/lua/pool"
+	bolt "github.com/xyproto/permissionbolt"
+)
+
+func TestSessionCookie(t *testing.T) {
+	boltFile, err := ioutil.TempFile("", "algernon_session")
+	assert.Equal(t, err, nil)
+	boltFile.Close()
+	defer os.Remove(boltFile.Name())
+
+	ac := &Config{}
+	ac.perm, err = bolt.NewWithConf(boltFile.Name())
+	assert.Equal(t, err, nil)
+	ac.luapool = pool.New()
+	defer ac.luapool.Shutdown()
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		ac.FilePage(w, req, "testdata/session.lua", "")
+	}))
+	defer server.Close()
+
+	jar, err := cookiejar.New(nil)
+	assert.Equal(t, err, nil)
+	client := &http.Client{Jar: jar}
+	get := func(query string) (*http.Response, string) {
+		resp, err := client.Get(server.URL + "/?" + query)
+		assert.Equal(t, err, nil)
+		defer resp.Body.Close()
+		body, err := ioutil.ReadAll(resp.Body)
+		assert.Equal(t, err, nil)
+		return resp, string(body)
+	}
+
+	// No session is created when nothing is set
+	resp, body := get("")
+	assert.Equal(t, resp.Header.Get("Set-Cookie"), "")
+	assert.Equal(t, body, "\n")
+
+	// Setting a value creates the session and sets the cookie
+	resp, body = get("action=set&name=bob")
+	assert.Equal(t, body, "bob\n")
+	cookies := resp.Cookies()
+	assert.Equal(t, len(cookies), 1)
+	assert.Equal(t, cookies[0].Name, sessionCookieName)
+	assert.Equal(t, cookies[0].HttpOnly, true)
+	assert.Equal(t, cookies[0].MaxAge, int(defaultSessionTimeout.Seconds()))
+
+	// The value is read back with the cookie
+	resp, body = get("")
+	assert.Equal(t, resp.Header.Get("Set-Cookie"), "")
+	assert.Equal(t, body, "bob\n")
+
+	// Destroying the session removes the cookie
+	resp, body = get("action=destroy")
+	assert.Equal(t, body, "\n")
+	assert.Equal(t, resp.Cookies()[0].MaxAge, -1)
+	_, body = get("")
+	assert.Equal(t, body, "\n")
+}
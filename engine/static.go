@@ -82,10 +82,10 @@ func (ac *Config) ServeStaticFile(filename, colonPort string) error {
 	HTTPserver := ac.NewGracefulServer(mux, false, ac.serverHost+colonPort)
 
 	// Attempt to serve just the single file
-	if errServe := HTTPserver.ListenAndServe(); errServe != nil {
+	if errServe := serveErr(HTTPserver.ListenAndServe()); errServe != nil {
 		// If it fails, try several times, increasing the port by 1 each time
 		for i := 0; i < maxAttemptsAtIncreasingPortNumber; i++ {
-			if errServe = HTTPserver.ListenAndServe(); errServe != nil {
+			if errServe = serveErr(HTTPserver.ListenAndServe()); errServe != nil {
 				cancelChannel <- true
 				if !strings.HasSuffix(errServe.Error(), "already in use") {
 					// Not a problem with address already being in use
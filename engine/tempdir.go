@@ -0,0 +1,62 @@
+package engine
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+)
+
+// checkTempDir checks that the given directory exists and that temporary
+// files can be created in it
+func checkTempDir(dir string) error {
+	fi, err := os.Stat(dir)
+	if err != nil {
+		return err
+	}
+	if !fi.IsDir() {
+		return fmt.Errorf("%s is not a directory", dir)
+	}
+	f, err := ioutil.TempFile(dir, "algernon")
+	if err != nil {
+		return fmt.Errorf("%s is not writable: %s", dir, err)
+	}
+	f.Close()
+	return os.Remove(f.Name())
+}
+
+// setTempDir uses the given directory for temporary files, like uploaded
+// files that are too large to be kept in memory. The environment variable
+// for the temporary directory is also set, since os.TempDir is used by
+// the standard library when receiving uploaded files.
+func (ac *Config) setTempDir(dir string) error {
+	if err := checkTempDir(dir); err != nil {
+		return err
+	}
+	envVar := "TMPDIR"
+	if runtime.GOOS == "windows" {
+		envVar = "TMP"
+	}
+	if err := os.Setenv(envVar, dir); err != nil {
+		return err
+	}
+	ac.tempDir = dir
+	return nil
+}
+
+// moveServerTempDir creates a new temporary directory for the server, in the
+// directory given with --tmpdir, and removes the one that was created at start
+func (ac *Config) moveServerTempDir() error {
+	serverTempDir, err := ioutil.TempDir(ac.tempDir, "algernon")
+	if err != nil {
+		return err
+	}
+	os.RemoveAll(ac.serverTempDir)
+	ac.serverTempDir = serverTempDir
+	if runtime.GOOS == "windows" {
+		ac.defaultBoltFilename = filepath.Join(serverTempDir, "algernon.db")
+		ac.defaultLogFile = filepath.Join(serverTempDir, "algernon.log")
+	}
+	return nil
+}
@@ -0,0 +1,73 @@
+package engine
+
+import (
+	"bytes"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/bmizerany/assert"
+	"github.com/xyproto/gopher-lua"
+	bolt "github.com/xyproto/permissionbolt"
+)
+
+func TestSetTempDir(t *testing.T) {
+	defer os.Setenv("TMPDIR", os.Getenv("TMPDIR"))
+	dir, err := ioutil.TempDir("", "algernon_tmpdir")
+	assert.Equal(t, err, nil)
+	defer os.RemoveAll(dir)
+
+	ac := &Config{}
+	assert.NotEqual(t, ac.setTempDir(filepath.Join(dir, "missing")), nil)
+	assert.Equal(t, ac.tempDir, "")
+	assert.Equal(t, ac.setTempDir(dir), nil)
+	assert.Equal(t, ac.tempDir, dir)
+
+	// Uploaded files that do not fit in memory are written to the directory
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	fw, err := mw.CreateFormFile("file", "large.txt")
+	assert.Equal(t, err, nil)
+	fw.Write(bytes.Repeat([]byte("a"), 4096))
+	mw.Close()
+	req := httptest.NewRequest("POST", "/upload", &body)
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+	assert.Equal(t, req.ParseMultipartForm(1024), nil)
+	defer req.MultipartForm.RemoveAll()
+	entries, err := ioutil.ReadDir(dir)
+	assert.Equal(t, err, nil)
+	assert.Equal(t, len(entries), 1)
+
+	// The same goes for other temporary files
+	f, err := ioutil.TempFile(ac.tempDir, "algernon")
+	assert.Equal(t, err, nil)
+	f.Close()
+	assert.Equal(t, filepath.Dir(f.Name()), dir)
+}
+
+func TestSetTempDirLua(t *testing.T) {
+	defer os.Setenv("TMPDIR", os.Getenv("TMPDIR"))
+	dir, err := ioutil.TempDir("", "algernon_tmpdir")
+	assert.Equal(t, err, nil)
+	defer os.RemoveAll(dir)
+
+	ac := &Config{}
+	ac.perm, err = bolt.NewWithConf(filepath.Join(dir, "algernon.db"))
+	assert.Equal(t, err, nil)
+
+	L := lua.NewState()
+	defer L.Close()
+	assert.Equal(t, ac.LoadServerConfigFunctions(L, "serverconf.lua"), nil)
+	assert.Equal(t, L.DoString(`assert(SetTempDir("`+dir+`"))`), nil)
+	assert.Equal(t, ac.tempDir, dir)
+
+	// A file is not a directory
+	err = L.DoString(`assert(SetTempDir("` + filepath.Join(dir, "algernon.db") + `"))`)
+	assert.NotEqual(t, err, nil)
+	assert.Equal(t, strings.Contains(err.Error(), "is not a directory"), true)
+	assert.Equal(t, ac.tempDir, dir)
+}
@@ -0,0 +1,8 @@
+print(GetCookie("theme"))
+print(GetCookie("missing") == "")
+assert(SetCookie("session", "abc123", {maxage=3600, path="/", httponly=true, secure=true, samesite="strict"}))
+assert(SetCookie("plain", "1"))
+local ok, err = SetCookie("bad name", "1")
+assert(not ok and err ~= nil)
+ok, err = SetCookie("session", "1", {samesite="sometimes"})
+assert(not ok and err ~= nil)
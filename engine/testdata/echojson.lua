@@ -0,0 +1,14 @@
+local limit = tonumber(header("X-Limit"))
+local data, err
+if limit then
+  data, err = requestJSON(limit)
+else
+  data, err = requestJSON()
+end
+if not data then
+  status(400)
+  print(err)
+  return
+end
+data.echo = true
+assert(respondJSON(data))
@@ -0,0 +1,3 @@
+print("partial output")
+local secret = nil
+secret.database_password = "hunter2"
@@ -0,0 +1,6 @@
+assert(eventSource())
+local i = 1
+while emit("tick", "event " .. i) do
+  i = i + 1
+  sleep(0.01)
+end
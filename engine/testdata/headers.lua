@@ -0,0 +1,5 @@
+assert(setheader("Cache-Control", "no-cache"))
+assert(addheader("X-Tag", "a"))
+assert(addheader("X-Tag", "b"))
+print("hello")
+print(setheader("X-Late", "1"))
@@ -0,0 +1,5 @@
+setheader("X-Preload-Test", "1")
+preload("/style.css", "style")
+preload("/app.js", "script")
+print("hello")
+preload("/late.png", "image")
@@ -0,0 +1,2 @@
+local pushed, err = Push(urldata().path)
+print(tostring(pushed) .. " " .. tostring(err))
@@ -0,0 +1,7 @@
+local code = tonumber(urldata().code)
+if code then
+  redirect("/target", code)
+else
+  redirect("/target")
+end
+print("not sent after a redirect")
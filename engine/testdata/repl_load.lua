@@ -0,0 +1,6 @@
+-- Loaded by TestREPLLoad
+function triple(x)
+  return x * 3
+end
+
+loadcount = 1
@@ -0,0 +1 @@
+print(method(), path(), header("X-Test"), useragent(), clientIP())
@@ -0,0 +1,5 @@
+local ok, err = ServeFile(urldata().file)
+if not ok then
+  print("error: " .. err)
+end
+print("not sent after serving a file")
@@ -0,0 +1,7 @@
+local action = urldata().action
+if action == "set" then
+  assert(session():set("name", urldata().name))
+elseif action == "destroy" then
+  assert(session():destroy())
+end
+print(session():get("name"))
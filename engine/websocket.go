@@ -0,0 +1,66 @@
+package engine
+
+import (
+	"errors"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/gorilla/websocket"
+	log "github.com/sirupsen/logrus"
+	"github.com/xyproto/algernon/lua/wsconn"
+	"github.com/xyproto/gopher-lua"
+)
+
+// errWebSocketUpvalues is returned if a WebSocket handler function refers to
+// local variables from outside of the function, which are not available when
+// the function runs in another Lua state
+var errWebSocketUpvalues = errors.New("a WebSocket handler can not use local variables from outside of the function")
+
+// webSocketUpgrader returns an upgrader that accepts WebSocket connections
+// from pages on the same host, or from the origins that are allowed with
+// --cors or SetCORS
+func (ac *Config) webSocketUpgrader() *websocket.Upgrader {
+	return &websocket.Upgrader{
+		CheckOrigin: func(req *http.Request) bool {
+			origin := req.Header.Get("Origin")
+			if origin == "" || allowedOrigin(ac.corsOrigins, origin) != "" {
+				return true
+			}
+			u, err := url.Parse(origin)
+			return err == nil && strings.EqualFold(u.Host, req.Host)
+		},
+	}
+}
+
+// webSocketHandler returns a handler that upgrades the connection to a
+// WebSocket and calls the given Lua function with the connection. Each
+// connection runs the function in its own Lua state from the pool.
+func (ac *Config) webSocketHandler(handlePath string, handleFunc *lua.LFunction) http.HandlerFunc {
+	upgrader := ac.webSocketUpgrader()
+	return func(w http.ResponseWriter, req *http.Request) {
+		conn, err := upgrader.Upgrade(w, req, nil)
+		if err != nil {
+			// The upgrader has already written an error response
+			log.Error("WebSocket handler for "+handlePath+" could not upgrade the connection: ", err)
+			return
+		}
+		c := wsconn.New(conn)
+		defer c.Close()
+
+		// Retrieve a Lua state
+		L := ac.luapool.Get()
+		defer ac.luapool.Put(L)
+
+		ac.LoadBasicSystemFunctions(L)
+		wsconn.Load(L)
+
+		// Run the function in this Lua state, with the connection as the argument
+		L.Push(L.NewFunctionFromProto(handleFunc.Proto))
+		L.Push(wsconn.NewUserData(L, c))
+		if err := L.PCall(1, 0, nil); err != nil {
+			// Non-fatal error
+			log.Error("WebSocket handler for "+handlePath+" failed:", err)
+		}
+	}
+}
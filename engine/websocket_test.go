@@ -0,0 +1,83 @@
+package engine
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/bmizerany/assert"
+	"github.com/gorilla/websocket"
+	"github.com/xyproto/algernon/lua/pool"
+	"github.com/xyproto/gopher-lua"
+)
+
+func TestWebSocketHandler(t *testing.T) {
+	ac := &Config{disableRateLimiting: true}
+	ac.luapool = pool.New()
+	defer ac.luapool.Shutdown()
+	mux := http.NewServeMux()
+
+	L := lua.NewState()
+	defer L.Close()
+	ac.LoadLuaHandlerFunctions(L, "serverconf.lua", mux, false, nil, "")
+	err := L.DoString(`
+		WebSocketHandler("/echo", function(ws)
+			while true do
+				local msg = ws:receive()
+				if not msg then
+					break
+				end
+				if msg == "bye" then
+					ws:close()
+					break
+				end
+				assert(ws:send("echo: " .. msg))
+			end
+		end)
+	`)
+	assert.Equal(t, err, nil)
+
+	// Functions that use local variables from outside of the function can
+	// not run in another Lua state
+	err = L.DoString(`
+		local prefix = "echo: "
+		WebSocketHandler("/prefix", function(ws)
+			ws:send(prefix)
+		end)
+	`)
+	assert.NotEqual(t, err, nil)
+
+	// Connections can be upgraded when responses are compressed
+	server := httptest.NewServer(CompressionHandler(mux))
+	defer server.Close()
+	wsURL := "ws" + strings.TrimPrefix(server.URL, "http") + "/echo"
+
+	conn, _, err := websocket.DefaultDialer.Dial(wsURL, nil)
+	assert.Equal(t, err, nil)
+	defer conn.Close()
+
+	for _, msg := range []string{"hello", "again"} {
+		assert.Equal(t, conn.WriteMessage(websocket.TextMessage, []byte(msg)), nil)
+		_, data, err := conn.ReadMessage()
+		assert.Equal(t, err, nil)
+		assert.Equal(t, string(data), "echo: "+msg)
+	}
+
+	// The connection is closed cleanly by the handler
+	assert.Equal(t, conn.WriteMessage(websocket.TextMessage, []byte("bye")), nil)
+	_, _, err = conn.ReadMessage()
+	assert.Equal(t, websocket.IsCloseError(err, websocket.CloseNormalClosure), true)
+
+	// Connections from other origins are refused
+	header := http.Header{"Origin": []string{"https://example.com"}}
+	_, resp, err := websocket.DefaultDialer.Dial(wsURL, header)
+	assert.NotEqual(t, err, nil)
+	assert.Equal(t, resp.StatusCode, http.StatusForbidden)
+
+	// Unless they are allowed with --cors or SetCORS
+	ac.corsOrigins = []string{"https://example.com"}
+	allowed, _, err := websocket.DefaultDialer.Dial(wsURL, header)
+	assert.Equal(t, err, nil)
+	allowed.Close()
+}
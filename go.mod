@@ -10,6 +10,8 @@ require (
 	github.com/go-gcfg/gcfg v1.2.3
 	github.com/go-sourcemap/sourcemap v2.1.2+incompatible // indirect
 	github.com/golang/protobuf v1.3.1 // indirect
+	github.com/gomodule/redigo v2.0.0+incompatible
+	github.com/gorilla/websocket v1.4.2
 	github.com/jvatic/goja-babel v0.0.0-20170714233534-00569a238089
 	github.com/konsorten/go-windows-terminal-sequences v1.0.2 // indirect
 	github.com/lucas-clemente/quic-go v0.11.0
@@ -25,7 +27,6 @@ require (
 	github.com/shopspring/decimal v0.0.0-20180709203117-cd690d0c9e24 // indirect
 	github.com/sirupsen/logrus v1.4.1
 	github.com/stvp/assert v0.0.0-20170616060220-4bc16443988b // indirect
-	github.com/tylerb/graceful v1.2.15
 	github.com/wellington/sass v0.0.0-20160911051022-cab90b3986d6
 	github.com/xyproto/datablock v0.0.0-20180830133147-8c3914e5c4fe
 	github.com/xyproto/gluamapper v0.0.0-20190219142928-9e3518c991d4
@@ -47,7 +48,7 @@ require (
 	github.com/xyproto/term v0.3.0
 	github.com/xyproto/unzip v0.0.0-20150601123358-823950573952
 	github.com/yosssi/gcss v0.1.0
-	golang.org/x/crypto v0.0.0-20190404164418-38d8ce5564a5 // indirect
+	golang.org/x/crypto v0.0.0-20190404164418-38d8ce5564a5
 	golang.org/x/net v0.0.0-20190404232315-eb5bcb51f2a3
 	golang.org/x/time v0.0.0-20190308202827-9d24e82272b4 // indirect
 	google.golang.org/appengine v1.5.0 // indirect
@@ -25,12 +25,16 @@ func PprintToWriter(w io.Writer, value lua.LValue) {
 	switch v := value.(type) {
 	case *lua.LTable:
 		t := (*lua.LTable)(v)
+		// Tables that contain other tables are output recursively
+		if nestedTable(t) {
+			pprintTable(w, t)
+			return
+		}
 		// Even if t.Len() is 0, the table may be full of elements
 		m, isAnArray, err := Table2interfaceMapGlua(t)
 		if err != nil {
-			//log.Info("try: for k,v in pairs(t) do pprint(k,v) end")
 			// Could not convert to a map
-			fmt.Fprint(w, v)
+			pprintTable(w, t)
 			return
 		}
 		if isAnArray {
@@ -53,7 +57,7 @@ func PprintToWriter(w io.Writer, value lua.LValue) {
 		}
 		// A go map, but with "interface{}" hidden
 		// TODO: Also hide double quotes, but only when they surround the keys in the map
-		fmt.Fprint(w, strings.Replace(fmt.Sprintf("%#v", m)[29:], ":[]interface {}", "=", -1), "\"", "", -1)
+		fmt.Fprint(w, strings.Replace(fmt.Sprintf("%#v", m)[29:], ":[]interface {}", "=", -1))
 	case *lua.LFunction:
 		if v.Proto != nil {
 			// Extended information about the function
@@ -104,6 +108,15 @@ func Strings2table(L *lua.LState, sl []string) *lua.LTable {
 	return table
 }
 
+// Table2strings converts the array part of a Lua table to a string slice
+func Table2strings(luaTable *lua.LTable) []string {
+	sl := make([]string, 0, luaTable.Len())
+	for i := 1; i <= luaTable.Len(); i++ {
+		sl = append(sl, luaTable.RawGetInt(i).String())
+	}
+	return sl
+}
+
 // Map2table converts a map[string]string to a Lua table
 func Map2table(L *lua.LState, m map[string]string) *lua.LTable {
 	table := L.NewTable()
@@ -332,3 +345,74 @@ func Table2interfaceMapGlua(luaTable *lua.LTable) (retmap map[interface{}]interf
 	}
 	return m, isAnArray, nil
 }
+
+// Value2interface converts a Lua value to a Go value that can be used with
+// templates. Tables with only the indices 1 to n become []interface{} and
+// other tables become map[string]interface{}. Whole numbers become int.
+func Value2interface(value lua.LValue) interface{} {
+	switch v := value.(type) {
+	case *lua.LNilType:
+		return nil
+	case lua.LBool:
+		return bool(v)
+	case lua.LString:
+		return string(v)
+	case lua.LNumber:
+		if float64(v) == float64(int(v)) {
+			return int(v)
+		}
+		return float64(v)
+	case *lua.LTable:
+		count := 0
+		v.ForEach(func(_, _ lua.LValue) {
+			count++
+		})
+		if length := v.MaxN(); length > 0 && length == count {
+			s := make([]interface{}, length)
+			for i := range s {
+				s[i] = Value2interface(v.RawGetInt(i + 1))
+			}
+			return s
+		}
+		m := make(map[string]interface{}, count)
+		v.ForEach(func(key, element lua.LValue) {
+			m[key.String()] = Value2interface(element)
+		})
+		return m
+	default:
+		return v.String()
+	}
+}
+
+// Interface2value converts a value as decoded by encoding/json (nil, bool,
+// float64, string, []interface{} or map[string]interface{}) to a Lua value.
+// Arrays become tables with indices starting at 1.
+func Interface2value(L *lua.LState, value interface{}) lua.LValue {
+	switch v := value.(type) {
+	case nil:
+		return lua.LNil
+	case bool:
+		return lua.LBool(v)
+	case float64:
+		return lua.LNumber(v)
+	case int:
+		return lua.LNumber(v)
+	case string:
+		return lua.LString(v)
+	case []interface{}:
+		table := L.CreateTable(len(v), 0)
+		for i, element := range v {
+			// Not using Append, since it skips nil values
+			table.RawSetInt(i+1, Interface2value(L, element))
+		}
+		return table
+	case map[string]interface{}:
+		table := L.CreateTable(0, len(v))
+		for key, element := range v {
+			L.RawSet(table, lua.LString(key), Interface2value(L, element))
+		}
+		return table
+	default:
+		return lua.LString(fmt.Sprintf("%v", v))
+	}
+}
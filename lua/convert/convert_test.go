@@ -0,0 +1,27 @@
+package convert
+
+import (
+	"testing"
+
+	"github.com/bmizerany/assert"
+	"github.com/xyproto/gopher-lua"
+)
+
+func TestValue2interface(t *testing.T) {
+	L := lua.NewState()
+	defer L.Close()
+
+	err := L.DoString(`data = {name = "Bob", age = 42, height = 1.8, admin = true, tags = {"a", "b"}, empty = {}, nested = {x = {1}}}`)
+	assert.Equal(t, err, nil)
+
+	assert.Equal(t, Value2interface(L.GetGlobal("data")), map[string]interface{}{
+		"name":   "Bob",
+		"age":    42,
+		"height": 1.8,
+		"admin":  true,
+		"tags":   []interface{}{"a", "b"},
+		"empty":  map[string]interface{}{},
+		"nested": map[string]interface{}{"x": []interface{}{1}},
+	})
+	assert.Equal(t, Value2interface(lua.LNil), nil)
+}
@@ -0,0 +1,127 @@
+package convert
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/xyproto/gopher-lua"
+)
+
+// Tables that are longer than this when written on one line, are written
+// over several lines, with indentation
+const maxTableLineLength = 80
+
+// For checking if a table key can be written as a name, like "a" in {a = 1}
+var luaName = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// nestedTable checks if the given table contains other tables
+func nestedTable(t *lua.LTable) bool {
+	nested := false
+	t.ForEach(func(key, value lua.LValue) {
+		if key.Type() == lua.LTTable || value.Type() == lua.LTTable {
+			nested = true
+		}
+	})
+	return nested
+}
+
+// literal returns a Lua value in a form that is close to a Lua literal
+func literal(value lua.LValue, indent string, visited map[*lua.LTable]bool) string {
+	switch v := value.(type) {
+	case lua.LString:
+		return strconv.Quote(string(v))
+	case *lua.LTable:
+		return tableLiteral(v, indent, visited)
+	default:
+		return value.String()
+	}
+}
+
+// keyLess sorts table keys with numbers first, then strings, then the rest
+func keyLess(a, b lua.LValue) bool {
+	an, aIsNum := a.(lua.LNumber)
+	bn, bIsNum := b.(lua.LNumber)
+	switch {
+	case aIsNum && bIsNum:
+		return an < bn
+	case aIsNum != bIsNum:
+		return aIsNum
+	}
+	as, aIsStr := a.(lua.LString)
+	bs, bIsStr := b.(lua.LString)
+	switch {
+	case aIsStr && bIsStr:
+		return as < bs
+	case aIsStr != bIsStr:
+		return aIsStr
+	}
+	return a.String() < b.String()
+}
+
+// tableLiteral returns a table in a form that is close to a Lua table
+// literal, like {a = 1, b = {2, 3}}. Large tables are written over several
+// lines. Tables that refer to themselves are written as <cycle>.
+func tableLiteral(t *lua.LTable, indent string, visited map[*lua.LTable]bool) string {
+	if visited[t] {
+		return "<cycle>"
+	}
+	visited[t] = true
+	defer delete(visited, t)
+
+	innerIndent := indent + "  "
+	var items []string
+
+	// The array part, with indices starting at 1
+	length := 0
+	for ; t.RawGetInt(length+1) != lua.LNil; length++ {
+		items = append(items, literal(t.RawGetInt(length+1), innerIndent, visited))
+	}
+
+	// The rest of the keys, in sorted order
+	var keys []lua.LValue
+	t.ForEach(func(key, _ lua.LValue) {
+		if n, ok := key.(lua.LNumber); ok && float64(n) == float64(int(n)) && int(n) >= 1 && int(n) <= length {
+			return
+		}
+		keys = append(keys, key)
+	})
+	sort.Slice(keys, func(i, j int) bool {
+		return keyLess(keys[i], keys[j])
+	})
+	for _, key := range keys {
+		var keyString string
+		if s, ok := key.(lua.LString); ok && luaName.MatchString(string(s)) {
+			keyString = string(s)
+		} else {
+			keyString = "[" + literal(key, innerIndent, visited) + "]"
+		}
+		items = append(items, keyString+" = "+literal(t.RawGet(key), innerIndent, visited))
+	}
+
+	if len(items) == 0 {
+		return "{}"
+	}
+
+	// Write the table on one line, if it is short enough
+	oneLine := "{" + strings.Join(items, ", ") + "}"
+	if len(indent)+len(oneLine) <= maxTableLineLength && !strings.Contains(oneLine, "\n") {
+		return oneLine
+	}
+	var buf bytes.Buffer
+	buf.WriteString("{\n")
+	for _, item := range items {
+		buf.WriteString(innerIndent + item + ",\n")
+	}
+	buf.WriteString(indent + "}")
+	return buf.String()
+}
+
+// pprintTable outputs a table that contains other tables, recursively
+func pprintTable(w io.Writer, t *lua.LTable) {
+	fmt.Fprint(w, tableLiteral(t, "", make(map[*lua.LTable]bool)))
+}
@@ -0,0 +1,58 @@
+package convert
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/bmizerany/assert"
+	"github.com/xyproto/gopher-lua"
+)
+
+// pprintLua evaluates the given Lua expression and pretty prints the result
+func pprintLua(t *testing.T, L *lua.LState, expression string) string {
+	if err := L.DoString("value = " + expression); err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	PprintToWriter(&buf, L.GetGlobal("value"))
+	return buf.String()
+}
+
+func TestPprintFlat(t *testing.T) {
+	L := lua.NewState()
+	defer L.Close()
+
+	assert.Equal(t, pprintLua(t, L, `{1, 2, 3}`), `{1, 2, 3}`)
+	assert.Equal(t, pprintLua(t, L, `{"a", "b"}`), `{"a", "b"}`)
+	assert.Equal(t, pprintLua(t, L, `{a = 1, b = 2}`), `{"a":1, "b":2}`)
+	assert.Equal(t, pprintLua(t, L, `{}`), `{}`)
+}
+
+func TestPprintNested(t *testing.T) {
+	L := lua.NewState()
+	defer L.Close()
+
+	assert.Equal(t, pprintLua(t, L, `{a = 1, b = {2, 3}}`), `{a = 1, b = {2, 3}}`)
+	assert.Equal(t, pprintLua(t, L, `{{1}, "x", {y = true}, ["a b"] = {}}`), `{{1}, "x", {y = true}, ["a b"] = {}}`)
+
+	// Large tables are indented
+	assert.Equal(t, pprintLua(t, L, `{names = {"alpha", "beta", "gamma", "delta", "epsilon"}, numbers = {1, 2, 3, 4, 5, 6, 7, 8, 9, 10}}`), `{
+  names = {"alpha", "beta", "gamma", "delta", "epsilon"},
+  numbers = {1, 2, 3, 4, 5, 6, 7, 8, 9, 10},
+}`)
+}
+
+func TestPprintCycle(t *testing.T) {
+	L := lua.NewState()
+	defer L.Close()
+
+	if err := L.DoString(`value = {name = "a", list = {1}}; value.self = value; value.list[2] = value.list`); err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	PprintToWriter(&buf, L.GetGlobal("value"))
+	assert.Equal(t, buf.String(), `{list = {1, <cycle>}, name = "a", self = <cycle>}`)
+
+	// The same table may appear several times, as long as it is not a cycle
+	assert.Equal(t, pprintLua(t, L, `(function() local t = {1} return {t, t} end)()`), `{{1}, {1}}`)
+}
@@ -0,0 +1,93 @@
+package datastruct
+
+import (
+	"encoding/json"
+	"strings"
+
+	"github.com/gomodule/redigo/redis"
+	"github.com/xyproto/gopher-lua"
+)
+
+// Characters that have a special meaning in the patterns for SCAN MATCH
+var patternEscaper = strings.NewReplacer(`\`, `\\`, "*", `\*`, "?", `\?`, "[", `\[`, "]", `\]`)
+
+// fieldKeys returns the Redis keys of the elements that belong to this key,
+// named id + ":" + element by simpleredis
+func (rk *redisKey) fieldKeys() ([]string, error) {
+	rk.backend.sync()
+	conn := (*redis.Pool)(rk.pool).Get()
+	defer conn.Close()
+	if rk.dbindex != 0 {
+		if _, err := conn.Do("SELECT", rk.dbindex); err != nil {
+			return nil, err
+		}
+		// Leave the pooled connection at the default database
+		defer conn.Do("SELECT", 0)
+	}
+	var found []string
+	err := scanKeys(conn, patternEscaper.Replace(rk.key)+":*", func(keys []string) error {
+		found = append(found, keys...)
+		return nil
+	})
+	return found, err
+}
+
+// redisCommand is a command with arguments, for sending in a transaction
+type redisCommand struct {
+	name string
+	args []interface{}
+}
+
+// transaction sends the given commands in a MULTI/EXEC transaction, so that
+// other clients see either all or none of the changes. Returns the first error.
+func (rk *redisKey) transaction(commands []redisCommand) error {
+	rk.backend.sync()
+	conn := (*redis.Pool)(rk.pool).Get()
+	defer conn.Close()
+	if rk.dbindex != 0 {
+		if _, err := conn.Do("SELECT", rk.dbindex); err != nil {
+			return err
+		}
+		// Leave the pooled connection at the default database
+		defer conn.Do("SELECT", 0)
+	}
+	conn.Send("MULTI")
+	for _, command := range commands {
+		conn.Send(command.name, command.args...)
+	}
+	replies, err := redis.Values(conn.Do("EXEC"))
+	if err != nil {
+		return err
+	}
+	for _, reply := range replies {
+		if err, ok := reply.(redis.Error); ok {
+			return err
+		}
+	}
+	return nil
+}
+
+// pushJSON pushes the given value as a JSON string, or nil and an error message
+func pushJSON(L *lua.LState, v interface{}, err error) int {
+	if err == nil {
+		var data []byte
+		if data, err = json.Marshal(v); err == nil {
+			L.Push(lua.LString(data))
+			return 1 // Number of returned values
+		}
+	}
+	L.Push(lua.LNil)
+	L.Push(lua.LString(err.Error()))
+	return 2 // Number of returned values
+}
+
+// pushImported pushes true, or false and an error message
+func pushImported(L *lua.LState, err error) int {
+	if err != nil {
+		L.Push(lua.LFalse)
+		L.Push(lua.LString(err.Error()))
+		return 2 // Number of returned values
+	}
+	L.Push(lua.LTrue)
+	return 1 // Number of returned values
+}
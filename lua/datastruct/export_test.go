@@ -0,0 +1,110 @@
+package datastruct
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/bmizerany/assert"
+	"github.com/xyproto/gopher-lua"
+	"github.com/xyproto/simplebolt"
+)
+
+// The script for exporting, clearing and importing data structures.
+// Works with all database backends, except for the KeyValue.
+const exportImportScript = `
+	local set = Set("tags")
+	set:add("go")
+	set:add("lua")
+	set:add("redis")
+	local list = List("log")
+	list:add("started")
+	list:add("stopped")
+	list:add("started")
+	local hash = HashMap("users")
+	hash:set("alice", "name", "Alice")
+	hash:set("alice", "email", "alice@example.com")
+	hash:set("bob", "name", "Bob")
+
+	for _, ds in ipairs({set, list, hash}) do
+		local exported, err = ds:export()
+		assert(exported, err)
+		ds:clear()
+		assert(ds:export() ~= exported)
+		assert(ds:import(exported))
+		assert(ds:export() == exported)
+
+		-- Invalid JSON leaves the data as it is
+		local ok, err = ds:import("{")
+		assert(not ok)
+		assert(err)
+		assert(ds:export() == exported)
+	end
+
+	assert(set:export() == '["go","lua","redis"]')
+	assert(list:export() == '["started","stopped","started"]')
+	assert(hash:get("alice", "email") == "alice@example.com")
+	assert(#hash:getall() == 2)
+`
+
+func TestExportImport(t *testing.T) {
+	L, fr := newRedisTestState(t)
+	defer L.Close()
+
+	assert.Equal(t, L.DoString(exportImportScript), nil)
+
+	err := L.DoString(`
+		local kv = KeyValue("settings")
+		kv:set("theme", "dark")
+		kv:set("lang", "nb")
+		local exported = kv:export()
+		assert(exported == '{"lang":"nb","theme":"dark"}')
+		kv:clear()
+		assert(kv:export() == "{}")
+		assert(kv:import(exported))
+		assert(kv:get("theme") == "dark")
+		assert(kv:export() == exported)
+
+		-- Importing replaces the existing keys
+		assert(kv:import('{"theme":"light"}'))
+		assert(kv:get("lang") == "")
+		assert(kv:export() == '{"theme":"light"}')
+	`)
+	assert.Equal(t, err, nil)
+
+	// The import is sent as one transaction
+	before := commandCount(fr)
+	assert.Equal(t, L.DoString(`assert(List("log"):import('["a","b","c"]'))`), nil)
+	assert.Equal(t, commandCount(fr)-before, 4) // DEL and three RPUSH
+}
+
+func TestExportImportBolt(t *testing.T) {
+	f, err := ioutil.TempFile("", "algernon_export")
+	assert.Equal(t, err, nil)
+	f.Close()
+	defer os.Remove(f.Name())
+	db, err := simplebolt.New(f.Name())
+	assert.Equal(t, err, nil)
+	defer db.Close()
+	creator := simplebolt.NewCreator(db)
+
+	L := lua.NewState()
+	defer L.Close()
+	LoadList(L, creator)
+	LoadSet(L, creator)
+	LoadHash(L, creator)
+	LoadKeyValue(L, creator)
+
+	assert.Equal(t, L.DoString(exportImportScript), nil)
+
+	// The keys can not be listed without Redis
+	err = L.DoString(`
+		local kv = KeyValue("settings")
+		assert(kv:import('{"theme":"dark"}'))
+		assert(kv:get("theme") == "dark")
+		local exported, err = kv:export()
+		assert(exported == nil)
+		assert(string.find(err, "requires Redis"))
+	`)
+	assert.Equal(t, err, nil)
+}
@@ -0,0 +1,795 @@
+package datastruct
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+	"github.com/xyproto/gopher-lua"
+	"github.com/xyproto/simpleredis"
+)
+
+// fakeRedis is a small in-memory implementation of the Redis commands that
+// are used by simpleredis and by the functions in this package. Database
+// indices are ignored and expired keys are removed when they are accessed.
+type fakeRedis struct {
+	mut      sync.Mutex
+	strs     map[string]string
+	lists    map[string][]string
+	sets     map[string]map[string]bool
+	hashes   map[string]map[string]string
+	zsets    map[string]map[string]float64
+	expires  map[string]time.Time
+	commands int // the number of received commands
+	// the connections that are subscribed to each channel
+	subscribers map[string][]*fakeConn
+	// the open connections, and if the server is down, for simulating that
+	// the connection to Redis is lost
+	conns map[*fakeConn]bool
+	down  bool
+}
+
+// fakeConn is a connection to the fake Redis server. Replies and published
+// messages may be written from different goroutines.
+type fakeConn struct {
+	mut  sync.Mutex
+	conn net.Conn
+}
+
+// reply writes a reply in the Redis protocol
+func (fc *fakeConn) reply(reply interface{}) {
+	fc.mut.Lock()
+	defer fc.mut.Unlock()
+	writeReply(fc.conn, reply)
+}
+
+// Replies that are not strings, integers, nil or arrays
+type (
+	status   string
+	errReply string
+)
+
+// startFakeRedis starts a fake Redis server. Returns the server, and a
+// connection pool for connecting to it.
+func startFakeRedis(t testing.TB) (*fakeRedis, *simpleredis.ConnectionPool) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fr := &fakeRedis{
+		strs:    make(map[string]string),
+		lists:   make(map[string][]string),
+		sets:    make(map[string]map[string]bool),
+		hashes:  make(map[string]map[string]string),
+		zsets:   make(map[string]map[string]float64),
+		expires: make(map[string]time.Time),
+
+		subscribers: make(map[string][]*fakeConn),
+		conns:       make(map[*fakeConn]bool),
+	}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			fr.mut.Lock()
+			down := fr.down
+			fr.mut.Unlock()
+			if down {
+				conn.Close()
+				continue
+			}
+			go fr.serve(conn)
+		}
+	}()
+	addr := listener.Addr().String()
+	pool := simpleredis.ConnectionPool(redis.Pool{
+		MaxIdle: 3,
+		Dial: func() (redis.Conn, error) {
+			return redis.Dial("tcp", addr)
+		},
+	})
+	return fr, &pool
+}
+
+// readCommand reads a command, sent as an array of bulk strings
+func readCommand(r *bufio.Reader) ([]string, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	if !strings.HasPrefix(line, "*") {
+		return nil, fmt.Errorf("unexpected line: %q", line)
+	}
+	n, _ := strconv.Atoi(strings.TrimSpace(line[1:]))
+	args := make([]string, n)
+	for i := range args {
+		line, err = r.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		length, _ := strconv.Atoi(strings.TrimSpace(line[1:]))
+		buf := make([]byte, length+2)
+		if _, err := io.ReadFull(r, buf); err != nil {
+			return nil, err
+		}
+		args[i] = string(buf[:length])
+	}
+	return args, nil
+}
+
+// writeReply writes a reply in the Redis protocol
+func writeReply(w io.Writer, reply interface{}) {
+	switch v := reply.(type) {
+	case nil:
+		io.WriteString(w, "$-1\r\n")
+	case status:
+		io.WriteString(w, "+"+string(v)+"\r\n")
+	case errReply:
+		io.WriteString(w, "-"+string(v)+"\r\n")
+	case int:
+		fmt.Fprintf(w, ":%d\r\n", v)
+	case string:
+		fmt.Fprintf(w, "$%d\r\n%s\r\n", len(v), v)
+	case []string:
+		fmt.Fprintf(w, "*%d\r\n", len(v))
+		for _, s := range v {
+			writeReply(w, s)
+		}
+	case []interface{}:
+		fmt.Fprintf(w, "*%d\r\n", len(v))
+		for _, element := range v {
+			writeReply(w, element)
+		}
+	}
+}
+
+func (fr *fakeRedis) serve(conn net.Conn) {
+	fc := &fakeConn{conn: conn}
+	fr.mut.Lock()
+	fr.conns[fc] = true
+	fr.mut.Unlock()
+	defer fr.unsubscribe(fc)
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	subscribed := false
+	var transaction [][]string // the commands after MULTI, if any
+	for {
+		args, err := readCommand(r)
+		if err != nil {
+			return
+		}
+		command := strings.ToUpper(args[0])
+		switch {
+		case command == "MULTI":
+			transaction = [][]string{}
+			fc.reply(status("OK"))
+			continue
+		case command == "EXEC":
+			replies := []interface{}{}
+			fr.mut.Lock()
+			for _, args := range transaction {
+				fr.commands++
+				fr.expire()
+				replies = append(replies, fr.do(strings.ToUpper(args[0]), args[1:]))
+			}
+			fr.mut.Unlock()
+			transaction = nil
+			fc.reply(replies)
+			continue
+		case transaction != nil:
+			transaction = append(transaction, args)
+			fc.reply(status("QUEUED"))
+			continue
+		case command == "BLPOP":
+			fr.mut.Lock()
+			fr.commands++
+			fr.mut.Unlock()
+			fc.reply(fr.blpop(args[1], args[2]))
+			continue
+		case command == "SUBSCRIBE":
+			fr.mut.Lock()
+			fr.commands++
+			fr.subscribers[args[1]] = append(fr.subscribers[args[1]], fc)
+			fr.mut.Unlock()
+			subscribed = true
+			fc.reply([]interface{}{"subscribe", args[1], 1})
+			continue
+		case command == "PING" && subscribed:
+			fc.reply([]interface{}{"pong", ""})
+			continue
+		}
+		fr.mut.Lock()
+		fr.commands++
+		fr.expire()
+		reply := fr.do(command, args[1:])
+		fr.mut.Unlock()
+		fc.reply(reply)
+	}
+}
+
+// unsubscribe removes the given connection from all channels
+func (fr *fakeRedis) unsubscribe(fc *fakeConn) {
+	fr.mut.Lock()
+	defer fr.mut.Unlock()
+	delete(fr.conns, fc)
+	for channel, subscribers := range fr.subscribers {
+		for i, subscriber := range subscribers {
+			if subscriber == fc {
+				fr.subscribers[channel] = append(subscribers[:i], subscribers[i+1:]...)
+				break
+			}
+		}
+	}
+}
+
+// setDown closes all connections and refuses new connections, until it is
+// called with false
+func (fr *fakeRedis) setDown(down bool) {
+	fr.mut.Lock()
+	defer fr.mut.Unlock()
+	fr.down = down
+	if down {
+		for fc := range fr.conns {
+			fc.conn.Close()
+		}
+	}
+}
+
+// dropSubscribers closes the connections that are subscribed to a channel
+func (fr *fakeRedis) dropSubscribers() {
+	fr.mut.Lock()
+	defer fr.mut.Unlock()
+	for _, subscribers := range fr.subscribers {
+		for _, subscriber := range subscribers {
+			subscriber.conn.Close()
+		}
+	}
+}
+
+// blpop waits for an element to pop from the given list, for up to the given
+// number of seconds. Returns the key and the element, or nil on timeout.
+func (fr *fakeRedis) blpop(key, timeoutArg string) interface{} {
+	seconds, _ := strconv.ParseFloat(timeoutArg, 64)
+	deadline := time.Now().Add(time.Duration(seconds * float64(time.Second)))
+	for {
+		fr.mut.Lock()
+		fr.expire()
+		value := fr.do("LPOP", []string{key})
+		fr.mut.Unlock()
+		if value != nil {
+			return []string{key, value.(string)}
+		}
+		if time.Now().After(deadline) {
+			return nil
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// expire removes the keys that have expired
+func (fr *fakeRedis) expire() {
+	now := time.Now()
+	for key, when := range fr.expires {
+		if now.After(when) {
+			fr.del(key)
+		}
+	}
+}
+
+// del removes a key. Returns 1 if it existed, or else 0.
+func (fr *fakeRedis) del(key string) int {
+	existed := fr.exists(key)
+	delete(fr.strs, key)
+	delete(fr.lists, key)
+	delete(fr.sets, key)
+	delete(fr.hashes, key)
+	delete(fr.zsets, key)
+	delete(fr.expires, key)
+	if existed {
+		return 1
+	}
+	return 0
+}
+
+func (fr *fakeRedis) exists(key string) bool {
+	_, isStr := fr.strs[key]
+	_, isList := fr.lists[key]
+	_, isSet := fr.sets[key]
+	_, isHash := fr.hashes[key]
+	_, isZSet := fr.zsets[key]
+	return isStr || isList || isSet || isHash || isZSet
+}
+
+// keys returns all the keys, sorted
+func (fr *fakeRedis) keys() []string {
+	var keys []string
+	for _, m := range []interface{}{fr.strs, fr.lists, fr.sets, fr.hashes, fr.zsets} {
+		switch m := m.(type) {
+		case map[string]string:
+			for key := range m {
+				keys = append(keys, key)
+			}
+		case map[string][]string:
+			for key := range m {
+				keys = append(keys, key)
+			}
+		case map[string]map[string]bool:
+			for key := range m {
+				keys = append(keys, key)
+			}
+		case map[string]map[string]string:
+			for key := range m {
+				keys = append(keys, key)
+			}
+		case map[string]map[string]float64:
+			for key := range m {
+				keys = append(keys, key)
+			}
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// lrange returns a copy of the elements from start to stop, both inclusive
+func lrange(list []string, startArg, stopArg string) []string {
+	start, _ := strconv.Atoi(startArg)
+	stop, _ := strconv.Atoi(stopArg)
+	return append([]string{}, sliceRange(list, start, stop)...)
+}
+
+// zmembers returns the members of a sorted set, ordered by score and then
+// by member
+func (fr *fakeRedis) zmembers(key string) []string {
+	zset := fr.zsets[key]
+	members := []string{}
+	for member := range zset {
+		members = append(members, member)
+	}
+	sort.Slice(members, func(i, j int) bool {
+		if zset[members[i]] != zset[members[j]] {
+			return zset[members[i]] < zset[members[j]]
+		}
+		return members[i] < members[j]
+	})
+	return members
+}
+
+// reversed returns the given strings in reverse order
+func reversed(sl []string) []string {
+	r := make([]string, len(sl))
+	for i, s := range sl {
+		r[len(sl)-1-i] = s
+	}
+	return r
+}
+
+// parseScore parses a score for ZRANGEBYSCORE. Returns the score and true if
+// the score is inclusive.
+func parseScore(s string) (float64, bool) {
+	inclusive := !strings.HasPrefix(s, "(")
+	s = strings.TrimPrefix(s, "(")
+	switch s {
+	case "-inf":
+		return math.Inf(-1), inclusive
+	case "+inf", "inf":
+		return math.Inf(1), inclusive
+	}
+	f, _ := strconv.ParseFloat(s, 64)
+	return f, inclusive
+}
+
+// incrBy adds the given number to the value of a key
+func (fr *fakeRedis) incrBy(key string, n int) interface{} {
+	value := 0
+	if s, ok := fr.strs[key]; ok {
+		var err error
+		if value, err = strconv.Atoi(s); err != nil {
+			return errReply("ERR value is not an integer or out of range")
+		}
+	}
+	value += n
+	fr.strs[key] = strconv.Itoa(value)
+	return value
+}
+
+func (fr *fakeRedis) do(command string, args []string) interface{} {
+	switch command {
+	case "PING":
+		return status("PONG")
+	case "SELECT", "AUTH":
+		return status("OK")
+	case "SET":
+		fr.del(args[0])
+		fr.strs[args[0]] = args[1]
+		for i := 2; i+1 < len(args); i += 2 {
+			n, _ := strconv.Atoi(args[i+1])
+			switch strings.ToUpper(args[i]) {
+			case "PX":
+				fr.expires[args[0]] = time.Now().Add(time.Duration(n) * time.Millisecond)
+			case "EX":
+				fr.expires[args[0]] = time.Now().Add(time.Duration(n) * time.Second)
+			}
+		}
+		return status("OK")
+	case "SETEX":
+		n, _ := strconv.Atoi(args[1])
+		fr.del(args[0])
+		fr.strs[args[0]] = args[2]
+		fr.expires[args[0]] = time.Now().Add(time.Duration(n) * time.Second)
+		return status("OK")
+	case "GET":
+		if value, ok := fr.strs[args[0]]; ok {
+			return value
+		}
+		return nil
+	case "PUBLISH":
+		for _, subscriber := range fr.subscribers[args[0]] {
+			subscriber.reply([]interface{}{"message", args[0], args[1]})
+		}
+		return len(fr.subscribers[args[0]])
+	case "MGET":
+		values := make([]interface{}, len(args))
+		for i, key := range args {
+			if value, ok := fr.strs[key]; ok {
+				values[i] = value
+			}
+		}
+		return values
+	case "MSET":
+		for i := 0; i+1 < len(args); i += 2 {
+			fr.del(args[i])
+			fr.strs[args[i]] = args[i+1]
+		}
+		return status("OK")
+	case "DEL":
+		deleted := 0
+		for _, key := range args {
+			deleted += fr.del(key)
+		}
+		return deleted
+	case "EXISTS":
+		if fr.exists(args[0]) {
+			return 1
+		}
+		return 0
+	case "KEYS":
+		matches := []string{}
+		for _, key := range fr.keys() {
+			if ok, _ := path.Match(args[0], key); ok {
+				matches = append(matches, key)
+			}
+		}
+		return matches
+	case "SCAN":
+		// The cursor is the position in the sorted keys
+		keys := fr.keys()
+		start, _ := strconv.Atoi(args[0])
+		count, pattern := 10, "*"
+		for i := 1; i+1 < len(args); i += 2 {
+			switch strings.ToUpper(args[i]) {
+			case "COUNT":
+				count, _ = strconv.Atoi(args[i+1])
+			case "MATCH":
+				pattern = args[i+1]
+			}
+		}
+		if start > len(keys) {
+			start = len(keys)
+		}
+		stop := start + count
+		next := strconv.Itoa(stop)
+		if stop >= len(keys) {
+			stop, next = len(keys), "0"
+		}
+		// Like Redis, the keys are matched after a batch has been selected
+		matches := []string{}
+		for _, key := range keys[start:stop] {
+			if ok, _ := path.Match(pattern, key); ok {
+				matches = append(matches, key)
+			}
+		}
+		return []interface{}{next, matches}
+	case "TYPE":
+		if _, ok := fr.strs[args[0]]; ok {
+			return status("string")
+		}
+		for redisType, exists := range map[string]bool{
+			"list": fr.lists[args[0]] != nil,
+			"set":  fr.sets[args[0]] != nil,
+			"hash": fr.hashes[args[0]] != nil,
+			"zset": fr.zsets[args[0]] != nil,
+		} {
+			if exists {
+				return status(redisType)
+			}
+		}
+		return status("none")
+	case "TTL", "PTTL":
+		if !fr.exists(args[0]) {
+			return -2
+		}
+		when, ok := fr.expires[args[0]]
+		if !ok {
+			return -1
+		}
+		if command == "PTTL" {
+			return int(time.Until(when) / time.Millisecond)
+		}
+		return int((time.Until(when) + time.Second/2) / time.Second)
+	case "EXPIRE", "PEXPIRE":
+		if !fr.exists(args[0]) {
+			return 0
+		}
+		n, _ := strconv.Atoi(args[1])
+		unit := time.Second
+		if command == "PEXPIRE" {
+			unit = time.Millisecond
+		}
+		fr.expires[args[0]] = time.Now().Add(time.Duration(n) * unit)
+		return 1
+	case "PERSIST":
+		if _, ok := fr.expires[args[0]]; !ok {
+			return 0
+		}
+		delete(fr.expires, args[0])
+		return 1
+	case "INCR":
+		return fr.incrBy(args[0], 1)
+	case "DECR":
+		return fr.incrBy(args[0], -1)
+	case "SADD":
+		if fr.sets[args[0]] == nil {
+			fr.sets[args[0]] = make(map[string]bool)
+		}
+		added := 0
+		for _, member := range args[1:] {
+			if !fr.sets[args[0]][member] {
+				fr.sets[args[0]][member] = true
+				added++
+			}
+		}
+		return added
+	case "SREM":
+		removed := 0
+		for _, member := range args[1:] {
+			if fr.sets[args[0]][member] {
+				delete(fr.sets[args[0]], member)
+				removed++
+			}
+		}
+		if len(fr.sets[args[0]]) == 0 {
+			delete(fr.sets, args[0])
+		}
+		return removed
+	case "SISMEMBER":
+		if fr.sets[args[0]][args[1]] {
+			return 1
+		}
+		return 0
+	case "SCARD":
+		return len(fr.sets[args[0]])
+	case "SMEMBERS":
+		members := []string{}
+		for member := range fr.sets[args[0]] {
+			members = append(members, member)
+		}
+		sort.Strings(members)
+		return members
+	case "SPOP", "SRANDMEMBER":
+		// Map iteration order is random
+		for member := range fr.sets[args[0]] {
+			if command == "SPOP" {
+				delete(fr.sets[args[0]], member)
+				if len(fr.sets[args[0]]) == 0 {
+					delete(fr.sets, args[0])
+				}
+			}
+			return member
+		}
+		return nil
+	case "SUNION", "SINTER":
+		counts := make(map[string]int)
+		for _, key := range args {
+			for member := range fr.sets[key] {
+				counts[member]++
+			}
+		}
+		members := []string{}
+		for member, count := range counts {
+			if command == "SUNION" || count == len(args) {
+				members = append(members, member)
+			}
+		}
+		return members
+	case "RPUSH", "LPUSH":
+		for _, value := range args[1:] {
+			if command == "RPUSH" {
+				fr.lists[args[0]] = append(fr.lists[args[0]], value)
+			} else {
+				fr.lists[args[0]] = append([]string{value}, fr.lists[args[0]]...)
+			}
+		}
+		return len(fr.lists[args[0]])
+	case "LPOP", "RPOP":
+		list := fr.lists[args[0]]
+		if len(list) == 0 {
+			return nil
+		}
+		var value string
+		if command == "LPOP" {
+			value, fr.lists[args[0]] = list[0], list[1:]
+		} else {
+			value, fr.lists[args[0]] = list[len(list)-1], list[:len(list)-1]
+		}
+		if len(fr.lists[args[0]]) == 0 {
+			delete(fr.lists, args[0])
+		}
+		return value
+	case "LLEN":
+		return len(fr.lists[args[0]])
+	case "LRANGE":
+		return lrange(fr.lists[args[0]], args[1], args[2])
+	case "LTRIM":
+		fr.lists[args[0]] = lrange(fr.lists[args[0]], args[1], args[2])
+		if len(fr.lists[args[0]]) == 0 {
+			delete(fr.lists, args[0])
+		}
+		return status("OK")
+	case "HSET":
+		if fr.hashes[args[0]] == nil {
+			fr.hashes[args[0]] = make(map[string]string)
+		}
+		_, existed := fr.hashes[args[0]][args[1]]
+		fr.hashes[args[0]][args[1]] = args[2]
+		if existed {
+			return 0
+		}
+		return 1
+	case "HINCRBY":
+		if fr.hashes[args[0]] == nil {
+			fr.hashes[args[0]] = make(map[string]string)
+		}
+		value := 0
+		if s, ok := fr.hashes[args[0]][args[1]]; ok {
+			var err error
+			if value, err = strconv.Atoi(s); err != nil {
+				return errReply("ERR hash value is not an integer")
+			}
+		}
+		n, _ := strconv.Atoi(args[2])
+		value += n
+		fr.hashes[args[0]][args[1]] = strconv.Itoa(value)
+		return value
+	case "HGET":
+		if value, ok := fr.hashes[args[0]][args[1]]; ok {
+			return value
+		}
+		return nil
+	case "HEXISTS":
+		if _, ok := fr.hashes[args[0]][args[1]]; ok {
+			return 1
+		}
+		return 0
+	case "HDEL":
+		if _, ok := fr.hashes[args[0]][args[1]]; !ok {
+			return 0
+		}
+		delete(fr.hashes[args[0]], args[1])
+		if len(fr.hashes[args[0]]) == 0 {
+			delete(fr.hashes, args[0])
+		}
+		return 1
+	case "HGETALL":
+		fields := []string{}
+		for key, value := range fr.hashes[args[0]] {
+			fields = append(fields, key, value)
+		}
+		return fields
+	case "ZADD":
+		if fr.zsets[args[0]] == nil {
+			fr.zsets[args[0]] = make(map[string]float64)
+		}
+		added := 0
+		for i := 1; i+1 < len(args); i += 2 {
+			score, err := strconv.ParseFloat(args[i], 64)
+			if err != nil {
+				return errReply("ERR value is not a valid float")
+			}
+			if _, ok := fr.zsets[args[0]][args[i+1]]; !ok {
+				added++
+			}
+			fr.zsets[args[0]][args[i+1]] = score
+		}
+		return added
+	case "ZSCORE":
+		if score, ok := fr.zsets[args[0]][args[1]]; ok {
+			return strconv.FormatFloat(score, 'g', -1, 64)
+		}
+		return nil
+	case "ZRANK", "ZREVRANK":
+		members := fr.zmembers(args[0])
+		if command == "ZREVRANK" {
+			members = reversed(members)
+		}
+		for i, member := range members {
+			if member == args[1] {
+				return i
+			}
+		}
+		return nil
+	case "ZRANGE", "ZREVRANGE":
+		members := fr.zmembers(args[0])
+		if command == "ZREVRANGE" {
+			members = reversed(members)
+		}
+		return lrange(members, args[1], args[2])
+	case "ZRANGEBYSCORE":
+		min, minInclusive := parseScore(args[1])
+		max, maxInclusive := parseScore(args[2])
+		members := []string{}
+		for _, member := range fr.zmembers(args[0]) {
+			score := fr.zsets[args[0]][member]
+			if (score > min || (minInclusive && score == min)) && (score < max || (maxInclusive && score == max)) {
+				members = append(members, member)
+			}
+		}
+		return members
+	case "ZREM":
+		removed := 0
+		for _, member := range args[1:] {
+			if _, ok := fr.zsets[args[0]][member]; ok {
+				delete(fr.zsets[args[0]], member)
+				removed++
+			}
+		}
+		if len(fr.zsets[args[0]]) == 0 {
+			delete(fr.zsets, args[0])
+		}
+		return removed
+	case "HKEYS":
+		keys := []string{}
+		for key := range fr.hashes[args[0]] {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		return keys
+	}
+	return errReply("ERR unknown command '" + command + "'")
+}
+
+// newRedisTestState returns a Lua state where the data structures are
+// backed by a fake Redis server
+func newRedisTestState(t testing.TB) (*lua.LState, *fakeRedis) {
+	fr, pool := startFakeRedis(t)
+	return newRedisState(pool), fr
+}
+
+// newRedisState returns a Lua state where the data structures are backed by
+// the given Redis connection pool
+func newRedisState(pool *simpleredis.ConnectionPool) *lua.LState {
+	creator := simpleredis.NewCreator(pool, 0)
+
+	L := lua.NewState()
+	LoadList(L, creator)
+	LoadSet(L, creator)
+	LoadHash(L, creator)
+	LoadKeyValue(L, creator)
+	LoadSortedSet(L)
+	LoadPipeline(L)
+	LoadNames(L)
+	LoadRedis(L, pool, 0)
+	return L
+}
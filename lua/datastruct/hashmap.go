@@ -1,16 +1,52 @@
 package datastruct
 
 import (
+	"encoding/json"
+	"strconv"
 	"strings"
 
+	"github.com/gomodule/redigo/redis"
 	"github.com/xyproto/algernon/lua/convert"
 	"github.com/xyproto/gopher-lua"
 	"github.com/xyproto/pinterface"
+
+	log "github.com/sirupsen/logrus"
 )
 
 // Identifier for the Hash class in Lua
 const lHashClass = "HASH"
 
+// A hash map that is stored in Redis, for commands that are not in
+// pinterface.IHashMap
+type redisHashMap struct {
+	pinterface.IHashMap
+	*redisKey
+}
+
+// Set a key and value for an element, or buffer the command if a pipeline is active
+func (rh *redisHashMap) Set(elementid, key, value string) error {
+	if rh.field(elementid).send("HSET", key, value) {
+		return nil
+	}
+	return rh.IHashMap.Set(elementid, key, value)
+}
+
+// Remove a key for an element, or buffer the command if a pipeline is active
+func (rh *redisHashMap) DelKey(elementid, key string) error {
+	if rh.field(elementid).send("HDEL", key) {
+		return nil
+	}
+	return rh.IHashMap.DelKey(elementid, key)
+}
+
+// Remove an element, or buffer the command if a pipeline is active
+func (rh *redisHashMap) Del(elementid string) error {
+	if rh.field(elementid).send("DEL") {
+		return nil
+	}
+	return rh.IHashMap.Del(elementid)
+}
+
 // Get the first argument, "self", and cast it from userdata to a hash map.
 func checkHash(L *lua.LState) pinterface.IHashMap {
 	ud := L.CheckUserData(1)
@@ -30,6 +66,10 @@ func newHashMap(L *lua.LState, creator pinterface.ICreator, id string) (*lua.LUs
 	if err != nil {
 		return nil, err
 	}
+	// Use Redis commands directly, if Redis is the backend
+	if rk := newRedisKey(L, id); rk != nil {
+		hash = &redisHashMap{hash, rk}
+	}
 	// Create a new userdata struct
 	ud := L.NewUserData()
 	ud.Value = hash
@@ -121,8 +161,9 @@ func hashAll(L *lua.LState) int {
 	return 1 // Number of returned values
 }
 
-// Get all subkeys of the hash map
-// hash::keys() -> table
+// For a given element id (for instance a user id), get all keys
+// hash:keys(string) -> table
+// hash:fields(string) -> table
 func hashKeys(L *lua.LState) int {
 	hash := checkHash(L) // arg 1
 	elementid := L.CheckString(2)
@@ -136,6 +177,95 @@ func hashKeys(L *lua.LState) int {
 	return 1 // Number of returned values
 }
 
+// For a given element id (for instance a user id), get all keys and values
+// as a table. Returns an empty table if the element does not exist.
+// hash:getmap(string) -> table
+func hashGetMap(L *lua.LState) int {
+	hash := checkHash(L) // arg 1
+	elementid := L.CheckString(2)
+	m, err := hashFields(hash, elementid)
+	if err != nil {
+		// Return an empty table
+		L.Push(L.NewTable())
+		return 1 // Number of returned values
+	}
+	L.Push(convert.Map2table(L, m))
+	return 1 // Number of returned values
+}
+
+// hashFields returns all keys and values for the given element id. With
+// Redis, they are fetched with a single HGETALL instead of one HGET per key.
+func hashFields(hash pinterface.IHashMap, elementid string) (map[string]string, error) {
+	if rh, ok := hash.(*redisHashMap); ok {
+		return redis.StringMap(rh.field(elementid).do("HGETALL"))
+	}
+	keys, err := hash.Keys(elementid)
+	if err != nil {
+		return nil, err
+	}
+	m := make(map[string]string, len(keys))
+	for _, key := range keys {
+		if m[key], err = hash.Get(elementid, key); err != nil {
+			return nil, err
+		}
+	}
+	return m, nil
+}
+
+// For a given element id (for instance a user id), remove the whole element
+// after the given number of seconds. Redis expires keys, not fields, so all
+// the keys and values of the element are removed. Returns true if the element
+// exists and the expiry was set. Requires Redis.
+// hash:expire(string, number) -> bool
+func hashExpire(L *lua.LState) int {
+	hash := checkHash(L) // arg 1
+	elementid := L.CheckString(2)
+	seconds := L.CheckInt(3)
+	set := false
+	if rh, ok := hash.(*redisHashMap); ok {
+		n, err := redis.Int(rh.field(elementid).do("EXPIRE", seconds))
+		set = err == nil && n == 1
+	}
+	L.Push(lua.LBool(set))
+	return 1 // Number of returned values
+}
+
+// For a given element id (for instance a user id), return the number of
+// seconds until the element expires. Returns -1 if the element does not
+// expire and -2 if the element does not exist.
+// hash:ttl(string) -> number
+func hashTTL(L *lua.LState) int {
+	hash := checkHash(L) // arg 1
+	elementid := L.CheckString(2)
+	ttl := -2
+	if rh, ok := hash.(*redisHashMap); ok {
+		if seconds, err := redis.Int(rh.field(elementid).do("TTL")); err == nil {
+			ttl = seconds
+		}
+	} else if exists, err := hash.Exists(elementid); err == nil && exists {
+		// Elements never expire when the backend is not Redis
+		ttl = -1
+	}
+	L.Push(lua.LNumber(ttl))
+	return 1 // Number of returned values
+}
+
+// For a given element id (for instance a user id), remove the expiry, so
+// that the element is kept. Returns true if the element had an expiry.
+// Requires Redis.
+// hash:persist(string) -> bool
+func hashPersist(L *lua.LState) int {
+	hash := checkHash(L) // arg 1
+	elementid := L.CheckString(2)
+	removed := false
+	if rh, ok := hash.(*redisHashMap); ok {
+		n, err := redis.Int(rh.field(elementid).do("PERSIST"))
+		removed = err == nil && n == 1
+	}
+	L.Push(lua.LBool(removed))
+	return 1 // Number of returned values
+}
+
 // Remove a key for an entry in a hash map (for instance the email field for a user)
 // Returns true if successful
 // hash:delkey(string, string) -> bool
@@ -173,19 +303,129 @@ func hashClear(L *lua.LState) int {
 	return 1 // Number of returned values
 }
 
+// For a given element id (for instance a user id), increase the number
+// stored at the given key by one, and return the new value.
+// Creates the key with the value "1" if it did not already exist.
+// Returns an empty string if the existing value is not a number.
+// The increment is only atomic when Redis is the backend.
+// hash:inc(string, string) -> string
+func hashInc(L *lua.LState) int {
+	hash := checkHash(L) // arg 1
+	elementid := L.CheckString(2)
+	key := L.CheckString(3)
+	increased, err := hashIncrement(hash, elementid, key)
+	if err != nil {
+		log.Error(err.Error())
+		L.Push(lua.LString(""))
+		return 1 // Number of returned values
+	}
+	L.Push(lua.LString(increased))
+	return 1 // Number of returned values
+}
+
+// hashIncrement increases the number stored at the given element id and key
+// by one, and returns the new value
+func hashIncrement(hash pinterface.IHashMap, elementid, key string) (string, error) {
+	if rh, ok := hash.(*redisHashMap); ok {
+		n, err := redis.Int64(rh.field(elementid).do("HINCRBY", key, 1))
+		if err != nil {
+			return "", err
+		}
+		return strconv.FormatInt(n, 10), nil
+	}
+	var n int64
+	if has, err := hash.Has(elementid, key); err == nil && has {
+		value, err := hash.Get(elementid, key)
+		if err != nil {
+			return "", err
+		}
+		if n, err = strconv.ParseInt(value, 10, 64); err != nil {
+			return "", err
+		}
+	}
+	increased := strconv.FormatInt(n+1, 10)
+	return increased, hash.Set(elementid, key, increased)
+}
+
+// Return the hash map as a JSON object, where the element ids map to objects
+// with the keys and values of each element, for backups.
+// Returns nil and an error message if there were errors.
+// hash:export() -> string
+func hashExport(L *lua.LState) int {
+	hash := checkHash(L) // arg 1
+	elementids, err := hash.All()
+	if err != nil {
+		return pushJSON(L, nil, err)
+	}
+	elements := make(map[string]map[string]string, len(elementids))
+	for _, elementid := range elementids {
+		if elements[elementid], err = hashFields(hash, elementid); err != nil {
+			return pushJSON(L, nil, err)
+		}
+	}
+	return pushJSON(L, elements, nil)
+}
+
+// Replace the contents of the hash map with the elements in the given JSON
+// object, as returned by hash:export(). With Redis, this is done in a
+// transaction. Returns true if successful, or false and an error message.
+// hash:import(string) -> bool
+func hashImport(L *lua.LState) int {
+	hash := checkHash(L) // arg 1
+	var elements map[string]map[string]string
+	if err := json.Unmarshal([]byte(L.CheckString(2)), &elements); err != nil {
+		return pushImported(L, err)
+	}
+	if rh, ok := hash.(*redisHashMap); ok {
+		keys, err := rh.fieldKeys()
+		if err != nil {
+			return pushImported(L, err)
+		}
+		var commands []redisCommand
+		for _, key := range keys {
+			commands = append(commands, redisCommand{"DEL", []interface{}{key}})
+		}
+		for elementid, fields := range elements {
+			for key, value := range fields {
+				commands = append(commands, redisCommand{"HSET", []interface{}{rh.field(elementid).key, key, value}})
+			}
+		}
+		return pushImported(L, rh.transaction(commands))
+	}
+	if err := hash.Clear(); err != nil {
+		return pushImported(L, err)
+	}
+	for elementid, fields := range elements {
+		for key, value := range fields {
+			if err := hash.Set(elementid, key, value); err != nil {
+				return pushImported(L, err)
+			}
+		}
+	}
+	return pushImported(L, nil)
+}
+
 // The hash map methods that are to be registered
 var hashMethods = map[string]lua.LGFunction{
 	"__tostring": hashToString,
 	"set":        hashSet,
 	"get":        hashGet,
+	"inc":        hashInc,
 	"has":        hashHas,
 	"exists":     hashExists,
 	"getall":     hashAll,
 	"keys":       hashKeys,
+	"fields":     hashKeys,
+	"getmap":     hashGetMap,
+	"expire":     hashExpire,
+	"ttl":        hashTTL,
+	"persist":    hashPersist,
 	"delkey":     hashDelKey,
 	"del":        hashDel,
 	"remove":     hashRemove,
 	"clear":      hashClear,
+	"export":     hashExport,
+	"import":     hashImport,
 }
 
 // LoadHash makes functions related to HTTP requests and responses available to Lua scripts
@@ -194,7 +434,7 @@ func LoadHash(L *lua.LState, creator pinterface.ICreator) {
 	// Register the hash map class and the methods that belongs with it.
 	mt := L.NewTypeMetatable(lHashClass)
 	mt.RawSetH(lua.LString("__index"), mt)
-	L.SetFuncs(mt, hashMethods)
+	L.SetFuncs(mt, pipelineMethods(hashMethods, "set", "delkey", "del"))
 
 	// The constructor for new hash maps takes a name and an optional redis db index
 	L.SetGlobal("HashMap", L.NewFunction(func(L *lua.LState) int {
@@ -209,6 +449,7 @@ func LoadHash(L *lua.LState, creator pinterface.ICreator) {
 			case pinterface.IRedisCreator:
 				rh.SelectDatabase(localDBIndex)
 			}
+			selectRedisDatabase(L, localDBIndex)
 		}
 
 		// Create a new hash map in Lua
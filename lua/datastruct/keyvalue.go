@@ -1,6 +1,13 @@
 package datastruct
 
 import (
+	"encoding/json"
+	"errors"
+	"strconv"
+	"strings"
+
+	"github.com/gomodule/redigo/redis"
+	"github.com/xyproto/algernon/lua/convert"
 	"github.com/xyproto/gopher-lua"
 	"github.com/xyproto/pinterface"
 
@@ -10,6 +17,33 @@ import (
 // Identifier for the Set class in Lua
 const lKeyValueClass = "KEYVALUE"
 
+// errNoKeyValueExport is returned when exporting a key/value without Redis,
+// since the keys can not be listed with the other database backends
+var errNoKeyValueExport = errors.New("exporting a KeyValue requires Redis as the database backend")
+
+// A key/value collection that is stored in Redis, for commands that are not
+// in pinterface.IKeyValue
+type redisKeyValue struct {
+	pinterface.IKeyValue
+	*redisKey
+}
+
+// Set a key and value, or buffer the command if a pipeline is active
+func (rkv *redisKeyValue) Set(key, value string) error {
+	if rkv.field(key).send("SET", value) {
+		return nil
+	}
+	return rkv.IKeyValue.Set(key, value)
+}
+
+// Remove a key, or buffer the command if a pipeline is active
+func (rkv *redisKeyValue) Del(key string) error {
+	if rkv.field(key).send("DEL") {
+		return nil
+	}
+	return rkv.IKeyValue.Del(key)
+}
+
 // Get the first argument, "self", and cast it from userdata to a key/value
 func checkKeyValue(L *lua.LState) pinterface.IKeyValue {
 	ud := L.CheckUserData(1)
@@ -29,6 +63,10 @@ func newKeyValue(L *lua.LState, creator pinterface.ICreator, id string) (*lua.LU
 	if err != nil {
 		return nil, err
 	}
+	// Use Redis commands directly, if Redis is the backend
+	if rk := newRedisKey(L, id); rk != nil {
+		kv = &redisKeyValue{kv, rk}
+	}
 	// Create a new userdata struct
 	ud := L.NewUserData()
 	ud.Value = kv
@@ -54,6 +92,46 @@ func kvSet(L *lua.LState) int {
 	return 1 // Number of returned values
 }
 
+// Set a key and value that expires after the given number of seconds.
+// Returns true if successful. Requires Redis.
+// kv:setexpire(string, string, number) -> bool
+func kvSetExpire(L *lua.LState) int {
+	kv := checkKeyValue(L) // arg 1
+	key := L.CheckString(2)
+	value := L.ToString(3)
+	seconds := L.CheckInt(4)
+	rkv, ok := kv.(*redisKeyValue)
+	if !ok {
+		L.Push(lua.LFalse)
+		return 1 // Number of returned values
+	}
+	var err error
+	if !rkv.field(key).send("SETEX", seconds, value) {
+		_, err = rkv.field(key).do("SETEX", seconds, value)
+	}
+	L.Push(lua.LBool(err == nil))
+	return 1 // Number of returned values
+}
+
+// Takes a key, returns the number of seconds until it expires.
+// Returns -1 if the key does not expire and -2 if the key does not exist.
+// kv:ttl(string) -> number
+func kvTTL(L *lua.LState) int {
+	kv := checkKeyValue(L) // arg 1
+	key := L.CheckString(2)
+	ttl := -2
+	if rkv, ok := kv.(*redisKeyValue); ok {
+		if seconds, err := redis.Int(rkv.field(key).do("TTL")); err == nil {
+			ttl = seconds
+		}
+	} else if _, err := kv.Get(key); err == nil {
+		// Keys never expire when the backend is not Redis
+		ttl = -1
+	}
+	L.Push(lua.LNumber(ttl))
+	return 1 // Number of returned values
+}
+
 // Takes a key, returns a value. May return an empty string.
 // kv:get(string) -> string
 func kvGet(L *lua.LState) int {
@@ -67,6 +145,92 @@ func kvGet(L *lua.LState) int {
 	return 1 // Number of returned values
 }
 
+// Takes a table with keys, returns a table with the keys and values.
+// Keys that do not exist are left out.
+// kv:mget(table) -> table
+func kvMGet(L *lua.LState) int {
+	kv := checkKeyValue(L) // arg 1
+	keys := convert.Table2strings(L.CheckTable(2))
+	m, err := getMany(kv, keys)
+	if err != nil {
+		log.Error(err.Error())
+	}
+	L.Push(convert.Map2table(L, m))
+	return 1 // Number of returned values
+}
+
+// getMany returns the values for the given keys, leaving out the keys that
+// do not exist. With Redis, the values are fetched with a single MGET.
+func getMany(kv pinterface.IKeyValue, keys []string) (map[string]string, error) {
+	m := make(map[string]string, len(keys))
+	rkv, ok := kv.(*redisKeyValue)
+	if !ok {
+		for _, key := range keys {
+			if value, err := kv.Get(key); err == nil {
+				m[key] = value
+			}
+		}
+		return m, nil
+	}
+	if len(keys) == 0 {
+		return m, nil
+	}
+	args := make([]interface{}, len(keys))
+	for i, key := range keys {
+		args[i] = rkv.field(key).key
+	}
+	values, err := redis.Values(rkv.doCommand(0, "MGET", args...))
+	if err != nil {
+		return m, err
+	}
+	for i, value := range values {
+		// Keys that do not exist have nil values
+		if s, err := redis.String(value, nil); err == nil {
+			m[keys[i]] = s
+		}
+	}
+	return m, nil
+}
+
+// Takes a table with keys and values, and sets them. Returns true if
+// successful.
+// kv:mset(table) -> bool
+func kvMSet(L *lua.LState) int {
+	kv := checkKeyValue(L) // arg 1
+	m := make(map[string]string)
+	L.CheckTable(2).ForEach(func(key, value lua.LValue) {
+		m[key.String()] = value.String()
+	})
+	L.Push(lua.LBool(nil == setMany(kv, m)))
+	return 1 // Number of returned values
+}
+
+// setMany sets the given keys and values. With Redis, they are set with a
+// single MSET, or buffered if a pipeline is active.
+func setMany(kv pinterface.IKeyValue, m map[string]string) error {
+	rkv, ok := kv.(*redisKeyValue)
+	if !ok {
+		for key, value := range m {
+			if err := kv.Set(key, value); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	if len(m) == 0 {
+		return nil
+	}
+	args := make([]interface{}, 0, 2*len(m))
+	for key, value := range m {
+		args = append(args, rkv.field(key).key, value)
+	}
+	if rkv.sendCommand("MSET", args...) {
+		return nil
+	}
+	_, err := rkv.doCommand(0, "MSET", args...)
+	return err
+}
+
 // Takes a key, returns the value+1.
 // Creates a key/value and returns "1" if it did not already exist.
 // May return an empty string.
@@ -84,6 +248,42 @@ func kvInc(L *lua.LState) int {
 	return 1 // Number of returned values
 }
 
+// Takes a key, returns the value-1.
+// Creates a key/value and returns "-1" if it did not already exist.
+// The decrement is only atomic when Redis is the backend.
+// kv:dec(string) -> string
+func kvDec(L *lua.LState) int {
+	kv := checkKeyValue(L) // arg 1
+	key := L.CheckString(2)
+	decreased, err := decrement(kv, key)
+	if err != nil {
+		log.Error(err.Error())
+		L.Push(lua.LString("0"))
+		return 1
+	}
+	L.Push(lua.LString(decreased))
+	return 1 // Number of returned values
+}
+
+// decrement decreases the value of a key by one, and returns the new value
+func decrement(kv pinterface.IKeyValue, key string) (string, error) {
+	if rkv, ok := kv.(*redisKeyValue); ok {
+		n, err := redis.Int64(rkv.field(key).do("DECR"))
+		if err != nil {
+			return "", err
+		}
+		return strconv.FormatInt(n, 10), nil
+	}
+	var n int64
+	if value, err := kv.Get(key); err == nil && value != "" {
+		if n, err = strconv.ParseInt(value, 10, 64); err != nil {
+			return "", err
+		}
+	}
+	decreased := strconv.FormatInt(n-1, 10)
+	return decreased, kv.Set(key, decreased)
+}
+
 // Remove a key. Returns true if successful.
 // kv:del(string) -> bool
 func kvDel(L *lua.LState) int {
@@ -109,15 +309,80 @@ func kvClear(L *lua.LState) int {
 	return 1 // Number of returned values
 }
 
+// Return the key/value as a JSON object, for backups. Requires Redis, since
+// the keys can not be listed with the other database backends.
+// Returns nil and an error message if there were errors.
+// kv:export() -> string
+func kvExport(L *lua.LState) int {
+	kv := checkKeyValue(L) // arg 1
+	rkv, ok := kv.(*redisKeyValue)
+	if !ok {
+		return pushJSON(L, nil, errNoKeyValueExport)
+	}
+	fieldKeys, err := rkv.fieldKeys()
+	if err != nil {
+		return pushJSON(L, nil, err)
+	}
+	keys := make([]string, len(fieldKeys))
+	for i, fieldKey := range fieldKeys {
+		keys[i] = strings.TrimPrefix(fieldKey, rkv.key+":")
+	}
+	// Keys that are not strings are left out by getMany
+	m, err := getMany(kv, keys)
+	return pushJSON(L, m, err)
+}
+
+// Replace the contents of the key/value with the keys and values in the given
+// JSON object, as returned by kv:export(). With Redis, this is done in a
+// transaction. Returns true if successful, or false and an error message.
+// kv:import(string) -> bool
+func kvImport(L *lua.LState) int {
+	kv := checkKeyValue(L) // arg 1
+	var m map[string]string
+	if err := json.Unmarshal([]byte(L.CheckString(2)), &m); err != nil {
+		return pushImported(L, err)
+	}
+	if rkv, ok := kv.(*redisKeyValue); ok {
+		keys, err := rkv.fieldKeys()
+		if err != nil {
+			return pushImported(L, err)
+		}
+		var commands []redisCommand
+		for _, key := range keys {
+			commands = append(commands, redisCommand{"DEL", []interface{}{key}})
+		}
+		for key, value := range m {
+			commands = append(commands, redisCommand{"SET", []interface{}{rkv.field(key).key, value}})
+		}
+		return pushImported(L, rkv.transaction(commands))
+	}
+	if err := kv.Clear(); err != nil {
+		return pushImported(L, err)
+	}
+	for key, value := range m {
+		if err := kv.Set(key, value); err != nil {
+			return pushImported(L, err)
+		}
+	}
+	return pushImported(L, nil)
+}
+
 // The keyvalue methods that are to be registered
 var kvMethods = map[string]lua.LGFunction{
 	"__tostring": kvToString,
 	"set":        kvSet,
 	"get":        kvGet,
+	"mget":       kvMGet,
+	"mset":       kvMSet,
+	"setexpire":  kvSetExpire,
+	"ttl":        kvTTL,
 	"inc":        kvInc,
+	"dec":        kvDec,
 	"del":        kvDel,
 	"remove":     kvRemove,
 	"clear":      kvClear,
+	"export":     kvExport,
+	"import":     kvImport,
 }
 
 // LoadKeyValue makes functions related to HTTP requests and responses available to Lua scripts
@@ -126,7 +391,7 @@ func LoadKeyValue(L *lua.LState, creator pinterface.ICreator) {
 	// Register the KeyValue class and the methods that belongs with it.
 	mt := L.NewTypeMetatable(lKeyValueClass)
 	mt.RawSetH(lua.LString("__index"), mt)
-	L.SetFuncs(mt, kvMethods)
+	L.SetFuncs(mt, pipelineMethods(kvMethods, "set", "mset", "setexpire", "del"))
 
 	// The constructor for new KeyValues takes a name and an optional redis db index
 	L.SetGlobal("KeyValue", L.NewFunction(func(L *lua.LState) int {
@@ -141,6 +406,7 @@ func LoadKeyValue(L *lua.LState, creator pinterface.ICreator) {
 			case pinterface.IRedisCreator:
 				rh.SelectDatabase(localDBIndex)
 			}
+			selectRedisDatabase(L, localDBIndex)
 		}
 
 		// Create a new keyvalue in Lua
@@ -1,8 +1,12 @@
 package datastruct
 
 import (
+	"encoding/json"
+	"math"
 	"strings"
+	"time"
 
+	"github.com/gomodule/redigo/redis"
 	"github.com/xyproto/algernon/lua/convert"
 	"github.com/xyproto/gopher-lua"
 	"github.com/xyproto/pinterface"
@@ -14,8 +18,27 @@ const (
 
 	// Prefix when indenting JSON
 	indentPrefix = ""
+
+	// The longest time list:bpop waits for an element, in seconds. One of
+	// the connections in the Redis pool is in use while waiting.
+	maxBlockingPopTimeout = 30
 )
 
+// A list that is stored in Redis, for commands that are not in pinterface.IList
+type redisList struct {
+	pinterface.IList
+	*redisKey
+}
+
+// Add an element to the end of the list, or buffer the command if a pipeline
+// is active. simpleredis uses RPUSH for adding elements.
+func (rl *redisList) Add(value string) error {
+	if rl.send("RPUSH", value) {
+		return nil
+	}
+	return rl.IList.Add(value)
+}
+
 // Get the first argument, "self", and cast it from userdata to a list.
 func checkList(L *lua.LState) pinterface.IList {
 	ud := L.CheckUserData(1)
@@ -35,6 +58,10 @@ func newList(L *lua.LState, creator pinterface.ICreator, id string) (*lua.LUserD
 	if err != nil {
 		return nil, err
 	}
+	// Use Redis commands directly, if Redis is the backend
+	if rk := newRedisKey(L, id); rk != nil {
+		list = &redisList{list, rk}
+	}
 	// Create a new userdata struct
 	ud := L.NewUserData()
 	ud.Value = list
@@ -123,6 +150,122 @@ func listLastN(L *lua.LState) int {
 	return 1 // Number of returned values
 }
 
+// Get the elements from start to stop, both inclusive
+// The indices start at 0 and can be negative, where -1 is the last element.
+// Indices that are out of range are moved to the start or end of the list.
+// list:range(number, number) -> table
+func listRange(L *lua.LState) int {
+	list := checkList(L)   // arg 1
+	start := L.CheckInt(2) // arg 2
+	stop := L.CheckInt(3)  // arg 3
+	var results []string
+	if rl, ok := list.(*redisList); ok {
+		if values, err := redis.Strings(rl.do("LRANGE", start, stop)); err == nil {
+			results = values
+		}
+	} else if all, err := list.All(); err == nil {
+		results = sliceRange(all, start, stop)
+	}
+	L.Push(convert.Strings2table(L, results))
+	return 1 // Number of returned values
+}
+
+// sliceRange returns the elements from start to stop, both inclusive, in the
+// same way as the Redis LRANGE command
+func sliceRange(values []string, start, stop int) []string {
+	if start < 0 {
+		start += len(values)
+	}
+	if stop < 0 {
+		stop += len(values)
+	}
+	if start < 0 {
+		start = 0
+	}
+	if stop >= len(values) {
+		stop = len(values) - 1
+	}
+	if start > stop {
+		return []string{}
+	}
+	return values[start : stop+1]
+}
+
+// Remove and return an element from the list, using the given Redis command.
+// Returns an empty string if the list is empty, if there were errors or if
+// the backend is not Redis.
+func listPopWith(L *lua.LState, command string) int {
+	list := checkList(L) // arg 1
+	var value string
+	if rl, ok := list.(*redisList); ok {
+		if s, err := redis.String(rl.do(command)); err == nil {
+			value = s
+		}
+	}
+	L.Push(lua.LString(value))
+	return 1 // Number of returned values
+}
+
+// Remove and return the first element of the list
+// The returned value can be empty
+// list:pop() -> string
+func listPop(L *lua.LState) int {
+	return listPopWith(L, "LPOP")
+}
+
+// Remove and return the last element of the list
+// The returned value can be empty
+// list:poplast() -> string
+func listPopLast(L *lua.LState) int {
+	return listPopWith(L, "RPOP")
+}
+
+// Remove and return the first element of the list, waiting for up to the
+// given number of seconds for an element to be added if the list is empty.
+// The timeout is rounded up to whole seconds, and is at most 30 seconds.
+// Returns an empty string if the timeout was reached, if there were errors
+// or if the backend is not Redis.
+// list:bpop(number) -> string
+func listBlockingPop(L *lua.LState) int {
+	list := checkList(L)                                 // arg 1
+	seconds := int(math.Ceil(float64(L.CheckNumber(2)))) // arg 2
+	// BLPOP waits forever with a timeout of 0
+	if seconds < 1 {
+		seconds = 1
+	} else if seconds > maxBlockingPopTimeout {
+		seconds = maxBlockingPopTimeout
+	}
+	var value string
+	if rl, ok := list.(*redisList); ok {
+		// Wait a bit longer for the reply than Redis waits for an element.
+		// The reply is the key and the element, or nil if the timeout was reached.
+		timeout := time.Duration(seconds+1) * time.Second
+		if values, err := redis.Strings(rl.doWithTimeout(timeout, "BLPOP", seconds)); err == nil && len(values) == 2 {
+			value = values[1]
+		}
+	}
+	L.Push(lua.LString(value))
+	return 1 // Number of returned values
+}
+
+// Trim the list so that it only contains the elements from start to stop,
+// both inclusive. The indices start at 0 and can be negative, where -1 is
+// the last element. Returns true if successful.
+// list:trim(number, number) -> bool
+func listTrim(L *lua.LState) int {
+	list := checkList(L)   // arg 1
+	start := L.CheckInt(2) // arg 2
+	stop := L.CheckInt(3)  // arg 3
+	rl, ok := list.(*redisList)
+	if !ok {
+		L.Push(lua.LFalse)
+		return 1 // Number of returned values
+	}
+	_, err := rl.do("LTRIM", start, stop)
+	L.Push(lua.LBool(err == nil))
+	return 1 // Number of returned values
+}
+
 // Remove the list itself. Returns true if successful.
 // list:remove() -> bool
 func listRemove(L *lua.LState) int {
@@ -139,6 +282,47 @@ func listClear(L *lua.LState) int {
 	return 1 // Number of returned values
 }
 
+// Return the list as a JSON list of the elements, for backups. Unlike
+// list:json(), the elements are strings and not JSON documents.
+// Returns nil and an error message if there were errors.
+// list:export() -> string
+func listExport(L *lua.LState) int {
+	list := checkList(L) // arg 1
+	elements, err := list.All()
+	if elements == nil {
+		elements = []string{}
+	}
+	return pushJSON(L, elements, err)
+}
+
+// Replace the contents of the list with the elements in the given JSON list,
+// as returned by list:export(). With Redis, this is done in a transaction.
+// Returns true if successful, or false and an error message.
+// list:import(string) -> bool
+func listImport(L *lua.LState) int {
+	list := checkList(L) // arg 1
+	var elements []string
+	if err := json.Unmarshal([]byte(L.CheckString(2)), &elements); err != nil {
+		return pushImported(L, err)
+	}
+	if rl, ok := list.(*redisList); ok {
+		commands := []redisCommand{{"DEL", []interface{}{rl.key}}}
+		for _, element := range elements {
+			commands = append(commands, redisCommand{"RPUSH", []interface{}{rl.key, element}})
+		}
+		return pushImported(L, rl.transaction(commands))
+	}
+	if err := list.Clear(); err != nil {
+		return pushImported(L, err)
+	}
+	for _, element := range elements {
+		if err := list.Add(element); err != nil {
+			return pushImported(L, err)
+		}
+	}
+	return pushImported(L, nil)
+}
+
 // The list methods that are to be registered
 var listMethods = map[string]lua.LGFunction{
 	"__tostring": listToString,
@@ -146,9 +330,16 @@ var listMethods = map[string]lua.LGFunction{
 	"getall":     listAll,
 	"getlast":    listLast,
 	"getlastn":   listLastN,
+	"range":      listRange,
+	"pop":        listPop,
+	"poplast":    listPopLast,
+	"bpop":       listBlockingPop,
+	"trim":       listTrim,
 	"remove":     listRemove,
 	"clear":      listClear,
 	"json":       listJSON,
+	"export":     listExport,
+	"import":     listImport,
 }
 
 // LoadList makes functions related to HTTP requests and responses available to Lua scripts
@@ -157,7 +348,7 @@ func LoadList(L *lua.LState, creator pinterface.ICreator) {
 	// Register the list class and the methods that belongs with it.
 	mt := L.NewTypeMetatable(lListClass)
 	mt.RawSetH(lua.LString("__index"), mt)
-	L.SetFuncs(mt, listMethods)
+	L.SetFuncs(mt, pipelineMethods(listMethods, "add"))
 
 	// The constructor for new lists takes a name and an optional redis db index
 	L.SetGlobal("List", L.NewFunction(func(L *lua.LState) int {
@@ -172,6 +363,7 @@ func LoadList(L *lua.LState, creator pinterface.ICreator) {
 			case pinterface.IRedisCreator:
 				rh.SelectDatabase(localDBIndex)
 			}
+			selectRedisDatabase(L, localDBIndex)
 		}
 
 		// Create a new list in Lua
@@ -0,0 +1,133 @@
+package datastruct
+
+import (
+	"errors"
+	"sort"
+	"strings"
+
+	"github.com/gomodule/redigo/redis"
+	"github.com/xyproto/algernon/lua/convert"
+	"github.com/xyproto/gopher-lua"
+)
+
+// How many keys to ask for per SCAN call
+const scanCount = 1000
+
+// errNoNames is returned when listing the data structures without Redis
+var errNoNames = errors.New("listing the data structures requires Redis as the database backend")
+
+// scanKeys calls handle with the keys that match the given pattern, in
+// batches, using SCAN, which does not block Redis like KEYS does. An empty
+// pattern matches all keys.
+func scanKeys(conn redis.Conn, pattern string, handle func(keys []string) error) error {
+	cursor := "0"
+	for {
+		args := []interface{}{cursor, "COUNT", scanCount}
+		if pattern != "" {
+			args = append(args, "MATCH", pattern)
+		}
+		reply, err := redis.Values(conn.Do("SCAN", args...))
+		if err != nil {
+			return err
+		}
+		var keys []string
+		if _, err := redis.Scan(reply, &cursor, &keys); err != nil {
+			return err
+		}
+		if err := handle(keys); err != nil {
+			return err
+		}
+		if cursor == "0" {
+			return nil
+		}
+	}
+}
+
+// scanNames returns the sorted names of the data structures that are stored
+// as Redis keys of the given type, like "list" or "set". If namespaced is
+// true, the data structure is stored as one key per element, named id + ":" +
+// element, as is done by simpleredis for hash maps and key/values. Data
+// structures without any elements are not stored, and are not listed.
+func scanNames(backend *redisBackend, redisType string, namespaced bool) ([]string, error) {
+	backend.sync()
+	conn := (*redis.Pool)(backend.pool).Get()
+	defer conn.Close()
+	if backend.dbindex != 0 {
+		if _, err := conn.Do("SELECT", backend.dbindex); err != nil {
+			return nil, err
+		}
+		// Leave the pooled connection at the default database
+		defer conn.Do("SELECT", 0)
+	}
+	found := make(map[string]bool)
+	err := scanKeys(conn, "", func(keys []string) error {
+		// Ask for the types of all the keys in one round trip
+		for _, key := range keys {
+			conn.Send("TYPE", key)
+		}
+		if err := conn.Flush(); err != nil {
+			return err
+		}
+		for _, key := range keys {
+			keyType, err := redis.String(conn.Receive())
+			if err != nil {
+				return err
+			}
+			if keyType != redisType {
+				continue
+			}
+			if namespaced {
+				pos := strings.Index(key, ":")
+				if pos < 0 {
+					// Not created by simpleredis
+					continue
+				}
+				key = key[:pos]
+			}
+			found[key] = true
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, 0, len(found))
+	for name := range found {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// namesFunction returns a Lua function that returns a table with the sorted
+// names of the data structures of the given Redis type, or nil and an error
+// message
+func namesFunction(redisType string, namespaced bool) lua.LGFunction {
+	return func(L *lua.LState) int {
+		backend := getRedisBackend(L)
+		if backend == nil {
+			L.Push(lua.LNil)
+			L.Push(lua.LString(errNoNames.Error()))
+			return 2 // number of results
+		}
+		names, err := scanNames(backend, redisType, namespaced)
+		if err != nil {
+			L.Push(lua.LNil)
+			L.Push(lua.LString(err.Error()))
+			return 2 // number of results
+		}
+		L.Push(convert.Strings2table(L, names))
+		return 1 // number of results
+	}
+}
+
+// LoadNames makes functions for listing the names of the data structures
+// available to the given Lua state, for admin tools. The names can only be
+// listed when Redis is the database backend.
+func LoadNames(L *lua.LState) {
+	L.SetGlobal("ListLists", L.NewFunction(namesFunction("list", false)))
+	L.SetGlobal("ListSets", L.NewFunction(namesFunction("set", false)))
+	L.SetGlobal("ListSortedSets", L.NewFunction(namesFunction("zset", false)))
+	L.SetGlobal("ListHashMaps", L.NewFunction(namesFunction("hash", true)))
+	L.SetGlobal("ListKeyValues", L.NewFunction(namesFunction("string", true)))
+}
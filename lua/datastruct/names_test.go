@@ -0,0 +1,66 @@
+package datastruct
+
+import (
+	"strconv"
+	"testing"
+
+	"github.com/bmizerany/assert"
+	"github.com/xyproto/gopher-lua"
+)
+
+func TestListNames(t *testing.T) {
+	L, _ := newRedisTestState(t)
+	defer L.Close()
+
+	err := L.DoString(`
+		List("todo"):add("write tests")
+		List("log"):add("started")
+		Set("tags"):add("go")
+		HashMap("users"):set("alice", "name", "Alice")
+		HashMap("users"):set("bob", "name", "Bob")
+		HashMap("posts"):set("1", "title", "Hello")
+		KeyValue("settings"):set("theme", "dark")
+		SortedSet("leaderboard"):add("alice", 10)
+		-- Empty data structures are not stored
+		List("empty")
+
+		assert(table.concat(ListLists(), ",") == "log,todo")
+		assert(table.concat(ListSets(), ",") == "tags")
+		assert(table.concat(ListHashMaps(), ",") == "posts,users")
+		assert(table.concat(ListKeyValues(), ",") == "settings")
+		assert(table.concat(ListSortedSets(), ",") == "leaderboard")
+	`)
+	assert.Equal(t, err, nil)
+}
+
+func TestListNamesScan(t *testing.T) {
+	L, fr := newRedisTestState(t)
+	defer L.Close()
+
+	// More keys than are returned per SCAN call
+	for i := 0; i < 2*scanCount+1; i++ {
+		fr.sets["set"+strconv.Itoa(i)] = map[string]bool{"member": true}
+	}
+	before := commandCount(fr)
+	err := L.DoString(`
+		local names = ListSets()
+		assert(#names == ` + strconv.Itoa(2*scanCount+1) + `)
+		assert(names[1] == "set0")
+	`)
+	assert.Equal(t, err, nil)
+	// Three SCAN calls and one TYPE per key
+	assert.Equal(t, commandCount(fr)-before, 3+2*scanCount+1)
+}
+
+func TestListNamesWithoutRedis(t *testing.T) {
+	L := lua.NewState()
+	defer L.Close()
+	LoadNames(L)
+
+	err := L.DoString(`
+		local names, err = ListSets()
+		assert(names == nil)
+		assert(string.find(err, "requires Redis"))
+	`)
+	assert.Equal(t, err, nil)
+}
@@ -0,0 +1,164 @@
+package datastruct
+
+import (
+	"github.com/gomodule/redigo/redis"
+	"github.com/xyproto/gopher-lua"
+)
+
+// redisPipeline is a Redis connection where commands are buffered and then
+// sent in one go, instead of waiting for a reply after each command
+type redisPipeline struct {
+	conn    redis.Conn
+	dbindex int   // the database index that is selected for the connection
+	pending int   // the number of replies that have not been received yet
+	err     error // the first error, if any
+}
+
+// send buffers a command for the given database index
+func (p *redisPipeline) send(dbindex int, command string, args ...interface{}) {
+	if dbindex != p.dbindex {
+		p.queue("SELECT", dbindex)
+		p.dbindex = dbindex
+	}
+	p.queue(command, args...)
+}
+
+// queue buffers a command for the currently selected database
+func (p *redisPipeline) queue(command string, args ...interface{}) {
+	if err := p.conn.Send(command, args...); err != nil {
+		p.fail(err)
+		return
+	}
+	p.pending++
+}
+
+// flush sends the buffered commands and receives the replies
+func (p *redisPipeline) flush() {
+	if p.pending == 0 {
+		return
+	}
+	if err := p.conn.Flush(); err != nil {
+		p.fail(err)
+		p.pending = 0
+		return
+	}
+	for ; p.pending > 0; p.pending-- {
+		if _, err := p.conn.Receive(); err != nil {
+			p.fail(err)
+		}
+	}
+}
+
+// fail keeps the first error
+func (p *redisPipeline) fail(err error) {
+	if p.err == nil {
+		p.err = err
+	}
+}
+
+// close sends the remaining commands and returns the connection to the pool,
+// at the default database. Returns the first error, if any.
+func (p *redisPipeline) close() error {
+	if p.dbindex != 0 {
+		p.queue("SELECT", 0)
+	}
+	p.flush()
+	p.conn.Close()
+	return p.err
+}
+
+// sync sends the pipelined commands, if a pipeline is active
+func (backend *redisBackend) sync() {
+	if backend.pipe != nil {
+		backend.pipe.flush()
+	}
+}
+
+// send buffers a command with the key as the first argument, if a pipeline
+// is active. Returns false if the command should be sent right away instead.
+func (rk *redisKey) send(command string, args ...interface{}) bool {
+	return rk.sendCommand(command, append([]interface{}{rk.key}, args...)...)
+}
+
+// sendCommand buffers a command with the given arguments as they are, if a
+// pipeline is active. Returns false if the command should be sent right away
+// instead.
+func (rk *redisKey) sendCommand(command string, args ...interface{}) bool {
+	pipe := rk.backend.pipe
+	if pipe == nil {
+		return false
+	}
+	pipe.send(rk.dbindex, command, args...)
+	return true
+}
+
+// pipelineMethods returns the given methods, where the methods that are not
+// listed as queued send the pipelined commands before they run, so that the
+// data they return reflects the earlier commands. The methods, except
+// __tostring, return nil and an error message if Redis can not be reached.
+func pipelineMethods(methods map[string]lua.LGFunction, queued ...string) map[string]lua.LGFunction {
+	wrapped := make(map[string]lua.LGFunction, len(methods))
+	for name, fn := range methods {
+		if name == "__tostring" {
+			// Must return a string
+			wrapped[name] = syncFirst(fn)
+			continue
+		}
+		wrapped[name] = failFast(syncFirst(fn))
+	}
+	for _, name := range queued {
+		wrapped[name] = failFast(methods[name])
+	}
+	return wrapped
+}
+
+// syncFirst returns a function that sends the pipelined commands, if any,
+// before calling the given function
+func syncFirst(fn lua.LGFunction) lua.LGFunction {
+	return func(L *lua.LState) int {
+		if backend := getRedisBackend(L); backend != nil {
+			backend.sync()
+		}
+		return fn(L)
+	}
+}
+
+// LoadPipeline makes the pipeline function available to the given Lua state.
+// When Redis is not the database backend, the given function is just called.
+func LoadPipeline(L *lua.LState) {
+
+	// Call the given function. Commands that modify lists, sets, sorted sets,
+	// hash maps and key/values are buffered and sent to Redis in one go, when the
+	// function returns or when a method that returns data is called.
+	// Returns true if successful, or false and an error message.
+	L.SetGlobal("pipeline", L.NewFunction(func(L *lua.LState) int {
+		fn := L.CheckFunction(1)
+		backend := getRedisBackend(L)
+		if backend == nil || backend.pipe != nil {
+			// Nothing to buffer, or already within a pipeline
+			L.Push(fn)
+			L.Call(0, 0)
+			L.Push(lua.LTrue)
+			return 1 // number of results
+		}
+		backend.pipe = &redisPipeline{conn: (*redis.Pool)(backend.pool).Get()}
+		callErr := L.CallByParam(lua.P{Fn: fn, NRet: 0, Protect: true})
+		err := backend.pipe.close()
+		backend.pipe = nil
+		if callErr != nil {
+			// The commands up until the error have been sent, like they
+			// would have been without a pipeline
+			if apiErr, ok := callErr.(*lua.ApiError); ok {
+				L.Error(apiErr.Object, 0)
+			}
+			L.RaiseError("%v", callErr)
+		}
+		if err != nil {
+			L.Push(lua.LFalse)
+			L.Push(lua.LString(err.Error()))
+			return 2 // number of results
+		}
+		L.Push(lua.LTrue)
+		return 1 // number of results
+	}))
+}
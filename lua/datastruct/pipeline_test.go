@@ -0,0 +1,126 @@
+package datastruct
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/bmizerany/assert"
+	"github.com/xyproto/gopher-lua"
+)
+
+func TestPipeline(t *testing.T) {
+	L, fr := newRedisTestState(t)
+	defer L.Close()
+
+	// Return the number of elements that the Redis server has received
+	L.SetGlobal("stored", L.NewFunction(func(L *lua.LState) int {
+		fr.mut.Lock()
+		defer fr.mut.Unlock()
+		L.Push(lua.LNumber(len(fr.lists["numbers"])))
+		return 1 // number of results
+	}))
+
+	err := L.DoString(`
+		local list = List("numbers")
+		local kv = KeyValue("settings")
+		local ok = pipeline(function()
+			for i = 1, 10 do
+				list:add(tostring(i))
+			end
+			kv:set("color", "blue")
+			-- Nothing has been sent yet
+			assert(stored() == 0)
+			-- Reading sends the buffered commands first
+			assert(#list:getall() == 10)
+			assert(kv:get("color") == "blue")
+			assert(stored() == 10)
+			list:add("11")
+			kv:setexpire("session", "abc", 60)
+			HashMap("users"):set("bob", "age", "42")
+			Set("tags"):add("go")
+			Set("tags"):add("lua")
+			Set("tags"):del("go")
+			assert(stored() == 10)
+		end)
+		assert(ok)
+		assert(stored() == 11)
+		assert(list:getlast() == "11")
+		assert(kv:get("session") == "abc")
+		assert(kv:ttl("session") > 0)
+		assert(HashMap("users"):get("bob", "age") == "42")
+		assert(table.concat(Set("tags"):getall(), ",") == "lua")
+
+		-- Nested pipelines are part of the outer pipeline
+		assert(pipeline(function()
+			kv:set("a", "1")
+			assert(pipeline(function() kv:del("color") end))
+		end))
+		assert(kv:get("a") == "1")
+		assert(kv:get("color") == "")
+	`)
+	assert.Equal(t, err, nil)
+}
+
+func TestPipelineError(t *testing.T) {
+	L, _ := newRedisTestState(t)
+	defer L.Close()
+
+	err := L.DoString(`
+		local kv = KeyValue("settings")
+		local ok, err = pcall(pipeline, function()
+			kv:set("color", "green")
+			error("no more colors")
+		end)
+		assert(not ok)
+		assert(string.find(err, "no more colors"))
+		-- The commands before the error have been sent
+		assert(kv:get("color") == "green")
+		-- The pipeline is no longer active
+		kv:set("color", "red")
+		assert(kv:get("color") == "red")
+		assert(pipeline(function() kv:set("color", "blue") end))
+		assert(kv:get("color") == "blue")
+	`)
+	assert.Equal(t, err, nil)
+}
+
+func TestPipelineWithoutRedis(t *testing.T) {
+	L := lua.NewState()
+	defer L.Close()
+	LoadPipeline(L)
+
+	err := L.DoString(`
+		local called = false
+		assert(pipeline(function() called = true end))
+		assert(called)
+	`)
+	assert.Equal(t, err, nil)
+}
+
+// benchmarkInserts adds 1000 elements to a list, with the given Lua code
+// wrapped around the loop
+func benchmarkInserts(b *testing.B, before, after string) {
+	L, _ := newRedisTestState(b)
+	defer L.Close()
+	code := strings.Join([]string{
+		`local list = List("numbers")`,
+		before,
+		`for i = 1, 1000 do list:add(tostring(i)) end`,
+		after,
+		`list:clear()`,
+	}, "\n")
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := L.DoString(code); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkInsertSerial(b *testing.B) {
+	benchmarkInserts(b, "", "")
+}
+
+func BenchmarkInsertPipelined(b *testing.B) {
+	benchmarkInserts(b, "pipeline(function()", "end)")
+}
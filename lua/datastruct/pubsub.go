@@ -0,0 +1,182 @@
+package datastruct
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+	log "github.com/sirupsen/logrus"
+	"github.com/xyproto/gopher-lua"
+	"github.com/xyproto/simpleredis"
+)
+
+const (
+	// How often the connection for a subscription is checked with a PING.
+	// The connection is considered lost if nothing is received for twice
+	// as long.
+	pubSubPingInterval = 10 * time.Second
+
+	// How long to wait before reconnecting, when the connection for a
+	// subscription has been lost
+	pubSubReconnectDelay = time.Second
+)
+
+// errNoPubSub is returned when using pub/sub without Redis
+var errNoPubSub = errors.New("publish and subscribe require Redis as the database backend")
+
+// Subscribe receives the messages that are published on the given channel,
+// on a dedicated connection, and calls onMessage for each message in the
+// calling goroutine. Stops when onMessage returns false or when the context
+// is done. If the connection is lost, Subscribe reconnects and subscribes
+// again. Messages that are published while reconnecting are lost. Returns
+// an error if the first subscription fails.
+func Subscribe(ctx context.Context, pool *simpleredis.ConnectionPool, channel string, onMessage func(data string) bool) error {
+	subscribed := false
+	for {
+		ok, err := receiveMessages(ctx, pool, channel, onMessage)
+		subscribed = subscribed || ok
+		if err == nil || ctx.Err() != nil {
+			return nil
+		}
+		if !subscribed {
+			return err
+		}
+		log.Warnf("Lost the Redis connection for the %q subscription, reconnecting: %s", channel, err)
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(pubSubReconnectDelay):
+		}
+	}
+}
+
+// receiveMessages subscribes to the given channel and calls onMessage for
+// each message, until onMessage returns false, the context is done or the
+// connection fails. Returns true if the subscription was confirmed by Redis,
+// and the error if the connection failed.
+func receiveMessages(ctx context.Context, pool *simpleredis.ConnectionPool, channel string, onMessage func(data string) bool) (bool, error) {
+	// A connection in subscribed mode can not be used for other commands,
+	// so it is not taken from the pool
+	conn, err := (*redis.Pool)(pool).Dial()
+	if err != nil {
+		return false, err
+	}
+	defer conn.Close()
+	psc := redis.PubSubConn{Conn: conn}
+	if err := psc.Subscribe(channel); err != nil {
+		return false, err
+	}
+
+	// Receive in another goroutine, so that the context can be checked.
+	// Closing the connection makes the receiving goroutine stop.
+	notifications := make(chan interface{})
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		for {
+			notification := psc.ReceiveWithTimeout(2 * pubSubPingInterval)
+			select {
+			case notifications <- notification:
+			case <-done:
+				return
+			}
+			if _, failed := notification.(error); failed {
+				return
+			}
+		}
+	}()
+
+	ticker := time.NewTicker(pubSubPingInterval)
+	defer ticker.Stop()
+	subscribed := false
+	for {
+		select {
+		case <-ctx.Done():
+			return subscribed, nil
+		case <-ticker.C:
+			if err := psc.Ping(""); err != nil {
+				return subscribed, err
+			}
+		case notification := <-notifications:
+			switch n := notification.(type) {
+			case error:
+				return subscribed, n
+			case redis.Subscription:
+				subscribed = true
+			case redis.Message:
+				if !onMessage(string(n.Data)) {
+					return subscribed, nil
+				}
+			}
+		}
+	}
+}
+
+// LoadPubSub makes the publish and subscribe functions available to the given
+// Lua state. Subscriptions end when the given context is done, which should
+// be the context of the HTTP request. Must be called after LoadRedis.
+func LoadPubSub(L *lua.LState, ctx context.Context) {
+
+	// Publish a message on the given channel.
+	// Returns the number of subscribers that received the message,
+	// or nil and an error message.
+	L.SetGlobal("publish", L.NewFunction(func(L *lua.LState) int {
+		channel := L.CheckString(1)
+		message := L.ToString(2)
+		backend := getRedisBackend(L)
+		if backend == nil {
+			L.Push(lua.LNil)
+			L.Push(lua.LString(errNoPubSub.Error()))
+			return 2 // number of results
+		}
+		conn := (*redis.Pool)(backend.pool).Get()
+		defer conn.Close()
+		receivers, err := redis.Int(conn.Do("PUBLISH", channel, message))
+		if err != nil {
+			L.Push(lua.LNil)
+			L.Push(lua.LString(err.Error()))
+			return 2 // number of results
+		}
+		L.Push(lua.LNumber(receivers))
+		return 1 // number of results
+	}))
+
+	// Call the given function with each message that is published on the
+	// given channel, until the function returns false or the client
+	// disconnects. Returns true, or false and an error message if
+	// subscribing failed.
+	L.SetGlobal("subscribe", L.NewFunction(func(L *lua.LState) int {
+		channel := L.CheckString(1)
+		fn := L.CheckFunction(2)
+		backend := getRedisBackend(L)
+		if backend == nil {
+			L.Push(lua.LFalse)
+			L.Push(lua.LString(errNoPubSub.Error()))
+			return 2 // number of results
+		}
+		var callErr error
+		err := Subscribe(ctx, backend.pool, channel, func(data string) bool {
+			if callErr = L.CallByParam(lua.P{Fn: fn, NRet: 1, Protect: true}, lua.LString(data), lua.LString(channel)); callErr != nil {
+				return false
+			}
+			ret := L.Get(-1)
+			L.Pop(1)
+			return ret != lua.LFalse
+		})
+		if callErr != nil {
+			// Pass on errors from the given function, after unsubscribing
+			if apiErr, ok := callErr.(*lua.ApiError); ok {
+				L.Error(apiErr.Object, 0)
+			}
+			L.RaiseError("%v", callErr)
+		}
+		if err != nil {
+			L.Push(lua.LFalse)
+			L.Push(lua.LString(err.Error()))
+			return 2 // number of results
+		}
+		L.Push(lua.LTrue)
+		return 1 // number of results
+	}))
+}
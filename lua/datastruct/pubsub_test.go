@@ -0,0 +1,132 @@
+package datastruct
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bmizerany/assert"
+	"github.com/xyproto/gopher-lua"
+)
+
+// waitForSubscriber waits until a connection other than the given one is
+// subscribed to the given channel, and returns it
+func waitForSubscriber(t *testing.T, fr *fakeRedis, channel string, previous *fakeConn) *fakeConn {
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		fr.mut.Lock()
+		var subscriber *fakeConn
+		if subscribers := fr.subscribers[channel]; len(subscribers) == 1 && subscribers[0] != previous {
+			subscriber = subscribers[0]
+		}
+		fr.mut.Unlock()
+		if subscriber != nil {
+			return subscriber
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatal("no subscriber for " + channel)
+	return nil
+}
+
+// waitingSubscribers returns the number of connections that are subscribed
+// to the given channel
+func waitingSubscribers(fr *fakeRedis, channel string) int {
+	fr.mut.Lock()
+	defer fr.mut.Unlock()
+	return len(fr.subscribers[channel])
+}
+
+func TestPubSub(t *testing.T) {
+	fr, pool := startFakeRedis(t)
+	subscriber := newRedisState(pool)
+	defer subscriber.Close()
+	LoadPubSub(subscriber, context.Background())
+	publisher := newRedisState(pool)
+	defer publisher.Close()
+	LoadPubSub(publisher, context.Background())
+
+	done := make(chan error, 1)
+	go func() {
+		done <- subscriber.DoString(`
+			received = {}
+			assert(subscribe("news", function(message, channel)
+				table.insert(received, channel .. ": " .. message)
+				-- Unsubscribe after two messages
+				return #received < 2
+			end))
+		`)
+	}()
+
+	conn := waitForSubscriber(t, fr, "news", nil)
+	assert.Equal(t, publisher.DoString(`assert(publish("news", "hello") == 1)`), nil)
+
+	// The subscription is renewed when the connection is lost
+	fr.dropSubscribers()
+	waitForSubscriber(t, fr, "news", conn)
+	assert.Equal(t, publisher.DoString(`assert(publish("news", "world") == 1)`), nil)
+
+	select {
+	case err := <-done:
+		assert.Equal(t, err, nil)
+	case <-time.After(5 * time.Second):
+		t.Fatal("the subscription did not end")
+	}
+	assert.Equal(t, subscriber.DoString(`
+		assert(table.concat(received, ",") == "news: hello,news: world")
+	`), nil)
+
+	// The connection is closed after unsubscribing
+	for i := 0; i < 500 && waitingSubscribers(fr, "news") > 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.Equal(t, publisher.DoString(`assert(publish("news", "nobody") == 0)`), nil)
+}
+
+func TestSubscribeEnds(t *testing.T) {
+	fr, pool := startFakeRedis(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	L := newRedisState(pool)
+	defer L.Close()
+	LoadPubSub(L, ctx)
+
+	// The subscription ends when the request is done
+	done := make(chan error, 1)
+	go func() {
+		done <- L.DoString(`assert(subscribe("news", function() end))`)
+	}()
+	conn := waitForSubscriber(t, fr, "news", nil)
+	cancel()
+	assert.Equal(t, <-done, nil)
+
+	// Errors in the given function end the subscription
+	L2 := newRedisState(pool)
+	defer L2.Close()
+	LoadPubSub(L2, context.Background())
+	go func() {
+		done <- L2.DoString(`subscribe("news", function() error("no news is good news") end)`)
+	}()
+	// The connection of the ended subscription may not be closed yet
+	waitForSubscriber(t, fr, "news", conn)
+	assert.Equal(t, L.DoString(`publish("news", "hello")`), nil)
+	err := <-done
+	assert.NotEqual(t, err, nil)
+	assert.Equal(t, strings.Contains(err.Error(), "no news is good news"), true)
+}
+
+func TestPubSubWithoutRedis(t *testing.T) {
+	L := lua.NewState()
+	defer L.Close()
+	LoadPubSub(L, context.Background())
+
+	err := L.DoString(`
+		local ok, err = publish("news", "hello")
+		assert(ok == nil)
+		assert(string.find(err, "require Redis"))
+		ok, err = subscribe("news", function() end)
+		assert(not ok)
+		assert(string.find(err, "require Redis"))
+	`)
+	assert.Equal(t, err, nil)
+}
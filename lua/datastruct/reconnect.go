@@ -0,0 +1,215 @@
+package datastruct
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+	log "github.com/sirupsen/logrus"
+	"github.com/xyproto/gopher-lua"
+	"github.com/xyproto/simpleredis"
+)
+
+const (
+	// How long to wait before connecting to Redis again, after the
+	// connection was lost. The delay doubles for each failed attempt.
+	minReconnectDelay = 100 * time.Millisecond
+	maxReconnectDelay = 5 * time.Second
+)
+
+// ErrRedisUnreachable is returned by the data structure methods when Redis
+// can not be reached, so that scripts can tell it apart from other errors
+var ErrRedisUnreachable = errors.New("Redis is unreachable")
+
+// redisHealth keeps track of whether Redis can be reached, for a connection pool
+type redisHealth struct {
+	mut      sync.Mutex
+	failures int       // the number of failures since the last successful command
+	retryAt  time.Time // when to try connecting again
+	lost     int       // the number of failures so far, for noticing new failures
+}
+
+// The connection pools that reconnect with a delay, and their health
+var redisHealthMap sync.Map // *simpleredis.ConnectionPool -> *redisHealth
+
+// fail records that Redis could not be reached, and delays the next attempt
+// at connecting
+func (h *redisHealth) fail(err error) {
+	h.mut.Lock()
+	defer h.mut.Unlock()
+	if h.failures == 0 {
+		log.Warnf("Lost the connection to Redis, reconnecting: %s", err)
+	}
+	delay := minReconnectDelay << uint(h.failures)
+	if delay > maxReconnectDelay || delay <= 0 {
+		delay = maxReconnectDelay
+	}
+	h.failures++
+	h.lost++
+	h.retryAt = time.Now().Add(delay)
+}
+
+// succeed records that a command was sent and a reply was received
+func (h *redisHealth) succeed() {
+	h.mut.Lock()
+	defer h.mut.Unlock()
+	if h.failures > 0 {
+		log.Info("Reconnected to Redis")
+		h.failures = 0
+	}
+}
+
+// waiting returns true while waiting before connecting again
+func (h *redisHealth) waiting() bool {
+	h.mut.Lock()
+	defer h.mut.Unlock()
+	return h.failures > 0 && time.Now().Before(h.retryAt)
+}
+
+// lostCount returns the number of failures so far
+func (h *redisHealth) lostCount() int {
+	h.mut.Lock()
+	defer h.mut.Unlock()
+	return h.lost
+}
+
+// healthOf returns the health of the given connection pool,
+// or nil if ReconnectWithBackoff has not been called for it
+func healthOf(pool *simpleredis.ConnectionPool) *redisHealth {
+	if health, ok := redisHealthMap.Load(pool); ok {
+		return health.(*redisHealth)
+	}
+	return nil
+}
+
+// ReconnectWithBackoff makes the given connection pool keep track of whether
+// Redis can be reached. After the connection has been lost, connecting again
+// is attempted after a delay that doubles for each failed attempt, from
+// 100ms up to 5s. Until then, getting a connection fails right away with
+// ErrRedisUnreachable. Must be called before the pool is used.
+func ReconnectWithBackoff(pool *simpleredis.ConnectionPool) {
+	health := &redisHealth{}
+	if _, loaded := redisHealthMap.LoadOrStore(pool, health); loaded {
+		return
+	}
+	redisPool := (*redis.Pool)(pool)
+	dial := redisPool.Dial
+	redisPool.Dial = func() (redis.Conn, error) {
+		if health.waiting() {
+			return nil, ErrRedisUnreachable
+		}
+		conn, err := dial()
+		if err != nil {
+			health.fail(err)
+			return nil, err
+		}
+		return &healthConn{Conn: conn, health: health}, nil
+	}
+}
+
+// healthConn is a Redis connection that reports to redisHealth when the
+// connection fails, or when a reply is received
+type healthConn struct {
+	redis.Conn
+	health *redisHealth
+	failed bool
+}
+
+// check reports the state of the connection after sending a command or
+// receiving a reply. Returns the given error.
+func (hc *healthConn) check(err error) error {
+	if hc.failed {
+		return err
+	}
+	if connErr := hc.Conn.Err(); connErr != nil {
+		// The connection can not be used any more
+		hc.failed = true
+		hc.health.fail(connErr)
+		return err
+	}
+	if _, isReply := err.(redis.Error); err == nil || isReply {
+		hc.health.succeed()
+	}
+	return err
+}
+
+// Do sends a command and returns the reply
+func (hc *healthConn) Do(command string, args ...interface{}) (interface{}, error) {
+	reply, err := hc.Conn.Do(command, args...)
+	return reply, hc.check(err)
+}
+
+// Send buffers a command
+func (hc *healthConn) Send(command string, args ...interface{}) error {
+	if err := hc.Conn.Send(command, args...); err != nil {
+		return hc.check(err)
+	}
+	return nil
+}
+
+// Flush sends the buffered commands
+func (hc *healthConn) Flush() error {
+	if err := hc.Conn.Flush(); err != nil {
+		return hc.check(err)
+	}
+	return nil
+}
+
+// Receive receives a reply
+func (hc *healthConn) Receive() (interface{}, error) {
+	reply, err := hc.Conn.Receive()
+	return reply, hc.check(err)
+}
+
+// DoWithTimeout sends a command and waits for the reply for up to the given duration
+func (hc *healthConn) DoWithTimeout(timeout time.Duration, command string, args ...interface{}) (interface{}, error) {
+	reply, err := redis.DoWithTimeout(hc.Conn, timeout, command, args...)
+	return reply, hc.check(err)
+}
+
+// ReceiveWithTimeout waits for a reply for up to the given duration
+func (hc *healthConn) ReceiveWithTimeout(timeout time.Duration) (interface{}, error) {
+	reply, err := redis.ReceiveWithTimeout(hc.Conn, timeout)
+	return reply, hc.check(err)
+}
+
+// failFast returns a function that returns nil and the ErrRedisUnreachable
+// message instead of calling the given function, while waiting before
+// connecting to Redis again. If the connection is lost while the given
+// function runs, its results are replaced the same way.
+func failFast(fn lua.LGFunction) lua.LGFunction {
+	return func(L *lua.LState) int {
+		backend := getRedisBackend(L)
+		if backend == nil {
+			return fn(L)
+		}
+		health := healthOf(backend.pool)
+		if health == nil {
+			return fn(L)
+		}
+		if health.waiting() {
+			L.Push(lua.LNil)
+			L.Push(lua.LString(ErrRedisUnreachable.Error()))
+			return 2 // number of results
+		}
+		lost := health.lostCount()
+		n := fn(L)
+		if health.lostCount() != lost {
+			L.Pop(n)
+			L.Push(lua.LNil)
+			L.Push(lua.LString(ErrRedisUnreachable.Error()))
+			return 2 // number of results
+		}
+		return n
+	}
+}
+
+// redisAlive returns true if Redis can be reached. While waiting before
+// connecting again, false is returned without trying.
+func redisAlive(pool *simpleredis.ConnectionPool) bool {
+	if health := healthOf(pool); health != nil && health.waiting() {
+		return false
+	}
+	return pool.Ping() == nil
+}
@@ -0,0 +1,54 @@
+package datastruct
+
+import (
+	"testing"
+	"time"
+
+	"github.com/bmizerany/assert"
+)
+
+func TestRedisReconnect(t *testing.T) {
+	fr, pool := startFakeRedis(t)
+	ReconnectWithBackoff(pool)
+	L := newRedisState(pool)
+	defer L.Close()
+
+	err := L.DoString(`
+		assert(RedisAlive())
+		kv = KeyValue("settings")
+		kv:set("theme", "dark")
+		assert(kv:get("theme") == "dark")
+	`)
+	assert.Equal(t, err, nil)
+
+	// The connection is lost
+	fr.setDown(true)
+	err = L.DoString(`
+		local value, err = kv:get("theme")
+		assert(value == nil)
+		assert(err == "Redis is unreachable")
+		assert(not RedisAlive())
+		-- Fails right away while waiting before connecting again
+		value, err = List("todo"):getall()
+		assert(value == nil)
+		assert(err == "Redis is unreachable")
+		assert(tostring(kv) ~= nil)
+	`)
+	assert.Equal(t, err, nil)
+
+	// Connecting again works out after a delay
+	fr.setDown(false)
+	alive := false
+	for deadline := time.Now().Add(10 * time.Second); !alive && time.Now().Before(deadline); {
+		time.Sleep(50 * time.Millisecond)
+		assert.Equal(t, L.DoString(`alive = RedisAlive()`), nil)
+		alive = L.GetGlobal("alive").String() == "true"
+	}
+	assert.Equal(t, alive, true)
+	err = L.DoString(`
+		local value, err = kv:get("theme")
+		assert(value == "dark")
+		assert(err == nil)
+	`)
+	assert.Equal(t, err, nil)
+}
@@ -0,0 +1,170 @@
+package datastruct
+
+import (
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+	"github.com/xyproto/gopher-lua"
+	"github.com/xyproto/simpleredis"
+)
+
+// RedisStats contains statistics about a Redis connection pool
+type RedisStats struct {
+	Size      int           // number of connections in the pool, both active and idle
+	Active    int           // number of connections that are in use
+	Idle      int           // number of idle connections
+	MaxIdle   int           // maximum number of idle connections
+	MaxActive int           // maximum number of connections, 0 is unlimited
+	Latency   time.Duration // the time it took to PING the Redis server
+}
+
+// NewRedisStats retrieves statistics about the given connection pool and
+// measures the latency by sending a PING to the Redis server
+func NewRedisStats(pool *simpleredis.ConnectionPool) (*RedisStats, error) {
+	start := time.Now()
+	if err := pool.Ping(); err != nil {
+		return nil, err
+	}
+	latency := time.Since(start)
+
+	redisPool := (*redis.Pool)(pool)
+	poolStats := redisPool.Stats()
+	return &RedisStats{
+		Size:      poolStats.ActiveCount,
+		Active:    poolStats.ActiveCount - poolStats.IdleCount,
+		Idle:      poolStats.IdleCount,
+		MaxIdle:   redisPool.MaxIdle,
+		MaxActive: redisPool.MaxActive,
+		Latency:   latency,
+	}, nil
+}
+
+// Key for storing the Redis backend in the Lua registry
+const lRedisBackend = "algernon.redis"
+
+// redisBackend is the Redis connection pool and database index that is used
+// by the data structures in a Lua state
+type redisBackend struct {
+	pool    *simpleredis.ConnectionPool
+	dbindex int
+	pipe    *redisPipeline // the active pipeline, if any
+}
+
+// getRedisBackend returns the Redis backend for the given Lua state,
+// or nil if Redis is not the database backend
+func getRedisBackend(L *lua.LState) *redisBackend {
+	ud, ok := L.G.Registry.RawGetString(lRedisBackend).(*lua.LUserData)
+	if !ok {
+		return nil
+	}
+	backend, _ := ud.Value.(*redisBackend)
+	return backend
+}
+
+// selectRedisDatabase changes the Redis database index that is used for the
+// data structures that are created after this
+func selectRedisDatabase(L *lua.LState, dbindex int) {
+	if backend := getRedisBackend(L); backend != nil {
+		backend.dbindex = dbindex
+	}
+}
+
+// redisKey is a key in a Redis database, for sending commands that are not
+// available in the pinterface interfaces
+type redisKey struct {
+	backend *redisBackend
+	pool    *simpleredis.ConnectionPool
+	dbindex int
+	key     string
+}
+
+// newRedisKey returns a Redis key for the given Lua state,
+// or nil if Redis is not the database backend
+func newRedisKey(L *lua.LState, key string) *redisKey {
+	backend := getRedisBackend(L)
+	if backend == nil {
+		return nil
+	}
+	return &redisKey{backend, backend.pool, backend.dbindex, key}
+}
+
+// field returns the Redis key for an element that belongs to this key,
+// using the same naming scheme as simpleredis (id + ":" + name)
+func (rk *redisKey) field(name string) *redisKey {
+	return &redisKey{rk.backend, rk.pool, rk.dbindex, rk.key + ":" + name}
+}
+
+// do sends a command with the key as the first argument, followed by the
+// given arguments. The connection is returned to the pool afterwards.
+// Pipelined commands are sent first, so that the result reflects them.
+func (rk *redisKey) do(command string, args ...interface{}) (interface{}, error) {
+	return rk.doWithTimeout(0, command, args...)
+}
+
+// doWithTimeout is like do, but waits for the reply for up to the given
+// duration, for blocking commands. 0 uses the read timeout of the connection.
+func (rk *redisKey) doWithTimeout(timeout time.Duration, command string, args ...interface{}) (interface{}, error) {
+	return rk.doCommand(timeout, command, append([]interface{}{rk.key}, args...)...)
+}
+
+// doCommand sends a command with the given arguments as they are, for
+// commands that take several keys, like MGET. The reply is waited for for up
+// to the given duration, where 0 uses the read timeout of the connection.
+func (rk *redisKey) doCommand(timeout time.Duration, command string, args ...interface{}) (interface{}, error) {
+	rk.backend.sync()
+	conn := (*redis.Pool)(rk.pool).Get()
+	defer conn.Close()
+	if rk.dbindex != 0 {
+		if _, err := conn.Do("SELECT", rk.dbindex); err != nil {
+			return nil, err
+		}
+		// Leave the pooled connection at the default database
+		defer conn.Do("SELECT", 0)
+	}
+	if timeout > 0 {
+		return redis.DoWithTimeout(conn, timeout, command, args...)
+	}
+	return conn.Do(command, args...)
+}
+
+// LoadRedis makes functions for inspecting the Redis backend available to the
+// given Lua state, in the "redis" table. The connection pool and database
+// index are also used by the data structures, for commands that are specific
+// to Redis.
+func LoadRedis(L *lua.LState, pool *simpleredis.ConnectionPool, dbindex int) {
+	backend := L.NewUserData()
+	backend.Value = &redisBackend{pool: pool, dbindex: dbindex}
+	L.G.Registry.RawSetString(lRedisBackend, backend)
+
+	redisTable := L.NewTable()
+
+	// Return a table with the size of the connection pool, the number of
+	// active and idle connections and the PING latency in milliseconds.
+	// Returns nil and an error message if Redis could not be reached.
+	L.SetField(redisTable, "stats", L.NewFunction(func(L *lua.LState) int {
+		stats, err := NewRedisStats(pool)
+		if err != nil {
+			L.Push(lua.LNil)
+			L.Push(lua.LString(err.Error()))
+			return 2 // number of results
+		}
+		table := L.NewTable()
+		table.RawSetString("size", lua.LNumber(stats.Size))
+		table.RawSetString("active", lua.LNumber(stats.Active))
+		table.RawSetString("idle", lua.LNumber(stats.Idle))
+		table.RawSetString("maxidle", lua.LNumber(stats.MaxIdle))
+		table.RawSetString("maxactive", lua.LNumber(stats.MaxActive))
+		table.RawSetString("latency", lua.LNumber(float64(stats.Latency)/float64(time.Millisecond)))
+		L.Push(table)
+		return 1 // number of results
+	}))
+
+	L.SetGlobal("redis", redisTable)
+
+	// Return true if Redis can be reached. After the connection has been
+	// lost, false is returned until connecting again works out.
+	L.SetGlobal("RedisAlive", L.NewFunction(func(L *lua.LState) int {
+		L.Push(lua.LBool(redisAlive(pool)))
+		return 1 // number of results
+	}))
+}
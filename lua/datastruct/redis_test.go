@@ -0,0 +1,486 @@
+package datastruct
+
+import (
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/bmizerany/assert"
+	"github.com/gomodule/redigo/redis"
+	"github.com/xyproto/gopher-lua"
+	"github.com/xyproto/simpleredis"
+)
+
+func TestRedisStats(t *testing.T) {
+	_, pool := startFakeRedis(t)
+
+	L := lua.NewState()
+	defer L.Close()
+	LoadRedis(L, pool, 0)
+
+	err := L.DoString(`
+		stats = redis.stats()
+		for _, key in ipairs({"size", "active", "idle", "maxidle", "maxactive", "latency"}) do
+			assert(type(stats[key]) == "number", key)
+		end
+		assert(stats.latency >= 0)
+		assert(stats.maxidle == 3)
+	`)
+	assert.Equal(t, err, nil)
+}
+
+func TestRedisStatsUnreachable(t *testing.T) {
+	pool := simpleredis.ConnectionPool(redis.Pool{
+		Dial: func() (redis.Conn, error) {
+			return redis.Dial("tcp", "127.0.0.1:1")
+		},
+	})
+
+	L := lua.NewState()
+	defer L.Close()
+	LoadRedis(L, &pool, 0)
+
+	err := L.DoString(`
+		local stats, err = redis.stats()
+		assert(stats == nil and err ~= nil)
+	`)
+	assert.Equal(t, err, nil)
+}
+
+func TestSetSize(t *testing.T) {
+	L, _ := newRedisTestState(t)
+	defer L.Close()
+
+	err := L.DoString(`
+		local s = Set("fruits")
+		assert(s:size() == 0)
+		s:add("apple")
+		s:add("banana")
+		s:add("cherry")
+		assert(s:size() == 3)
+		-- Adding a duplicate does not change the size
+		s:add("banana")
+		assert(s:size() == 3)
+		s:del("apple")
+		assert(s:size() == 2)
+	`)
+	assert.Equal(t, err, nil)
+}
+
+func TestListPop(t *testing.T) {
+	L, _ := newRedisTestState(t)
+	defer L.Close()
+
+	err := L.DoString(`
+		-- First in, first out
+		local queue = List("queue")
+		queue:add("a")
+		queue:add("b")
+		queue:add("c")
+		assert(queue:pop() == "a")
+		assert(queue:pop() == "b")
+		assert(table.concat(queue:getall(), ",") == "c")
+		assert(queue:pop() == "c")
+		assert(queue:pop() == "")
+
+		-- Last in, first out
+		local stack = List("stack")
+		stack:add("a")
+		stack:add("b")
+		stack:add("c")
+		assert(stack:poplast() == "c")
+		assert(stack:poplast() == "b")
+		assert(table.concat(stack:getlastn(5), ",") == "a")
+		assert(stack:poplast() == "a")
+		assert(stack:poplast() == "")
+	`)
+	assert.Equal(t, err, nil)
+}
+
+func TestListBlockingPop(t *testing.T) {
+	_, pool := startFakeRedis(t)
+	L := newRedisState(pool)
+	defer L.Close()
+
+	// Add a job after a short delay, from another connection
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		conn := (*redis.Pool)(pool).Get()
+		defer conn.Close()
+		conn.Do("RPUSH", "jobs", "job 1")
+	}()
+
+	start := time.Now()
+	err := L.DoString(`
+		local jobs = List("jobs")
+		assert(jobs:bpop(5) == "job 1")
+	`)
+	assert.Equal(t, err, nil)
+	assert.Equal(t, time.Since(start) < 5*time.Second, true)
+
+	// An empty string is returned when the timeout is reached
+	start = time.Now()
+	err = L.DoString(`
+		assert(List("jobs"):bpop(0.5) == "")
+	`)
+	assert.Equal(t, err, nil)
+	assert.Equal(t, time.Since(start) >= time.Second, true)
+}
+
+func TestListTrim(t *testing.T) {
+	L, _ := newRedisTestState(t)
+	defer L.Close()
+
+	err := L.DoString(`
+		local log = List("log")
+		for i = 1, 10 do
+			log:add("line " .. i)
+		end
+		-- Keep the last three lines
+		assert(log:trim(-3, -1))
+		assert(table.concat(log:getall(), ",") == "line 8,line 9,line 10")
+		assert(table.concat(log:getlastn(2), ",") == "line 9,line 10")
+		assert(log:getlast() == "line 10")
+		assert(log:trim(0, 0))
+		assert(table.concat(log:getall(), ",") == "line 8")
+	`)
+	assert.Equal(t, err, nil)
+}
+
+func TestKeyValueExpire(t *testing.T) {
+	L, _ := newRedisTestState(t)
+	defer L.Close()
+
+	err := L.DoString(`
+		kv = KeyValue("sessions")
+		assert(kv:ttl("token") == -2)
+		kv:set("user", "bob")
+		assert(kv:ttl("user") == -1)
+		assert(kv:setexpire("token", "abc123", 1))
+		assert(kv:get("token") == "abc123")
+		local ttl = kv:ttl("token")
+		assert(ttl >= 0 and ttl <= 1, ttl)
+	`)
+	assert.Equal(t, err, nil)
+
+	time.Sleep(1100 * time.Millisecond)
+
+	err = L.DoString(`
+		assert(kv:get("token") == "")
+		assert(kv:ttl("token") == -2)
+		assert(kv:get("user") == "bob")
+	`)
+	assert.Equal(t, err, nil)
+}
+
+func TestKeyValueDec(t *testing.T) {
+	L, _ := newRedisTestState(t)
+	defer L.Close()
+
+	err := L.DoString(`
+		local kv = KeyValue("counters")
+		assert(kv:inc("visitors") == "1")
+		assert(kv:inc("visitors") == "2")
+		assert(kv:dec("visitors") == "1")
+		assert(kv:get("visitors") == "1")
+		assert(kv:dec("missing") == "-1")
+	`)
+	assert.Equal(t, err, nil)
+}
+
+// commandCount returns the number of commands the fake Redis server has received
+func commandCount(fr *fakeRedis) int {
+	fr.mut.Lock()
+	defer fr.mut.Unlock()
+	return fr.commands
+}
+
+func TestKeyValueMultiple(t *testing.T) {
+	L, fr := newRedisTestState(t)
+	defer L.Close()
+
+	assert.Equal(t, L.DoString(`
+		kv = KeyValue("cache")
+		values = {}
+		keys = {}
+		for i = 1, 100 do
+			values["key" .. i] = "value " .. i
+			table.insert(keys, "key" .. i)
+		end
+	`), nil)
+
+	// Setting and getting 100 keys takes one command each
+	before := commandCount(fr)
+	assert.Equal(t, L.DoString(`assert(kv:mset(values))`), nil)
+	assert.Equal(t, commandCount(fr)-before, 1)
+	before = commandCount(fr)
+	assert.Equal(t, L.DoString(`
+		local got = kv:mget(keys)
+		for i = 1, 100 do
+			assert(got["key" .. i] == "value " .. i)
+		end
+	`), nil)
+	assert.Equal(t, commandCount(fr)-before, 1)
+
+	// Compared to one command per key with kv:get
+	before = commandCount(fr)
+	assert.Equal(t, L.DoString(`
+		for i = 1, 100 do
+			assert(kv:get("key" .. i) == "value " .. i)
+		end
+	`), nil)
+	assert.Equal(t, commandCount(fr)-before, 100)
+
+	// Keys that do not exist are left out
+	assert.Equal(t, L.DoString(`
+		local got = kv:mget({"key1", "missing", "key2"})
+		assert(got.key1 == "value 1")
+		assert(got.key2 == "value 2")
+		assert(got.missing == nil)
+		assert(next(kv:mget({})) == nil)
+		assert(kv:mset({}))
+	`), nil)
+}
+
+// benchmarkGets gets 100 keys from a KeyValue, with the given Lua code
+func benchmarkGets(b *testing.B, code string) {
+	L, _ := newRedisTestState(b)
+	defer L.Close()
+	if err := L.DoString(`
+		kv = KeyValue("cache")
+		keys = {}
+		for i = 1, 100 do
+			kv:set("key" .. i, "value " .. i)
+			table.insert(keys, "key" .. i)
+		end
+	`); err != nil {
+		b.Fatal(err)
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := L.DoString(code); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkKeyValueGet(b *testing.B) {
+	benchmarkGets(b, `for _, key in ipairs(keys) do kv:get(key) end`)
+}
+
+func BenchmarkKeyValueMGet(b *testing.B) {
+	benchmarkGets(b, `kv:mget(keys)`)
+}
+
+func TestHashInc(t *testing.T) {
+	L, _ := newRedisTestState(t)
+	defer L.Close()
+
+	err := L.DoString(`
+		local hash = HashMap("users")
+		assert(hash:inc("bob", "visits") == "1")
+		assert(hash:inc("bob", "visits") == "2")
+		assert(hash:get("bob", "visits") == "2")
+		hash:set("bob", "name", "Bob")
+		assert(hash:inc("bob", "name") == "")
+		assert(hash:get("bob", "name") == "Bob")
+	`)
+	assert.Equal(t, err, nil)
+}
+
+func TestHashGetMap(t *testing.T) {
+	L, _ := newRedisTestState(t)
+	defer L.Close()
+
+	err := L.DoString(`
+		local users = HashMap("users")
+		users:set("alice", "name", "Alice")
+		users:set("alice", "email", "alice@example.com")
+		users:set("alice", "visits", "3")
+		users:set("bob", "name", "Bob")
+
+		local alice = users:getmap("alice")
+		assert(alice.name == "Alice")
+		assert(alice.email == "alice@example.com")
+		assert(alice.visits == "3")
+		local count = 0
+		for _ in pairs(alice) do
+			count = count + 1
+		end
+		assert(count == 3)
+
+		assert(table.concat(users:fields("alice"), ",") == "email,name,visits")
+		assert(users:getmap("bob").name == "Bob")
+
+		-- An element that does not exist
+		assert(next(users:getmap("eve")) == nil)
+		assert(#users:fields("eve") == 0)
+	`)
+	assert.Equal(t, err, nil)
+}
+
+func TestHashExpire(t *testing.T) {
+	L, _ := newRedisTestState(t)
+	defer L.Close()
+
+	err := L.DoString(`
+		local users = HashMap("users")
+		users:set("guest", "name", "Guest")
+		users:set("guest", "email", "guest@example.com")
+		users:set("bob", "name", "Bob")
+		assert(users:ttl("guest") == -1)
+		assert(users:ttl("nobody") == -2)
+		assert(not users:expire("nobody", 60))
+
+		-- Removing the expiry keeps the element
+		assert(users:expire("bob", 1))
+		assert(users:ttl("bob") == 1)
+		assert(users:persist("bob"))
+		assert(users:ttl("bob") == -1)
+		assert(not users:persist("bob"))
+
+		assert(users:expire("guest", 1))
+		assert(users:exists("guest"))
+	`)
+	assert.Equal(t, err, nil)
+
+	// The whole element expires, not just a field
+	time.Sleep(1100 * time.Millisecond)
+	err = L.DoString(`
+		local users = HashMap("users")
+		assert(not users:exists("guest"))
+		assert(users:get("guest", "name") == "")
+		assert(users:ttl("guest") == -2)
+		assert(users:get("bob", "name") == "Bob")
+	`)
+	assert.Equal(t, err, nil)
+}
+
+func TestHashIncConcurrent(t *testing.T) {
+	_, pool := startFakeRedis(t)
+
+	const workers, increments = 8, 25
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			// Lua states can not be shared between goroutines
+			L := newRedisState(pool)
+			defer L.Close()
+			if err := L.DoString(`
+				local hash = HashMap("counters")
+				for i = 1, ` + strconv.Itoa(increments) + ` do
+					hash:inc("page", "hits")
+				end
+			`); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	L := newRedisState(pool)
+	defer L.Close()
+	err := L.DoString(`hits = HashMap("counters"):get("page", "hits")`)
+	assert.Equal(t, err, nil)
+	assert.Equal(t, L.GetGlobal("hits").String(), strconv.Itoa(workers*increments))
+}
+
+func TestSetUnionIntersect(t *testing.T) {
+	L, _ := newRedisTestState(t)
+	defer L.Close()
+
+	err := L.DoString(`
+		local function joined(t)
+			return table.concat(t, ",")
+		end
+		local a, b, c = Set("a"), Set("b"), Set("c")
+		for _, v in ipairs({"x", "y", "z"}) do a:add(v) end
+		for _, v in ipairs({"y", "z", "w"}) do b:add(v) end
+		for _, v in ipairs({"q"}) do c:add(v) end
+
+		-- Overlapping sets
+		assert(joined(a:union("b")) == "w,x,y,z")
+		assert(joined(a:intersect("b")) == "y,z")
+
+		-- Disjoint sets
+		assert(joined(a:union("c")) == "q,x,y,z")
+		assert(#a:intersect("c") == 0)
+
+		-- A missing set is empty
+		assert(joined(a:union("missing")) == "x,y,z")
+		assert(#a:intersect("missing") == 0)
+		assert(#Set("empty"):union("missing") == 0)
+
+		-- The same set
+		assert(joined(a:union("a")) == "x,y,z")
+		assert(joined(a:intersect("a")) == "x,y,z")
+
+		-- Neither set is modified
+		assert(a:size() == 3 and b:size() == 3)
+	`)
+	assert.Equal(t, err, nil)
+}
+
+func TestSetPop(t *testing.T) {
+	L, _ := newRedisTestState(t)
+	defer L.Close()
+
+	err := L.DoString(`
+		local s = Set("jobs")
+		for _, v in ipairs({"a", "b", "c"}) do s:add(v) end
+
+		local member = s:random()
+		assert(s:has(member))
+		assert(s:size() == 3)
+
+		local popped = {}
+		for i = 1, 3 do
+			local member = s:pop()
+			assert(member ~= "" and not popped[member])
+			assert(not s:has(member))
+			popped[member] = true
+			assert(s:size() == 3 - i)
+		end
+		assert(popped.a and popped.b and popped.c)
+		assert(#s:getall() == 0)
+		assert(s:pop() == "")
+		assert(s:random() == "")
+	`)
+	assert.Equal(t, err, nil)
+}
+
+func TestListRange(t *testing.T) {
+	L, _ := newRedisTestState(t)
+	defer L.Close()
+
+	err := L.DoString(`
+		local function joined(t)
+			return table.concat(t, ",")
+		end
+		local list = List("pages")
+		assert(#list:range(0, -1) == 0)
+		for _, v in ipairs({"a", "b", "c", "d", "e"}) do list:add(v) end
+
+		-- Positive indices
+		assert(joined(list:range(0, 1)) == "a,b")
+		assert(joined(list:range(2, 4)) == "c,d,e")
+
+		-- Negative indices
+		assert(joined(list:range(-2, -1)) == "d,e")
+		assert(joined(list:range(-5, -5)) == "a")
+
+		-- Mixed indices
+		assert(joined(list:range(1, -2)) == "b,c,d")
+		assert(joined(list:range(-3, 3)) == "c,d")
+
+		-- Out of range indices are clamped
+		assert(joined(list:range(-100, 100)) == "a,b,c,d,e")
+		assert(joined(list:range(3, 100)) == "d,e")
+		assert(#list:range(10, 20) == 0)
+		assert(#list:range(3, 1) == 0)
+	`)
+	assert.Equal(t, err, nil)
+}
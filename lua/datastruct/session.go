@@ -0,0 +1,213 @@
+package datastruct
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"strconv"
+	"time"
+
+	"github.com/xyproto/gopher-lua"
+	"github.com/xyproto/pinterface"
+)
+
+const (
+	// Identifier for the Session class in Lua
+	lSessionClass = "Session"
+
+	// The name of the hash map that holds the session data
+	sessionHashName = "sessions"
+
+	// The hash map key for when a session expires, as a Unix timestamp
+	sessionExpiresKey = "_expires"
+)
+
+// Session is the data for one visitor, stored in a hash map with the session
+// ID as the element ID. The session is created when a value is first set.
+type Session struct {
+	hash      pinterface.IHashMap
+	rk        *redisKey // the key of the hash map, if Redis is the backend
+	id        string
+	ttl       time.Duration
+	setCookie func(id string) error // for sending the session ID to the client, or removing it if empty
+}
+
+// newSessionID returns a random session ID, with 128 bits of randomness
+func newSessionID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// newSession returns the session with the given ID, if it exists and has not
+// expired, or a session that will be created when a value is first set
+func newSession(hash pinterface.IHashMap, rk *redisKey, id string, ttl time.Duration, setCookie func(string) error) *Session {
+	s := &Session{hash: hash, rk: rk, ttl: ttl, setCookie: setCookie}
+	if id == "" {
+		return s
+	}
+	expires, err := hash.Get(id, sessionExpiresKey)
+	if err != nil {
+		return s
+	}
+	if unixTime, err := strconv.ParseInt(expires, 10, 64); err != nil || time.Now().Unix() >= unixTime {
+		// The session has expired, or is invalid
+		hash.Del(id)
+		return s
+	}
+	s.id = id
+	return s
+}
+
+// touch extends the lifetime of the session
+func (s *Session) touch() error {
+	expires := time.Now().Add(s.ttl).Unix()
+	if err := s.hash.Set(s.id, sessionExpiresKey, strconv.FormatInt(expires, 10)); err != nil {
+		return err
+	}
+	if s.rk != nil {
+		// Let Redis remove the session data when it expires
+		if _, err := s.rk.field(s.id).do("EXPIRE", int(s.ttl/time.Second)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Set stores a value in the session. The session is created, and the
+// session ID is sent to the client, if needed.
+func (s *Session) Set(key, value string) error {
+	if key == sessionExpiresKey {
+		return errors.New(sessionExpiresKey + " is a reserved session key")
+	}
+	if s.id == "" {
+		id, err := newSessionID()
+		if err != nil {
+			return err
+		}
+		if err := s.setCookie(id); err != nil {
+			return err
+		}
+		s.id = id
+	}
+	if err := s.hash.Set(s.id, key, value); err != nil {
+		return err
+	}
+	return s.touch()
+}
+
+// Get returns a value from the session, or an empty string
+func (s *Session) Get(key string) string {
+	if s.id == "" || key == sessionExpiresKey {
+		return ""
+	}
+	value, err := s.hash.Get(s.id, key)
+	if err != nil {
+		return ""
+	}
+	return value
+}
+
+// Destroy removes the session data and the session cookie
+func (s *Session) Destroy() error {
+	if s.id == "" {
+		return nil
+	}
+	if err := s.hash.Del(s.id); err != nil {
+		return err
+	}
+	s.id = ""
+	return s.setCookie("")
+}
+
+// Get the first argument, "self", and cast it from userdata to a session
+func checkSession(L *lua.LState) *Session {
+	ud := L.CheckUserData(1)
+	if session, ok := ud.Value.(*Session); ok {
+		return session
+	}
+	L.ArgError(1, "session expected")
+	return nil
+}
+
+// Set a value in the session. The session is created if needed.
+// Returns true if successful, or false and an error message.
+// session:set(string, string) -> bool
+func sessionSet(L *lua.LState) int {
+	session := checkSession(L) // arg 1
+	if err := session.Set(L.CheckString(2), L.ToString(3)); err != nil {
+		L.Push(lua.LFalse)
+		L.Push(lua.LString(err.Error()))
+		return 2 // Number of returned values
+	}
+	L.Push(lua.LTrue)
+	return 1 // Number of returned values
+}
+
+// Get a value from the session. May return an empty string.
+// session:get(string) -> string
+func sessionGet(L *lua.LState) int {
+	session := checkSession(L) // arg 1
+	L.Push(lua.LString(session.Get(L.CheckString(2))))
+	return 1 // Number of returned values
+}
+
+// Remove the session data and the session cookie. Returns true if successful.
+// session:destroy() -> bool
+func sessionDestroy(L *lua.LState) int {
+	session := checkSession(L) // arg 1
+	L.Push(lua.LBool(nil == session.Destroy()))
+	return 1 // Number of returned values
+}
+
+// Return the session ID, or an empty string if no session has been created.
+// session:id() -> string
+func sessionID(L *lua.LState) int {
+	session := checkSession(L) // arg 1
+	L.Push(lua.LString(session.id))
+	return 1 // Number of returned values
+}
+
+// The session methods that are to be registered
+var sessionMethods = map[string]lua.LGFunction{
+	"set":     sessionSet,
+	"get":     sessionGet,
+	"destroy": sessionDestroy,
+	"id":      sessionID,
+}
+
+// LoadSession makes the session function available to Lua scripts. id is the
+// session ID from the request, or an empty string. The session expires after
+// the given duration without changes. setCookie is called with a new session
+// ID when a session is created, and with an empty string when it is destroyed.
+func LoadSession(L *lua.LState, creator pinterface.ICreator, id string, ttl time.Duration, setCookie func(string) error) {
+
+	// Register the session class and the methods that belongs with it.
+	mt := L.NewTypeMetatable(lSessionClass)
+	mt.RawSetH(lua.LString("__index"), mt)
+	L.SetFuncs(mt, sessionMethods)
+
+	// The session is looked up when it is first used, and then reused
+	var userdata *lua.LUserData
+
+	// Return the session for the current request.
+	// Returns nil and an error message if the session hash map is unavailable.
+	L.SetGlobal("session", L.NewFunction(func(L *lua.LState) int {
+		if userdata == nil {
+			hash, err := creator.NewHashMap(sessionHashName)
+			if err != nil {
+				L.Push(lua.LNil)
+				L.Push(lua.LString(err.Error()))
+				return 2 // Number of returned values
+			}
+			userdata = L.NewUserData()
+			userdata.Value = newSession(hash, newRedisKey(L, sessionHashName), id, ttl, setCookie)
+			L.SetMetatable(userdata, L.GetTypeMetatable(lSessionClass))
+		}
+		L.Push(userdata)
+		return 1 // Number of returned values
+	}))
+
+}
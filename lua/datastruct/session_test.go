@@ -0,0 +1,90 @@
+package datastruct
+
+import (
+	"testing"
+	"time"
+
+	"github.com/bmizerany/assert"
+	"github.com/xyproto/gopher-lua"
+	"github.com/xyproto/simpleredis"
+)
+
+// newSessionState returns a Lua state for a request with the given session
+// ID, and a pointer to the session ID that is sent to the client
+func newSessionState(pool *simpleredis.ConnectionPool, id string, ttl time.Duration) (*lua.LState, *string) {
+	L := newRedisState(pool)
+	cookie := new(string)
+	*cookie = id
+	LoadSession(L, simpleredis.NewCreator(pool, 0), id, ttl, func(id string) error {
+		*cookie = id
+		return nil
+	})
+	return L, cookie
+}
+
+func TestSession(t *testing.T) {
+	_, pool := startFakeRedis(t)
+
+	// The session is created when a value is first set
+	L, cookie := newSessionState(pool, "", time.Hour)
+	err := L.DoString(`
+		assert(session():id() == "")
+		assert(session():get("name") == "")
+		assert(session():set("name", "bob"))
+		assert(#session():id() == 32)
+		assert(session():get("name") == "bob")
+		local ok, err = session():set("_expires", "0")
+		assert(not ok and err ~= nil)
+	`)
+	assert.Equal(t, err, nil)
+	L.Close()
+	id := *cookie
+	assert.Equal(t, len(id), 32)
+
+	// The next request has the session ID
+	L, cookie = newSessionState(pool, id, time.Hour)
+	err = L.DoString(`
+		assert(session():get("name") == "bob")
+	`)
+	assert.Equal(t, err, nil)
+	// The session data expires in Redis too
+	ttl, err := newRedisKey(L, "sessions:"+id).do("TTL")
+	assert.Equal(t, err, nil)
+	assert.Equal(t, ttl, int64(3600))
+
+	// Destroying the session removes the data and the cookie
+	err = L.DoString(`
+		assert(session():destroy())
+		assert(session():id() == "")
+		assert(session():get("name") == "")
+	`)
+	assert.Equal(t, err, nil)
+	assert.Equal(t, *cookie, "")
+	L.Close()
+
+	// Unknown session IDs are not used
+	L, _ = newSessionState(pool, id, time.Hour)
+	assert.Equal(t, L.DoString(`assert(session():id() == "")`), nil)
+	L.Close()
+}
+
+func TestSessionExpiry(t *testing.T) {
+	_, pool := startFakeRedis(t)
+
+	L, cookie := newSessionState(pool, "", time.Second)
+	assert.Equal(t, L.DoString(`assert(session():set("name", "bob"))`), nil)
+	L.Close()
+
+	L, _ = newSessionState(pool, *cookie, time.Second)
+	assert.Equal(t, L.DoString(`assert(session():get("name") == "bob")`), nil)
+	L.Close()
+
+	time.Sleep(1100 * time.Millisecond)
+
+	L, _ = newSessionState(pool, *cookie, time.Second)
+	assert.Equal(t, L.DoString(`
+		assert(session():id() == "")
+		assert(session():get("name") == "")
+	`), nil)
+	L.Close()
+}
@@ -1,8 +1,11 @@
 package datastruct
 
 import (
+	"encoding/json"
+	"sort"
 	"strings"
 
+	"github.com/gomodule/redigo/redis"
 	"github.com/xyproto/algernon/lua/convert"
 	"github.com/xyproto/gopher-lua"
 	"github.com/xyproto/pinterface"
@@ -11,6 +14,28 @@ import (
 // Identifier for the Set class in Lua
 const lSetClass = "SET"
 
+// A set that is stored in Redis, for commands that are not in pinterface.ISet
+type redisSet struct {
+	pinterface.ISet
+	*redisKey
+}
+
+// Add an element to the set, or buffer the command if a pipeline is active
+func (rs *redisSet) Add(value string) error {
+	if rs.send("SADD", value) {
+		return nil
+	}
+	return rs.ISet.Add(value)
+}
+
+// Remove an element from the set, or buffer the command if a pipeline is active
+func (rs *redisSet) Del(value string) error {
+	if rs.send("SREM", value) {
+		return nil
+	}
+	return rs.ISet.Del(value)
+}
+
 // Get the first argument, "self", and cast it from userdata to a set.
 func checkSet(L *lua.LState) pinterface.ISet {
 	ud := L.CheckUserData(1)
@@ -30,6 +55,10 @@ func newSet(L *lua.LState, creator pinterface.ICreator, id string) (*lua.LUserDa
 	if err != nil {
 		return nil, err
 	}
+	// Use Redis commands directly, if Redis is the backend
+	if rk := newRedisKey(L, id); rk != nil {
+		set = &redisSet{set, rk}
+	}
 	// Create a new userdata struct
 	ud := L.NewUserData()
 	ud.Value = set
@@ -83,6 +112,24 @@ func setHas(L *lua.LState) int {
 	return 1 // Number of returned values
 }
 
+// Get the number of elements in the set
+// Returns 0 if there were errors.
+// set:size() -> number
+func setSize(L *lua.LState) int {
+	set := checkSet(L) // arg 1
+	var size int
+	if rs, ok := set.(*redisSet); ok {
+		n, err := redis.Int(rs.do("SCARD"))
+		if err == nil {
+			size = n
+		}
+	} else if all, err := set.All(); err == nil {
+		size = len(all)
+	}
+	L.Push(lua.LNumber(size))
+	return 1 // Number of returned values
+}
+
 // Get all members of the set
 // set:getall() -> table
 func setAll(L *lua.LState) int {
@@ -97,6 +144,66 @@ func setAll(L *lua.LState) int {
 	return 1 // Number of returned values
 }
 
+// Get a random member of the set, using the given Redis command.
+// Returns an empty string if the set is empty, if there were errors or if
+// the backend is not Redis.
+func setMemberWith(L *lua.LState, command string) int {
+	set := checkSet(L) // arg 1
+	var member string
+	if rs, ok := set.(*redisSet); ok {
+		if s, err := redis.String(rs.do(command)); err == nil {
+			member = s
+		}
+	}
+	L.Push(lua.LString(member))
+	return 1 // Number of returned values
+}
+
+// Remove and return a random member of the set
+// The returned value can be empty
+// set:pop() -> string
+func setPop(L *lua.LState) int {
+	return setMemberWith(L, "SPOP")
+}
+
+// Return a random member of the set, without removing it
+// The returned value can be empty
+// set:random() -> string
+func setRandom(L *lua.LState) int {
+	return setMemberWith(L, "SRANDMEMBER")
+}
+
+// Combine the members of the set with the members of another set, using the
+// given Redis command. Neither set is modified. Returns an empty table if
+// there were errors or if the backend is not Redis.
+func setCombineWith(L *lua.LState, command string) int {
+	set := checkSet(L)            // arg 1
+	otherName := L.CheckString(2) // arg 2
+	var members []string
+	if rs, ok := set.(*redisSet); ok {
+		if result, err := redis.Strings(rs.do(command, otherName)); err == nil {
+			sort.Strings(result)
+			members = result
+		}
+	}
+	L.Push(convert.Strings2table(L, members))
+	return 1 // Number of returned values
+}
+
+// Get the members that are in this set, or in the set with the given name,
+// or in both. The members are sorted.
+// set:union(string) -> table
+func setUnion(L *lua.LState) int {
+	return setCombineWith(L, "SUNION")
+}
+
+// Get the members that are in both this set and the set with the given name.
+// The members are sorted.
+// set:intersect(string) -> table
+func setIntersect(L *lua.LState) int {
+	return setCombineWith(L, "SINTER")
+}
+
 // Remove the set itself. Returns true if successful.
 // set:remove() -> bool
 func setRemove(L *lua.LState) int {
@@ -113,6 +220,47 @@ func setClear(L *lua.LState) int {
 	return 1 // Number of returned values
 }
 
+// Return the set as a JSON list of the sorted members, for backups.
+// Returns nil and an error message if there were errors.
+// set:export() -> string
+func setExport(L *lua.LState) int {
+	set := checkSet(L) // arg 1
+	members, err := set.All()
+	sort.Strings(members)
+	if members == nil {
+		members = []string{}
+	}
+	return pushJSON(L, members, err)
+}
+
+// Replace the contents of the set with the members in the given JSON list,
+// as returned by set:export(). With Redis, this is done in a transaction.
+// Returns true if successful, or false and an error message.
+// set:import(string) -> bool
+func setImport(L *lua.LState) int {
+	set := checkSet(L) // arg 1
+	var members []string
+	if err := json.Unmarshal([]byte(L.CheckString(2)), &members); err != nil {
+		return pushImported(L, err)
+	}
+	if rs, ok := set.(*redisSet); ok {
+		commands := []redisCommand{{"DEL", []interface{}{rs.key}}}
+		for _, member := range members {
+			commands = append(commands, redisCommand{"SADD", []interface{}{rs.key, member}})
+		}
+		return pushImported(L, rs.transaction(commands))
+	}
+	if err := set.Clear(); err != nil {
+		return pushImported(L, err)
+	}
+	for _, member := range members {
+		if err := set.Add(member); err != nil {
+			return pushImported(L, err)
+		}
+	}
+	return pushImported(L, nil)
+}
+
 // The set methods that are to be registered
 var setMethods = map[string]lua.LGFunction{
 	"__tostring": setToString,
@@ -120,8 +268,15 @@ var setMethods = map[string]lua.LGFunction{
 	"del":        setDel,
 	"has":        setHas,
 	"getall":     setAll,
+	"size":       setSize,
+	"pop":        setPop,
+	"random":     setRandom,
+	"union":      setUnion,
+	"intersect":  setIntersect,
 	"remove":     setRemove,
 	"clear":      setClear,
+	"export":     setExport,
+	"import":     setImport,
 }
 
 // LoadSet makes functions related to HTTP requests and responses available to Lua scripts
@@ -130,7 +285,7 @@ func LoadSet(L *lua.LState, creator pinterface.ICreator) {
 	// Register the set class and the methods that belongs with it.
 	mt := L.NewTypeMetatable(lSetClass)
 	mt.RawSetH(lua.LString("__index"), mt)
-	L.SetFuncs(mt, setMethods)
+	L.SetFuncs(mt, pipelineMethods(setMethods, "add", "del"))
 
 	// The constructor for new sets takes a name and an optional redis db index
 	L.SetGlobal("Set", L.NewFunction(func(L *lua.LState) int {
@@ -145,6 +300,7 @@ func LoadSet(L *lua.LState, creator pinterface.ICreator) {
 			case pinterface.IRedisCreator:
 				rh.SelectDatabase(localDBIndex)
 			}
+			selectRedisDatabase(L, localDBIndex)
 		}
 
 		// Create a new set in Lua
@@ -0,0 +1,213 @@
+package datastruct
+
+import (
+	"errors"
+	"strconv"
+
+	"github.com/gomodule/redigo/redis"
+	"github.com/xyproto/algernon/lua/convert"
+	"github.com/xyproto/gopher-lua"
+)
+
+// Identifier for the SortedSet class in Lua
+const lSortedSetClass = "SORTEDSET"
+
+// errNoSortedSets is returned when creating a sorted set without Redis
+var errNoSortedSets = errors.New("sorted sets require Redis as the database backend")
+
+// A sorted set that is stored in Redis. There is no sorted set in
+// pinterface, so sorted sets are only available with Redis.
+type sortedSet struct {
+	*redisKey
+}
+
+// Get the first argument, "self", and cast it from userdata to a sorted set.
+func checkSortedSet(L *lua.LState) *sortedSet {
+	ud := L.CheckUserData(1)
+	if zset, ok := ud.Value.(*sortedSet); ok {
+		return zset
+	}
+	L.ArgError(1, "sorted set expected")
+	return nil
+}
+
+// Create a new sorted set.
+// id is the name of the sorted set.
+func newSortedSet(L *lua.LState, id string) (*lua.LUserData, error) {
+	rk := newRedisKey(L, id)
+	if rk == nil {
+		return nil, errNoSortedSets
+	}
+	// Create a new userdata struct
+	ud := L.NewUserData()
+	ud.Value = &sortedSet{rk}
+	L.SetMetatable(ud, L.GetTypeMetatable(lSortedSetClass))
+	return ud, nil
+}
+
+// String representation
+// Returns the name of the sorted set
+// tostring(zset) -> string
+func zsetToString(L *lua.LState) int {
+	zset := checkSortedSet(L) // arg 1
+	L.Push(lua.LString(zset.key))
+	return 1 // Number of returned values
+}
+
+// Add a member with the given score, or update the score if the member
+// already exists. Returns true if successful.
+// zset:add(string, number) -> bool
+func zsetAdd(L *lua.LState) int {
+	zset := checkSortedSet(L) // arg 1
+	member := L.ToString(2)
+	score := float64(L.CheckNumber(3))
+	var err error
+	if !zset.send("ZADD", score, member) {
+		_, err = zset.do("ZADD", score, member)
+	}
+	L.Push(lua.LBool(err == nil))
+	return 1 // Number of returned values
+}
+
+// Get the score of a member.
+// Returns nil if the member does not exist or if there were errors.
+// zset:score(string) -> number
+func zsetScore(L *lua.LState) int {
+	zset := checkSortedSet(L) // arg 1
+	member := L.ToString(2)
+	score, err := redis.Float64(zset.do("ZSCORE", member))
+	if err != nil {
+		L.Push(lua.LNil)
+		return 1 // Number of returned values
+	}
+	L.Push(lua.LNumber(score))
+	return 1 // Number of returned values
+}
+
+// Get the position of a member, where 0 is the member with the lowest score,
+// or with the highest score if the optional argument is true.
+// Returns nil if the member does not exist or if there were errors.
+// zset:rank(string[, bool]) -> number
+func zsetRank(L *lua.LState) int {
+	zset := checkSortedSet(L) // arg 1
+	member := L.ToString(2)
+	command := "ZRANK"
+	if L.ToBool(3) {
+		command = "ZREVRANK"
+	}
+	rank, err := redis.Int(zset.do(command, member))
+	if err != nil {
+		L.Push(lua.LNil)
+		return 1 // Number of returned values
+	}
+	L.Push(lua.LNumber(rank))
+	return 1 // Number of returned values
+}
+
+// Get the members from the start position to the stop position, both
+// inclusive, ordered from the lowest to the highest score, or from the
+// highest to the lowest score if the optional argument is true. Positions
+// start at 0 and can be negative, where -1 is the last member.
+// zset:range(number, number[, bool]) -> table
+func zsetRange(L *lua.LState) int {
+	zset := checkSortedSet(L) // arg 1
+	start := L.CheckInt(2)    // arg 2
+	stop := L.CheckInt(3)     // arg 3
+	command := "ZRANGE"
+	if L.ToBool(4) {
+		command = "ZREVRANGE"
+	}
+	members, err := redis.Strings(zset.do(command, start, stop))
+	if err != nil {
+		// Return an empty table
+		L.Push(L.NewTable())
+		return 1 // Number of returned values
+	}
+	L.Push(convert.Strings2table(L, members))
+	return 1 // Number of returned values
+}
+
+// scoreArg returns the given argument as a score for ZRANGEBYSCORE.
+// Strings like "-inf", "+inf" and "(5" (exclusive) are passed on as they are.
+func scoreArg(L *lua.LState, n int) string {
+	if number, ok := L.Get(n).(lua.LNumber); ok {
+		return strconv.FormatFloat(float64(number), 'g', -1, 64)
+	}
+	return L.CheckString(n)
+}
+
+// Get the members with scores between min and max, both inclusive, ordered
+// from the lowest to the highest score. min and max can also be "-inf" and
+// "+inf".
+// zset:rangebyscore(number, number) -> table
+func zsetRangeByScore(L *lua.LState) int {
+	zset := checkSortedSet(L) // arg 1
+	min := scoreArg(L, 2)     // arg 2
+	max := scoreArg(L, 3)     // arg 3
+	members, err := redis.Strings(zset.do("ZRANGEBYSCORE", min, max))
+	if err != nil {
+		// Return an empty table
+		L.Push(L.NewTable())
+		return 1 // Number of returned values
+	}
+	L.Push(convert.Strings2table(L, members))
+	return 1 // Number of returned values
+}
+
+// Remove a member. Returns true if successful.
+// zset:remove(string) -> bool
+func zsetRemove(L *lua.LState) int {
+	zset := checkSortedSet(L) // arg 1
+	member := L.ToString(2)
+	var err error
+	if !zset.send("ZREM", member) {
+		_, err = zset.do("ZREM", member)
+	}
+	L.Push(lua.LBool(err == nil))
+	return 1 // Number of returned values
+}
+
+// The sorted set methods that are to be registered
+var zsetMethods = map[string]lua.LGFunction{
+	"__tostring":   zsetToString,
+	"add":          zsetAdd,
+	"score":        zsetScore,
+	"rank":         zsetRank,
+	"range":        zsetRange,
+	"rangebyscore": zsetRangeByScore,
+	"remove":       zsetRemove,
+}
+
+// LoadSortedSet makes the SortedSet constructor available to Lua scripts.
+// Sorted sets can only be created when Redis is the database backend.
+func LoadSortedSet(L *lua.LState) {
+
+	// Register the sorted set class and the methods that belongs with it.
+	mt := L.NewTypeMetatable(lSortedSetClass)
+	mt.RawSetH(lua.LString("__index"), mt)
+	L.SetFuncs(mt, pipelineMethods(zsetMethods, "add", "remove"))
+
+	// The constructor for new sorted sets takes a name and an optional redis db index
+	L.SetGlobal("SortedSet", L.NewFunction(func(L *lua.LState) int {
+		name := L.CheckString(1)
+
+		// Check if the optional argument is given
+		if L.GetTop() == 2 {
+			selectRedisDatabase(L, L.ToInt(2))
+		}
+
+		// Create a new sorted set in Lua
+		userdata, err := newSortedSet(L, name)
+		if err != nil {
+			L.Push(lua.LNil)
+			L.Push(lua.LString(err.Error()))
+			L.Push(lua.LNumber(1))
+			return 3 // Number of returned values
+		}
+
+		// Return the sorted set object
+		L.Push(userdata)
+		return 1 // Number of returned values
+	}))
+
+}
@@ -0,0 +1,84 @@
+package datastruct
+
+import (
+	"testing"
+
+	"github.com/bmizerany/assert"
+	"github.com/xyproto/gopher-lua"
+)
+
+func TestSortedSetLeaderboard(t *testing.T) {
+	L, _ := newRedisTestState(t)
+	defer L.Close()
+
+	err := L.DoString(`
+		local scores = SortedSet("leaderboard")
+		assert(scores:add("alice", 120))
+		assert(scores:add("bob", 95))
+		assert(scores:add("carol", 150))
+		assert(scores:add("dave", 80))
+		assert(scores:add("eve", 110.5))
+
+		-- Top 3, with the highest score first
+		assert(table.concat(scores:range(0, 2, true), ",") == "carol,alice,eve")
+		-- Lowest score first
+		assert(table.concat(scores:range(0, -1), ",") == "dave,bob,eve,alice,carol")
+
+		assert(scores:rank("carol", true) == 0)
+		assert(scores:rank("alice", true) == 1)
+		assert(scores:rank("dave") == 0)
+		assert(scores:rank("nobody") == nil)
+
+		assert(scores:score("eve") == 110.5)
+		assert(scores:score("nobody") == nil)
+
+		-- Updating a score moves the member
+		assert(scores:add("dave", 200))
+		assert(scores:rank("dave", true) == 0)
+		assert(scores:score("dave") == 200)
+
+		assert(table.concat(scores:rangebyscore(100, 150), ",") == "eve,alice,carol")
+		assert(table.concat(scores:rangebyscore("(110.5", "+inf"), ",") == "alice,carol,dave")
+
+		assert(scores:remove("carol"))
+		assert(scores:rank("carol") == nil)
+		assert(table.concat(scores:range(0, 1, true), ",") == "dave,alice")
+		assert(tostring(scores) == "leaderboard")
+	`)
+	assert.Equal(t, err, nil)
+}
+
+func TestSortedSetPipeline(t *testing.T) {
+	L, fr := newRedisTestState(t)
+	defer L.Close()
+
+	err := L.DoString(`
+		local feed = SortedSet("feed")
+		assert(pipeline(function()
+			for i = 1, 10 do
+				feed:add("post " .. i, i)
+			end
+			-- Methods that return data send the buffered commands first
+			assert(feed:score("post 10") == 10)
+			feed:remove("post 1")
+		end))
+		assert(table.concat(feed:range(0, 2, true), ",") == "post 10,post 9,post 8")
+	`)
+	assert.Equal(t, err, nil)
+	fr.mut.Lock()
+	defer fr.mut.Unlock()
+	assert.Equal(t, len(fr.zsets["feed"]), 9)
+}
+
+func TestSortedSetWithoutRedis(t *testing.T) {
+	L := lua.NewState()
+	defer L.Close()
+	LoadSortedSet(L)
+
+	err := L.DoString(`
+		local scores, err = SortedSet("leaderboard")
+		assert(scores == nil)
+		assert(string.find(err, "require Redis"))
+	`)
+	assert.Equal(t, err, nil)
+}
@@ -0,0 +1,108 @@
+// Package httpclient provides Lua functions for sending HTTP requests
+package httpclient
+
+import (
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/xyproto/gopher-lua"
+)
+
+// DefaultTimeout is the default timeout for sending a request and reading
+// the response
+const DefaultTimeout = 10 * time.Second
+
+// Request is an outgoing HTTP request
+type Request struct {
+	Method  string        // GET if empty
+	URL     string        // absolute URL
+	Header  http.Header   // may be nil
+	Body    string        // may be empty
+	Timeout time.Duration // 0 is no timeout
+}
+
+// Do sends the request and returns the response body and status code
+func (r *Request) Do() (string, int, error) {
+	method := r.Method
+	if method == "" {
+		method = "GET"
+	}
+	req, err := http.NewRequest(strings.ToUpper(method), r.URL, strings.NewReader(r.Body))
+	if err != nil {
+		return "", 0, err
+	}
+	for key, values := range r.Header {
+		req.Header[key] = values
+	}
+	client := &http.Client{Timeout: r.Timeout}
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", 0, err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", resp.StatusCode, err
+	}
+	return string(body), resp.StatusCode, nil
+}
+
+// newRequest creates a request from a Lua table with the fields "method",
+// "url", "headers", "body" and "timeout" (in seconds). Only "url" is required.
+func newRequest(table *lua.LTable, timeout time.Duration) *Request {
+	r := &Request{
+		Method:  lua.LVAsString(table.RawGetString("method")),
+		URL:     lua.LVAsString(table.RawGetString("url")),
+		Body:    lua.LVAsString(table.RawGetString("body")),
+		Timeout: timeout,
+	}
+	if headers, ok := table.RawGetString("headers").(*lua.LTable); ok {
+		r.Header = make(http.Header)
+		headers.ForEach(func(key, value lua.LValue) {
+			r.Header.Add(key.String(), value.String())
+		})
+	}
+	if seconds, ok := table.RawGetString("timeout").(lua.LNumber); ok {
+		r.Timeout = time.Duration(float64(seconds) * float64(time.Second))
+	}
+	return r
+}
+
+// pushResponse pushes the response body and status code to the Lua stack,
+// or an empty string, the status code (0 if there was no response) and an
+// error message
+func pushResponse(L *lua.LState, body string, statusCode int, err error) int {
+	L.Push(lua.LString(body))
+	L.Push(lua.LNumber(statusCode))
+	if err != nil {
+		L.Push(lua.LString(err.Error()))
+		return 3 // number of results
+	}
+	return 2 // number of results
+}
+
+// Load makes functions for sending HTTP requests available to the given Lua
+// state. The given timeout is used unless a request specifies another one.
+func Load(L *lua.LState, timeout time.Duration) {
+
+	// Send a GET request to the given URL.
+	// Returns the response body and status code, and an error message if
+	// the request failed.
+	L.SetGlobal("HTTPGet", L.NewFunction(func(L *lua.LState) int {
+		r := &Request{URL: L.CheckString(1), Timeout: timeout}
+		body, statusCode, err := r.Do()
+		return pushResponse(L, body, statusCode, err)
+	}))
+
+	// Send a HTTP request, given a table with the fields "method", "url",
+	// "headers", "body" and "timeout" (in seconds).
+	// Returns the response body and status code, and an error message if
+	// the request failed.
+	L.SetGlobal("HTTPRequest", L.NewFunction(func(L *lua.LState) int {
+		body, statusCode, err := newRequest(L.CheckTable(1), timeout).Do()
+		return pushResponse(L, body, statusCode, err)
+	}))
+
+}
@@ -0,0 +1,82 @@
+package httpclient
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/bmizerany/assert"
+	"github.com/xyproto/gopher-lua"
+)
+
+func newTestServer() *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		switch req.URL.Path {
+		case "/echo":
+			body, _ := ioutil.ReadAll(req.Body)
+			fmt.Fprintf(w, "%s %s %s", req.Method, req.Header.Get("X-Test"), body)
+		case "/slow":
+			time.Sleep(500 * time.Millisecond)
+			fmt.Fprint(w, "too late")
+		default:
+			http.Error(w, "not here", http.StatusNotFound)
+		}
+	}))
+}
+
+func TestHTTPGet(t *testing.T) {
+	server := newTestServer()
+	defer server.Close()
+
+	L := lua.NewState()
+	defer L.Close()
+	Load(L, 100*time.Millisecond)
+	L.SetGlobal("url", lua.LString(server.URL))
+
+	err := L.DoString(`
+		local body, code, err = HTTPGet(url .. "/echo")
+		assert(body == "GET  " and code == 200 and err == nil)
+
+		-- Not found is not an error
+		body, code, err = HTTPGet(url .. "/missing")
+		assert(body == "not here\n" and code == 404 and err == nil)
+
+		-- Too slow
+		body, code, err = HTTPGet(url .. "/slow")
+		assert(body == "" and code == 0 and err ~= nil)
+	`)
+	assert.Equal(t, err, nil)
+}
+
+func TestHTTPRequest(t *testing.T) {
+	server := newTestServer()
+	defer server.Close()
+
+	L := lua.NewState()
+	defer L.Close()
+	Load(L, 100*time.Millisecond)
+	L.SetGlobal("url", lua.LString(server.URL))
+
+	err := L.DoString(`
+		local body, code, err = HTTPRequest({
+			method = "post",
+			url = url .. "/echo",
+			headers = {["X-Test"] = "yes"},
+			body = "hello",
+		})
+		assert(body == "POST yes hello" and code == 200 and err == nil)
+
+		-- The default timeout can be changed per request
+		body, code, err = HTTPRequest({url = url .. "/slow", timeout = 2})
+		assert(body == "too late" and code == 200 and err == nil)
+		body, code, err = HTTPRequest({url = url .. "/slow", timeout = 0.1})
+		assert(code == 0 and err ~= nil)
+
+		body, code, err = HTTPRequest({url = "not a url"})
+		assert(code == 0 and err ~= nil)
+	`)
+	assert.Equal(t, err, nil)
+}
@@ -377,6 +377,16 @@ func Load(L *lua.LState) {
 
 }
 
+// Decode converts the given JSON data to a Lua value. Objects become tables
+// with string keys and arrays become tables with indices starting at 1.
+func Decode(L *lua.LState, data []byte) (lua.LValue, error) {
+	var value interface{}
+	if err := json.Unmarshal(data, &value); err != nil {
+		return lua.LNil, err
+	}
+	return convert.Interface2value(L, value), nil
+}
+
 // LoadJSONFunctions makes helper functions for converting to JSON available
 func LoadJSONFunctions(L *lua.LState) {
 
@@ -397,12 +407,14 @@ func LoadJSONFunctions(L *lua.LState) {
 		// Convert the Lua table to a map that can be used when converting to JSON (map[string]interface{})
 		mapinterface := convert.Table2interfaceMap(table)
 
-		// If an optional argument is supplied, indent the given number of spaces
+		// If an optional argument is supplied, indent with the given string
+		// or the given number of spaces. The keys of maps are always sorted.
 		if L.GetTop() == 2 {
-			indentLevel := L.ToInt(2)
-			indentString := ""
-			for i := 0; i < indentLevel; i++ {
-				indentString += " "
+			var indentString string
+			if s, ok := L.Get(2).(lua.LString); ok {
+				indentString = string(s)
+			} else {
+				indentString = strings.Repeat(" ", L.ToInt(2))
 			}
 			b, err = json.MarshalIndent(mapinterface, indentPrefix, indentString)
 		} else {
@@ -422,4 +434,18 @@ func LoadJSONFunctions(L *lua.LState) {
 	L.SetGlobal("toJSON", toJSON) // Alias for backward compatibility
 	L.SetGlobal("ToJSON", toJSON) // Alias for backward compatibility
 
+	// Convert JSON to a table. Objects become tables with string keys and
+	// arrays become tables with indices starting at 1. Returns nil and an
+	// error message if the JSON could not be decoded.
+	L.SetGlobal("JSONDecode", L.NewFunction(func(L *lua.LState) int {
+		value, err := Decode(L, []byte(L.CheckString(1)))
+		if err != nil {
+			L.Push(lua.LNil)
+			L.Push(lua.LString(err.Error()))
+			return 2 // number of results
+		}
+		L.Push(value)
+		return 1 // number of results
+	}))
+
 }
@@ -0,0 +1,73 @@
+package jnode
+
+import (
+	"testing"
+
+	"github.com/bmizerany/assert"
+	"github.com/xyproto/gopher-lua"
+)
+
+func TestJSONDecode(t *testing.T) {
+	L := lua.NewState()
+	defer L.Close()
+	LoadJSONFunctions(L)
+
+	err := L.DoString(`
+		local t = JSONDecode('{"name": "algernon", "tags": ["a", "b"], "count": 3, "ok": true, "none": null, "nested": {"x": 1.5}}')
+		assert(t.name == "algernon")
+		assert(#t.tags == 2 and t.tags[1] == "a" and t.tags[2] == "b")
+		assert(t.count == 3)
+		assert(t.ok == true)
+		assert(t.none == nil)
+		assert(t.nested.x == 1.5)
+
+		-- Arrays are indexed from 1, and null leaves a hole
+		local a = JSONDecode('[10, null, 30]')
+		assert(a[1] == 10 and a[2] == nil and a[3] == 30)
+
+		-- Other values than objects and arrays
+		assert(JSONDecode('"hello"') == "hello")
+		assert(JSONDecode('42') == 42)
+
+		local value, err = JSONDecode('{"name": ')
+		assert(value == nil and err ~= nil)
+	`)
+	assert.Equal(t, err, nil)
+}
+
+func TestJSONRoundTrip(t *testing.T) {
+	L := lua.NewState()
+	defer L.Close()
+	LoadJSONFunctions(L)
+
+	err := L.DoString(`
+		local original = {name = "algernon", version = 2, nested = {key = "value"}}
+		local t = JSONDecode(JSON(original))
+		assert(t.name == "algernon" and t.version == 2)
+		assert(t.nested.key == "value")
+
+		local s = '{"a":"b","c":{"d":"e"}}'
+		assert(JSON(JSONDecode(s)) == s)
+	`)
+	assert.Equal(t, err, nil)
+}
+
+func TestJSONIndent(t *testing.T) {
+	L := lua.NewState()
+	defer L.Close()
+	LoadJSONFunctions(L)
+
+	err := L.DoString(`
+		local t = {b = "2", a = "1", c = {d = "x"}}
+
+		-- Compact, with sorted keys
+		assert(JSON(t) == '{"a":"1","b":"2","c":{"d":"x"}}')
+
+		-- Indented with a number of spaces
+		assert(JSON(t, 2) == '{\n  "a": "1",\n  "b": "2",\n  "c": {\n    "d": "x"\n  }\n}')
+
+		-- Indented with a string
+		assert(JSON(t, "\t") == '{\n\t"a": "1",\n\t"b": "2",\n\t"c": {\n\t\t"d": "x"\n\t}\n}')
+	`)
+	assert.Equal(t, err, nil)
+}
@@ -0,0 +1,164 @@
+// Package passwords provides Lua functions for hashing and verifying passwords
+package passwords
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/xyproto/gopher-lua"
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Argon2Params are the parameters used when hashing with Argon2id.
+// They are encoded in the resulting hash string, so that they can be
+// changed later on without breaking the verification of existing hashes.
+type Argon2Params struct {
+	Memory     uint32 // memory use, in KiB
+	Time       uint32 // number of passes over the memory
+	Threads    uint8  // number of threads
+	SaltLength uint32 // length of the random salt, in bytes
+	KeyLength  uint32 // length of the derived key, in bytes
+}
+
+// DefaultArgon2Params are the parameters used by argon2hash, as recommended
+// for Argon2id in RFC 9106 (with 64 MiB of memory)
+var DefaultArgon2Params = Argon2Params{
+	Memory:     64 * 1024,
+	Time:       3,
+	Threads:    4,
+	SaltLength: 16,
+	KeyLength:  32,
+}
+
+var (
+	errInvalidHash         = errors.New("the encoded hash is not an Argon2id hash")
+	errIncompatibleVersion = errors.New("incompatible version of Argon2")
+)
+
+// b64 is the base64 encoding used for the salt and key in the encoded hash
+var b64 = base64.RawStdEncoding
+
+// Argon2Hash hashes the given password with Argon2id and a random salt.
+// Returns the hash in the "$argon2id$v=19$m=65536,t=3,p=4$salt$key" format.
+func Argon2Hash(password string, params Argon2Params) (string, error) {
+	salt := make([]byte, params.SaltLength)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+	key := argon2.IDKey([]byte(password), salt, params.Time, params.Memory, params.Threads, params.KeyLength)
+	return fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s", argon2.Version, params.Memory, params.Time, params.Threads, b64.EncodeToString(salt), b64.EncodeToString(key)), nil
+}
+
+// DecodeArgon2Hash retrieves the parameters, salt and key from an encoded hash
+func DecodeArgon2Hash(encodedHash string) (Argon2Params, []byte, []byte, error) {
+	var params Argon2Params
+	fields := strings.Split(encodedHash, "$")
+	if len(fields) != 6 || fields[0] != "" || fields[1] != "argon2id" {
+		return params, nil, nil, errInvalidHash
+	}
+	var version int
+	if _, err := fmt.Sscanf(fields[2], "v=%d", &version); err != nil {
+		return params, nil, nil, errInvalidHash
+	}
+	if version != argon2.Version {
+		return params, nil, nil, errIncompatibleVersion
+	}
+	if _, err := fmt.Sscanf(fields[3], "m=%d,t=%d,p=%d", &params.Memory, &params.Time, &params.Threads); err != nil {
+		return params, nil, nil, errInvalidHash
+	}
+	if params.Time == 0 || params.Threads == 0 {
+		return params, nil, nil, errInvalidHash
+	}
+	salt, err := b64.DecodeString(fields[4])
+	if err != nil {
+		return params, nil, nil, errInvalidHash
+	}
+	key, err := b64.DecodeString(fields[5])
+	if err != nil || len(key) == 0 {
+		return params, nil, nil, errInvalidHash
+	}
+	params.SaltLength = uint32(len(salt))
+	params.KeyLength = uint32(len(key))
+	return params, salt, key, nil
+}
+
+// Argon2Verify checks if the given password matches the encoded Argon2id hash,
+// using the parameters that are encoded in the hash
+func Argon2Verify(password, encodedHash string) (bool, error) {
+	params, salt, key, err := DecodeArgon2Hash(encodedHash)
+	if err != nil {
+		return false, err
+	}
+	otherKey := argon2.IDKey([]byte(password), salt, params.Time, params.Memory, params.Threads, params.KeyLength)
+	return subtle.ConstantTimeCompare(key, otherKey) == 1, nil
+}
+
+// BcryptMatch checks if the given password matches the given bcrypt hash.
+// Returns false if the hash is malformed.
+func BcryptMatch(password, hash string) bool {
+	return bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) == nil
+}
+
+// Load makes functions for hashing and verifying passwords available to the
+// given Lua state: argon2hash, argon2verify, bcrypt and bcryptMatch
+func Load(L *lua.LState) {
+
+	// Hash a password with Argon2id. Returns the encoded hash, or nil and an
+	// error message.
+	L.SetGlobal("argon2hash", L.NewFunction(func(L *lua.LState) int {
+		password := L.CheckString(1)
+		encodedHash, err := Argon2Hash(password, DefaultArgon2Params)
+		if err != nil {
+			L.Push(lua.LNil)
+			L.Push(lua.LString(err.Error()))
+			return 2 // number of results
+		}
+		L.Push(lua.LString(encodedHash))
+		return 1 // number of results
+	}))
+
+	// Check a password against an Argon2id hash. Returns true if it matches.
+	// Returns false and an error message if the hash could not be decoded.
+	L.SetGlobal("argon2verify", L.NewFunction(func(L *lua.LState) int {
+		password := L.CheckString(1)
+		encodedHash := L.CheckString(2)
+		ok, err := Argon2Verify(password, encodedHash)
+		if err != nil {
+			L.Push(lua.LBool(false))
+			L.Push(lua.LString(err.Error()))
+			return 2 // number of results
+		}
+		L.Push(lua.LBool(ok))
+		return 1 // number of results
+	}))
+
+	// Hash a password with bcrypt, with an optional cost (the default is 10).
+	// Returns the hash, or nil and an error message.
+	L.SetGlobal("bcrypt", L.NewFunction(func(L *lua.LState) int {
+		password := L.CheckString(1)
+		cost := L.OptInt(2, bcrypt.DefaultCost)
+		hash, err := bcrypt.GenerateFromPassword([]byte(password), cost)
+		if err != nil {
+			L.Push(lua.LNil)
+			L.Push(lua.LString(err.Error()))
+			return 2 // number of results
+		}
+		L.Push(lua.LString(hash))
+		return 1 // number of results
+	}))
+
+	// Check a password against a bcrypt hash. Returns true if it matches, and
+	// false if it does not match or if the hash is malformed.
+	L.SetGlobal("bcryptMatch", L.NewFunction(func(L *lua.LState) int {
+		password := L.CheckString(1)
+		hash := L.CheckString(2)
+		L.Push(lua.LBool(BcryptMatch(password, hash)))
+		return 1 // number of results
+	}))
+
+}
@@ -0,0 +1,97 @@
+package passwords
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/bmizerany/assert"
+	"github.com/xyproto/gopher-lua"
+)
+
+// Use cheap parameters, to keep the tests fast
+var testParams = Argon2Params{
+	Memory:     1024,
+	Time:       2,
+	Threads:    1,
+	SaltLength: 8,
+	KeyLength:  16,
+}
+
+func TestArgon2HashVerify(t *testing.T) {
+	encodedHash, err := Argon2Hash("hunter2", testParams)
+	assert.Equal(t, err, nil)
+	assert.Equal(t, strings.HasPrefix(encodedHash, "$argon2id$v=19$m=1024,t=2,p=1$"), true)
+
+	ok, err := Argon2Verify("hunter2", encodedHash)
+	assert.Equal(t, err, nil)
+	assert.Equal(t, ok, true)
+
+	ok, err = Argon2Verify("hunter3", encodedHash)
+	assert.Equal(t, err, nil)
+	assert.Equal(t, ok, false)
+
+	// The same password and a new salt gives a different hash
+	otherHash, err := Argon2Hash("hunter2", testParams)
+	assert.Equal(t, err, nil)
+	assert.NotEqual(t, encodedHash, otherHash)
+}
+
+func TestArgon2Params(t *testing.T) {
+	encodedHash, err := Argon2Hash("secret", testParams)
+	assert.Equal(t, err, nil)
+
+	// The parameters round-trip through the encoded hash
+	params, salt, key, err := DecodeArgon2Hash(encodedHash)
+	assert.Equal(t, err, nil)
+	assert.Equal(t, params, testParams)
+	assert.Equal(t, len(salt), 8)
+	assert.Equal(t, len(key), 16)
+
+	_, _, _, err = DecodeArgon2Hash("$2a$10$notanargon2hash")
+	assert.Equal(t, err, errInvalidHash)
+
+	_, _, _, err = DecodeArgon2Hash("$argon2id$v=16$m=1024,t=2,p=1$c2FsdA$a2V5")
+	assert.Equal(t, err, errIncompatibleVersion)
+}
+
+func TestLuaArgon2(t *testing.T) {
+	L := lua.NewState()
+	defer L.Close()
+	Load(L)
+
+	err := L.DoString(`
+		local hash = argon2hash("hunter2")
+		assert(hash:sub(1, 31) == "$argon2id$v=19$m=65536,t=3,p=4$")
+		assert(argon2verify("hunter2", hash))
+		assert(not argon2verify("hunter3", hash))
+		local ok, err = argon2verify("hunter2", "not a hash")
+		assert(not ok and err ~= nil)
+	`)
+	assert.Equal(t, err, nil)
+}
+
+func TestLuaBcrypt(t *testing.T) {
+	L := lua.NewState()
+	defer L.Close()
+	Load(L)
+
+	err := L.DoString(`
+		-- Use the lowest cost, to keep the test fast
+		local hash = bcrypt("hunter2", 4)
+		assert(hash:sub(1, 7) == "$2a$04$")
+		assert(bcryptMatch("hunter2", hash))
+		assert(not bcryptMatch("hunter3", hash))
+
+		-- The hash is salted
+		assert(bcrypt("hunter2", 4) ~= hash)
+
+		-- A malformed hash does not match
+		assert(not bcryptMatch("hunter2", "not a hash"))
+		assert(not bcryptMatch("hunter2", ""))
+
+		-- An invalid cost
+		local hash, err = bcrypt("hunter2", 100)
+		assert(hash == nil and err ~= nil)
+	`)
+	assert.Equal(t, err, nil)
+}
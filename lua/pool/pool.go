@@ -14,11 +14,71 @@ import (
 type LStatePool struct {
 	m     sync.Mutex
 	saved []*lua.LState
+	// The generation of the pool is increased when the pool is cleared.
+	// Lua states that were borrowed in an earlier generation are not
+	// returned to the pool.
+	generation uint64
+	borrowed   map[*lua.LState]uint64
+	// The maximum number of Lua states, 0 is unlimited. When all of them are
+	// borrowed, Get either waits for one to be returned (block), or creates
+	// a new Lua state that is discarded when it is returned.
+	size     int
+	block    bool
+	returned *sync.Cond // signalled when a Lua state is returned
 }
 
-// New returns a new Lua pool structure
+// Stats contains statistics about a Lua state pool
+type Stats struct {
+	InUse int  // number of borrowed Lua states
+	Idle  int  // number of Lua states that are ready to be borrowed
+	Size  int  // maximum number of Lua states, 0 is unlimited
+	Block bool // if Get waits when all Lua states are borrowed
+}
+
+// New returns a new Lua pool structure, with no limit on the number of Lua states
 func New() *LStatePool {
-	return &LStatePool{saved: make([]*lua.LState, 0, 4)}
+	pl := &LStatePool{saved: make([]*lua.LState, 0, 4), borrowed: make(map[*lua.LState]uint64)}
+	pl.returned = sync.NewCond(&pl.m)
+	return pl
+}
+
+// SetSize sets the maximum number of Lua states, where 0 is unlimited.
+// If block is true, Get waits for a Lua state to be returned when all of them
+// are borrowed. If not, Get creates a new Lua state that is not kept in the
+// pool when it is returned.
+func (pl *LStatePool) SetSize(size int, block bool) {
+	pl.m.Lock()
+	defer pl.m.Unlock()
+	if size < 0 {
+		size = 0
+	}
+	pl.size = size
+	pl.block = block
+	if size > 0 {
+		// Drop the idle Lua states that no longer fit
+		keep := size - len(pl.borrowed)
+		if keep < 0 {
+			keep = 0
+		}
+		if len(pl.saved) > keep {
+			pl.saved = pl.saved[:keep]
+		}
+	}
+	// The waiting Get calls may be able to continue
+	pl.returned.Broadcast()
+}
+
+// Stats returns the current number of borrowed and idle Lua states,
+// together with the configured size
+func (pl *LStatePool) Stats() Stats {
+	pl.m.Lock()
+	defer pl.m.Unlock()
+	return Stats{InUse: len(pl.borrowed), Idle: len(pl.saved), Size: pl.size, Block: pl.block}
+}
+
+// full checks if all Lua states are borrowed and no more may be created
+func (pl *LStatePool) full() bool {
+	return pl.block && pl.size > 0 && len(pl.saved) == 0 && len(pl.borrowed) >= pl.size
 }
 
 // New returns a new Lua state
@@ -33,12 +93,18 @@ func (pl *LStatePool) New() *lua.LState {
 func (pl *LStatePool) Get() *lua.LState {
 	pl.m.Lock()
 	defer pl.m.Unlock()
+	for pl.full() {
+		pl.returned.Wait()
+	}
 	n := len(pl.saved)
+	var x *lua.LState
 	if n == 0 {
-		return pl.New()
+		x = pl.New()
+	} else {
+		x = pl.saved[n-1]
+		pl.saved = pl.saved[0 : n-1]
 	}
-	x := pl.saved[n-1]
-	pl.saved = pl.saved[0 : n-1]
+	pl.borrowed[x] = pl.generation
 	return x
 }
 
@@ -46,9 +112,30 @@ func (pl *LStatePool) Get() *lua.LState {
 func (pl *LStatePool) Put(L *lua.LState) {
 	pl.m.Lock()
 	defer pl.m.Unlock()
+	generation, ok := pl.borrowed[L]
+	delete(pl.borrowed, L)
+	pl.returned.Signal()
+	if ok && generation != pl.generation {
+		// Borrowed before the pool was cleared
+		return
+	}
+	if pl.size > 0 && len(pl.saved)+len(pl.borrowed) >= pl.size {
+		// Created while the pool was exhausted, or the pool has shrunk
+		return
+	}
 	pl.saved = append(pl.saved, L)
 }
 
+// Clear removes all Lua states from the pool, so that new Lua states are
+// used for the next scripts. Lua states that are borrowed when the pool is
+// cleared are not returned to the pool.
+func (pl *LStatePool) Clear() {
+	pl.m.Lock()
+	defer pl.m.Unlock()
+	pl.saved = pl.saved[:0]
+	pl.generation++
+}
+
 // Shutdown can be used then the Lua pool is being shut down
 func (pl *LStatePool) Shutdown() {
 	// The following line causes a race condition with the
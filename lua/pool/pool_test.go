@@ -0,0 +1,142 @@
+package pool
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/bmizerany/assert"
+	"github.com/xyproto/gopher-lua"
+)
+
+// useConcurrently borrows and returns Lua states from many goroutines, and
+// returns the highest number of Lua states that were borrowed at once.
+// Fails if the goroutines do not finish within a few seconds.
+func useConcurrently(t *testing.T, pl *LStatePool) int {
+	var (
+		wg       sync.WaitGroup
+		inUse    int32
+		maxInUse int32
+	)
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 20; j++ {
+				L := pl.Get()
+				n := atomic.AddInt32(&inUse, 1)
+				for {
+					max := atomic.LoadInt32(&maxInUse)
+					if n <= max || atomic.CompareAndSwapInt32(&maxInUse, max, n) {
+						break
+					}
+				}
+				if err := L.DoString(`x = (x or 0) + 1`); err != nil {
+					t.Error(err)
+				}
+				atomic.AddInt32(&inUse, -1)
+				pl.Put(L)
+			}
+		}()
+	}
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatal("deadlock: the Lua states were not returned in time")
+	}
+	return int(maxInUse)
+}
+
+func TestBlockingPool(t *testing.T) {
+	pl := New()
+	pl.SetSize(2, true)
+	maxInUse := useConcurrently(t, pl)
+	assert.Equal(t, maxInUse <= 2, true)
+
+	// All Lua states have been returned, and no more than 2 are kept
+	stats := pl.Stats()
+	assert.Equal(t, stats.InUse, 0)
+	assert.Equal(t, stats.Idle <= 2, true)
+	assert.Equal(t, stats.Size, 2)
+	assert.Equal(t, stats.Block, true)
+}
+
+func TestGrowingPool(t *testing.T) {
+	pl := New()
+	pl.SetSize(2, false)
+	useConcurrently(t, pl)
+
+	// The extra Lua states are not kept
+	stats := pl.Stats()
+	assert.Equal(t, stats.InUse, 0)
+	assert.Equal(t, stats.Idle <= 2, true)
+}
+
+func TestBlockingGet(t *testing.T) {
+	pl := New()
+	pl.SetSize(1, true)
+	L := pl.Get()
+
+	got := make(chan *lua.LState)
+	go func() {
+		got <- pl.Get()
+	}()
+	select {
+	case <-got:
+		t.Fatal("Get should wait while the only Lua state is borrowed")
+	case <-time.After(50 * time.Millisecond):
+	}
+	assert.Equal(t, pl.Stats().InUse, 1)
+
+	// Returning the Lua state lets the waiting Get continue with it
+	pl.Put(L)
+	select {
+	case L2 := <-got:
+		assert.Equal(t, L2, L)
+	case <-time.After(5 * time.Second):
+		t.Fatal("Get did not continue after the Lua state was returned")
+	}
+}
+
+func TestSetSizeWakesWaiting(t *testing.T) {
+	pl := New()
+	pl.SetSize(1, true)
+	pl.Get()
+
+	got := make(chan *lua.LState)
+	go func() {
+		got <- pl.Get()
+	}()
+	time.Sleep(20 * time.Millisecond)
+
+	// Allowing the pool to grow lets the waiting Get create a new Lua state
+	pl.SetSize(1, false)
+	select {
+	case L := <-got:
+		assert.NotEqual(t, L, nil)
+	case <-time.After(5 * time.Second):
+		t.Fatal("Get did not continue after the pool was allowed to grow")
+	}
+	assert.Equal(t, pl.Stats().InUse, 2)
+}
+
+func TestClearWhileBorrowed(t *testing.T) {
+	pl := New()
+	pl.SetSize(1, true)
+	L := pl.Get()
+	pl.Clear()
+	pl.Put(L)
+
+	// The Lua state from before the pool was cleared is not reused,
+	// but the pool is not exhausted either
+	stats := pl.Stats()
+	assert.Equal(t, stats.InUse, 0)
+	assert.Equal(t, stats.Idle, 0)
+	assert.NotEqual(t, pl.Get(), L)
+}
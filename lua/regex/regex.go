@@ -0,0 +1,109 @@
+// Package regex provides Lua functions for using regular expressions
+package regex
+
+import (
+	"regexp"
+	"sync"
+
+	"github.com/xyproto/gopher-lua"
+)
+
+// maxCached is the maximum number of compiled regular expressions to keep
+const maxCached = 256
+
+var (
+	cache      = make(map[string]*regexp.Regexp)
+	cacheMutex sync.RWMutex
+)
+
+// compile returns the compiled regular expression for the given pattern.
+// Compiled regular expressions are cached, so that patterns that are used
+// in a loop are only compiled once.
+func compile(pattern string) (*regexp.Regexp, error) {
+	cacheMutex.RLock()
+	re, ok := cache[pattern]
+	cacheMutex.RUnlock()
+	if ok {
+		return re, nil
+	}
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, err
+	}
+	cacheMutex.Lock()
+	if len(cache) >= maxCached {
+		// Start over, instead of keeping track of which patterns are in use
+		cache = make(map[string]*regexp.Regexp)
+	}
+	cache[pattern] = re
+	cacheMutex.Unlock()
+	return re, nil
+}
+
+// checkRegexp compiles the pattern given as the first argument. If the
+// pattern is invalid, the given failure value and an error message are
+// pushed to the stack and false is returned.
+func checkRegexp(L *lua.LState, failure lua.LValue) (*regexp.Regexp, bool) {
+	re, err := compile(L.CheckString(1))
+	if err != nil {
+		L.Push(failure)
+		L.Push(lua.LString(err.Error()))
+		return nil, false
+	}
+	return re, true
+}
+
+// Load makes functions for matching, finding and replacing with regular
+// expressions available to the given Lua state
+func Load(L *lua.LState) {
+
+	// Check if the given string matches the given regular expression.
+	// Returns false and an error message if the pattern is invalid.
+	L.SetGlobal("regexMatch", L.NewFunction(func(L *lua.LState) int {
+		re, ok := checkRegexp(L, lua.LFalse)
+		if !ok {
+			return 2 // number of results
+		}
+		L.Push(lua.LBool(re.MatchString(L.CheckString(2))))
+		return 1 // number of results
+	}))
+
+	// Find the first match of the given regular expression in the given
+	// string. Returns a table with the captured groups, or with the whole
+	// match if the pattern has no groups. Returns nil if there is no match,
+	// or nil and an error message if the pattern is invalid.
+	L.SetGlobal("regexFind", L.NewFunction(func(L *lua.LState) int {
+		re, ok := checkRegexp(L, lua.LNil)
+		if !ok {
+			return 2 // number of results
+		}
+		matches := re.FindStringSubmatch(L.CheckString(2))
+		if matches == nil {
+			L.Push(lua.LNil)
+			return 1 // number of results
+		}
+		if len(matches) > 1 {
+			// Only return the groups
+			matches = matches[1:]
+		}
+		table := L.CreateTable(len(matches), 0)
+		for i, match := range matches {
+			table.RawSetInt(i+1, lua.LString(match))
+		}
+		L.Push(table)
+		return 1 // number of results
+	}))
+
+	// Replace all matches of the given regular expression in the given
+	// string. The replacement may refer to groups with $1, $2 or ${name}.
+	// Returns nil and an error message if the pattern is invalid.
+	L.SetGlobal("regexReplace", L.NewFunction(func(L *lua.LState) int {
+		re, ok := checkRegexp(L, lua.LNil)
+		if !ok {
+			return 2 // number of results
+		}
+		L.Push(lua.LString(re.ReplaceAllString(L.CheckString(2), L.CheckString(3))))
+		return 1 // number of results
+	}))
+
+}
@@ -0,0 +1,57 @@
+package regex
+
+import (
+	"testing"
+
+	"github.com/bmizerany/assert"
+	"github.com/xyproto/gopher-lua"
+)
+
+func TestLuaRegex(t *testing.T) {
+	L := lua.NewState()
+	defer L.Close()
+	Load(L)
+
+	err := L.DoString(`
+		-- Matching
+		assert(regexMatch("^[a-z]+@[a-z]+\\.com$", "bob@example.com"))
+		assert(not regexMatch("^[a-z]+$", "Bob"))
+
+		-- Capturing groups
+		local groups = regexFind("(\\d{4})-(\\d{2})-(\\d{2})", "Released on 2018-06-01.")
+		assert(#groups == 3 and groups[1] == "2018" and groups[2] == "06" and groups[3] == "01")
+		local found = regexFind("\\d+", "abc 123 456")
+		assert(#found == 1 and found[1] == "123")
+		assert(regexFind("\\d+", "abc") == nil)
+
+		-- Replacing, with backreferences
+		assert(regexReplace("(\\w+)@(\\w+)", "bob@example alice@test", "$2:$1") == "example:bob test:alice")
+		assert(regexReplace("(?P<first>\\w+) (?P<last>\\w+)", "Ada Lovelace", "${last}, ${first}") == "Lovelace, Ada")
+		assert(regexReplace("x", "abc", "y") == "abc")
+
+		-- Invalid patterns
+		local ok, err = regexMatch("(", "abc")
+		assert(ok == false and err ~= nil)
+		local result, err = regexFind("[", "abc")
+		assert(result == nil and err ~= nil)
+		result, err = regexReplace("*", "abc", "")
+		assert(result == nil and err ~= nil)
+	`)
+	assert.Equal(t, err, nil)
+}
+
+func TestCompileCache(t *testing.T) {
+	re1, err := compile("a+b")
+	assert.Equal(t, err, nil)
+	re2, err := compile("a+b")
+	assert.Equal(t, err, nil)
+	// The same compiled regular expression is returned
+	assert.Equal(t, re1 == re2, true)
+
+	// The cache does not grow without bounds
+	for i := 0; i < maxCached*2; i++ {
+		_, err := compile(string(rune('a'+i%26)) + "{" + string(rune('0'+i%10)) + "}" + string(rune('A'+i/26)))
+		assert.Equal(t, err, nil)
+	}
+	assert.Equal(t, len(cache) <= maxCached, true)
+}
@@ -0,0 +1,187 @@
+// Package sitemap provides Lua functions for rendering sitemap.xml files
+package sitemap
+
+import (
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"strconv"
+
+	"github.com/xyproto/gopher-lua"
+)
+
+const (
+	// Namespace is the XML namespace for sitemaps and sitemap indexes
+	Namespace = "http://www.sitemaps.org/schemas/sitemap/0.9"
+
+	// MaxURLs is the maximum number of URLs in a single sitemap
+	MaxURLs = 50000
+)
+
+// The valid values for changefreq
+var changeFrequencies = map[string]bool{
+	"always":  true,
+	"hourly":  true,
+	"daily":   true,
+	"weekly":  true,
+	"monthly": true,
+	"yearly":  true,
+	"never":   true,
+}
+
+// URL is an entry in a sitemap. Only Loc is required.
+type URL struct {
+	Loc        string `xml:"loc"`
+	LastMod    string `xml:"lastmod,omitempty"`
+	ChangeFreq string `xml:"changefreq,omitempty"`
+	Priority   string `xml:"priority,omitempty"`
+}
+
+// Sitemap is an entry in a sitemap index
+type Sitemap struct {
+	Loc     string `xml:"loc"`
+	LastMod string `xml:"lastmod,omitempty"`
+}
+
+type urlset struct {
+	XMLName xml.Name `xml:"urlset"`
+	Xmlns   string   `xml:"xmlns,attr"`
+	URLs    []URL    `xml:"url"`
+}
+
+type sitemapindex struct {
+	XMLName  xml.Name  `xml:"sitemapindex"`
+	Xmlns    string    `xml:"xmlns,attr"`
+	Sitemaps []Sitemap `xml:"sitemap"`
+}
+
+// render marshals the given value as an indented XML document
+func render(v interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	buf.WriteString(xml.Header)
+	enc := xml.NewEncoder(&buf)
+	enc.Indent("", "  ")
+	if err := enc.Encode(v); err != nil {
+		return nil, err
+	}
+	buf.WriteString("\n")
+	return buf.Bytes(), nil
+}
+
+// Render renders a sitemap with the given URLs. Returns an error if there are
+// too many URLs or if one of them is invalid.
+func Render(urls []URL) ([]byte, error) {
+	if len(urls) > MaxURLs {
+		return nil, fmt.Errorf("a sitemap can not contain more than %d URLs", MaxURLs)
+	}
+	for _, u := range urls {
+		if u.Loc == "" {
+			return nil, errors.New("a sitemap URL must have a loc")
+		}
+		if u.ChangeFreq != "" && !changeFrequencies[u.ChangeFreq] {
+			return nil, fmt.Errorf("invalid changefreq for %s: %s", u.Loc, u.ChangeFreq)
+		}
+		if u.Priority != "" {
+			if p, err := strconv.ParseFloat(u.Priority, 64); err != nil || p < 0 || p > 1 {
+				return nil, fmt.Errorf("invalid priority for %s: %s", u.Loc, u.Priority)
+			}
+		}
+	}
+	return render(urlset{Xmlns: Namespace, URLs: urls})
+}
+
+// RenderIndex renders a sitemap index that refers to the given sitemaps
+func RenderIndex(sitemaps []Sitemap) ([]byte, error) {
+	for _, s := range sitemaps {
+		if s.Loc == "" {
+			return nil, errors.New("a sitemap in a sitemap index must have a loc")
+		}
+	}
+	return render(sitemapindex{Xmlns: Namespace, Sitemaps: sitemaps})
+}
+
+// Split splits the given URLs into parts of at most n URLs each, where each
+// part can be rendered as a sitemap and referred to from a sitemap index
+func Split(urls []URL, n int) [][]URL {
+	if n <= 0 || n > MaxURLs {
+		n = MaxURLs
+	}
+	var parts [][]URL
+	for len(urls) > n {
+		parts = append(parts, urls[:n])
+		urls = urls[n:]
+	}
+	return append(parts, urls)
+}
+
+// field returns the string value of the given field in a Lua table, or an
+// empty string. Numbers are converted to strings.
+func field(table *lua.LTable, name string) string {
+	value := table.RawGetString(name)
+	switch v := value.(type) {
+	case lua.LString:
+		return string(v)
+	case lua.LNumber:
+		return strconv.FormatFloat(float64(v), 'f', -1, 64)
+	}
+	return ""
+}
+
+// Table2URLs converts a Lua table to a slice of URLs. Each element can be a
+// string with the location, or a table with loc, lastmod, changefreq and
+// priority fields.
+func Table2URLs(table *lua.LTable) []URL {
+	var urls []URL
+	table.ForEach(func(_, value lua.LValue) {
+		switch v := value.(type) {
+		case lua.LString:
+			urls = append(urls, URL{Loc: string(v)})
+		case *lua.LTable:
+			urls = append(urls, URL{
+				Loc:        field(v, "loc"),
+				LastMod:    field(v, "lastmod"),
+				ChangeFreq: field(v, "changefreq"),
+				Priority:   field(v, "priority"),
+			})
+		}
+	})
+	return urls
+}
+
+// Load makes functions for rendering sitemaps available to the given Lua
+// state: sitemap and sitemapindex
+func Load(L *lua.LState) {
+
+	// Render a sitemap from a table of URLs. Each URL is either a string or a
+	// table with loc, lastmod, changefreq and priority. Returns the XML, or nil
+	// and an error message.
+	L.SetGlobal("sitemap", L.NewFunction(func(L *lua.LState) int {
+		data, err := Render(Table2URLs(L.CheckTable(1)))
+		if err != nil {
+			L.Push(lua.LNil)
+			L.Push(lua.LString(err.Error()))
+			return 2 // number of results
+		}
+		L.Push(lua.LString(data))
+		return 1 // number of results
+	}))
+
+	// Render a sitemap index from a table of sitemap URLs. Returns the XML,
+	// or nil and an error message.
+	L.SetGlobal("sitemapindex", L.NewFunction(func(L *lua.LState) int {
+		var sitemaps []Sitemap
+		for _, u := range Table2URLs(L.CheckTable(1)) {
+			sitemaps = append(sitemaps, Sitemap{Loc: u.Loc, LastMod: u.LastMod})
+		}
+		data, err := RenderIndex(sitemaps)
+		if err != nil {
+			L.Push(lua.LNil)
+			L.Push(lua.LString(err.Error()))
+			return 2 // number of results
+		}
+		L.Push(lua.LString(data))
+		return 1 // number of results
+	}))
+
+}
@@ -0,0 +1,77 @@
+package sitemap
+
+import (
+	"encoding/xml"
+	"strings"
+	"testing"
+
+	"github.com/bmizerany/assert"
+	"github.com/xyproto/gopher-lua"
+)
+
+func TestRender(t *testing.T) {
+	data, err := Render([]URL{
+		{Loc: "https://example.com/", LastMod: "2018-06-01", ChangeFreq: "daily", Priority: "1.0"},
+		{Loc: "https://example.com/about?a=1&b=2"},
+	})
+	assert.Equal(t, err, nil)
+	assert.Equal(t, strings.HasPrefix(string(data), xml.Header), true)
+
+	// The XML can be parsed back again
+	var parsed urlset
+	assert.Equal(t, xml.Unmarshal(data, &parsed), nil)
+	assert.Equal(t, parsed.XMLName.Local, "urlset")
+	assert.Equal(t, parsed.XMLName.Space, Namespace)
+	assert.Equal(t, len(parsed.URLs), 2)
+	assert.Equal(t, parsed.URLs[0], URL{Loc: "https://example.com/", LastMod: "2018-06-01", ChangeFreq: "daily", Priority: "1.0"})
+	assert.Equal(t, parsed.URLs[1].Loc, "https://example.com/about?a=1&b=2")
+
+	// Optional elements are left out
+	assert.Equal(t, strings.Count(string(data), "<lastmod>"), 1)
+
+	_, err = Render([]URL{{Loc: "https://example.com/", ChangeFreq: "sometimes"}})
+	assert.NotEqual(t, err, nil)
+	_, err = Render([]URL{{Loc: "https://example.com/", Priority: "1.5"}})
+	assert.NotEqual(t, err, nil)
+	_, err = Render([]URL{{LastMod: "2018-06-01"}})
+	assert.NotEqual(t, err, nil)
+}
+
+func TestSplit(t *testing.T) {
+	urls := []URL{{Loc: "/a"}, {Loc: "/b"}, {Loc: "/c"}, {Loc: "/d"}, {Loc: "/e"}}
+	parts := Split(urls, 2)
+	assert.Equal(t, len(parts), 3)
+	assert.Equal(t, parts[2], []URL{{Loc: "/e"}})
+	assert.Equal(t, len(Split(urls, 0)), 1)
+
+	data, err := RenderIndex([]Sitemap{{Loc: "https://example.com/sitemap-1.xml"}, {Loc: "https://example.com/sitemap-2.xml"}})
+	assert.Equal(t, err, nil)
+	var parsed sitemapindex
+	assert.Equal(t, xml.Unmarshal(data, &parsed), nil)
+	assert.Equal(t, parsed.XMLName.Local, "sitemapindex")
+	assert.Equal(t, len(parsed.Sitemaps), 2)
+	assert.Equal(t, parsed.Sitemaps[1].Loc, "https://example.com/sitemap-2.xml")
+}
+
+func TestLuaSitemap(t *testing.T) {
+	L := lua.NewState()
+	defer L.Close()
+	Load(L)
+
+	err := L.DoString(`
+		xmldata = sitemap({
+			"https://example.com/",
+			{loc="https://example.com/news", lastmod="2018-06-01", changefreq="hourly", priority=0.8},
+		})
+		local ok, err = sitemap({{loc="https://example.com/", changefreq="sometimes"}})
+		assert(ok == nil and err ~= nil)
+	`)
+	assert.Equal(t, err, nil)
+
+	var parsed urlset
+	assert.Equal(t, xml.Unmarshal([]byte(L.GetGlobal("xmldata").String()), &parsed), nil)
+	assert.Equal(t, parsed.URLs, []URL{
+		{Loc: "https://example.com/"},
+		{Loc: "https://example.com/news", LastMod: "2018-06-01", ChangeFreq: "hourly", Priority: "0.8"},
+	})
+}
@@ -3,6 +3,8 @@ package upload
 
 import (
 	"bytes"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
@@ -12,6 +14,7 @@ import (
 	"strconv"
 
 	log "github.com/sirupsen/logrus"
+	"github.com/xyproto/algernon/lua/convert"
 	"github.com/xyproto/algernon/utils"
 	"github.com/xyproto/gopher-lua"
 )
@@ -31,6 +34,9 @@ const (
 	// Chunk size when reading uploaded file
 	chunkSize int64 = 4 * utils.KiB
 	//chunkSize = defaultMemoryLimit
+
+	// File permissions for saved files
+	defaultPermissions os.FileMode = 0660
 )
 
 // UploadedFile represents a file that has been uploaded but not yet been
@@ -41,6 +47,9 @@ type UploadedFile struct {
 	header    textproto.MIMEHeader
 	filename  string
 	buf       *bytes.Buffer
+	fperm     os.FileMode // file permissions for saved files, 0 is the default
+	discarded bool
+	reader    *bytes.Reader // for reading the data with read and lines
 }
 
 // New creates a struct that is used for accepting an uploaded file
@@ -97,7 +106,7 @@ func New(req *http.Request, scriptdir, formID string, uploadLimit int64) (*Uploa
 	}
 
 	// all ok
-	return &UploadedFile{req, scriptdir, handler.Header, handler.Filename, buf}, nil
+	return &UploadedFile{req, scriptdir, handler.Header, handler.Filename, buf, 0, false, nil}, nil
 }
 
 // Get the first argument, "self", and cast it from userdata to
@@ -112,12 +121,13 @@ func checkUploadedFile(L *lua.LState) *UploadedFile {
 }
 
 // Create a new Upload file
-func constructUploadedFile(L *lua.LState, req *http.Request, scriptdir, formID string, uploadLimit int64) (*lua.LUserData, error) {
+func constructUploadedFile(L *lua.LState, req *http.Request, scriptdir, formID string, uploadLimit int64, fperm os.FileMode) (*lua.LUserData, error) {
 	// Create a new UploadedFile
 	uploadedfile, err := New(req, scriptdir, formID, uploadLimit)
 	if err != nil {
 		return nil, err
 	}
+	uploadedfile.fperm = fperm
 	// Create a new userdata struct
 	ud := L.NewUserData()
 	ud.Value = uploadedfile
@@ -158,9 +168,20 @@ func uploadedfileMimeType(L *lua.LState) int {
 	return 1 // number of results
 }
 
+// permissions returns the file permissions for saved files
+func (ulf *UploadedFile) permissions() os.FileMode {
+	if ulf.fperm == 0 {
+		return defaultPermissions
+	}
+	return ulf.fperm
+}
+
 // Write the uploaded file to the given full filename.
 // Does not overwrite files.
 func (ulf *UploadedFile) write(fullFilename string, fperm os.FileMode) error {
+	if ulf.discarded {
+		return errors.New("the uploaded file has been discarded")
+	}
 	// Check if the file already exists
 	if _, err := os.Stat(fullFilename); err == nil { // exists
 		log.Error(fullFilename, " already exists")
@@ -186,11 +207,11 @@ func (ulf *UploadedFile) write(fullFilename string, fperm os.FileMode) error {
 func uploadedfileSave(L *lua.LState) int {
 	ulf := checkUploadedFile(L) // arg 1
 	givenFilename := ""
-	if L.GetTop() == 2 {
+	if L.GetTop() >= 2 {
 		givenFilename = L.ToString(2) // optional argument
 	}
 	// optional argument, file permissions
-	var givenPermissions os.FileMode = 0660
+	givenPermissions := ulf.permissions()
 	if L.GetTop() == 3 {
 		givenPermissions = os.FileMode(L.ToInt(3))
 	}
@@ -207,8 +228,7 @@ func uploadedfileSave(L *lua.LState) int {
 	writeFilename := filepath.Join(ulf.scriptdir, filename)
 
 	// Write the file and return true if successful
-	L.Push(lua.LBool(ulf.write(writeFilename, givenPermissions) == nil))
-	return 1 // number of results
+	return pushWriteResult(L, ulf.write(writeFilename, givenPermissions))
 }
 
 // Save the file locally, to a given directory
@@ -217,7 +237,7 @@ func uploadedfileSaveIn(L *lua.LState) int {
 	givenDirectory := L.ToString(2) // required argument
 
 	// optional argument, file permissions
-	var givenPermissions os.FileMode = 0660
+	givenPermissions := ulf.permissions()
 	if L.GetTop() == 3 {
 		givenPermissions = os.FileMode(L.ToInt(3))
 	}
@@ -231,10 +251,173 @@ func uploadedfileSaveIn(L *lua.LState) int {
 	}
 
 	// Write the file and return true if successful
-	L.Push(lua.LBool(ulf.write(writeFilename, givenPermissions) == nil))
+	return pushWriteResult(L, ulf.write(writeFilename, givenPermissions))
+}
+
+// pushWriteResult pushes true, or false and an error message
+func pushWriteResult(L *lua.LState, err error) int {
+	if err != nil {
+		L.Push(lua.LBool(false))
+		L.Push(lua.LString(err.Error()))
+		return 2 // number of results
+	}
+	L.Push(lua.LBool(true))
+	return 1 // number of results
+}
+
+// Discard the uploaded data, to free the memory before the request is done.
+// Temporary files for the uploaded form data are also removed.
+func uploadedfileDiscard(L *lua.LState) int {
+	ulf := checkUploadedFile(L) // arg 1
+	ulf.buf = new(bytes.Buffer)
+	ulf.reader = nil
+	ulf.discarded = true
+	if ulf.req != nil && ulf.req.MultipartForm != nil {
+		if err := ulf.req.MultipartForm.RemoveAll(); err != nil {
+			log.Error("Could not remove the temporary upload files: ", err)
+		}
+	}
+	return 0 // number of results
+}
+
+// dataReader returns a reader for the uploaded data, that keeps track of how
+// much has been read with read and lines
+func (ulf *UploadedFile) dataReader() *bytes.Reader {
+	if ulf.reader == nil {
+		ulf.reader = bytes.NewReader(ulf.buf.Bytes())
+	}
+	return ulf.reader
+}
+
+// Read at most the given number of bytes from the uploaded data, after what
+// has already been read. Returns nil when all the data has been read.
+func uploadedfileRead(L *lua.LState) int {
+	ulf := checkUploadedFile(L) // arg 1
+	n := L.CheckInt(2)
+	if n < 0 {
+		L.ArgError(2, "the number of bytes can not be negative")
+	}
+	r := ulf.dataReader()
+	if r.Len() == 0 {
+		L.Push(lua.LNil)
+		return 1 // number of results
+	}
+	if n > r.Len() {
+		n = r.Len()
+	}
+	data := make([]byte, n)
+	r.Read(data)
+	L.Push(lua.LString(data))
 	return 1 // number of results
 }
 
+// Call the given Lua function with each line of the uploaded data, after what
+// has already been read, without the line endings. Stops if the function
+// returns false. Returns the number of lines that were handled, or nil and an
+// error message.
+func uploadedfileLines(L *lua.LState) int {
+	ulf := checkUploadedFile(L) // arg 1
+	luaFunc := L.CheckFunction(2)
+
+	r := ulf.dataReader()
+	count := 0
+	for r.Len() > 0 {
+		// The rest of the data, that has not been read yet
+		data := ulf.buf.Bytes()[r.Size()-int64(r.Len()):]
+		line := data
+		if i := bytes.IndexByte(data, '\n'); i >= 0 {
+			line = data[:i+1]
+		}
+		r.Seek(int64(len(line)), io.SeekCurrent)
+		line = bytes.TrimSuffix(bytes.TrimSuffix(line, []byte("\n")), []byte("\r"))
+		count++
+		if err := L.CallByParam(lua.P{Fn: luaFunc, NRet: 1, Protect: true}, lua.LString(line)); err != nil {
+			L.Push(lua.LNil)
+			L.Push(lua.LString(err.Error()))
+			return 2 // number of results
+		}
+		ret := L.Get(-1)
+		L.Pop(1)
+		if ret == lua.LFalse {
+			break
+		}
+	}
+	L.Push(lua.LNumber(count))
+	return 1 // number of results
+}
+
+// Decode an uploaded JSON array, one element at a time, and call the given
+// Lua function with each element. Only one element is kept in memory at the
+// time. Stops if the function returns false. Returns the number of elements
+// that were handled, or nil and an error message with the byte offset, if the
+// JSON data is not a well-formed array.
+func uploadedfileJSONStream(L *lua.LState) int {
+	ulf := checkUploadedFile(L) // arg 1
+	luaFunc := L.CheckFunction(2)
+
+	count, err := streamJSONArray(bytes.NewReader(ulf.buf.Bytes()), func(element interface{}) (bool, error) {
+		if err := L.CallByParam(lua.P{Fn: luaFunc, NRet: 1, Protect: true}, convert.Interface2value(L, element)); err != nil {
+			return false, err
+		}
+		ret := L.Get(-1)
+		L.Pop(1)
+		return ret != lua.LFalse, nil
+	})
+	if err != nil {
+		L.Push(lua.LNil)
+		L.Push(lua.LString(err.Error()))
+		return 2 // number of results
+	}
+	L.Push(lua.LNumber(count))
+	return 1 // number of results
+}
+
+// streamJSONArray decodes a JSON array from the given reader, one element at
+// the time, and calls the given function with each element. Stops if the
+// function returns false or an error. Returns the number of handled elements.
+func streamJSONArray(r io.Reader, handle func(interface{}) (bool, error)) (int, error) {
+	dec := json.NewDecoder(r)
+	tok, err := dec.Token()
+	if err != nil {
+		return 0, jsonStreamError(dec, err)
+	}
+	if tok != json.Delim('[') {
+		return 0, fmt.Errorf("expected a JSON array, at byte offset %d", dec.InputOffset())
+	}
+	count := 0
+	for dec.More() {
+		var element interface{}
+		if err := dec.Decode(&element); err != nil {
+			return count, jsonStreamError(dec, err)
+		}
+		count++
+		keepGoing, err := handle(element)
+		if err != nil {
+			return count, err
+		}
+		if !keepGoing {
+			return count, nil
+		}
+	}
+	// Read the closing bracket
+	if _, err := dec.Token(); err != nil {
+		return count, jsonStreamError(dec, err)
+	}
+	return count, nil
+}
+
+// jsonStreamError adds the byte offset of the problem to the given error
+func jsonStreamError(dec *json.Decoder, err error) error {
+	offset := dec.InputOffset()
+	if syntaxErr, ok := err.(*json.SyntaxError); ok {
+		offset = syntaxErr.Offset
+	}
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return fmt.Errorf("malformed JSON at byte offset %d: %s", offset, err)
+}
+
 // The hash map methods that are to be registered
 var uploadedfileMethods = map[string]lua.LGFunction{
 	"__tostring": uploadedfileToString,
@@ -243,10 +426,15 @@ var uploadedfileMethods = map[string]lua.LGFunction{
 	"mimetype":   uploadedfileMimeType,
 	"save":       uploadedfileSave,
 	"savein":     uploadedfileSaveIn,
+	"discard":    uploadedfileDiscard,
+	"read":       uploadedfileRead,
+	"lines":      uploadedfileLines,
+	"jsonstream": uploadedfileJSONStream,
 }
 
-// Load makes functions related to saving an uploaded file available
-func Load(L *lua.LState, w http.ResponseWriter, req *http.Request, scriptdir string) {
+// Load makes functions related to saving an uploaded file available.
+// fperm is the file permissions for saved files, or 0 for the default (0660).
+func Load(L *lua.LState, w http.ResponseWriter, req *http.Request, scriptdir string, fperm os.FileMode) {
 
 	// Register the UploadedFile class and the methods that belongs with it.
 	mt := L.NewTypeMetatable(Class)
@@ -267,7 +455,7 @@ func Load(L *lua.LState, w http.ResponseWriter, req *http.Request, scriptdir str
 			uploadLimit = int64(L.ToInt(2)) * utils.MiB // optional upload limit, in MiB
 		}
 		// Construct a new UploadedFile
-		userdata, err := constructUploadedFile(L, req, scriptdir, formID, uploadLimit)
+		userdata, err := constructUploadedFile(L, req, scriptdir, formID, uploadLimit, fperm)
 		if err != nil {
 			// Log the error
 			log.Error(err)
@@ -0,0 +1,196 @@
+package upload
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/bmizerany/assert"
+	"github.com/xyproto/gopher-lua"
+)
+
+// uploadedData returns a Lua state where "ulf" is an UploadedFile with the
+// given data, that is saved in the given directory with the given permissions
+func uploadedData(data, scriptdir string, fperm os.FileMode) *lua.LState {
+	L := lua.NewState()
+	Load(L, nil, nil, scriptdir, fperm)
+	ud := L.NewUserData()
+	ud.Value = &UploadedFile{scriptdir: scriptdir, filename: "data.txt", buf: bytes.NewBufferString(data), fperm: fperm}
+	L.SetMetatable(ud, L.GetTypeMetatable(Class))
+	L.SetGlobal("ulf", ud)
+	return L
+}
+
+// uploadedJSON returns a Lua state where "ulf" is an UploadedFile with the given data
+func uploadedJSON(data string) *lua.LState {
+	L := lua.NewState()
+	Load(L, nil, nil, "", 0)
+	ud := L.NewUserData()
+	ud.Value = &UploadedFile{filename: "data.json", buf: bytes.NewBufferString(data)}
+	L.SetMetatable(ud, L.GetTypeMetatable(Class))
+	L.SetGlobal("ulf", ud)
+	return L
+}
+
+func TestJSONStream(t *testing.T) {
+	// A large array of objects
+	const n = 10000
+	var sb strings.Builder
+	sb.WriteString("[")
+	for i := 1; i <= n; i++ {
+		if i > 1 {
+			sb.WriteString(",")
+		}
+		fmt.Fprintf(&sb, `{"id": %d, "name": "item %d", "tags": ["a", "b"]}`, i, i)
+	}
+	sb.WriteString("]")
+
+	L := uploadedJSON(sb.String())
+	defer L.Close()
+
+	err := L.DoString(`
+		sum, names = 0, 0
+		count = ulf:jsonstream(function(item)
+			sum = sum + item.id
+			if item.name == "item " .. item.id and item.tags[2] == "b" then
+				names = names + 1
+			end
+		end)
+	`)
+	assert.Equal(t, err, nil)
+	assert.Equal(t, L.GetGlobal("count"), lua.LNumber(n))
+	assert.Equal(t, L.GetGlobal("sum"), lua.LNumber(n*(n+1)/2))
+	assert.Equal(t, L.GetGlobal("names"), lua.LNumber(n))
+}
+
+func TestJSONStreamStop(t *testing.T) {
+	L := uploadedJSON(`[1, 2, 3, 4]`)
+	defer L.Close()
+
+	// Returning false from the function stops the decoding
+	err := L.DoString(`count = ulf:jsonstream(function(x) return x < 2 end)`)
+	assert.Equal(t, err, nil)
+	assert.Equal(t, L.GetGlobal("count"), lua.LNumber(2))
+}
+
+func TestJSONStreamMalformed(t *testing.T) {
+	L := uploadedJSON(`[{"id": 1}, {"id": 2,, {"id": 3}]`)
+	defer L.Close()
+
+	err := L.DoString(`
+		seen = 0
+		count, err = ulf:jsonstream(function(item) seen = seen + 1 end)
+	`)
+	assert.Equal(t, err, nil)
+	assert.Equal(t, L.GetGlobal("count"), lua.LNil)
+	assert.Equal(t, L.GetGlobal("seen"), lua.LNumber(1))
+	assert.Equal(t, strings.HasPrefix(L.GetGlobal("err").String(), "malformed JSON at byte offset 22:"), true)
+
+	L2 := uploadedJSON(`{"id": 1}`)
+	defer L2.Close()
+	err = L2.DoString(`count, err = ulf:jsonstream(function(item) end)`)
+	assert.Equal(t, err, nil)
+	assert.Equal(t, L2.GetGlobal("err").String(), "expected a JSON array, at byte offset 1")
+}
+
+func TestSavePermissions(t *testing.T) {
+	dir, err := ioutil.TempDir("", "algernon_upload")
+	assert.Equal(t, err, nil)
+	defer os.RemoveAll(dir)
+
+	for _, fperm := range []os.FileMode{0600, 0640} {
+		L := uploadedData("hello", dir, fperm)
+		filename := fmt.Sprintf("saved%o.txt", fperm)
+		assert.Equal(t, L.DoString(`assert(ulf:save("`+filename+`"))`), nil)
+		L.Close()
+		fi, err := os.Stat(filepath.Join(dir, filename))
+		assert.Equal(t, err, nil)
+		assert.Equal(t, fi.Mode().Perm(), fperm)
+	}
+
+	// The permissions given to save take precedence
+	L := uploadedData("hello", dir, 0640)
+	defer L.Close()
+	assert.Equal(t, L.DoString(`assert(ulf:save("given.txt", tonumber("600", 8)))`), nil)
+	fi, err := os.Stat(filepath.Join(dir, "given.txt"))
+	assert.Equal(t, err, nil)
+	assert.Equal(t, fi.Mode().Perm(), os.FileMode(0600))
+}
+
+func TestDiscard(t *testing.T) {
+	dir, err := ioutil.TempDir("", "algernon_upload")
+	assert.Equal(t, err, nil)
+	defer os.RemoveAll(dir)
+
+	L := uploadedData("hello", dir, 0)
+	defer L.Close()
+	assert.Equal(t, L.DoString(`
+		before = ulf:size()
+		ulf:discard()
+		after = ulf:size()
+		ok, err = ulf:save("discarded.txt")
+	`), nil)
+	assert.Equal(t, L.GetGlobal("before"), lua.LNumber(5))
+	assert.Equal(t, L.GetGlobal("after"), lua.LNumber(0))
+	assert.Equal(t, L.GetGlobal("ok"), lua.LFalse)
+	assert.Equal(t, L.GetGlobal("err").String(), "the uploaded file has been discarded")
+	_, err = os.Stat(filepath.Join(dir, "discarded.txt"))
+	assert.Equal(t, os.IsNotExist(err), true)
+}
+
+func TestLines(t *testing.T) {
+	L := uploadedData("name,count\r\napples,3\npears,5\n\nplums,7", "", 0)
+	defer L.Close()
+
+	err := L.DoString(`
+		seen = {}
+		count = ulf:lines(function(line) table.insert(seen, line) end)
+	`)
+	assert.Equal(t, err, nil)
+	assert.Equal(t, L.GetGlobal("count"), lua.LNumber(5))
+	seen := L.GetGlobal("seen").(*lua.LTable)
+	var lines []string
+	seen.ForEach(func(_, line lua.LValue) { lines = append(lines, line.String()) })
+	assert.Equal(t, lines, []string{"name,count", "apples,3", "pears,5", "", "plums,7"})
+}
+
+func TestLinesStop(t *testing.T) {
+	L := uploadedData("header\n1\n2\n3\n", "", 0)
+	defer L.Close()
+
+	// Returning false stops the iteration, and the rest can be read later
+	err := L.DoString(`
+		header = nil
+		count = ulf:lines(function(line) header = line return false end)
+		total = 0
+		rest = ulf:lines(function(line) total = total + tonumber(line) end)
+		done = ulf:read(10)
+	`)
+	assert.Equal(t, err, nil)
+	assert.Equal(t, L.GetGlobal("header"), lua.LString("header"))
+	assert.Equal(t, L.GetGlobal("count"), lua.LNumber(1))
+	assert.Equal(t, L.GetGlobal("rest"), lua.LNumber(3))
+	assert.Equal(t, L.GetGlobal("total"), lua.LNumber(6))
+	assert.Equal(t, L.GetGlobal("done"), lua.LNil)
+}
+
+func TestRead(t *testing.T) {
+	L := uploadedData("abcdefg", "", 0)
+	defer L.Close()
+
+	err := L.DoString(`
+		a = ulf:read(3)
+		b = ulf:read(3)
+		c = ulf:read(3)
+		d = ulf:read(3)
+	`)
+	assert.Equal(t, err, nil)
+	assert.Equal(t, L.GetGlobal("a"), lua.LString("abc"))
+	assert.Equal(t, L.GetGlobal("b"), lua.LString("def"))
+	assert.Equal(t, L.GetGlobal("c"), lua.LString("g"))
+	assert.Equal(t, L.GetGlobal("d"), lua.LNil)
+}
@@ -0,0 +1,161 @@
+// Package wsconn provides a WebSocket connection class for Lua
+package wsconn
+
+import (
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/xyproto/gopher-lua"
+)
+
+// Class is an identifier for the WebSocket class in Lua
+const Class = "WebSocket"
+
+const (
+	// How long to wait for a pong, or any other message, from the client
+	pongWait = 60 * time.Second
+
+	// How often to send pings to the client. Must be shorter than pongWait.
+	pingPeriod = pongWait * 9 / 10
+
+	// How long a control message may take to write
+	writeWait = 10 * time.Second
+)
+
+// Conn is a WebSocket connection that sends pings to the client, to keep the
+// connection alive, until it is closed
+type Conn struct {
+	conn      *websocket.Conn
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// New wraps the given WebSocket connection and starts sending pings to the client
+func New(conn *websocket.Conn) *Conn {
+	c := &Conn{conn: conn, done: make(chan struct{})}
+	conn.SetReadDeadline(time.Now().Add(pongWait))
+	conn.SetPongHandler(func(string) error {
+		return conn.SetReadDeadline(time.Now().Add(pongWait))
+	})
+	go c.keepAlive()
+	return c
+}
+
+// keepAlive sends pings to the client, until the connection is closed
+func (c *Conn) keepAlive() {
+	ticker := time.NewTicker(pingPeriod)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := c.conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(writeWait)); err != nil {
+				return
+			}
+		case <-c.done:
+			return
+		}
+	}
+}
+
+// Send sends a text message
+func (c *Conn) Send(msg string) error {
+	return c.conn.WriteMessage(websocket.TextMessage, []byte(msg))
+}
+
+// Receive waits for the next text or binary message
+func (c *Conn) Receive() (string, error) {
+	_, data, err := c.conn.ReadMessage()
+	if err != nil {
+		return "", err
+	}
+	// Any message from the client means that the connection is alive
+	c.conn.SetReadDeadline(time.Now().Add(pongWait))
+	return string(data), nil
+}
+
+// Close sends a close message to the client and closes the connection.
+// It is safe to call Close more than once.
+func (c *Conn) Close() error {
+	var err error
+	c.closeOnce.Do(func() {
+		close(c.done)
+		msg := websocket.FormatCloseMessage(websocket.CloseNormalClosure, "")
+		c.conn.WriteControl(websocket.CloseMessage, msg, time.Now().Add(writeWait))
+		err = c.conn.Close()
+	})
+	return err
+}
+
+// Get the first argument, "self", and cast it from userdata to a Conn
+func checkConn(L *lua.LState) *Conn {
+	ud := L.CheckUserData(1)
+	if conn, ok := ud.Value.(*Conn); ok {
+		return conn
+	}
+	L.ArgError(1, "WebSocket expected")
+	return nil
+}
+
+// String representation
+func connToString(L *lua.LState) int {
+	L.Push(lua.LString("WebSocket connection"))
+	return 1 // number of results
+}
+
+// Send a text message. Returns true, or false and an error message.
+func connSend(L *lua.LState) int {
+	c := checkConn(L) // arg 1
+	if err := c.Send(L.CheckString(2)); err != nil {
+		L.Push(lua.LBool(false))
+		L.Push(lua.LString(err.Error()))
+		return 2 // number of results
+	}
+	L.Push(lua.LBool(true))
+	return 1 // number of results
+}
+
+// Wait for the next message. Returns the message, or nil and an error
+// message if the connection has been closed.
+func connReceive(L *lua.LState) int {
+	c := checkConn(L) // arg 1
+	msg, err := c.Receive()
+	if err != nil {
+		L.Push(lua.LNil)
+		L.Push(lua.LString(err.Error()))
+		return 2 // number of results
+	}
+	L.Push(lua.LString(msg))
+	return 1 // number of results
+}
+
+// Close the connection
+func connClose(L *lua.LState) int {
+	c := checkConn(L) // arg 1
+	c.Close()
+	return 0 // number of results
+}
+
+// The WebSocket methods that are to be registered
+var connMethods = map[string]lua.LGFunction{
+	"__tostring": connToString,
+	"send":       connSend,
+	"receive":    connReceive,
+	"close":      connClose,
+}
+
+// Load registers the WebSocket class and the methods that belongs with it
+func Load(L *lua.LState) {
+	mt := L.NewTypeMetatable(Class)
+	mt.RawSetH(lua.LString("__index"), mt)
+	L.SetFuncs(mt, connMethods)
+}
+
+// NewUserData returns the given connection as a WebSocket userdata, for the
+// given Lua state. Load must be called first.
+func NewUserData(L *lua.LState, c *Conn) *lua.LUserData {
+	ud := L.NewUserData()
+	ud.Value = c
+	L.SetMetatable(ud, L.GetTypeMetatable(Class))
+	return ud
+}
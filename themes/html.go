@@ -5,6 +5,7 @@ package themes
 import (
 	"bytes"
 	"fmt"
+	"html"
 	"strings"
 )
 
@@ -85,6 +86,30 @@ func HTMLLink(text, url string, isDirectory bool) string {
 	return "<a href=\"/" + url + "\">" + text + "</a><br>"
 }
 
+// HTMLDirEntry builds a table row for a directory listing, given the link
+// text, the escaped URL path to a file/directory, a boolean that is true if
+// the URL is to a directory, the size and the modification time.
+// The link text is HTML escaped.
+func HTMLDirEntry(text, urlpath string, isDirectory bool, size, modified string) string {
+	// Add a final slash, if needed
+	if isDirectory {
+		text += "/"
+		urlpath += "/"
+	}
+	return "<tr><td><a href=\"" + urlpath + "\">" + html.EscapeString(text) + "</a></td><td>" + size + "</td><td>" + modified + "</td></tr>"
+}
+
+// HTMLDirTable wraps the given table rows from HTMLDirEntry in a table, with
+// some spacing between the columns
+func HTMLDirTable(rows []byte) []byte {
+	var buf bytes.Buffer
+	buf.WriteString("<style>table.dirlist th, table.dirlist td { text-align: left; padding: 0.1em 2em 0.1em 0; }</style>")
+	buf.WriteString("<table class=\"dirlist\"><tr><th>Name</th><th>Size</th><th>Modified</th></tr>")
+	buf.Write(rows)
+	buf.WriteString("</table>")
+	return buf.Bytes()
+}
+
 // StyleAmber modifies Amber source code so that a link to the given stylesheet URL is added
 func StyleAmber(amberdata []byte, url string) []byte {
 	// If the given url is not already mentioned and the data contains "body"
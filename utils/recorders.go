@@ -8,14 +8,19 @@ import (
 	log "github.com/sirupsen/logrus"
 )
 
+// CopyRecorderHeaders copies the HTTP headers from a ResponseRecorder to a
+// ResponseWriter. Must be called before the status code is written.
+func CopyRecorderHeaders(w http.ResponseWriter, recorder *httptest.ResponseRecorder) {
+	for key, values := range recorder.HeaderMap {
+		// Keep all the values, for headers that may be given several times
+		w.Header()[key] = append([]string{}, values...)
+	}
+}
+
 // WriteRecorder writes to a ResponseWriter from a ResponseRecorder.
 // Also flushes the recorder and returns how many bytes were written.
 func WriteRecorder(w http.ResponseWriter, recorder *httptest.ResponseRecorder) int64 {
-	for key, values := range recorder.HeaderMap {
-		for _, value := range values {
-			w.Header().Set(key, value)
-		}
-	}
+	CopyRecorderHeaders(w, recorder)
 	bytesWritten, err := recorder.Body.WriteTo(w)
 	if err != nil {
 		// Writing failed
@@ -0,0 +1,25 @@
+package utils
+
+import (
+	"net/http/httptest"
+	"testing"
+
+	"github.com/bmizerany/assert"
+)
+
+func TestWriteRecorder(t *testing.T) {
+	recorder := httptest.NewRecorder()
+	recorder.Header().Add("Set-Cookie", "a=1")
+	recorder.Header().Add("Set-Cookie", "b=2")
+	recorder.Header().Set("Content-Type", "text/plain")
+	recorder.WriteString("hello")
+
+	w := httptest.NewRecorder()
+	w.Header().Set("Content-Type", "text/html")
+	n := WriteRecorder(w, recorder)
+
+	assert.Equal(t, n, int64(5))
+	assert.Equal(t, w.Body.String(), "hello")
+	assert.Equal(t, w.Header()["Set-Cookie"], []string{"a=1", "b=2"})
+	assert.Equal(t, w.Header()["Content-Type"], []string{"text/plain"})
+}